@@ -6,6 +6,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -21,6 +23,7 @@ import (
 	"github.com/CodisLabs/codis/pkg/proxy/router"
 	"github.com/CodisLabs/codis/pkg/utils"
 	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/docopt/docopt-go"
 	"github.com/ngaut/gostats"
@@ -31,18 +34,25 @@ var (
 	addr       = ":9000"
 	httpAddr   = ":9001"
 	configFile = "config.ini"
+
+	logFile io.WriteCloser // -L 指定的日志文件，没有指定时为nil
 )
 
-var usage = `usage: proxy [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>] [--log-filesize=<filesize>] [--cpu=<cpu_num>] [--addr=<proxy_listen_addr>] [--http-addr=<debug_http_server_addr>]
+var usage = `usage: proxy [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>] [--log-filesize=<filesize>] [--cpu=<cpu_num>] [--addr=<proxy_listen_addr>] [--http-addr=<debug_http_server_addr>] [--no-stats] [--metrics-log-interval=<seconds>] [--export-table=<file>] [--import-table=<file>] [--online-delay=<duration>]
 
 options:
    -c	set config file
    -L	set output log file, default is stdout
    --log-level=<loglevel>	set log level: info, warn, error, debug [default: info]
    --log-filesize=<maxsize>  set max log file size, suffixes "KB", "MB", "GB" are allowed, 1KB=1024 bytes, etc. Default is 1GB.
-   --cpu=<cpu_num>		num of cpu cores that proxy can use
+   --cpu=<cpu_num>		num of cpu cores that proxy can use, default is the cgroup cpu quota in a container, or all cores of host
    --addr=<proxy_listen_addr>		proxy listen address, example: 0.0.0.0:9000
    --http-addr=<debug_http_server_addr>		debug vars http server
+   --no-stats	disable stats of commands, same as disable_stats=true in config file
+   --metrics-log-interval=<seconds>	log a line of ops/sec, error rate, clients and alive backends every <seconds>, default is off
+   --export-table=<file>	write the routing table to <file> when proxy starts serving and again when it exits
+   --import-table=<file>	serve with the routing table in <file> if the coordinator is unavailable at startup
+   --online-delay=<duration>	wait <duration>, like 500ms or 10s, after startup before marking proxy online, 0 marks it at once [default: 1s]
 `
 
 const banner string = `
@@ -87,12 +97,95 @@ func setCrashLog(file string) {
 	}
 }
 
+// 重新打开 -L 指定的日志文件，用于 logrotate 把文件改名之后继续写到原来的路径
+func reopenLog() error {
+	f, ok := logFile.(log.Reopener)
+	if !ok {
+		return errors.New("no log file is specified by -L")
+	}
+	if err := f.Reopen(); err != nil {
+		return err
+	}
+	log.Info("log file is reopened")
+	return nil
+}
+
+func handleReopenLog(w http.ResponseWriter, r *http.Request) {
+	if err := reopenLog(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"reopened": true})
+}
+
 // 通过http接口动态设置日志级别
 func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	setLogLevel(r.Form.Get("level"))
 }
 
+// 通过http接口动态设置慢命令的阈值，比如 threshold=10ms，0表示不记录
+func handleSlowlogConfig(w http.ResponseWriter, r *http.Request) {
+	s := r.FormValue("threshold")
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		http.Error(w, fmt.Sprintf("invalid threshold %q, should be a duration like 10ms", s), http.StatusBadRequest)
+		return
+	}
+	old := router.SetSlowlogThreshold(d)
+	log.Infof("set slowlog threshold from %s to %s by %s", old, d, r.RemoteAddr)
+	writeJSON(w, map[string]interface{}{"old": old.String(), "new": d.String()})
+}
+
+// 开启维护模式之后，所有命令都返回 msg 作为错误，比如 /maintenance?on=true&msg=ERR+upgrading，/maintenance?on=false 恢复
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.FormValue("on"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid on %q, should be true or false", r.FormValue("on")), http.StatusBadRequest)
+		return
+	}
+	msg := strings.TrimSpace(r.FormValue("msg"))
+	if strings.ContainsAny(msg, "\r\n") {
+		http.Error(w, "msg should be a single line", http.StatusBadRequest)
+		return
+	}
+	router.SetMaintenance(on, msg)
+	if on {
+		log.Warnf("maintenance mode on by %s, reply %q", r.RemoteAddr, router.Maintenance().Message)
+	} else {
+		log.Warnf("maintenance mode off by %s", r.RemoteAddr)
+	}
+	writeJSON(w, map[string]interface{}{"maintenance": router.Maintenance()})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// 导出路由表，先写到临时文件再改名，不会读到写了一半的文件
+func writeRoutingTable(s *proxy.Server, file string) error {
+	b, err := s.ExportRoutingTable()
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Infof("export routing table to %s", file)
+	return nil
+}
+
 // 检查 ulimit -n 是否大于min
 func checkUlimit(min int) {
 	ulimitN, err := exec.Command("/bin/sh", "-c", "ulimit -n").Output()
@@ -138,6 +231,7 @@ func main() {
 		} else {
 			defer f.Close()
 			log.StdLog = log.New(f, "")
+			logFile = f
 		}
 	}
 	log.SetLevel(log.LEVEL_INFO)
@@ -150,12 +244,22 @@ func main() {
 
 	cpus = runtime.NumCPU()
 	// set cpu
-	// 设置使用cpu核数
+	// 设置使用cpu核数，没有指定时在容器中使用cgroup限制的cpu数，避免使用宿主机的核数
 	if args["--cpu"] != nil {
 		cpus, err = strconv.Atoi(args["--cpu"].(string))
 		if err != nil {
 			log.PanicErrorf(err, "parse cpu number failed")
 		}
+		log.Infof("use %d cpus, set by --cpu", cpus)
+	} else if quota, ok := utils.CPUQuota(); ok {
+		if n := int(quota); n < 1 {
+			cpus = 1
+		} else if n < cpus {
+			cpus = n
+		}
+		log.Infof("use %d cpus, cgroup cpu quota = %.2f, host has %d cpus", cpus, quota, runtime.NumCPU())
+	} else {
+		log.Infof("use %d cpus of host, no cgroup cpu quota", cpus)
 	}
 
 	// set addr
@@ -170,6 +274,11 @@ func main() {
 		httpAddr = args["--http-addr"].(string)
 	}
 
+	// 关闭命令统计，用于测试转发本身的性能
+	if noStats, _ := args["--no-stats"].(bool); noStats {
+		router.DisableStats()
+	}
+
 	// 可打开文件描述符数必须大于1024
 	checkUlimit(1024)
 	// 设置go使用的cpu数
@@ -177,6 +286,19 @@ func main() {
 
 	// 可通过http请求动态调整日志级别
 	http.HandleFunc("/setloglevel", handleSetLogLevel)
+	http.HandleFunc("/slowlog/config", handleSlowlogConfig)
+	http.HandleFunc("/maintenance", handleMaintenance)
+	http.HandleFunc("/log/reopen", handleReopenLog)
+	// 收到 SIGUSR2 时重新打开日志文件
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if err := reopenLog(); err != nil {
+				log.WarnErrorf(err, "reopen log file on SIGUSR2 failed")
+			}
+		}
+	}()
 	go func() {
 		err := http.ListenAndServe(httpAddr, nil)
 		log.PanicError(err, "http debug server quit")
@@ -186,23 +308,113 @@ func main() {
 	// 加载配置文件
 	conf, err := proxy.LoadConf(configFile)
 	if err != nil {
-		log.PanicErrorf(err, "load config failed")
+		log.PanicErrorf(err, "load config '%s' failed", configFile)
 	}
 
 	// 捕获 SIGTERM 信号
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
 
+	// 启动时zk不可用则使用导入的路由表，路由表需要包含全部的slot
+	var table *proxy.RoutingTable
+	if file, ok := args["--import-table"].(string); ok && file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.PanicErrorf(err, "read routing table '%s' failed", file)
+		}
+		if table, err = proxy.ParseRoutingTable(b); err != nil {
+			log.PanicErrorf(err, "load routing table '%s' failed", file)
+		}
+	}
+
+	// 启动之后等待多久再设置为online，数字表示秒
+	var onlineDelay = time.Second
+	if s, ok := args["--online-delay"].(string); ok && s != "" {
+		d, err := time.ParseDuration(s)
+		if n, e := strconv.Atoi(s); e == nil {
+			d, err = time.Second*time.Duration(n), nil
+		}
+		if err != nil || d < 0 {
+			log.Panicf("invalid online delay %q, should be a duration like 500ms or 10s", s)
+		}
+		onlineDelay = d
+	}
+
 	// 建立一个新的proxy-server，会开启相关协程处理 redis-client 的请求，和后端 redis-server 建立连接
 	// 是主要的逻辑处理部分
-	s := proxy.New(addr, httpAddr, conf)
+	s := proxy.NewWithTable(addr, httpAddr, conf, table)
 	defer s.Close()
 
+	// 开始服务之后导出路由表，退出之前再导出一次
+	exportTable, _ := args["--export-table"].(string)
+	if exportTable != "" {
+		go func() {
+			for writeRoutingTable(s, exportTable) != nil {
+				time.Sleep(time.Second)
+			}
+		}()
+	}
+
+	// 定期在日志中输出关键指标
+	if args["--metrics-log-interval"] != nil {
+		n, err := strconv.Atoi(args["--metrics-log-interval"].(string))
+		if err != nil || n <= 0 {
+			log.Panicf("invalid metrics log interval %q, should be a positive number of seconds", args["--metrics-log-interval"])
+		}
+		s.StartMetricsLog(time.Second * time.Duration(n))
+	}
+
 	// stats包 提供了一个http接口获取相关信息  /debug/vars
 	stats.PublishJSONFunc("router", func() string {
 		var m = make(map[string]interface{})
 		m["ops"] = router.OpCounts()
+		m["failed"] = router.FailedCounts()
+		m["broadcasts"] = router.BroadcastCounts()
+		m["localpings"] = router.LocalPingCounts()
+		m["sessions"] = router.SessionCounts()
+		m["retries"] = router.RetryCounts()
+		m["writes_not_retried"] = router.WritesNotRetriedCounts()
+		m["handshake_timeouts"] = router.HandshakeTimeoutCounts()
+		m["read_timeouts"] = router.ReadTimeoutCounts()
+		m["oversized_requests"] = router.OversizedRequestCounts()
+		m["pipeline_slot_limits"] = router.PipelineSlotLimitCounts()
+		m["goodbyes"] = router.GoodbyeCounts()
+		m["client_gone"] = router.ClientGoneCounts()
+		m["response_buffer_throttles"] = router.BufferThrottleCounts()
+		m["response_buffer_closes"] = router.BufferCloseCounts()
+		m["slow_commands"] = router.SlowCommandCounts()
+		m["backend_drained"], m["backend_drain_forced"] = router.DrainedConnCounts()
+		m["pipeline_batches"] = router.PipelineBatches()
+		m["quarantines"] = router.QuarantineCounts()
+		m["disabled_rejects"] = router.DisabledRejectCounts()
+		m["denied_conns"] = router.DeniedConnCounts()
+		m["fallbacks"] = router.FallbackCounts()
+		m["group_down_rejects"] = router.GroupDownRejectCounts()
+		m["conflict_rejects"] = router.ConflictRejectCounts()
+		m["malformed_replies"] = router.MalformedReplyCounts()
+		m["mismatched_replies"] = router.MismatchedReplyCounts()
+		m["pre_migrate_hits"] = router.PreMigrateHitCounts()
+		m["pre_migrate_rejects"] = router.PreMigrateRejectCounts()
+		m["stale_rejects"] = router.StaleRejectCounts()
+		m["arity_rejects"] = router.ArityRejectCounts()
+		m["max_keys_rejects"] = router.MaxKeysRejectCounts()
+		m["key_rejects"] = router.KeyRejectCounts()
+		m["unknown_commands"] = router.UnknownCommandCounts()
+		m["acl_rejects"] = router.ACLRejectCounts()
+		m["oversized_replies"] = router.OversizedReplyCounts()
+		m["replica_reads"] = router.ReplicaReadCounts()
+		m["replica_lag_redirects"] = router.ReplicaLagRedirectCounts()
+		m["pinned_sessions"] = router.PinnedSessionCounts()
+		m["read_after_writes"] = router.ReadAfterWriteCounts()
+		if x := s.ConnectionCountries(); x != nil {
+			m["conns_by_country"] = x
+		}
+		if x := router.ShadowStats(); x != nil {
+			m["shadow"] = x
+		}
 		m["cmds"] = router.GetAllOpStats()
+		m["apps"] = router.GetAllAppStats()
+		m["stats_enabled"] = router.StatsEnabled()
 		m["info"] = s.Info()
 		m["build"] = map[string]interface{}{
 			"version": utils.Version,
@@ -212,14 +424,139 @@ func main() {
 		return string(b)
 	})
 
+	// 获取proxy的状态信息
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Status())
+	})
+	// 获取内部队列的长度，用于排查 proxy 卡住的原因
+	http.HandleFunc("/debug/internals", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Internals())
+	})
+	// 获取生效的全部配置，包括默认值，密码和私钥被隐藏
+	http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, conf)
+	})
+	// 获取命令表，以及黑名单和重命名的配置
+	http.HandleFunc("/commands", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, router.CommandTable())
+	})
+	// 获取所有客户端连接的状态
+	http.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, router.ClientList())
+	})
+	// 获取正在迁移中的slot的进度
+	http.HandleFunc("/migration/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.MigrationStatus())
+	})
+	// 强制从zk重新加载路由信息
+	http.HandleFunc("/router/reload", func(w http.ResponseWriter, r *http.Request) {
+		n, err := s.ReloadSlots()
+		if err != nil {
+			log.WarnErrorf(err, "reload slots failed")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"updated": n})
+	})
+	// 手动下线或者恢复一个后端，维护单个slave时不需要修改zk上的配置
+	http.HandleFunc("/backend/disable", func(w http.ResponseWriter, r *http.Request) {
+		addr := r.FormValue("addr")
+		persist, _ := strconv.ParseBool(r.FormValue("persist"))
+		if err := s.DisableBackend(addr, persist); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"disabled": addr, "persist": persist})
+	})
+	http.HandleFunc("/backend/enable", func(w http.ResponseWriter, r *http.Request) {
+		addr := r.FormValue("addr")
+		if err := s.EnableBackend(addr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"enabled": addr})
+	})
+	// 暂停发往一个group的命令，每条命令最多排队 timeout，比如 /group/pause?id=1&timeout=5s，/group/resume?id=1 恢复
+	http.HandleFunc("/group/pause", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id %q", r.FormValue("id")), http.StatusBadRequest)
+			return
+		}
+		timeout, err := time.ParseDuration(r.FormValue("timeout"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid timeout %q, should be a duration like 5s", r.FormValue("timeout")), http.StatusBadRequest)
+			return
+		}
+		if err := router.PauseGroup(id, timeout); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Warnf("group %d paused by %s, commands wait up to %s", id, r.RemoteAddr, timeout)
+		writeJSON(w, map[string]interface{}{"paused_groups": router.PausedGroups()})
+	})
+	http.HandleFunc("/group/resume", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id %q", r.FormValue("id")), http.StatusBadRequest)
+			return
+		}
+		if !router.ResumeGroup(id) {
+			http.Error(w, fmt.Sprintf("group %d is not paused", id), http.StatusBadRequest)
+			return
+		}
+		log.Warnf("group %d resumed by %s", id, r.RemoteAddr)
+		writeJSON(w, map[string]interface{}{"resumed": id, "paused_groups": router.PausedGroups()})
+	})
+	// 清空每个后端的不同key数量的估算
+	http.HandleFunc("/backends/keys/reset", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"reset": s.ResetBackendKeys()})
+	})
+	// 最近失败的命令，只包含命令名和第一个key
+	http.HandleFunc("/failures", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, router.Failures())
+	})
+	http.HandleFunc("/failures/reset", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"reset": router.ResetFailures()})
+	})
+	// 返回和 /debug/vars 中 cmds 相同格式的命令统计，同时清零，用于按窗口计算速率
+	http.HandleFunc("/stats/snapshot-reset", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, router.SnapshotAndResetOpStats())
+	})
+	// 将统计信息的快照写到 stats_dump_dir 下的文件中，file 为空时使用当前时间作为文件名
+	http.HandleFunc("/stats/dump", func(w http.ResponseWriter, r *http.Request) {
+		path, err := s.DumpStats(r.FormValue("file"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"file": path})
+	})
+	// 收到 SIGUSR1 时同样写一份快照
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			if _, err := s.DumpStats(""); err != nil {
+				log.WarnErrorf(err, "dump stats on SIGUSR1 failed")
+			}
+		}
+	}()
+
 	go func() {
 		<-c
 		log.Info("ctrl-c or SIGTERM found, bye bye...")
+		if exportTable != "" {
+			if err := writeRoutingTable(s, exportTable); err != nil {
+				log.WarnErrorf(err, "export routing table failed")
+			}
+		}
 		s.Close()
 	}()
 
-	// 等待1秒后将自己的状态设置为online
-	time.Sleep(time.Second)
+	// 等待 --online-delay 之后将自己的状态设置为online
+	log.Infof("wait %s before marking myself online", onlineDelay)
+	time.Sleep(onlineDelay)
 	if err := s.SetMyselfOnline(); err != nil {
 		log.WarnError(err, "mark myself online fail, you need mark online manually by dashboard")
 	}
@@ -0,0 +1,136 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 已经 accept、等待创建会话的连接
+type acceptedConn struct {
+	net.Conn
+	at time.Time // accept 返回的时间
+}
+
+// 建立连接的统计，用于判断 accept 和 TLS 握手是否跟不上连接的速度
+type acceptStats struct {
+	accepted   atomic2.Int64 // accept 的连接数，包括被拒绝的
+	waitUsecs  atomic2.Int64 // 从 accept 返回到开始创建会话的时间
+	handshakes atomic2.Int64 // 完成的 TLS 握手数，包括失败的
+	tlsUsecs   atomic2.Int64 // TLS 握手的时间
+}
+
+// 同时有 accept_workers 个协程调用 accept，以及同样数量的协程创建会话，全部 accept 的协程退出之后返回
+func (s *Server) handleConns() {
+	ch := s.accepted
+	defer close(ch)
+
+	for i := 0; i < s.conf.acceptWorkers; i++ {
+		go func() {
+			for c := range ch {
+				s.newSession(c)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.conf.acceptWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(ch)
+		}()
+	}
+	wg.Wait()
+}
+
+// 循环处理 redis 客户端的连接，通过 ch 通道交给 newSession 处理
+func (s *Server) acceptLoop(ch chan<- *acceptedConn) {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.WarnErrorf(err, "[%p] proxy accept new connection failed, get temporary error", s)
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			log.WarnErrorf(err, "[%p] proxy accept new connection failed, get non-temporary error, must shutdown", s)
+			return
+		}
+		s.accepts.accepted.Incr()
+		if router.IsDenied(c.RemoteAddr()) {
+			// 来源ip因为错误太多被隔离，直接关闭
+			c.Close()
+		} else {
+			if s.connLog != nil {
+				s.connLog.push(c.RemoteAddr())
+			}
+			ch <- &acceptedConn{Conn: c, at: time.Now()}
+		}
+	}
+}
+
+func (s *Server) newSession(a *acceptedConn) {
+	s.sessionBeat.beat()
+	s.sessionsCreated.Incr()
+	s.accepts.waitUsecs.Add(int64(time.Since(a.at) / time.Microsecond))
+	c := a.Conn
+	x := router.NewSessionSize(c, s.conf.passwd, s.conf.maxBufSize, s.conf.maxTimeout)
+	x.MaxInflight = s.conf.maxInflight
+	x.LocalPing = s.conf.localPing
+	x.RetryReads = s.conf.retryReads
+	x.ReadReplica = s.conf.readReplica
+	x.CheckArity = s.conf.checkArity
+	x.MaxArgs = s.conf.maxArgs
+	x.MaxKeys = s.conf.maxKeys
+	x.MaxRequestSize = s.conf.maxRequestSize
+	x.MaxPipelineSlots = s.conf.maxPipelineSlots
+	x.HandshakeTimeout = time.Second * time.Duration(s.conf.handshakeTimeout)
+	x.ReadTimeout = time.Millisecond * time.Duration(s.conf.readTimeout)
+	x.ReadAfterWrite = time.Millisecond * time.Duration(s.conf.readAfterWrite)
+	if s.conf.flushPolicy == "coalesce" {
+		x.FlushDelay = time.Microsecond * time.Duration(s.conf.flushDelay)
+		x.FlushSize = s.conf.flushSize
+	}
+	// 针对一个redis-client连接的处理函数，会将请求交由 s.router 转发给后端 redis-server
+	go func() {
+		// 使用 TLS 时先完成握手
+		if tc, ok := c.(*tls.Conn); ok {
+			start := time.Now()
+			err := handshakeTLS(tc, time.Second*time.Duration(s.conf.handshakeTimeout))
+			s.accepts.handshakes.Incr()
+			s.accepts.tlsUsecs.Add(int64(time.Since(start) / time.Microsecond))
+			if err != nil {
+				log.WarnErrorf(err, "session [%d] tls handshake failed", x.Id())
+				x.Close()
+				return
+			}
+			identifyTLSClient(x, tc, s.conf.tlsClientAs)
+		}
+		x.Serve(s.router, s.conf.maxPipeline)
+	}()
+}
+
+// 用于 /status，等待时间是平均值，单位 us
+func (s *Server) acceptStatus() map[string]interface{} {
+	var m = map[string]interface{}{
+		"workers":  s.conf.acceptWorkers,
+		"accepted": s.accepts.accepted.Get(),
+	}
+	if n := s.sessionsCreated.Get(); n != 0 {
+		m["avg_wait_us"] = s.accepts.waitUsecs.Get() / n
+	}
+	if n := s.accepts.handshakes.Get(); n != 0 {
+		m["tls_handshakes"] = n
+		m["avg_tls_handshake_us"] = s.accepts.tlsUsecs.Get() / n
+	}
+	return m
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestAcceptWorkers(t *testing.T) {
+	conf := newTestConf()
+	conf.acceptWorkers = 4
+	s, err := NewForTest(TestConfig{Config: conf, Backend: "127.0.0.1:1"})
+	assert.MustNoError(err)
+	defer s.Close()
+
+	const n = 32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.Dial("tcp", s.Addr())
+			assert.MustNoError(err)
+			defer c.Close()
+			// PING 由proxy直接回复，不需要后端
+			_, err = c.Write([]byte("PING\r\n"))
+			assert.MustNoError(err)
+			line, err := bufio.NewReader(c).ReadString('\n')
+			assert.MustNoError(err)
+			assert.Must(line == "+PONG\r\n")
+		}()
+	}
+	wg.Wait()
+
+	m := s.acceptStatus()
+	assert.Must(m["workers"] == 4 && m["accepted"] == int64(n))
+	_, ok := m["avg_wait_us"]
+	assert.Must(ok && s.sessionsCreated.Get() == n)
+	_, ok = m["tls_handshakes"]
+	assert.Must(!ok)
+}
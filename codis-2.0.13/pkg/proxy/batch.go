@@ -0,0 +1,78 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 合并窗口内收到的 action 通知，迁移大量slot时避免每个通知都更新一次路由
+// 窗口内被修改的slot只在最后按zk上的最新状态更新一次，所有的 action 在路由更新之后才回复
+type actionBatch struct {
+	slots     map[int]bool // slot -> true 表示重新从zk获取，false 表示下线
+	responses []int64      // 等待回复的 action 序号
+	events    int
+}
+
+func newActionBatch() *actionBatch {
+	return &actionBatch{slots: make(map[int]bool)}
+}
+
+// 同一个slot以最后一次修改为准
+func (b *actionBatch) setSlot(i int, fill bool) {
+	b.slots[i] = fill
+}
+
+func (b *actionBatch) sortedSlots() []int {
+	var slots = make([]int, 0, len(b.slots))
+	for i := range b.slots {
+		slots = append(slots, i)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// 收到第一个 action 通知之后，继续接收 window 内的通知，然后统一更新路由并回复
+func (s *Server) processBatch(e interface{}, window time.Duration) {
+	s.batch = newActionBatch()
+	s.processAction(e)
+	s.batch.events++
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for wait := true; wait; {
+		select {
+		case e := <-s.evtbus:
+			if lost, ok := e.(*coordinatorLost); ok {
+				s.onCoordinatorLost(lost)
+				continue
+			}
+			log.Infof("got event %s, %v, lastActionSeq %d", s.info.Id, e, s.lastActionSeq)
+			s.processAction(e)
+			s.batch.events++
+		case <-timer.C:
+			wait = false
+		}
+	}
+
+	b := s.batch
+	s.batch = nil
+	slots := b.sortedSlots()
+	for _, i := range slots {
+		if b.slots[i] {
+			s.fillSlot(i)
+		} else {
+			s.resetSlot(i)
+		}
+	}
+	for _, seq := range b.responses {
+		s.responseAction(seq)
+	}
+	s.batches.Incr()
+	s.batchedEvents.Add(int64(b.events))
+	log.Infof("batch of %d events applied, %d slots updated, %d actions responded", b.events, len(slots), len(b.responses))
+}
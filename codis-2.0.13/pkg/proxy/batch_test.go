@@ -0,0 +1,24 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestActionBatch(t *testing.T) {
+	b := newActionBatch()
+	b.setSlot(7, true)
+	b.setSlot(3, true)
+	b.setSlot(7, false)
+	b.setSlot(1, false)
+	b.setSlot(1, true)
+
+	// 每个slot只更新一次，以最后一次修改为准
+	slots := b.sortedSlots()
+	assert.Must(len(slots) == 3 && slots[0] == 1 && slots[1] == 3 && slots[2] == 7)
+	assert.Must(b.slots[1] && b.slots[3] && !b.slots[7])
+}
@@ -4,8 +4,18 @@
 package proxy
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/bytesize"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/c4pt0r/cfg"
 )
@@ -22,58 +32,643 @@ type Config struct {
 
 	pingPeriod       int // seconds，定期向后端redis发送心跳
 	maxTimeout       int // seconds，client会话超时时间
+	handshakeTimeout int // seconds，client建立连接后完成握手的超时时间，0表示不限制
+	readTimeout      int // ms，client开始发送一条命令之后发送完的超时时间，0表示不限制
+	goodbyeTimeout   int // seconds，下线时等待client空闲并回复 goodbye 的时间
 	maxBufSize       int // 每个client连接的缓冲区大小
 	maxPipeline      int // pipeline最大值
+	listenBacklog    int // 监听端口的 accept 队列长度，0表示使用系统默认值
+	acceptWorkers    int // 同时调用 accept 的协程数，以及同时创建会话的协程数
+	maxInflight      int // 每个client同时发往后端的请求数上限，0表示不限制
+	maxArgs          int // 单条命令的参数个数上限，0表示不限制
+	maxKeys          int // 单条命令的key的个数上限，0表示不限制
+	maxKeyLength     int // 单个key的长度上限，0表示不限制
+	maxApps          int // 按应用统计命令时的应用数量上限，0表示不按应用统计
+	failureLogSize   int // 保留的最近失败的命令数，0表示不记录
+	maxBackendQueue  int // 每个后端等待返回的请求数上限，超过时直接返回错误，0表示不限制
+	reconnectJitter  int // ms，和后端的连接出错后，重连之前在 50ms 的基础上随机多等待的时间上限
+	drainTimeout     int // seconds，后端被移除后等待已经发送的请求返回的时间，0表示一直等待
+	batchWindow      int // ms，合并这段时间内收到的zk通知，统一更新路由，0表示不合并
+	readAfterWrite   int // ms，开启读slave时，写入之后这段时间内读取同一个key会发送给master
+	hotSlotReads     int // 每秒的只读命令数超过这个值的slot分散到slave读取，0表示不开启
+	defaultGroup     int // 没有分配group的slot发送到这个group，0表示不开启
+	groupDownTimeout int // ms，group的全部后端都不可用时，wait 策略等待恢复的时间
 	zkSessionTimeout int // zk连接超时时间，单位 ms
+	stallThreshold   int // seconds，watchdog 认为事件循环或者创建会话的协程停顿的时间
+	maxPipelineSlots int // 一批 pipeline 同时转发到的 slot 个数上限，0表示不限制
+	clientSndBuf     int // 客户端连接的 socket 发送缓冲区大小，0表示使用系统默认值
+	clientRcvBuf     int // 客户端连接的 socket 接收缓冲区大小
+	backendSndBuf    int // 后端连接的 socket 发送缓冲区大小
+	backendRcvBuf    int // 后端连接的 socket 接收缓冲区大小
+
+	tlsCertFile   string   // 客户端连接使用 TLS 时的证书，为空表示不使用 TLS
+	tlsKeyFile    string   // 证书的私钥
+	tlsMinVersion string   // 允许的最低 TLS 版本，1.2 或者 1.3
+	tlsCiphers    []string // 允许的 TLS 1.2 加密套件，为空表示使用 go 的默认值
+	tlsClientCA   string   // 签发客户端证书的 CA，配置之后要求客户端提供证书，为空表示不验证客户端
+	tlsClientAs   []string // 客户端证书的 CN 用作应用名（app）或者 acl_users 中的用户（user）
+
+	groupDownPolicy string // group的全部后端都不可用时的处理，fail 或者 wait
+	unknownAction   string // 命令表中没有的命令的处理，forward、reject 或者 forward-first-backend
+
+	preMigrate      string // slot处于预迁移状态时的处理，wait 或者 tryagain
+	preMigrateRetry int    // tryagain 时返回错误之前在proxy内部重试的次数
+	preMigrateDelay int    // ms，每次重试之前等待的时间
+
+	flushPolicy string // 回复的发送策略，immediate 或者 coalesce
+	flushDelay  int    // us，coalesce 时回复最多等待的时间
+	flushSize   int    // coalesce 时最多缓存的回复数
+
+	coordinatorOptional bool   // 启动后zk不可用时继续使用已有的路由提供服务
+	staleTableAction    string // 和zk失去连接超过 staleTableMaxAge 之后的处理，serve 或者 reject
+	staleTableMaxAge    int    // seconds
+	conflictPolicy      string // 同一个master被多个group声明时的处理，serve 或者 reject 这些group的slot
+
+	goodbye    string // 下线时回复给空闲client的错误，为空表示直接关闭
+	serverName string // HELLO 和 INFO 返回的服务名
+
+	allowCommands  []string          // 允许执行的默认被禁用的命令，比如 FLUSHALL
+	renameCommands map[string]string // 重命名的命令，原来的名字 -> 新的名字，为空表示禁用
+	aclUsers       []*router.ACLUser // 通过 AUTH <user> <password> 登录的用户，只能执行允许的命令，访问允许的key
+	replicaMaxLag  map[string]int    // 只读命令允许的slave复制延迟，单位秒，* 表示其它只读命令，没有配置时不限制
+	replicaUserLag map[string]int    // 用户允许的slave复制延迟，优先于命令的配置，default 表示没有登录为 acl_users 的会话
+	urgentCommands []string          // 在后端队列中优先发送的命令
+	urgentUsers    []string          // acl_users 中的用户，全部命令在后端队列中优先发送
+	localPing      bool              // 是否由proxy直接回复 PING，不转发给后端
+	localTime      bool              // 是否由proxy用自己的时钟回复 TIME，不转发给后端
+	strictReplies  bool              // 是否校验后端回复的格式和类型，不符时关闭后端连接
+	rejectEmptyKey bool              // 是否拒绝key为空的命令
+	logFailures    bool              // 后端出错时在日志中记录发送命令的客户端
+	staticReplies  bool              // 由proxy直接回复的 +OK、+PONG 等固定结果是否共用预先编码的回复
+	retryReads     bool              // 后端出错时是否重试只读命令
+	readReplica    bool              // 是否将只读命令发送给slave
+	checkArity     bool              // 转发前是否按命令表检查参数个数
+	randomWeighted bool              // RANDOMKEY 是否按照每个后端的 DBSIZE 选择后端
+	shutdown       bool              // 是否允许通过 SHUTDOWN 命令关闭proxy，需要设置密码
+	verifyPing     bool              // 建立后端连接时检查 PING 是否返回 PONG
+	verifyVersion  bool              // 建立后端连接时通过 INFO 获取 redis_version
+	keyCardinality bool              // 是否估算每个后端的不同key的数量
+	disableStats   bool              // 关闭命令统计
+	watchdog       bool              // 是否检查事件循环和创建会话的协程是否停顿
+	maxReplySize   int64             // 后端返回结果的大小上限，0表示不限制
+	maxRequestSize int64             // 客户端发送的单条命令的大小上限，0表示不限制
+	diagBudget     int64             // 最近失败的命令和等待导出的 span 共用的内存上限，0表示不限制
+	maxRespBuffer  int64             // 每个连接还没有发送给客户端的回复的大小上限，0表示不限制
+	bufferGrace    int               // seconds，回复超过上限持续这么久之后关闭连接，0表示不关闭
+	slowlog        time.Duration     // 执行时间超过这个值的命令记录到日志中，0表示不记录
+	multiplex      bool              // 所有client复用每个后端的共享连接，关闭后每个client使用自己的后端连接
+	poolSize       int               // 每个后端的共享连接数
+	affinity       bool              // 同一个client发往同一个后端的命令总是使用同一个共享连接
+
+	infoBackends bool // INFO 是否汇总所有后端的信息
+	infoCacheTTL int  // seconds，后端信息的缓存时间
+
+	warmup        int    // 开始服务之前提前建立的和每个后端的连接数，0表示不预热
+	warmupTimeout int    // seconds
+	warmupOnError string // 有后端连接失败时的处理，proceed 或者 abort
+
+	logSamplingWindow    int // seconds，相同的日志在窗口内超过 logSamplingThreshold 次之后不再输出，0表示不限制
+	logSamplingThreshold int
+	logMaxLine           int // 日志内容的长度上限，超过的部分被截断，0表示不限制
+
+	statsdAddr     string   // StatsD 地址，为空则不推送
+	statsdPrefix   string   // 推送的指标名前缀
+	statsdInterval int      // seconds，推送间隔
+	statsdMetrics  []string // 推送的指标集合
+	statsDumpDir   string   // /stats/dump 和 SIGUSR1 写入统计信息快照的目录，为空则不开启
+
+	quarantineErrors   int    // 客户端在窗口内允许的协议错误和非法命令数，超过之后隔离，0表示不开启
+	quarantineWindow   int    // seconds
+	quarantineAction   string // close 或者 throttle
+	quarantineDuration int    // seconds，throttle 暂停读取的时间，以及来源ip在黑名单中的时间
+	quarantineDenylist bool   // 隔离时是否将来源ip加入黑名单
+
+	traceEndpoint   string  // OTLP/HTTP 的地址，为空则不开启
+	traceService    string  // 导出的 service.name
+	traceSampleRate float64 // 采样率，0 到 1 之间
+
+	logConns  bool   // accept 连接时在日志中记录来源ip的反向解析
+	geoipFile string // 开启 logConns 时查询来源ip的国家和 ASN 的数据库，为空则不查询
+
+	shadowAddr  string // 复制写命令的另一个集群的proxy地址，为空则不开启
+	shadowAuth  string
+	shadowQueue int // 等待复制的命令数上限，超过时丢弃
 }
 
-// 加载配置文件
+// 配置项缺失
+type ErrMissingKey struct {
+	Key string
+}
+
+func (e *ErrMissingKey) Error() string {
+	return fmt.Sprintf("invalid config: %s entry is missing", e.Key)
+}
+
+// 配置项的值不合法
+type ErrInvalidValue struct {
+	Key    string
+	Value  string
+	Reason string
+}
+
+func (e *ErrInvalidValue) Error() string {
+	return fmt.Sprintf("invalid config: read %s = %s, %s", e.Key, e.Value, e.Reason)
+}
+
+// 加载配置文件，返回遇到的第一个配置错误
 func LoadConf(configFile string) (*Config, error) {
+	conf, errs, err := loadConf(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, errs[0]
+	}
+	return conf, nil
+}
+
+// 检查配置文件，返回全部的配置错误，而不是遇到第一个就停止
+func ValidateConf(configFile string) []error {
+	_, errs, err := loadConf(configFile)
+	if err != nil {
+		return []error{err}
+	}
+	return errs
+}
+
+func loadConf(configFile string) (*Config, []error, error) {
 	c := cfg.NewCfg(configFile)
 	if err := c.Load(); err != nil {
-		log.PanicErrorf(err, "load config '%s' failed", configFile)
+		return nil, nil, errors.Trace(err)
 	}
 
+	var errs []error
+
 	conf := &Config{}
 	conf.productName, _ = c.ReadString("product", "test")
 	if len(conf.productName) == 0 {
-		log.Panicf("invalid config: product entry is missing in %s", configFile)
+		errs = append(errs, &ErrMissingKey{Key: "product"})
 	}
 	conf.dashboardAddr, _ = c.ReadString("dashboard_addr", "")
 	if conf.dashboardAddr == "" {
-		log.Panicf("invalid config: dashboard_addr is missing in %s", configFile)
+		errs = append(errs, &ErrMissingKey{Key: "dashboard_addr"})
 	}
 	conf.zkAddr, _ = c.ReadString("zk", "")
 	if len(conf.zkAddr) == 0 {
-		log.Panicf("invalid config: need zk entry is missing in %s", configFile)
+		errs = append(errs, &ErrMissingKey{Key: "zk"})
 	}
 	conf.zkAddr = strings.TrimSpace(conf.zkAddr)
 	conf.passwd, _ = c.ReadString("password", "")
 
 	conf.proxyId, _ = c.ReadString("proxy_id", "")
 	if len(conf.proxyId) == 0 {
-		log.Panicf("invalid config: need proxy_id entry is missing in %s", configFile)
+		errs = append(errs, &ErrMissingKey{Key: "proxy_id"})
 	}
 
 	conf.proto, _ = c.ReadString("proto", "tcp")
 	conf.provider, _ = c.ReadString("coordinator", "zookeeper")
 
+	loadConfList := func(entry string, defval string) []string {
+		v, _ := c.ReadString(entry, defval)
+		var list []string
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+
+	conf.allowCommands = loadConfList("allow_commands", "")
+	conf.renameCommands = make(map[string]string)
+	for _, s := range loadConfList("rename_commands", "") {
+		kv := strings.SplitN(s, ":", 2)
+		name := strings.ToUpper(strings.TrimSpace(kv[0]))
+		if len(kv) != 2 || name == "" {
+			errs = append(errs, &ErrInvalidValue{Key: "rename_commands", Value: s, Reason: "should be like CONFIG:NEWNAME or FLUSHALL:"})
+			continue
+		}
+		if _, ok := conf.renameCommands[name]; ok {
+			errs = append(errs, &ErrInvalidValue{Key: "rename_commands", Value: s, Reason: name + " is renamed twice"})
+			continue
+		}
+		conf.renameCommands[name] = strings.ToUpper(strings.TrimSpace(kv[1]))
+	}
+	var users = make(map[string]bool)
+	for _, s := range loadConfList("acl_users", "") {
+		u, err := router.ParseACLUser(s)
+		if err != nil {
+			errs = append(errs, &ErrInvalidValue{Key: "acl_users", Value: s, Reason: err.Error()})
+			continue
+		}
+		if users[u.Name] {
+			errs = append(errs, &ErrInvalidValue{Key: "acl_users", Value: s, Reason: u.Name + " is defined twice"})
+			continue
+		}
+		users[u.Name] = true
+		conf.aclUsers = append(conf.aclUsers, u)
+	}
+	// 格式为 "GET:1,*:10"，单位秒，命令名转换为大写
+	loadConfLag := func(entry string, upper bool, valid func(name string) string) map[string]int {
+		var m = make(map[string]int)
+		for _, s := range loadConfList(entry, "") {
+			kv := strings.SplitN(s, ":", 2)
+			name := strings.TrimSpace(kv[0])
+			if upper {
+				name = strings.ToUpper(name)
+			}
+			if len(kv) != 2 || name == "" {
+				errs = append(errs, &ErrInvalidValue{Key: entry, Value: s, Reason: "should be like GET:1"})
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err != nil || n < 0 {
+				errs = append(errs, &ErrInvalidValue{Key: entry, Value: s, Reason: "should be a non-negative number of seconds"})
+				continue
+			}
+			if reason := valid(name); reason != "" {
+				errs = append(errs, &ErrInvalidValue{Key: entry, Value: s, Reason: reason})
+				continue
+			}
+			m[name] = n
+		}
+		return m
+	}
+	conf.replicaMaxLag = loadConfLag("replica_max_lag", true, func(name string) string {
+		if c := router.GetCommand(name); name != "*" && (c == nil || !c.IsReadOnly()) {
+			return name + " is not a read-only command"
+		}
+		return ""
+	})
+	conf.replicaUserLag = loadConfLag("replica_max_lag_users", false, func(name string) string {
+		if name != "default" && !users[name] {
+			return name + " is not a user of acl_users"
+		}
+		return ""
+	})
+	for _, name := range loadConfList("high_priority_commands", "") {
+		if router.GetCommand(strings.ToUpper(name)) == nil {
+			errs = append(errs, &ErrInvalidValue{Key: "high_priority_commands", Value: name, Reason: "unknown command"})
+			continue
+		}
+		conf.urgentCommands = append(conf.urgentCommands, strings.ToUpper(name))
+	}
+	for _, name := range loadConfList("high_priority_users", "") {
+		if !users[name] {
+			errs = append(errs, &ErrInvalidValue{Key: "high_priority_users", Value: name, Reason: "not a user of acl_users"})
+			continue
+		}
+		conf.urgentUsers = append(conf.urgentUsers, name)
+	}
+
 	loadConfInt := func(entry string, defval int) int {
 		v, _ := c.ReadInt(entry, defval)
 		if v < 0 {
-			log.Panicf("invalid config: read %s = %d", entry, v)
+			errs = append(errs, &ErrInvalidValue{Key: entry, Value: strconv.Itoa(v), Reason: "should not be negative"})
+		}
+		return v
+	}
+
+	loadConfBool := func(entry string, defval bool) bool {
+		s, _ := c.ReadString(entry, strconv.FormatBool(defval))
+		v, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			errs = append(errs, &ErrInvalidValue{Key: entry, Value: s, Reason: "should be true or false"})
+			return defval
 		}
 		return v
 	}
 
 	conf.pingPeriod = loadConfInt("backend_ping_period", 5)
 	conf.maxTimeout = loadConfInt("session_max_timeout", 1800)
+	conf.handshakeTimeout = loadConfInt("handshake_timeout", 10)
+	conf.readTimeout = loadConfInt("client_read_timeout", 0)
 	conf.maxBufSize = loadConfInt("session_max_bufsize", 131072)
+	conf.clientSndBuf = loadConfInt("client_sndbuf", 0)
+	conf.clientRcvBuf = loadConfInt("client_rcvbuf", 0)
+	conf.backendSndBuf = loadConfInt("backend_sndbuf", 0)
+	conf.backendRcvBuf = loadConfInt("backend_rcvbuf", 0)
+	conf.goodbye, _ = c.ReadString("session_goodbye", "")
+	conf.goodbye = strings.TrimSpace(conf.goodbye)
+	if strings.ContainsAny(conf.goodbye, "\r\n") {
+		errs = append(errs, &ErrInvalidValue{Key: "session_goodbye", Value: conf.goodbye, Reason: "should be a single line"})
+	}
+	conf.goodbyeTimeout = loadConfInt("session_goodbye_timeout", 5)
 	conf.maxPipeline = loadConfInt("session_max_pipeline", 1024)
+	conf.listenBacklog = loadConfInt("listen_backlog", 0)
+	conf.acceptWorkers = loadConfInt("accept_workers", 1)
+	if conf.acceptWorkers == 0 {
+		errs = append(errs, &ErrInvalidValue{Key: "accept_workers", Value: "0", Reason: "should be at least 1"})
+	}
+	conf.tlsCertFile, _ = c.ReadString("tls_cert_file", "")
+	conf.tlsCertFile = strings.TrimSpace(conf.tlsCertFile)
+	conf.tlsKeyFile, _ = c.ReadString("tls_key_file", "")
+	conf.tlsKeyFile = strings.TrimSpace(conf.tlsKeyFile)
+	if (conf.tlsCertFile == "") != (conf.tlsKeyFile == "") {
+		errs = append(errs, &ErrInvalidValue{Key: "tls_key_file", Value: conf.tlsKeyFile, Reason: "should be set together with tls_cert_file"})
+	}
+	conf.tlsMinVersion, _ = c.ReadString("tls_min_version", "1.2")
+	conf.tlsMinVersion = strings.TrimSpace(conf.tlsMinVersion)
+	conf.tlsCiphers = loadConfList("tls_ciphers", "")
+	errs = append(errs, checkTLSConf(conf.tlsMinVersion, conf.tlsCiphers)...)
+	conf.tlsClientCA, _ = c.ReadString("tls_client_ca_file", "")
+	conf.tlsClientCA = strings.TrimSpace(conf.tlsClientCA)
+	conf.tlsClientAs = loadConfList("tls_client_identity", "")
+	errs = append(errs, checkTLSClientConf(conf.tlsCertFile, conf.tlsClientCA, conf.tlsClientAs)...)
+	conf.flushPolicy, _ = c.ReadString("reply_flush_policy", "immediate")
+	conf.flushPolicy = strings.ToLower(strings.TrimSpace(conf.flushPolicy))
+	if conf.flushPolicy != "immediate" && conf.flushPolicy != "coalesce" {
+		errs = append(errs, &ErrInvalidValue{Key: "reply_flush_policy", Value: conf.flushPolicy, Reason: "should be immediate or coalesce"})
+	}
+	conf.flushDelay = loadConfInt("reply_flush_delay", 200)
+	conf.flushSize = loadConfInt("reply_flush_size", 32)
+	if conf.flushPolicy == "coalesce" {
+		if conf.flushDelay == 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "reply_flush_delay", Value: "0", Reason: "should be positive"})
+		}
+		if conf.flushSize == 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "reply_flush_size", Value: "0", Reason: "should be positive"})
+		}
+	}
+	conf.maxInflight = loadConfInt("max_inflight_per_client", 0)
+	conf.maxArgs = loadConfInt("session_max_args", 0)
+	conf.maxPipelineSlots = loadConfInt("max_slots_per_pipeline", 0)
+	conf.maxKeys = loadConfInt("max_keys_per_command", 100000)
+	conf.maxKeyLength = loadConfInt("max_key_length", 0)
+	conf.rejectEmptyKey = loadConfBool("reject_empty_keys", false)
+	conf.checkArity = loadConfBool("session_check_arity", true)
+	conf.randomWeighted = loadConfBool("randomkey_weighted", false)
+	conf.localPing = loadConfBool("local_ping", true)
+	conf.localTime = loadConfBool("local_time", true)
+	conf.strictReplies = loadConfBool("strict_reply_validation", false)
+	conf.staticReplies = loadConfBool("static_replies", true)
+	conf.retryReads = loadConfBool("backend_retry_reads", false)
+	conf.readReplica = loadConfBool("backend_read_replica", false)
+	conf.multiplex = loadConfBool("backend_multiplex", true)
+	conf.poolSize = loadConfInt("backend_pool_size", 1)
+	if conf.poolSize == 0 {
+		errs = append(errs, &ErrInvalidValue{Key: "backend_pool_size", Value: "0", Reason: "should be at least 1"})
+	}
+	conf.affinity = loadConfBool("backend_affinity", true)
+	conf.readAfterWrite = loadConfInt("backend_read_after_write", 0)
+	conf.hotSlotReads = loadConfInt("backend_hot_slot_reads", 0)
+	conf.defaultGroup = loadConfInt("default_group", 0)
+	conf.groupDownPolicy, _ = c.ReadString("group_down_policy", "fail")
+	conf.groupDownPolicy = strings.ToLower(strings.TrimSpace(conf.groupDownPolicy))
+	if conf.groupDownPolicy != "fail" && conf.groupDownPolicy != "wait" {
+		errs = append(errs, &ErrInvalidValue{Key: "group_down_policy", Value: conf.groupDownPolicy, Reason: "should be fail or wait"})
+	}
+	conf.groupDownTimeout = loadConfInt("group_down_timeout", 1000)
+	conf.preMigrate, _ = c.ReadString("pre_migrate_policy", "wait")
+	conf.preMigrate = strings.ToLower(strings.TrimSpace(conf.preMigrate))
+	if conf.preMigrate != "wait" && conf.preMigrate != "tryagain" {
+		errs = append(errs, &ErrInvalidValue{Key: "pre_migrate_policy", Value: conf.preMigrate, Reason: "should be wait or tryagain"})
+	}
+	conf.unknownAction, _ = c.ReadString("unknown_command_action", "forward")
+	conf.unknownAction = strings.ToLower(strings.TrimSpace(conf.unknownAction))
+	switch conf.unknownAction {
+	case "forward", "reject", "forward-first-backend":
+	default:
+		errs = append(errs, &ErrInvalidValue{Key: "unknown_command_action", Value: conf.unknownAction, Reason: "should be forward, reject or forward-first-backend"})
+	}
+	conf.preMigrateRetry = loadConfInt("pre_migrate_retries", 3)
+	conf.preMigrateDelay = loadConfInt("pre_migrate_retry_delay", 10)
+	conf.maxBackendQueue = loadConfInt("backend_queue_max", 0)
+	conf.reconnectJitter = loadConfInt("backend_reconnect_jitter", 50)
+	conf.drainTimeout = loadConfInt("backend_drain_timeout", 10)
+	conf.batchWindow = loadConfInt("coordinator_batch_window", 0)
+	conf.verifyPing = loadConfBool("backend_verify_ping", false)
+	conf.verifyVersion = loadConfBool("backend_verify_version", false)
+	conf.keyCardinality = loadConfBool("backend_key_cardinality", false)
+	conf.disableStats = loadConfBool("disable_stats", false)
+	conf.watchdog = loadConfBool("watchdog", false)
+	conf.stallThreshold = loadConfInt("watchdog_stall_threshold", 10)
+	if conf.watchdog && conf.stallThreshold <= 0 {
+		errs = append(errs, &ErrInvalidValue{Key: "watchdog_stall_threshold", Value: strconv.Itoa(conf.stallThreshold), Reason: "should be positive when watchdog is on"})
+	}
+	conf.maxApps = loadConfInt("stats_max_apps", 0)
+	conf.failureLogSize = loadConfInt("failure_log_size", 128)
+	conf.logFailures = loadConfBool("log_backend_errors", false)
+	if conf.failureLogSize > 10000 {
+		errs = append(errs, &ErrInvalidValue{Key: "failure_log_size", Value: strconv.Itoa(conf.failureLogSize), Reason: "should be at most 10000"})
+	}
+	conf.shutdown = loadConfBool("proxy_shutdown", false)
+	conf.infoBackends = loadConfBool("info_backends", true)
+	conf.serverName, _ = c.ReadString("proxy_server_name", "codis")
+	conf.serverName = strings.TrimSpace(conf.serverName)
+	if conf.serverName == "" || strings.ContainsAny(conf.serverName, " \r\n") {
+		errs = append(errs, &ErrInvalidValue{Key: "proxy_server_name", Value: conf.serverName, Reason: "should be a name without spaces"})
+	}
+	conf.infoCacheTTL = loadConfInt("info_backends_cache", 1)
+	conf.logMaxLine = loadConfInt("log_max_line", log.DefaultMaxLine)
+	conf.logSamplingWindow = loadConfInt("log_sampling_window", 0)
+	conf.logSamplingThreshold = loadConfInt("log_sampling_threshold", 10)
+
+	conf.statsdAddr, _ = c.ReadString("statsd_addr", "")
+	conf.statsdAddr = strings.TrimSpace(conf.statsdAddr)
+	conf.statsdPrefix, _ = c.ReadString("statsd_prefix", "codis.proxy")
+	conf.statsdInterval = loadConfInt("statsd_interval", 10)
+	if conf.statsdAddr != "" && conf.statsdInterval == 0 {
+		errs = append(errs, &ErrInvalidValue{Key: "statsd_interval", Value: "0", Reason: "should be positive"})
+	}
+	conf.statsdMetrics = loadConfList("statsd_metrics", "ops,cmds,sessions")
+	conf.statsDumpDir, _ = c.ReadString("stats_dump_dir", "")
+	if conf.statsDumpDir = strings.TrimSpace(conf.statsDumpDir); conf.statsDumpDir != "" {
+		if fi, err := os.Stat(conf.statsDumpDir); err != nil || !fi.IsDir() {
+			errs = append(errs, &ErrInvalidValue{Key: "stats_dump_dir", Value: conf.statsDumpDir, Reason: "should be an existing directory"})
+		}
+	}
+
+	conf.quarantineErrors = loadConfInt("client_quarantine_errors", 0)
+	conf.quarantineWindow = loadConfInt("client_quarantine_window", 10)
+	if conf.quarantineErrors != 0 && conf.quarantineWindow == 0 {
+		errs = append(errs, &ErrInvalidValue{Key: "client_quarantine_window", Value: "0", Reason: "should be positive"})
+	}
+	conf.quarantineAction, _ = c.ReadString("client_quarantine_action", "close")
+	conf.quarantineAction = strings.ToLower(strings.TrimSpace(conf.quarantineAction))
+	if conf.quarantineAction != "close" && conf.quarantineAction != "throttle" {
+		errs = append(errs, &ErrInvalidValue{Key: "client_quarantine_action", Value: conf.quarantineAction, Reason: "should be close or throttle"})
+	}
+	conf.quarantineDuration = loadConfInt("client_quarantine_duration", 60)
+	conf.quarantineDenylist = loadConfBool("client_quarantine_denylist", false)
+
+	conf.logConns = loadConfBool("log_connections", false)
+	conf.geoipFile, _ = c.ReadString("log_connections_geoip_db", "")
+	conf.geoipFile = strings.TrimSpace(conf.geoipFile)
+	if conf.geoipFile != "" && !conf.logConns {
+		errs = append(errs, &ErrInvalidValue{Key: "log_connections_geoip_db", Value: conf.geoipFile, Reason: "only works with log_connections=true"})
+	}
+
+	conf.traceEndpoint, _ = c.ReadString("trace_otlp_endpoint", "")
+	conf.traceEndpoint = strings.TrimSpace(conf.traceEndpoint)
+	if conf.traceEndpoint != "" && !strings.HasPrefix(conf.traceEndpoint, "http://") && !strings.HasPrefix(conf.traceEndpoint, "https://") {
+		errs = append(errs, &ErrInvalidValue{Key: "trace_otlp_endpoint", Value: conf.traceEndpoint, Reason: "should be a http or https url"})
+	}
+	conf.traceService, _ = c.ReadString("trace_service_name", "codis-proxy")
+	conf.traceService = strings.TrimSpace(conf.traceService)
+	rate, _ := c.ReadString("trace_sample_rate", "1")
+	if v, err := strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || v < 0 || v > 1 {
+		errs = append(errs, &ErrInvalidValue{Key: "trace_sample_rate", Value: rate, Reason: "should be between 0 and 1"})
+	} else {
+		conf.traceSampleRate = v
+	}
+	conf.shadowAddr, _ = c.ReadString("shadow_addr", "")
+	conf.shadowAddr = strings.TrimSpace(conf.shadowAddr)
+	conf.shadowAuth, _ = c.ReadString("shadow_auth", "")
+	conf.shadowQueue = loadConfInt("shadow_queue_size", 1024)
+	if conf.shadowAddr != "" {
+		if _, _, err := net.SplitHostPort(conf.shadowAddr); err != nil {
+			errs = append(errs, &ErrInvalidValue{Key: "shadow_addr", Value: conf.shadowAddr, Reason: "should be host:port"})
+		}
+		if conf.shadowQueue == 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "shadow_queue_size", Value: "0", Reason: "should be positive"})
+		}
+	}
+	if s, _ := c.ReadString("max_reply_size", "512mb"); strings.TrimSpace(s) != "" {
+		v, err := bytesize.Parse(strings.TrimSpace(s))
+		if err != nil || v < 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "max_reply_size", Value: s, Reason: "should be a size like 512mb"})
+		}
+		conf.maxReplySize = v
+	}
+	if s, _ := c.ReadString("max_request_size", "0"); strings.TrimSpace(s) != "" {
+		v, err := bytesize.Parse(strings.TrimSpace(s))
+		if err != nil || v < 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "max_request_size", Value: s, Reason: "should be a size like 512mb"})
+		}
+		conf.maxRequestSize = v
+	}
+	if s, _ := c.ReadString("max_response_buffer", "128mb"); strings.TrimSpace(s) != "" {
+		v, err := bytesize.Parse(strings.TrimSpace(s))
+		if err != nil || v < 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "max_response_buffer", Value: s, Reason: "should be a size like 128mb"})
+		}
+		conf.maxRespBuffer = v
+	}
+	conf.bufferGrace = loadConfInt("max_response_buffer_grace", 0)
+	if s, _ := c.ReadString("slowlog_threshold", "0"); strings.TrimSpace(s) != "" {
+		v, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || v < 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "slowlog_threshold", Value: s, Reason: "should be a duration like 100ms"})
+		}
+		conf.slowlog = v
+	}
+	if s, _ := c.ReadString("diagnostics_memory_budget", "16mb"); strings.TrimSpace(s) != "" {
+		v, err := bytesize.Parse(strings.TrimSpace(s))
+		if err != nil || v < 0 {
+			errs = append(errs, &ErrInvalidValue{Key: "diagnostics_memory_budget", Value: s, Reason: "should be a size like 16mb"})
+		}
+		conf.diagBudget = v
+	}
 	conf.zkSessionTimeout = loadConfInt("zk_session_timeout", 30000)
 	if conf.zkSessionTimeout <= 100 {
 		conf.zkSessionTimeout *= 1000
 		log.Warn("zkSessionTimeout is to small, it is ms not second")
 	}
-	return conf, nil
+	conf.coordinatorOptional = loadConfBool("coordinator_optional", false)
+	conf.staleTableAction, _ = c.ReadString("stale_table_action", "serve")
+	conf.staleTableAction = strings.ToLower(strings.TrimSpace(conf.staleTableAction))
+	if conf.staleTableAction != "serve" && conf.staleTableAction != "reject" {
+		errs = append(errs, &ErrInvalidValue{Key: "stale_table_action", Value: conf.staleTableAction, Reason: "should be serve or reject"})
+	}
+	conf.staleTableMaxAge = loadConfInt("stale_table_max_age", 60)
+	conf.conflictPolicy, _ = c.ReadString("routing_conflict_policy", "serve")
+	conf.conflictPolicy = strings.ToLower(strings.TrimSpace(conf.conflictPolicy))
+	if conf.conflictPolicy != "serve" && conf.conflictPolicy != "reject" {
+		errs = append(errs, &ErrInvalidValue{Key: "routing_conflict_policy", Value: conf.conflictPolicy, Reason: "should be serve or reject"})
+	}
+	conf.warmup = loadConfInt("backend_warmup", 0)
+	if conf.warmup > conf.poolSize {
+		errs = append(errs, &ErrInvalidValue{Key: "backend_warmup", Value: strconv.Itoa(conf.warmup), Reason: "should not be larger than backend_pool_size"})
+	}
+	conf.warmupTimeout = loadConfInt("backend_warmup_timeout", 5)
+	conf.warmupOnError, _ = c.ReadString("backend_warmup_on_error", "proceed")
+	conf.warmupOnError = strings.ToLower(strings.TrimSpace(conf.warmupOnError))
+	if conf.warmupOnError != "proceed" && conf.warmupOnError != "abort" {
+		errs = append(errs, &ErrInvalidValue{Key: "backend_warmup_on_error", Value: conf.warmupOnError, Reason: "should be proceed or abort"})
+	}
+	return conf, errs, nil
+}
+
+// 在 /config 中隐藏的配置，配置了时显示为 ******
+var secretConfigs = map[string]bool{
+	"passwd":     true,
+	"shadowAuth": true,
+	"tlsKeyFile": true,
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// 按字段名输出生效的全部配置，包括使用默认值的配置，密码和私钥被隐藏
+// 通过反射遍历全部字段，新增的配置会自动输出，只有新增的敏感配置需要加入 secretConfigs
+func (conf *Config) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	v := reflect.ValueOf(conf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		switch {
+		case secretConfigs[name]:
+			if field.Len() != 0 {
+				m[name] = "******"
+			} else {
+				m[name] = ""
+			}
+		case name == "aclUsers":
+			var users = make([]map[string]interface{}, 0, len(conf.aclUsers))
+			for _, u := range conf.aclUsers {
+				users = append(users, map[string]interface{}{
+					"name": u.Name, "password": "******", "commands": u.Commands, "keys": u.Keys,
+				})
+			}
+			m[name] = users
+		default:
+			if x, ok := configValue(field); ok {
+				m[name] = x
+			}
+		}
+	}
+	return json.Marshal(m)
+}
+
+// 不能导出的字段只能按类型读取，fact 这样的函数不输出
+func configValue(v reflect.Value) (interface{}, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Bool:
+		return v.Bool(), true
+	case reflect.Int, reflect.Int64:
+		if v.Type() == durationType {
+			return time.Duration(v.Int()).String(), true
+		}
+		return v.Int(), true
+	case reflect.Float64:
+		return v.Float(), true
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil, false
+		}
+		var list = make([]string, v.Len())
+		for i := range list {
+			list[i] = v.Index(i).String()
+		}
+		return list, true
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String && v.Type().Elem().Kind() == reflect.Int {
+			var m = make(map[string]int64, v.Len())
+			for _, k := range v.MapKeys() {
+				m[k.String()] = v.MapIndex(k).Int()
+			}
+			return m, true
+		}
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return nil, false
+		}
+		var m = make(map[string]string, v.Len())
+		for _, k := range v.MapKeys() {
+			m[k.String()] = v.MapIndex(k).String()
+		}
+		return m, true
+	}
+	return nil, false
 }
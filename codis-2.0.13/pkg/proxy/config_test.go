@@ -0,0 +1,106 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func writeTempConf(content string) string {
+	f, err := ioutil.TempFile("", "codis-proxy-conf")
+	assert.MustNoError(err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	assert.MustNoError(err)
+	return f.Name()
+}
+
+func TestValidateConf(t *testing.T) {
+	file := writeTempConf("product=test\nzk=localhost:2181\nsession_max_pipeline=-1\n")
+	defer os.Remove(file)
+
+	errs := ValidateConf(file)
+	assert.Must(len(errs) == 3)
+
+	var missing []string
+	var invalid []string
+	for _, err := range errs {
+		switch e := err.(type) {
+		case *ErrMissingKey:
+			missing = append(missing, e.Key)
+		case *ErrInvalidValue:
+			invalid = append(invalid, e.Key)
+			assert.Must(e.Value == "-1")
+		default:
+			t.Fatalf("unexpected error type %T", err)
+		}
+	}
+	assert.Must(len(missing) == 2 && missing[0] == "dashboard_addr" && missing[1] == "proxy_id")
+	assert.Must(len(invalid) == 1 && invalid[0] == "session_max_pipeline")
+
+	_, err := LoadConf(file)
+	e, ok := err.(*ErrMissingKey)
+	assert.Must(ok && e.Key == "dashboard_addr")
+}
+
+func TestValidateTLSConf(t *testing.T) {
+	errs := checkTLSConf("1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_aes_256_gcm_sha384"})
+	assert.Must(len(errs) == 0)
+
+	errs = checkTLSConf("1.1", []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_NO_SUCH_CIPHER"})
+	assert.Must(len(errs) == 3)
+	for i, key := range []string{"tls_min_version", "tls_ciphers", "tls_ciphers"} {
+		assert.Must(errs[i].(*ErrInvalidValue).Key == key)
+	}
+	assert.Must(len(checkTLSConf("2.0", nil)) == 1)
+
+	assert.Must(len(checkTLSClientConf("cert.pem", "ca.pem", []string{"app", "user"})) == 0)
+	errs = checkTLSClientConf("", "ca.pem", []string{"cn"})
+	assert.Must(len(errs) == 2 && errs[0].(*ErrInvalidValue).Key == "tls_client_ca_file")
+	errs = checkTLSClientConf("cert.pem", "", []string{"app"})
+	assert.Must(len(errs) == 1 && errs[0].(*ErrInvalidValue).Reason == "requires tls_client_ca_file")
+}
+
+func TestCertSubject(t *testing.T) {
+	n := pkix.Name{CommonName: "app1", Organization: []string{"example"}, Country: []string{"CN"}}
+	assert.Must(certSubject(n) == "CN=app1,O=example,C=CN")
+	assert.Must(certSubject(pkix.Name{OrganizationalUnit: []string{"ops"}}) == "OU=ops")
+}
+
+func TestConfigJSON(t *testing.T) {
+	reader, err := router.ParseACLUser("reader usersecret get app:*")
+	assert.MustNoError(err)
+	conf := &Config{
+		productName:   "test",
+		passwd:        "topsecret",
+		shadowAddr:    "localhost:19000",
+		shadowAuth:    "shadowsecret",
+		aclUsers:      []*router.ACLUser{reader},
+		maxRespBuffer: 128 * 1024 * 1024,
+		staticReplies: true,
+	}
+	b, err := json.Marshal(conf)
+	assert.MustNoError(err)
+	for _, secret := range []string{"topsecret", "shadowsecret", "usersecret"} {
+		assert.Must(!strings.Contains(string(b), secret))
+	}
+
+	var m map[string]interface{}
+	assert.MustNoError(json.Unmarshal(b, &m))
+	// 除了 fact 以外的全部字段都会输出，包括没有设置的配置
+	assert.Must(len(m) == reflect.TypeOf(*conf).NumField()-1)
+	assert.Must(m["passwd"] == "******" && m["tlsKeyFile"] == "" && m["productName"] == "test")
+	assert.Must(m["maxRespBuffer"].(float64) == 128*1024*1024 && m["slowlog"] == "0s" && m["staticReplies"] == true)
+	users := m["aclUsers"].([]interface{})
+	assert.Must(len(users) == 1 && users[0].(map[string]interface{})["password"] == "******")
+}
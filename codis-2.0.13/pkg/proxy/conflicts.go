@@ -0,0 +1,124 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 同一个master地址被多个group声明时认为路由出现了冲突，比如故障切换之后旧的master没有下线又被加回了另一个group
+// 这时不同group的slot会写到同一个后端，或者同一个后端按照两份路由各自提供服务，即proxy看到的脑裂
+type routeConflicts struct {
+	mu sync.Mutex
+
+	slots  [router.MaxSlotNum]slotOwner
+	owners map[string]map[int]int // master地址 -> groupId -> slot数量
+}
+
+type slotOwner struct {
+	addr  string
+	group int
+}
+
+type RouteConflict struct {
+	Addr   string `json:"addr"`
+	Groups []int  `json:"groups"`
+	Slots  int    `json:"slots"`
+}
+
+// 记录slot新的路由，addr 为空表示slot被重置，由事件循环在更新路由之后调用
+func (s *Server) trackSlotOwner(i int, addr string, group int) {
+	c := &s.conflicts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.slots[i]
+	if old.addr == addr && old.group == group {
+		return
+	}
+	if c.owners == nil {
+		c.owners = make(map[string]map[int]int)
+	}
+	c.slots[i] = slotOwner{addr: addr, group: group}
+
+	if old.addr != "" {
+		before := len(c.owners[old.addr])
+		if c.owners[old.addr][old.group]--; c.owners[old.addr][old.group] == 0 {
+			delete(c.owners[old.addr], old.group)
+		}
+		if len(c.owners[old.addr]) == 0 {
+			delete(c.owners, old.addr)
+		}
+		s.checkConflict(old.addr, before)
+	}
+	if addr != "" {
+		before := len(c.owners[addr])
+		if c.owners[addr] == nil {
+			c.owners[addr] = make(map[int]int)
+		}
+		c.owners[addr][group]++
+		s.checkConflict(addr, before)
+	}
+	if s.conf.conflictPolicy == "reject" {
+		s.router.SetSlotConflict(i, len(c.owners[addr]) > 1)
+	}
+}
+
+// 地址的冲突状态变化时输出日志，reject 时标记或者清除这个地址上全部slot的冲突
+func (s *Server) checkConflict(addr string, before int) {
+	c := &s.conflicts
+	groups := c.groups(addr)
+	conflict := len(groups) > 1
+	switch {
+	case conflict == (before > 1):
+		return
+	case conflict:
+		log.Errorf("routing conflict: master %s is claimed by groups %v", addr, groups)
+	default:
+		log.Warnf("routing conflict of master %s is resolved, groups = %v", addr, groups)
+	}
+	if s.conf.conflictPolicy != "reject" {
+		return
+	}
+	for i := range c.slots {
+		if c.slots[i].addr == addr {
+			s.router.SetSlotConflict(i, conflict)
+		}
+	}
+}
+
+func (c *routeConflicts) groups(addr string) []int {
+	var groups []int
+	for g := range c.owners[addr] {
+		groups = append(groups, g)
+	}
+	sort.Ints(groups)
+	return groups
+}
+
+// 当前冲突的master，按地址排序，没有冲突时返回nil
+func (s *Server) RouteConflicts() []*RouteConflict {
+	c := &s.conflicts
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addrs []string
+	for addr, m := range c.owners {
+		if len(m) > 1 {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	var all []*RouteConflict
+	for _, addr := range addrs {
+		x := &RouteConflict{Addr: addr, Groups: c.groups(addr)}
+		for _, n := range c.owners[addr] {
+			x.Slots += n
+		}
+		all = append(all, x)
+	}
+	return all
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestRouteConflicts(t *testing.T) {
+	conf := newTestConf()
+	conf.conflictPolicy = "reject"
+	s := &Server{conf: conf, router: router.New()}
+	defer s.router.Close()
+
+	s.trackSlotOwner(0, "127.0.0.1:1", 1)
+	s.trackSlotOwner(1, "127.0.0.1:1", 1)
+	s.trackSlotOwner(2, "127.0.0.1:2", 2)
+	assert.Must(s.RouteConflicts() == nil)
+
+	// group 2 的master变成了 group 1 的master
+	s.trackSlotOwner(2, "127.0.0.1:1", 2)
+	s.trackSlotOwner(3, "127.0.0.1:1", 2)
+	all := s.RouteConflicts()
+	assert.Must(len(all) == 1 && all[0].Addr == "127.0.0.1:1" && all[0].Slots == 4)
+	assert.Must(len(all[0].Groups) == 2 && all[0].Groups[0] == 1 && all[0].Groups[1] == 2)
+	for i := 0; i < 4; i++ {
+		assert.Must(s.router.IsConflictSlot(i))
+	}
+
+	// 重置的slot不再计入
+	s.trackSlotOwner(3, "", 0)
+	assert.Must(s.RouteConflicts()[0].Slots == 3 && !s.router.IsConflictSlot(3))
+
+	s.trackSlotOwner(2, "127.0.0.1:2", 2)
+	assert.Must(s.RouteConflicts() == nil)
+	for i := 0; i < 3; i++ {
+		assert.Must(!s.router.IsConflictSlot(i))
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 开启 log_connections 时，在日志中记录每个 accept 的连接的来源，包括ip的反向解析，以及配置了 geoip 数据库时的国家和 ASN
+// 解析在单独的协程中进行，不阻塞 accept，队列满了直接丢弃；同一个ip的结果会缓存一段时间
+type connLogger struct {
+	geo   *geoipDB // 没有配置 geoip 数据库时为nil
+	queue chan net.Addr
+
+	cache map[string]*connOrigin // 只在解析的协程中访问
+
+	mu        sync.Mutex
+	countries map[string]int64 // 按国家统计的连接数，只有配置了 geoip 数据库时统计
+
+	dropped atomic2.Int64 // 队列满了没有记录的连接数
+}
+
+type connOrigin struct {
+	host    string
+	country string
+	asn     string
+	expire  time.Time
+}
+
+const (
+	connLogQueueSize = 1024
+	connLogCacheSize = 4096
+	connLogCacheTTL  = time.Minute * 10
+)
+
+func newConnLogger(geo *geoipDB) *connLogger {
+	x := &connLogger{geo: geo, queue: make(chan net.Addr, connLogQueueSize), cache: make(map[string]*connOrigin)}
+	if geo != nil {
+		x.countries = make(map[string]int64)
+	}
+	return x
+}
+
+func (s *Server) startConnLog() error {
+	if !s.conf.logConns {
+		return nil
+	}
+	var geo *geoipDB
+	if s.conf.geoipFile != "" {
+		db, err := loadGeoIP(s.conf.geoipFile)
+		if err != nil {
+			return err
+		}
+		geo = db
+		log.Infof("load geoip database %s, %d networks", s.conf.geoipFile, len(db.ranges))
+	}
+	s.connLog = newConnLogger(geo)
+	go s.connLog.run(s.kill)
+	return nil
+}
+
+// 由 accept 的协程调用
+func (l *connLogger) push(addr net.Addr) {
+	select {
+	case l.queue <- addr:
+	default:
+		l.dropped.Incr()
+	}
+}
+
+func (l *connLogger) run(kill <-chan interface{}) {
+	for {
+		select {
+		case <-kill:
+			return
+		case addr := <-l.queue:
+			l.logConn(addr, time.Now())
+		}
+	}
+}
+
+func (l *connLogger) logConn(addr net.Addr, now time.Time) {
+	ip := addrIP(addr)
+	if ip == nil {
+		log.Infof("accept connection from %s", addr)
+		return
+	}
+	o := l.origin(ip, now)
+	if l.countries != nil {
+		l.mu.Lock()
+		l.countries[o.country]++
+		l.mu.Unlock()
+	}
+	if l.geo == nil {
+		log.Infof("accept connection from %s, host = %s", addr, o.host)
+	} else {
+		log.Infof("accept connection from %s, host = %s, country = %s, asn = %s", addr, o.host, o.country, o.asn)
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch x := addr.(type) {
+	case *net.TCPAddr:
+		return x.IP
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// 缓存满了之后全部清空，反向解析失败时 host 和国家一样记为 unknown
+func (l *connLogger) origin(ip net.IP, now time.Time) *connOrigin {
+	key := ip.String()
+	if o := l.cache[key]; o != nil && now.Before(o.expire) {
+		return o
+	}
+	o := &connOrigin{host: "unknown", country: "unknown", asn: "unknown", expire: now.Add(connLogCacheTTL)}
+	if names, err := net.LookupAddr(key); err == nil && len(names) != 0 {
+		o.host = strings.TrimSuffix(names[0], ".")
+	}
+	if l.geo != nil {
+		if x := l.geo.lookup(ip); x != nil {
+			if x.country != "" {
+				o.country = x.country
+			}
+			if x.asn != "" {
+				o.asn = x.asn
+			}
+		}
+	}
+	if len(l.cache) >= connLogCacheSize {
+		l.cache = make(map[string]*connOrigin)
+	}
+	l.cache[key] = o
+	return o
+}
+
+// 按国家统计的连接数，没有开启或者没有配置 geoip 数据库时返回nil
+func (s *Server) ConnectionCountries() map[string]int64 {
+	if s.connLog == nil || s.connLog.countries == nil {
+		return nil
+	}
+	s.connLog.mu.Lock()
+	defer s.connLog.mu.Unlock()
+	var m = make(map[string]int64, len(s.connLog.countries))
+	for k, v := range s.connLog.countries {
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 来源ip所在的国家和自治系统，不依赖第三方的库，数据库是 CSV 格式的文本文件
+// 每行是 "network,country,asn"，比如 "1.0.0.0/24,AU,AS13335"，可以由 GeoLite2 的 CSV 文件合并得到
+// network 之外的列可以为空，以 # 开头的行和 network 开头的表头被忽略
+type geoipDB struct {
+	ranges []*geoipRange // 按起始地址排序，互不重叠
+}
+
+type geoipRange struct {
+	first, last net.IP // 都是16字节的格式
+	country     string
+	asn         string
+}
+
+func loadGeoIP(file string) (*geoipDB, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	db, err := parseGeoIP(bufio.NewScanner(f))
+	if err != nil {
+		return nil, errors.Errorf("geoip database %s: %s", file, err)
+	}
+	return db, nil
+}
+
+func parseGeoIP(scanner *bufio.Scanner) (*geoipDB, error) {
+	db := &geoipDB{}
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "network") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, errors.Errorf("line %d: should be like \"network,country,asn\"", n)
+		}
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, errors.Errorf("line %d: invalid network %q", n, fields[0])
+		}
+		x := &geoipRange{country: strings.TrimSpace(fields[1]), asn: strings.TrimSpace(fields[2])}
+		x.first, x.last = networkRange(ipnet)
+		db.ranges = append(db.ranges, x)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Sort(geoipRangeList(db.ranges))
+	for i := 1; i < len(db.ranges); i++ {
+		if bytes.Compare(db.ranges[i].first, db.ranges[i-1].last) <= 0 {
+			return nil, errors.Errorf("network %s overlaps with %s", db.ranges[i].first, db.ranges[i-1].first)
+		}
+	}
+	return db, nil
+}
+
+// 网段的第一个和最后一个地址
+func networkRange(ipnet *net.IPNet) (net.IP, net.IP) {
+	first := ipnet.IP.To16()
+	last := make(net.IP, len(first))
+	mask := ipnet.Mask
+	// IPv4 的掩码只有4字节，对应16字节格式的最后4字节
+	off := len(first) - len(mask)
+	copy(last, first)
+	for i := range mask {
+		last[off+i] |= ^mask[i]
+	}
+	return first, last
+}
+
+// 找不到时返回nil
+func (db *geoipDB) lookup(ip net.IP) *geoipRange {
+	if ip = ip.To16(); ip == nil {
+		return nil
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].first, ip) > 0
+	})
+	if i == 0 {
+		return nil
+	}
+	if x := db.ranges[i-1]; bytes.Compare(ip, x.last) <= 0 {
+		return x
+	}
+	return nil
+}
+
+type geoipRangeList []*geoipRange
+
+func (l geoipRangeList) Len() int           { return len(l) }
+func (l geoipRangeList) Less(i, j int) bool { return bytes.Compare(l[i].first, l[j].first) < 0 }
+func (l geoipRangeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,91 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+const testGeoIP = `network,country,asn
+# comment
+10.1.0.0/16,CN,AS4134
+1.0.0.0/24,AU,AS13335
+127.0.0.0/8,,
+2001:db8::/32,DE,
+`
+
+func TestGeoIP(t *testing.T) {
+	db, err := parseGeoIP(bufio.NewScanner(strings.NewReader(testGeoIP)))
+	assert.MustNoError(err)
+	assert.Must(len(db.ranges) == 4)
+	for ip, country := range map[string]string{
+		"1.0.0.0": "AU", "1.0.0.255": "AU", "10.1.200.3": "CN", "2001:db8:1::1": "DE", "127.0.0.1": "",
+	} {
+		x := db.lookup(net.ParseIP(ip))
+		assert.Must(x != nil && x.country == country)
+	}
+	for _, ip := range []string{"0.255.255.255", "1.0.1.0", "10.2.0.0", "2001:db9::1", "255.255.255.255"} {
+		assert.Must(db.lookup(net.ParseIP(ip)) == nil)
+	}
+	assert.Must(db.lookup(net.ParseIP("10.1.0.1")).asn == "AS4134")
+
+	for _, s := range []string{"1.0.0.0/24,AU", "1.0.0.0,AU,", "1.0.0.0/16,AU,\n1.0.1.0/24,AU,"} {
+		_, err := parseGeoIP(bufio.NewScanner(strings.NewReader(s)))
+		assert.Must(err != nil)
+	}
+}
+
+func TestConnLog(t *testing.T) {
+	db, err := parseGeoIP(bufio.NewScanner(strings.NewReader(testGeoIP)))
+	assert.MustNoError(err)
+	l := newConnLogger(db)
+	now := time.Now()
+	l.logConn(&net.TCPAddr{IP: net.ParseIP("1.0.0.1"), Port: 1000}, now)
+	l.logConn(&net.TCPAddr{IP: net.ParseIP("1.0.0.1"), Port: 1001}, now)
+	l.logConn(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}, now)
+	assert.Must(l.countries["AU"] == 2 && l.countries["unknown"] == 1)
+	o := l.cache["1.0.0.1"]
+	assert.Must(o != nil && o.country == "AU" && o.asn == "AS13335")
+	// 过期之后重新查询
+	o.country = "XX"
+	assert.Must(l.origin(net.ParseIP("1.0.0.1"), now).country == "XX")
+	assert.Must(l.origin(net.ParseIP("1.0.0.1"), now.Add(connLogCacheTTL)).country == "AU")
+}
+
+func TestConnLogServer(t *testing.T) {
+	f, err := ioutil.TempFile("", "geoip")
+	assert.MustNoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(testGeoIP)
+	assert.MustNoError(err)
+	f.Close()
+
+	conf := newTestConf()
+	conf.logConns = true
+	conf.geoipFile = f.Name() + ".missing"
+	_, err = NewForTest(TestConfig{Config: conf, Backend: "127.0.0.1:1"})
+	assert.Must(err != nil)
+
+	conf.geoipFile = f.Name()
+	s, err := NewForTest(TestConfig{Config: conf, Backend: "127.0.0.1:1"})
+	assert.MustNoError(err)
+	defer s.Close()
+	c, err := net.Dial("tcp", s.Addr())
+	assert.MustNoError(err)
+	c.Close()
+	for i := 0; i < 100 && s.ConnectionCountries()["unknown"] == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(s.ConnectionCountries()["unknown"] == 1)
+	assert.Must(s.Status()["connection_log"] != nil)
+
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 监听代理端口，backlog 为 0 时使用系统默认的 accept 队列长度
+// 返回实际生效的队列长度，内核会把它限制在 net.core.somaxconn 以内，无法获取时返回 0
+func listen(proto, addr string, backlog int) (net.Listener, int, error) {
+	if backlog == 0 || !strings.HasPrefix(proto, "tcp") {
+		l, err := net.Listen(proto, addr)
+		if err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+		return l, somaxconn(), nil
+	}
+	tcpAddr, err := net.ResolveTCPAddr(proto, addr)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	// net.Listen 不能设置 backlog，只能自己创建 socket
+	var family int
+	var sa syscall.Sockaddr
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil || (tcpAddr.IP == nil && proto == "tcp4") {
+		x := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(x.Addr[:], ip4)
+		family, sa = syscall.AF_INET, x
+	} else {
+		x := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(x.Addr[:], tcpAddr.IP.To16())
+		family, sa = syscall.AF_INET6, x
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	// 和 net.Listen 一样，没有指定地址时同时监听 IPv4 和 IPv6
+	if family == syscall.AF_INET6 && proto == "tcp" {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	if max := somaxconn(); max != 0 && max < backlog {
+		backlog = max
+	}
+	return l, backlog, nil
+}
+
+// 内核允许的 accept 队列长度上限，也是 net.Listen 使用的长度
+func somaxconn() int {
+	b, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
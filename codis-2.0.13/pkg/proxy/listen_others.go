@@ -0,0 +1,27 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"net"
+	"runtime"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 只有 linux 上支持设置 accept 队列的长度，其他系统使用默认值，返回 0 表示长度未知
+func listen(proto, addr string, backlog int) (net.Listener, int, error) {
+	if backlog != 0 {
+		log.Warnf("listen_backlog is not supported on %s, use the default backlog", runtime.GOOS)
+	}
+	l, err := net.Listen(proto, addr)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	return l, 0, nil
+}
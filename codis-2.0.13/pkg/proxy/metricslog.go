@@ -0,0 +1,48 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 每隔 interval 在日志中输出一行关键指标，没有外部监控时也能从日志中看到proxy的运行状况
+func (s *Server) StartMetricsLog(interval time.Duration) {
+	log.Infof("log metrics every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ops, errs, last := router.OpCounts(), router.FailedCounts(), time.Now()
+		for {
+			select {
+			case <-s.kill:
+				return
+			case now := <-ticker.C:
+				x, y := router.OpCounts(), router.FailedCounts()
+				var alive, total int
+				for _, b := range s.router.BackendStatus() {
+					if total++; b.Healthy {
+						alive++
+					}
+				}
+				log.Info(formatMetrics(x-ops, y-errs, now.Sub(last), router.SessionCounts(), alive, total))
+				ops, errs, last = x, y, now
+			}
+		}
+	}()
+}
+
+// 一行 key=value 格式的指标，ops 和 errors 是这段时间内的命令数和失败的命令数
+func formatMetrics(ops, errs int64, elapsed time.Duration, clients int64, alive, total int) string {
+	var rate float64
+	if ops != 0 {
+		rate = float64(errs) / float64(ops)
+	}
+	return fmt.Sprintf("metrics: ops_per_sec=%.1f error_rate=%.4f clients=%d backends_alive=%d/%d",
+		float64(ops)/elapsed.Seconds(), rate, clients, alive, total)
+}
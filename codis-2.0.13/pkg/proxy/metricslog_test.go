@@ -0,0 +1,18 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestFormatMetrics(t *testing.T) {
+	s := formatMetrics(1000, 5, time.Second*10, 12, 2, 3)
+	assert.Must(s == "metrics: ops_per_sec=100.0 error_rate=0.0050 clients=12 backends_alive=2/3")
+	s = formatMetrics(0, 0, time.Second, 0, 0, 0)
+	assert.Must(s == "metrics: ops_per_sec=0.0 error_rate=0.0000 clients=0 backends_alive=0/0")
+}
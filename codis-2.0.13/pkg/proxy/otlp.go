@@ -0,0 +1,273 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+const (
+	otlpQueueSize = 4096 // 等待导出的 span 数上限，超过之后丢弃
+	otlpBatchSize = 512  // 每次请求最多导出的 span 数
+)
+
+// 将采样的命令以 OTLP/HTTP JSON 格式导出到 OpenTelemetry collector
+type otlpExporter struct {
+	endpoint string
+	service  string
+
+	mu    sync.Mutex
+	queue []*router.Span // 等待导出的 span，按时间顺序
+	ready chan struct{}  // 攒够 otlpBatchSize 个 span 时通知导出协程
+
+	client *http.Client
+
+	exported atomic2.Int64
+	dropped  atomic2.Int64
+}
+
+func newOtlpExporter(endpoint, service string) *otlpExporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		ready:    make(chan struct{}, 1),
+		client:   &http.Client{Timeout: time.Second * 5},
+	}
+}
+
+// 配置了 trace_otlp_endpoint 时开启 PROXY TRACE，否则客户端传入 trace context 会返回错误
+func (s *Server) startTracing() {
+	if s.conf.traceEndpoint == "" {
+		router.SetTracing(0, nil)
+		return
+	}
+	s.tracer = newOtlpExporter(s.conf.traceEndpoint, s.conf.traceService)
+	router.RegisterDiagBuffer(s.tracer)
+	router.SetTracing(s.conf.traceSampleRate, s.tracer.export)
+	go s.tracer.run(time.Second, s.kill)
+}
+
+// 除了字符串之外一个 span 占用的内存
+const spanOverhead = 128
+
+func spanSize(s *router.Span) int64 {
+	return spanOverhead + int64(len(s.Name)+len(s.Client)+len(s.Backend)+len(s.Error))
+}
+
+// 交给导出协程，队列满了直接丢弃，不阻塞会话
+func (e *otlpExporter) export(s *router.Span) {
+	e.mu.Lock()
+	if len(e.queue) >= otlpQueueSize {
+		e.mu.Unlock()
+		e.dropped.Incr()
+		return
+	}
+	e.queue = append(e.queue, s)
+	n := len(e.queue)
+	e.mu.Unlock()
+
+	router.DiagAlloc(spanSize(s))
+	if n >= otlpBatchSize {
+		select {
+		case e.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 从队列中取出最多 max 个 span
+func (e *otlpExporter) take(max int) []*router.Span {
+	e.mu.Lock()
+	n := len(e.queue)
+	if n > max {
+		n = max
+	}
+	batch := make([]*router.Span, n)
+	copy(batch, e.queue)
+	e.queue = append(e.queue[:0], e.queue[n:]...)
+	e.mu.Unlock()
+
+	var size int64
+	for _, s := range batch {
+		size += spanSize(s)
+	}
+	router.DiagFree(size)
+	return batch
+}
+
+// 等待导出的 span 作为诊断缓冲区，超过内存预算时丢弃最早的 span
+func (e *otlpExporter) Oldest() (int64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) == 0 {
+		return 0, false
+	}
+	return e.queue[0].Start, true
+}
+
+func (e *otlpExporter) Evict() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) == 0 {
+		return 0
+	}
+	s := e.queue[0]
+	e.queue = append(e.queue[:0], e.queue[1:]...)
+	e.dropped.Incr()
+	return spanSize(s)
+}
+
+// 每隔 interval 导出队列中的全部 span，攒够 otlpBatchSize 个时提前导出，直到 kill 通道关闭
+func (e *otlpExporter) run(interval time.Duration, kill <-chan interface{}) {
+	log.Infof("export traces to %s every %s", e.endpoint, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kill:
+			return
+		case <-e.ready:
+			e.flush(false)
+		case <-ticker.C:
+			e.flush(true)
+		}
+	}
+}
+
+// 每次请求最多导出 otlpBatchSize 个 span，all 为 false 时只导出一批
+func (e *otlpExporter) flush(all bool) {
+	for {
+		batch := e.take(otlpBatchSize)
+		if len(batch) == 0 {
+			return
+		}
+		// 导出失败只记录日志，丢弃这一批 span
+		if err := e.post(batch); err != nil {
+			e.dropped.Add(int64(len(batch)))
+			log.WarnErrorf(err, "export %d spans to %s failed", len(batch), e.endpoint)
+		} else {
+			e.exported.Add(int64(len(batch)))
+		}
+		if !all || len(batch) < otlpBatchSize {
+			return
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpString(k, v string) otlpAttr {
+	return otlpAttr{Key: k, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpInt(k string, v int) otlpAttr {
+	return otlpInt64(k, int64(v))
+}
+
+func otlpInt64(k string, v int64) otlpAttr {
+	s := strconv.FormatInt(v, 10)
+	return otlpAttr{Key: k, Value: otlpValue{IntValue: &s}}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 表示出错
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId      string      `json:"traceId"`
+	SpanId       string      `json:"spanId"`
+	ParentSpanId string      `json:"parentSpanId"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"` // 2 表示 SERVER
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+// 按照 OTLP 的 JSON 编码，trace id 和 span id 使用 hex，时间使用字符串格式的纳秒
+func (e *otlpExporter) encode(batch []*router.Span) ([]byte, error) {
+	var spans = make([]*otlpSpan, len(batch))
+	for i, s := range batch {
+		x := &otlpSpan{
+			TraceId:      hex.EncodeToString(s.TraceId[:]),
+			SpanId:       hex.EncodeToString(s.SpanId[:]),
+			ParentSpanId: hex.EncodeToString(s.ParentId[:]),
+			Name:         s.Name,
+			Kind:         2,
+			Start:        strconv.FormatInt(s.Start*1e3, 10),
+			End:          strconv.FormatInt(s.End*1e3, 10),
+			Attributes: []otlpAttr{
+				otlpString("db.system", "redis"),
+				otlpString("db.operation", s.Name),
+				otlpString("client.address", s.Client),
+				otlpInt64("codis.session_id", s.Session),
+			},
+		}
+		if s.Slot >= 0 {
+			x.Attributes = append(x.Attributes, otlpInt("codis.slot", s.Slot))
+		}
+		if s.Backend != "" {
+			x.Attributes = append(x.Attributes, otlpString("server.address", s.Backend))
+		}
+		if s.Error != "" {
+			x.Status = &otlpStatus{Code: 2, Message: s.Error}
+		}
+		spans[i] = x
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{otlpString("service.name", e.service)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "codis-proxy"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+}
+
+func (e *otlpExporter) post(batch []*router.Span) error {
+	b, err := e.encode(batch)
+	if err != nil {
+		return err
+	}
+	rsp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", rsp.Status)
+	}
+	return nil
+}
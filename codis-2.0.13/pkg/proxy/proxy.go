@@ -5,12 +5,13 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,9 +19,13 @@ import (
 
 	"github.com/CodisLabs/codis/pkg/models"
 	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/wandoulabs/go-zookeeper/zk"
 	topo "github.com/wandoulabs/go-zookeeper/zk"
+	"github.com/wandoulabs/zkhelper"
 )
 
 // proxy-server
@@ -30,11 +35,39 @@ type Server struct {
 	info   models.ProxyInfo // proxy信息
 	groups map[int]int      // group信息
 
-	lastActionSeq int // 最近一次通知的序号
+	lastActionSeq int           // 最近一次通知的序号
+	lastReload    atomic2.Int64 // 最近一次强制重新加载路由的时间戳
+	reloadc       chan *reloadRequest
+
+	coordLostAt    atomic2.Int64 // 和zk失去连接的时间戳，0 表示连接正常
+	coordRetries   atomic2.Int64 // 失去连接之后重连的次数
+	coordBackoff   time.Duration // 下一次重连前的等待时间
+	coordNextRetry time.Time
+
+	imported bool // 启动时zk不可用，使用导入的路由表提供服务
+
+	batch         *actionBatch  // 正在合并的 action 通知，没有开启 coordinator_batch_window 时为nil
+	batches       atomic2.Int64 // 合并更新的次数
+	batchedEvents atomic2.Int64 // 合并的通知数
 
 	evtbus   chan interface{} // 用于监听zk节点，返回节点变更的事件
 	router   *router.Router   // 用于访问后端redis的路由
 	listener net.Listener
+	backlog  int           // 实际生效的 accept 队列长度，0 表示未知
+	tracer   *otlpExporter // 导出采样命令的 span，没有开启时为nil
+
+	accepted chan *acceptedConn // 已经 accept、等待创建会话的连接
+	accepts  acceptStats        // accept_workers 建立连接的统计
+
+	loopBeat        heartbeat     // 事件循环的心跳
+	sessionBeat     heartbeat     // 最近一次从 accepted 中取出连接创建会话的时间
+	watchBeat       heartbeat     // watchdog 自己的心跳
+	sessionsCreated atomic2.Int64 // 创建的会话数
+	stalls          atomic2.Int64 // watchdog 发现的停顿次数
+
+	connLog *connLogger // 开启 log_connections 时记录连接的来源，没有开启时为nil
+
+	conflicts routeConflicts // 被多个group声明的master
 
 	kill chan interface{} // 通过此通道通知close消息
 	wait sync.WaitGroup   // 用于等待proxy结束
@@ -43,8 +76,37 @@ type Server struct {
 
 // 创建一个 proxy-server
 func New(addr string, debugVarAddr string, conf *Config) *Server {
+	return NewWithTable(addr, debugVarAddr, conf, nil)
+}
+
+// table 不为nil时，启动时zk不可用则不注册到zk，使用这份路由表提供服务，之后也不会再连接zk
+func NewWithTable(addr string, debugVarAddr string, conf *Config, table *RoutingTable) *Server {
 	log.Infof("create proxy with config: %+v", conf)
 
+	// 监听代理端口，端口为 0 时由系统分配一个空闲端口
+	l, backlog, err := listen(conf.proto, addr, conf.listenBacklog)
+	if err != nil {
+		log.PanicErrorf(err, "open listener failed")
+	}
+	if conf.listenBacklog > backlog && backlog != 0 {
+		log.Warnf("listen_backlog = %d is capped to %d by net.core.somaxconn", conf.listenBacklog, backlog)
+	}
+	l = withSocketBuffers(l, conf.clientSndBuf, conf.clientRcvBuf)
+	if conf.tlsCertFile != "" {
+		c, err := newTLSConfig(conf)
+		if err != nil {
+			log.PanicErrorf(err, "load tls certificate failed")
+		}
+		l = tls.NewListener(l, c)
+		log.Infof("proxy serves clients over tls, min version = %s, ciphers = %v", conf.tlsMinVersion, conf.tlsCiphers)
+	}
+	// 注册到 zk 上的需要是实际监听的端口
+	_, proxyPort, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		log.PanicErrorf(err, "parse listener address failed")
+	}
+	log.Infof("proxy listening on %s, backlog = %d", l.Addr(), backlog)
+
 	proxyHost := strings.Split(addr, ":")[0]
 	debugHost := strings.Split(debugVarAddr, ":")[0]
 
@@ -61,43 +123,127 @@ func New(addr string, debugVarAddr string, conf *Config) *Server {
 		debugHost = hostname
 	}
 
-	s := &Server{conf: conf, lastActionSeq: -1, groups: make(map[int]int)}
+	s := &Server{conf: conf, lastActionSeq: -1, groups: make(map[int]int), listener: l, backlog: backlog}
 
-	// 创建集群拓扑信息管理对象
-	s.topo = NewTopo(conf.productName, conf.zkAddr, conf.fact, conf.provider, conf.zkSessionTimeout)
+	// 创建集群拓扑信息管理对象，有导入的路由表时在注册时才连接zk
+	if table == nil {
+		s.topo = NewTopo(conf.productName, conf.zkAddr, conf.fact, conf.provider, conf.zkSessionTimeout)
+		s.topo.optional = conf.coordinatorOptional
+	} else if err := s.checkTableProduct(table); err != nil {
+		log.PanicErrorf(err, "invalid routing table")
+	}
 	// 初始化proxy信息
 	s.info.Id = conf.proxyId
 	s.info.State = models.PROXY_STATE_OFFLINE
-	s.info.Addr = proxyHost + ":" + strings.Split(addr, ":")[1]
+	s.info.Addr = proxyHost + ":" + proxyPort
 	s.info.DebugVarAddr = debugHost + ":" + strings.Split(debugVarAddr, ":")[1]
 	s.info.Pid = os.Getpid()
 	s.info.StartAt = time.Now().String()
 	s.kill = make(chan interface{})
+	s.accepted = make(chan *acceptedConn, 4096)
 
 	log.Infof("proxy info = %+v", s.info)
 
-	// 监听代理端口
-	if l, err := net.Listen(conf.proto, addr); err != nil {
-		log.PanicErrorf(err, "open listener failed")
-	} else {
-		s.listener = l
-	}
 	// 创建一个访问后端redis的路由
+	if err := applyRouterConfig(conf); err != nil {
+		log.PanicErrorf(err, "apply router config failed")
+	}
 	s.router = router.NewWithAuth(conf.passwd)
+	if conf.shutdown {
+		if conf.passwd == "" {
+			log.Warn("proxy_shutdown is ignored because there is no password")
+		} else {
+			router.SetShutdown(func() {
+				log.Warn("shutdown by SHUTDOWN command")
+				s.Close()
+			})
+		}
+	}
 	s.evtbus = make(chan interface{}, 1024)
+	s.reloadc = make(chan *reloadRequest)
 
 	// 在zk上注册自身的信息，包括proxy和fence节点
-	s.register()
+	if table == nil {
+		s.register()
+	} else if err := s.registerOptional(); err != nil {
+		log.ErrorErrorf(err, "coordinator is unavailable, serve with the imported routing table")
+		s.imported = true
+		s.info.State = models.PROXY_STATE_ONLINE
+	}
+
+	// 定期推送统计信息到 StatsD
+	if conf.statsdAddr != "" {
+		e := newStatsdExporter(conf.statsdAddr, conf.statsdPrefix, conf.statsdMetrics)
+		go e.run(time.Second*time.Duration(conf.statsdInterval), s.kill)
+	}
+	if err := s.startConnLog(); err != nil {
+		log.PanicErrorf(err, "start connection logging failed")
+	}
+	s.startTracing()
+	s.startWatchdog()
 
 	s.wait.Add(1)
 	go func() {
 		defer s.wait.Done()
+		if s.imported {
+			s.serveImported(table)
+			return
+		}
 		// 启动proxy的主要处理函数
 		s.serve()
 	}()
 	return s
 }
 
+// 设置 router 和日志的全局配置，需要在创建 router 之前调用，proxy 和 NewForTest 共用
+func applyRouterConfig(conf *Config) error {
+	router.AllowCommands(conf.allowCommands...)
+	for name, rename := range conf.renameCommands {
+		if err := router.RenameCommand(name, rename); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if conf.disableStats {
+		router.DisableStats()
+	}
+	router.SetMaxApps(conf.maxApps)
+	router.SetFailureLogSize(conf.failureLogSize)
+	router.SetLogFailures(conf.logFailures)
+	router.SetDiagnosticsBudget(conf.diagBudget)
+	router.SetMaxReplySize(conf.maxReplySize)
+	router.SetStrictReplyValidation(conf.strictReplies)
+	router.SetSlowlogThreshold(conf.slowlog)
+	router.SetMaxResponseBuffer(conf.maxRespBuffer, time.Second*time.Duration(conf.bufferGrace))
+	router.SetMaxBackendQueue(conf.maxBackendQueue)
+	router.SetBackendSocketBuffers(conf.backendSndBuf, conf.backendRcvBuf)
+	router.SetReconnectJitter(time.Millisecond * time.Duration(conf.reconnectJitter))
+	router.SetDrainTimeout(time.Second * time.Duration(conf.drainTimeout))
+	router.SetVerifyBackend(conf.verifyPing, conf.verifyVersion)
+	router.SetKeyCardinality(conf.keyCardinality)
+	router.SetHotSlotReads(conf.hotSlotReads)
+	router.SetRandomKeyWeighted(conf.randomWeighted)
+	router.SetStaticReplies(conf.staticReplies)
+	router.SetLocalTime(conf.localTime)
+	router.SetKeyPolicy(conf.rejectEmptyKey, conf.maxKeyLength)
+	router.SetShadow(conf.shadowAddr, conf.shadowAuth, conf.shadowQueue)
+	router.SetBackendMultiplex(conf.multiplex)
+	router.SetBackendPoolSize(conf.poolSize)
+	router.SetBackendAffinity(conf.affinity)
+	router.SetGroupDownPolicy(conf.groupDownPolicy, time.Millisecond*time.Duration(conf.groupDownTimeout))
+	router.SetUnknownCommandAction(conf.unknownAction)
+	router.SetACLUsers(conf.aclUsers)
+	router.SetReplicaLagTolerance(conf.replicaMaxLag, conf.replicaUserLag)
+	router.SetHighPriority(conf.urgentCommands, conf.urgentUsers)
+	router.SetPreMigratePolicy(conf.preMigrate, conf.preMigrateRetry, time.Millisecond*time.Duration(conf.preMigrateDelay))
+	router.SetQuarantine(conf.quarantineErrors, time.Second*time.Duration(conf.quarantineWindow), conf.quarantineAction,
+		time.Second*time.Duration(conf.quarantineDuration), conf.quarantineDenylist)
+	router.SetInfo(utils.Version, conf.infoBackends, time.Second*time.Duration(conf.infoCacheTTL))
+	router.SetServerName(conf.serverName)
+	log.SetSampling(time.Second*time.Duration(conf.logSamplingWindow), conf.logSamplingThreshold)
+	log.SetMaxLine(conf.logMaxLine)
+	return nil
+}
+
 // 通过调用dashboard将自己的状态设置为online
 func (s *Server) SetMyselfOnline() error {
 	log.Info("mark myself online")
@@ -134,6 +280,10 @@ func (s *Server) serve() {
 	for i := 0; i < router.MaxSlotNum; i++ {
 		s.fillSlot(i)
 	}
+	if s.conf.warmup != 0 && !s.warmup() {
+		s.markOffline()
+		return
+	}
 	log.Info("proxy is serving")
 	go func() {
 		defer s.close()
@@ -149,37 +299,19 @@ func (s *Server) serve() {
 	s.loopEvents()
 }
 
-// 处理 redis 客户端的连接
-func (s *Server) handleConns() {
-
-	ch := make(chan net.Conn, 4096)
-	defer close(ch)
-
+// zk不可用时使用导入的路由表提供服务，和 NewForTest 一样路由表不会变更
+func (s *Server) serveImported(table *RoutingTable) {
+	defer s.close()
+	s.applyTable(table)
+	log.Info("proxy is serving with the imported routing table")
 	go func() {
-		for c := range ch {
-			x := router.NewSessionSize(c, s.conf.passwd, s.conf.maxBufSize, s.conf.maxTimeout)
-			// 针对一个redis-client连接的处理函数，会将请求交由 s.router 转发给后端 redis-server
-			go x.Serve(s.router, s.conf.maxPipeline)
-		}
+		defer s.close()
+		s.handleConns()
 	}()
-
-	// 循环处理 redis 客户端的连接，通过 ch 通道交给上面的 x.Server 函数处理
-	for {
-		c, err := s.listener.Accept()
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.WarnErrorf(err, "[%p] proxy accept new connection failed, get temporary error", s)
-				time.Sleep(time.Millisecond * 10)
-				continue
-			}
-			log.WarnErrorf(err, "[%p] proxy accept new connection failed, get non-temporary error, must shutdown", s)
-			return
-		} else {
-			ch <- c
-		}
-	}
+	s.loopStatic()
 }
 
+// 处理 redis 客户端的连接
 func (s *Server) Info() models.ProxyInfo {
 	return s.info
 }
@@ -198,6 +330,12 @@ func (s *Server) close() {
 	// 确保只执行一次
 	s.stop.Do(func() {
 		s.listener.Close()
+		// 关闭和后端的连接之前，先等待客户端空闲并回复 goodbye
+		if s.conf.goodbye != "" {
+			log.Infof("drain sessions with goodbye %q", s.conf.goodbye)
+			n := router.DrainSessions(s.conf.goodbye, time.Second*time.Duration(s.conf.goodbyeTimeout))
+			log.Infof("drain sessions done, %d sessions closed without goodbye", n)
+		}
 		// 关闭和redis之间的路由
 		if s.router != nil {
 			s.router.Close()
@@ -226,18 +364,41 @@ func (s *Server) rewatchNodes() []string {
 
 // 在zk上注册自身的信息，包括proxy和fence节点
 func (s *Server) register() {
+	if err := s.tryRegister(); err != nil {
+		log.PanicErrorf(err, "register proxy failed")
+	}
+}
+
+// 连接zk并注册，失败时返回错误，之后不再使用zk
+func (s *Server) registerOptional() error {
+	t, err := DialTopo(s.conf.productName, s.conf.zkAddr, s.conf.fact, s.conf.provider, s.conf.zkSessionTimeout)
+	if err != nil {
+		return err
+	}
+	t.optional = s.conf.coordinatorOptional
+	s.topo = t
+	if err := s.tryRegister(); err != nil {
+		t.conn().Close()
+		s.topo = nil
+		return err
+	}
+	return nil
+}
+
+func (s *Server) tryRegister() error {
 	// 在zk上创建自身的proxy信息
 	if _, err := s.topo.CreateProxyInfo(&s.info); err != nil {
-		log.PanicErrorf(err, "create proxy node failed")
+		return errors.Trace(err)
 	}
 	// 在fence节点上创建proxy信息
 	if _, err := s.topo.CreateProxyFenceNode(&s.info); err != nil && err != zk.ErrNodeExists {
-		log.PanicErrorf(err, "create fence node failed")
+		return errors.Trace(err)
 	}
 	log.Warn("********** Attention **********")
 	log.Warn("You should use `kill {pid}` rather than `kill -9 {pid}` to stop me,")
 	log.Warn("or the node resisted on zk will not be cleaned when I'm quiting and you must remove it manually")
 	log.Warn("*******************************")
+	return nil
 }
 
 // 将proxy状态修改为 offline，会删除zk上此proxy相关的节点
@@ -285,6 +446,23 @@ func (s *Server) waitOnline() bool {
 	}
 }
 
+// 开始处理客户端的连接之前建立和所有后端的连接，避免启动后的第一批请求变慢
+// 有后端失败并且 backend_warmup_on_error = abort 时返回false
+func (s *Server) warmup() bool {
+	log.Infof("warmup %d conns of each backend, %d backend conns", s.conf.warmup, s.router.BackendConns())
+	start := time.Now()
+	failed := s.router.Warmup(s.conf.warmup, time.Second*time.Duration(s.conf.warmupTimeout))
+	for addr, err := range failed {
+		log.WarnErrorf(err, "warmup backend conn to %s failed", addr)
+	}
+	log.Infof("warmup done in %s, %d backends failed", time.Since(start), len(failed))
+	if len(failed) != 0 && s.conf.warmupOnError == "abort" {
+		log.Errorf("warmup failed, abort and mark offline: %s", s.info.Id)
+		return false
+	}
+	return true
+}
+
 // 获取有状态变更的路径
 func getEventPath(evt interface{}) string {
 	return evt.(topo.Event).Path
@@ -329,37 +507,443 @@ func groupMaster(groupInfo models.ServerGroup) string {
 
 // 重置指定slot信息
 func (s *Server) resetSlot(i int) {
+	if s.batch != nil {
+		s.batch.setSlot(i, false)
+		return
+	}
 	s.router.ResetSlot(i)
+	s.trackSlotOwner(i, "", 0)
 }
 
-// 填充指定slot的信息，建立与所在redis-server的连接
-// 之后关于redis的操作会根据key映射到slot，再从slot中找到与其所在redis-server的连接
-func (s *Server) fillSlot(i int) {
+// slot在zk上记录的路由信息
+type slotRoute struct {
+	groupId int
+	addr    string // 所在group的master地址
+	from    string // 迁移中时，迁移源group的master地址
+	lock    bool   // 预迁移状态，需要阻塞住此slot的请求
+
+	fallback bool // slot没有分配group，由 default_group 服务
+
+	replicas []string // 所在group的slave地址，只在开启读slave时获取
+}
+
+// 从zk获取指定slot的路由信息
+func (s *Server) getSlotRoute(i int) (*slotRoute, error) {
 	// 获取指定id的slot信息，并且获取所在group的信息
 	slotInfo, slotGroup, err := s.topo.GetSlotByIndex(i)
 	if err != nil {
-		log.PanicErrorf(err, "get slot by index failed", i)
+		return nil, errors.Trace(err)
+	}
+	if slotGroup == nil {
+		return s.getFallbackRoute(i)
 	}
 
-	var from string
 	// 获取一个group中处于master身份的redis-server的地址
-	var addr = groupMaster(*slotGroup)
+	route := &slotRoute{groupId: slotInfo.GroupId, addr: groupMaster(*slotGroup)}
 	if slotInfo.State.Status == models.SLOT_STATUS_MIGRATE {
 		fromGroup, err := s.topo.GetGroup(slotInfo.State.MigrateStatus.From)
 		if err != nil {
-			log.PanicErrorf(err, "get migrate from failed")
+			return nil, errors.Trace(err)
+		}
+		route.from = groupMaster(*fromGroup)
+		if route.from == route.addr {
+			log.Panicf("set slot %04d migrate from %s to %s", i, route.from, route.addr)
 		}
-		from = groupMaster(*fromGroup)
-		if from == addr {
-			log.Panicf("set slot %04d migrate from %s to %s", i, from, addr)
+	}
+	route.lock = slotInfo.State.Status == models.SLOT_STATUS_PRE_MIGRATE
+	if s.conf.readReplica || s.conf.hotSlotReads != 0 {
+		route.replicas = groupSlaves(*slotGroup)
+	}
+	return route, nil
+}
+
+var ErrSlotNotAssigned = errors.New("slot is not assigned to any group")
+
+// 没有分配group的slot，配置了 default_group 时发送到这个group，否则返回错误
+// 只用于搭建集群的过程中，每次填充都输出 error 日志
+func (s *Server) getFallbackRoute(i int) (*slotRoute, error) {
+	if s.conf.defaultGroup == 0 {
+		return nil, errors.Trace(ErrSlotNotAssigned)
+	}
+	group, err := s.topo.GetGroup(s.conf.defaultGroup)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	route := &slotRoute{groupId: s.conf.defaultGroup, addr: groupMaster(*group), fallback: true}
+	if s.conf.readReplica || s.conf.hotSlotReads != 0 {
+		route.replicas = groupSlaves(*group)
+	}
+	log.Errorf("slot %04d is not assigned to any group, fallback to default_group %d, backend.addr = %s",
+		i, s.conf.defaultGroup, route.addr)
+	return route, nil
+}
+
+// 获取一个group中处于slave身份的redis-server的地址
+func groupSlaves(groupInfo models.ServerGroup) []string {
+	var slaves []string
+	for _, server := range groupInfo.Servers {
+		if server.Type == models.SERVER_TYPE_SLAVE {
+			slaves = append(slaves, server.Addr)
 		}
 	}
+	sort.Strings(slaves)
+	return slaves
+}
+
+// 填充指定slot的信息，建立与所在redis-server的连接
+// 之后关于redis的操作会根据key映射到slot，再从slot中找到与其所在redis-server的连接
+func (s *Server) fillSlot(i int) {
+	if s.batch != nil {
+		s.batch.setSlot(i, true)
+		return
+	}
+	route, err := s.getSlotRoute(i)
+	if err != nil {
+		log.PanicErrorf(err, "get slot %04d failed", i)
+	}
+	s.applySlotRoute(i, route)
+}
 
+func (s *Server) applySlotRoute(i int, route *slotRoute) {
 	// 将slot所在groupId加入到map中
-	s.groups[i] = slotInfo.GroupId
+	s.groups[i] = route.groupId
 	// 填充指定slot的信息，建立与所在redis-server的连接
-	s.router.FillSlot(i, addr, from,
-		slotInfo.State.Status == models.SLOT_STATUS_PRE_MIGRATE)
+	s.router.FillSlot(i, route.addr, route.from, route.lock)
+	s.router.SetSlotFallback(i, route.fallback)
+	s.router.SetSlotGroup(i, route.groupId)
+	if s.conf.readReplica || s.conf.hotSlotReads != 0 {
+		s.router.SetSlotReplicas(i, route.replicas)
+	}
+	s.trackSlotOwner(i, route.addr, route.groupId)
+}
+
+// 重新从zk获取全部slot的路由信息，只更新有变化的slot，返回更新的slot数量
+// 先获取全部slot的信息再统一更新，获取失败时不会修改当前的路由
+func (s *Server) reloadSlots() (int, error) {
+	var routes [router.MaxSlotNum]*slotRoute
+	for i := 0; i < len(routes); i++ {
+		route, err := s.getSlotRoute(i)
+		if err != nil {
+			return 0, err
+		}
+		routes[i] = route
+	}
+	var n int
+	for i, route := range routes {
+		addr, from, lock := s.router.GetSlotRoute(i)
+		replicas := s.router.GetSlotReplicas(i)
+		if addr == route.addr && from == route.from && lock == route.lock && s.router.IsFallbackSlot(i) == route.fallback &&
+			strings.Join(replicas, ",") == strings.Join(route.replicas, ",") {
+			continue
+		}
+		log.Warnf("reload slot %04d, backend.addr = %s -> %s, migrate.from = %s -> %s",
+			i, addr, route.addr, from, route.from)
+		s.applySlotRoute(i, route)
+		n++
+	}
+	s.lastReload.Set(time.Now().Unix())
+	s.router.ResetDisabledBackends()
+	log.Infof("reload slots finished, %d slots updated", n)
+	return n, nil
+}
+
+var ErrNotServing = errors.New("proxy is not serving")
+
+// 强制重新加载路由信息，用于zk的watch丢失通知的情况
+// 在事件循环中执行，不会与其它的路由变更同时进行
+func (s *Server) ReloadSlots() (int, error) {
+	return s.reload(&reloadRequest{done: make(chan struct{})})
+}
+
+func (s *Server) reload(req *reloadRequest) (int, error) {
+	select {
+	case s.reloadc <- req:
+	case <-s.kill:
+		return 0, ErrNotServing
+	case <-time.After(time.Second * 5):
+		return 0, ErrNotServing
+	}
+	<-req.done
+	return req.n, req.err
+}
+
+type reloadRequest struct {
+	n     int
+	err   error
+	table *RoutingTable // 不为nil时使用导入的路由表，只用于没有连接zk的proxy
+	done  chan struct{}
+}
+
+// 清空所有后端的不同key数量的估算，返回清空的后端数量
+func (s *Server) ResetBackendKeys() int {
+	return s.router.ResetBackendKeys()
+}
+
+// 手动下线一个后端，persist 为 false 时重新加载路由之后恢复
+func (s *Server) DisableBackend(addr string, persist bool) error {
+	return s.router.DisableBackend(addr, persist)
+}
+
+func (s *Server) EnableBackend(addr string) error {
+	return s.router.EnableBackend(addr)
+}
+
+// 返回proxy当前的状态信息
+func (s *Server) Status() map[string]interface{} {
+	var m = make(map[string]interface{})
+	m["info"] = s.Info()
+	m["listen_addr"] = s.listener.Addr().String()
+	m["listen_backlog"] = s.backlog
+	m["accept"] = s.acceptStatus()
+	if s.conf.tlsCertFile != "" {
+		m["tls"] = map[string]interface{}{
+			"min_version": s.conf.tlsMinVersion,
+			"ciphers":     s.conf.tlsCiphers,
+		}
+		if s.conf.tlsClientCA != "" {
+			m["tls"].(map[string]interface{})["client_identity"] = s.conf.tlsClientAs
+		}
+	}
+	if s.conf.flushPolicy == "coalesce" {
+		m["reply_flush"] = map[string]interface{}{
+			"policy":   s.conf.flushPolicy,
+			"delay_us": s.conf.flushDelay,
+			"size":     s.conf.flushSize,
+		}
+	} else {
+		m["reply_flush"] = map[string]interface{}{
+			"policy": s.conf.flushPolicy,
+		}
+	}
+	m["sessions"] = router.SessionCounts()
+	m["backend_multiplex"] = s.conf.multiplex
+	m["backend_conns"] = s.router.BackendConns()
+	m["backends"] = s.router.BackendStatus()
+	// 同一个客户端发往同一个后端的命令是否总是按顺序通过同一个连接发送
+	m["backend_affinity"] = router.BackendAffinity()
+	m["backend_pool_size"] = s.conf.poolSize
+	m["hot_slots"] = s.router.HotSlots()
+	if router.ReplicaLagEnabled() {
+		m["replica_lag"] = s.router.ReplicaLags()
+	}
+	m["groups"] = s.router.GroupStatus()
+	m["group_down_policy"] = s.conf.groupDownPolicy
+	m["pre_migrate_policy"] = s.conf.preMigrate
+	m["unknown_command_action"] = s.conf.unknownAction
+	m["slowlog_threshold"] = router.SlowlogThreshold().String()
+	// 没有开启维护模式时为 null
+	m["maintenance"] = router.Maintenance()
+	// 没有暂停的group时为 null
+	m["paused_groups"] = router.PausedGroups()
+	m["routing_conflicts"] = s.RouteConflicts()
+	m["routing_conflict_policy"] = s.conf.conflictPolicy
+	if x := router.ShadowStats(); x != nil {
+		m["shadow"] = x
+	}
+	m["client_backend_ratio"] = s.clientBackendRatio()
+	m["pipeline_window"] = s.pipelineWindow()
+	m["migrating_slots"] = len(s.router.MigrationStatus(false))
+	if s.conf.defaultGroup != 0 {
+		m["default_group"] = map[string]interface{}{
+			"group_id": s.conf.defaultGroup,
+			"slots":    s.router.FallbackSlots(),
+			"commands": router.FallbackCounts(),
+		}
+	}
+	m["table_age"] = int64(s.tableAge() / time.Second)
+	m["table_stale"] = router.IsTableStale()
+	m["failures"] = map[string]interface{}{
+		"size":     s.conf.failureLogSize,
+		"recorded": router.FailureCounts(),
+	}
+	m["diagnostics_memory"] = map[string]interface{}{
+		"budget":  s.conf.diagBudget,
+		"used":    router.DiagnosticsMemory(),
+		"evicted": router.DiagEvictedCounts(),
+	}
+	if s.conf.quarantineDenylist {
+		m["denied_clients"] = router.DeniedClients()
+	}
+	if s.tracer != nil {
+		m["tracing"] = map[string]interface{}{
+			"endpoint":    s.tracer.endpoint,
+			"sample_rate": s.conf.traceSampleRate,
+			"exported":    s.tracer.exported.Get(),
+			"dropped":     s.tracer.dropped.Get(),
+		}
+	}
+	if s.imported {
+		m["coordinator"] = map[string]interface{}{
+			"connected":      false,
+			"imported_table": true,
+		}
+	} else if t := s.coordLostAt.Get(); t != 0 {
+		m["coordinator"] = map[string]interface{}{
+			"connected":  false,
+			"lost_since": time.Unix(t, 0).String(),
+			"retries":    s.coordRetries.Get(),
+		}
+	} else {
+		m["coordinator"] = map[string]interface{}{
+			"connected": true,
+		}
+	}
+	if s.connLog != nil {
+		m["connection_log"] = map[string]interface{}{
+			"geoip_db": s.conf.geoipFile,
+			"dropped":  s.connLog.dropped.Get(),
+		}
+	}
+	if s.conf.watchdog {
+		m["watchdog"] = map[string]interface{}{
+			"stall_threshold": s.conf.stallThreshold,
+			"stalls":          s.stalls.Get(),
+		}
+	}
+	if s.conf.batchWindow != 0 {
+		m["coordinator_batch"] = map[string]interface{}{
+			"window_ms": s.conf.batchWindow,
+			"batches":   s.batches.Get(),
+			"events":    s.batchedEvents.Get(),
+		}
+	}
+	if t := s.lastReload.Get(); t != 0 {
+		m["last_reload"] = time.Unix(t, 0).String()
+	} else {
+		m["last_reload"] = ""
+	}
+	return m
+}
+
+// 和zk失去连接之后的重连间隔，每次失败之后加倍
+const (
+	minCoordinatorBackoff = time.Second
+	maxCoordinatorBackoff = time.Second * 30
+)
+
+// zk会话过期或者watch失效，只在 coordinator_optional 开启时会收到
+func (s *Server) onCoordinatorLost(e *coordinatorLost) {
+	if e.conn != s.topo.conn() || s.coordLostAt.Get() != 0 {
+		return
+	}
+	log.Errorf("coordinator lost, event = %+v, keep serving with the last known slots", e.event)
+	s.coordLostAt.Set(time.Now().Unix())
+	s.coordRetries.Set(0)
+	s.coordBackoff = minCoordinatorBackoff
+	s.coordNextRetry = time.Now().Add(s.coordBackoff)
+}
+
+func (s *Server) reconnectCoordinator() {
+	s.coordRetries.Incr()
+	lost := time.Since(time.Unix(s.coordLostAt.Get(), 0))
+	if err := s.rejoinCoordinator(); err != nil {
+		if s.coordBackoff *= 2; s.coordBackoff > maxCoordinatorBackoff {
+			s.coordBackoff = maxCoordinatorBackoff
+		}
+		s.coordNextRetry = time.Now().Add(s.coordBackoff)
+		log.ErrorErrorf(err, "reconnect coordinator failed, slots may be stale for %s, retry in %s", lost, s.coordBackoff)
+		return
+	}
+	s.coordLostAt.Set(0)
+	log.Warnf("coordinator reconnected after %s, %d retries", lost, s.coordRetries.Get())
+	if router.IsTableStale() {
+		router.SetTableStale(false)
+		log.Warnf("routing table is refreshed, stop rejecting commands")
+	}
+}
+
+// 路由信息没有更新的时间，和zk连接正常时为 0
+func (s *Server) tableAge() time.Duration {
+	if t := s.coordLostAt.Get(); t != 0 {
+		return time.Since(time.Unix(t, 0))
+	}
+	return 0
+}
+
+// 和zk失去连接太久时，根据 stale_table_action 决定是否拒绝命令
+func (s *Server) checkTableStale() {
+	if s.conf.staleTableAction != "reject" || router.IsTableStale() {
+		return
+	}
+	if age := s.tableAge(); age > time.Second*time.Duration(s.conf.staleTableMaxAge) {
+		router.SetTableStale(true)
+		log.Errorf("routing table is stale for %s, reject commands until coordinator is reconnected", age)
+	}
+}
+
+// 重新连接zk，重新注册proxy节点和监听，并且重新加载全部的slot
+func (s *Server) rejoinCoordinator() error {
+	if err := s.topo.Reconnect(); err != nil {
+		return err
+	}
+	// 会话过期之后临时节点已经被删除了
+	if _, err := s.topo.CreateProxyInfo(&s.info); err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNodeExists) {
+		return errors.Trace(err)
+	}
+	if _, err := s.topo.CreateProxyFenceNode(&s.info); err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNodeExists) {
+		return errors.Trace(err)
+	}
+	if _, err := s.topo.WatchNode(path.Join(models.GetProxyPath(s.topo.ProductName), s.info.Id), s.evtbus); err != nil {
+		return err
+	}
+	nodes, err := s.topo.WatchChildren(models.GetWatchActionPath(s.topo.ProductName), s.evtbus)
+	if err != nil {
+		return err
+	}
+	// 断开期间的 action 不再处理，直接重新加载全部的slot
+	seqs, err := models.ExtraSeqList(nodes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(seqs) != 0 {
+		s.lastActionSeq = seqs[len(seqs)-1]
+	}
+	n, err := s.reloadSlots()
+	if err != nil {
+		return err
+	}
+	log.Warnf("reload slots after coordinator reconnected, %d slots updated", n)
+	return nil
+}
+
+// 内部队列的长度，proxy 卡住时用于判断哪里在等待
+func (s *Server) Internals() map[string]interface{} {
+	var m = make(map[string]interface{})
+	m["accepted"] = &router.QueueLen{Len: len(s.accepted), Cap: cap(s.accepted)}
+	m["zk_events"] = &router.QueueLen{Len: len(s.evtbus), Cap: cap(s.evtbus)}
+	m["backends"] = s.router.BackendQueues()
+	m["sessions"] = router.SessionQueueStats()
+	m["heartbeats"] = s.heartbeatAges()
+	if x := router.ShadowQueue(); x != nil {
+		m["shadow"] = x
+	}
+	if s.tracer != nil {
+		s.tracer.mu.Lock()
+		m["trace_spans"] = len(s.tracer.queue)
+		s.tracer.mu.Unlock()
+	}
+	return m
+}
+
+// 复用后端连接时，这个比值可以看出复用的程度
+func (s *Server) clientBackendRatio() float64 {
+	if n := s.router.BackendConns(); n != 0 {
+		return float64(router.SessionCounts()) / float64(n)
+	}
+	return 0
+}
+
+// 一个客户端的 pipeline 中，最多可以有多少个命令在前面的命令返回之前转发给后端
+func (s *Server) pipelineWindow() int {
+	if n := s.conf.maxInflight; n > 0 && n < s.conf.maxPipeline {
+		return n
+	}
+	return s.conf.maxPipeline
+}
+
+// 获取正在迁移中的slot的进度
+func (s *Server) MigrationStatus() []*router.SlotMigration {
+	return s.router.MigrationStatus(true)
 }
 
 // 批量更新slots状态信息
@@ -514,7 +1098,12 @@ func (s *Server) processAction(e interface{}) {
 		// 检查通知内容，有需要就更新slot状态信息
 		if s.checkAndDoTopoChange(seq) {
 			// 需要回复的话，就在 ActionResponse 下创建节点完成回复
-			s.responseAction(int64(seq))
+			// 合并通知时，等到更新完路由之后再回复
+			if s.batch != nil {
+				s.batch.responses = append(s.batch.responses, int64(seq))
+			} else {
+				s.responseAction(int64(seq))
+			}
 		}
 	}
 
@@ -532,13 +1121,20 @@ func (s *Server) loopEvents() {
 	defer ticker.Stop()
 
 	var tick int = 0
+	var hotCheck = time.Now()
 	for s.info.State == models.PROXY_STATE_ONLINE {
+		s.loopBeat.beat()
 		select {
 		case <-s.kill:
 			// proxy停止
 			log.Infof("mark offline, proxy is killed: %s", s.info.Id)
 			s.markOffline()
 		case e := <-s.evtbus:
+			// 和zk的连接失效，继续使用已有的路由，稍后重连
+			if lost, ok := e.(*coordinatorLost); ok {
+				s.onCoordinatorLost(lost)
+				continue
+			}
 			// 检测到zk上有状态变更，进行相应的处理
 			evtPath := getEventPath(e)
 			log.Infof("got event %s, %v, lastActionSeq %d", s.info.Id, e, s.lastActionSeq)
@@ -555,8 +1151,34 @@ func (s *Server) loopEvents() {
 				}
 			}
 			// 处理 zk 上的 watch 节点变更的通知，主要有两种，一种是自身proxy的状态变更，一种是 action 通知消息的更新
-			s.processAction(e)
+			if s.conf.batchWindow != 0 {
+				s.processBatch(e, time.Millisecond*time.Duration(s.conf.batchWindow))
+			} else {
+				s.processAction(e)
+			}
+		case req := <-s.reloadc:
+			// 强制重新加载路由信息
+			req.n, req.err = s.reloadSlots()
+			close(req.done)
 		case <-ticker.C:
+			if s.coordLostAt.Get() != 0 && !time.Now().Before(s.coordNextRetry) {
+				s.reconnectCoordinator()
+			}
+			s.checkTableStale()
+			// 获取slave的复制延迟，延迟太大的slave不再处理不允许延迟的只读命令
+			if router.ReplicaLagEnabled() {
+				s.router.CheckReplicaLag()
+			}
+			// RANDOMKEY 按照key的数量选择后端时使用
+			if s.conf.randomWeighted {
+				s.router.CheckKeyCounts()
+			}
+			// 检查访问过多的slot，分散到slave读取
+			if s.conf.hotSlotReads != 0 {
+				now := time.Now()
+				s.router.CheckHotSlots(now.Sub(hotCheck))
+				hotCheck = now
+			}
 			// 每隔5秒钟向后端 redis-server 发送心跳包
 			if maxTick := s.conf.pingPeriod; maxTick != 0 {
 				if tick++; tick >= maxTick {
@@ -5,6 +5,7 @@ package proxy
 
 import (
 	"io"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -283,6 +284,30 @@ func TestRedisRestart(t *testing.T) {
 	}
 }
 
+func TestRandomPort(t *testing.T) {
+	c2 := *conf
+	c2.proxyId = "proxy_test_random_port"
+	s2 := New("127.0.0.1:0", ":0", &c2)
+	defer s2.Close()
+
+	err := models.SetProxyStatus(conn, c2.productName, c2.proxyId, models.PROXY_STATE_ONLINE)
+	assert.MustNoError(err)
+
+	addr := s2.Status()["listen_addr"].(string)
+	assert.Must(!strings.HasSuffix(addr, ":0") && !strings.HasSuffix(s2.Info().Addr, ":0"))
+
+	c, err := redis.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Do("SET", "key8", "value8")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 //this should be the last test
 func TestMarkOffline(t *testing.T) {
 	suicide := int64(0)
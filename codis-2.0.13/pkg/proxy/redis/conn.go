@@ -16,6 +16,9 @@ type Conn struct {
 	ReaderTimeout time.Duration
 	WriterTimeout time.Duration
 
+	// 不为零时代替 ReaderTimeout 作为读取的截止时间
+	ReaderDeadline time.Time
+
 	Reader *Decoder
 	Writer *Encoder
 }
@@ -50,7 +53,12 @@ type connReader struct {
 }
 
 func (r *connReader) Read(b []byte) (int, error) {
-	if timeout := r.ReaderTimeout; timeout != 0 {
+	if !r.ReaderDeadline.IsZero() {
+		if err := r.Sock.SetReadDeadline(r.ReaderDeadline); err != nil {
+			return 0, errors.Trace(err)
+		}
+		r.hasDeadline = true
+	} else if timeout := r.ReaderTimeout; timeout != 0 {
 		if err := r.Sock.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 			return 0, errors.Trace(err)
 		}
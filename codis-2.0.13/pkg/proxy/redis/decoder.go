@@ -16,6 +16,9 @@ var (
 	ErrBadRespCRLFEnd  = errors.New("bad resp CRLF end")
 	ErrBadRespBytesLen = errors.New("bad resp bytes len")
 	ErrBadRespArrayLen = errors.New("bad resp array len")
+	ErrRespTooLarge    = errors.New("resp is too large")
+	ErrBadRespType     = errors.New("bad resp type")
+	ErrBadRespInt      = errors.New("bad resp int")
 )
 
 func btoi(b []byte) (int64, error) {
@@ -53,6 +56,26 @@ type Decoder struct {
 	*bufio.Reader
 
 	Err error
+
+	// 单个 Resp 的大小上限，0表示不限制，包括所有字符串的长度，以及每个元素 RespOverhead 的开销
+	// 所以元素很多、每个元素都很小的数组也会超过上限，超过之后不再继续读取，返回 ErrRespTooLarge
+	MaxSize int64
+	size    int64
+
+	// 只接受完整格式的 RESP，用于校验后端的回复：不接受 inline 格式，整数需要是合法的数字，状态和错误中不能有 \r
+	Strict bool
+}
+
+// 解析出的每个 Resp 元素占用的内存，包括指针和 Resp 结构本身
+const RespOverhead = 64
+
+// 累加当前 Resp 的大小，超过 MaxSize 时返回错误，长度很大时也不会溢出
+func (d *Decoder) grow(n int64) error {
+	if d.MaxSize != 0 && n > d.MaxSize-d.size {
+		return errors.Trace(ErrRespTooLarge)
+	}
+	d.size += n
+	return nil
 }
 
 func NewDecoder(br *bufio.Reader) *Decoder {
@@ -71,6 +94,7 @@ func (d *Decoder) Decode() (*Resp, error) {
 	if d.Err != nil {
 		return nil, d.Err
 	}
+	d.size = RespOverhead
 	r, err := d.decodeResp(0)
 	if err != nil {
 		d.Err = err
@@ -86,6 +110,16 @@ func DecodeFromBytes(p []byte) (*Resp, error) {
 	return Decode(bufio.NewReader(bytes.NewReader(p)))
 }
 
+// 从 r 中解析一个 Resp，和proxy解析请求和后端回复的实现相同，方便外部的工具使用
+// r 不是 *bufio.Reader 时会包装一层缓冲，可能多读取之后的数据，连续解析多个 Resp 时应该传入同一个 *bufio.Reader，或者使用 Decoder
+func DecodeFromReader(r io.Reader) (*Resp, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return Decode(br)
+}
+
 // 将redis协议字符串解析到 Resp 类型中
 func (d *Decoder) decodeResp(depth int) (*Resp, error) {
 	b, err := d.ReadByte()
@@ -95,8 +129,15 @@ func (d *Decoder) decodeResp(depth int) (*Resp, error) {
 	switch t := RespType(b); t {
 	case TypeString, TypeError, TypeInt:
 		r := &Resp{Type: t}
-		r.Value, err = d.decodeTextBytes()
-		return r, err
+		if r.Value, err = d.decodeTextBytes(); err != nil {
+			return nil, err
+		}
+		if d.Strict {
+			if err := checkTextBytes(t, r.Value); err != nil {
+				return nil, err
+			}
+		}
+		return r, d.grow(int64(len(r.Value)))
 	case TypeBulkBytes:
 		r := &Resp{Type: t}
 		r.Value, err = d.decodeBulkBytes()
@@ -106,6 +147,9 @@ func (d *Decoder) decodeResp(depth int) (*Resp, error) {
 		r.Array, err = d.decodeArray(depth)
 		return r, err
 	default:
+		if d.Strict {
+			return nil, errors.Trace(ErrBadRespType)
+		}
 		if depth != 0 {
 			return nil, errors.Errorf("bad resp type %s", t)
 		}
@@ -130,6 +174,19 @@ func (d *Decoder) decodeTextBytes() ([]byte, error) {
 	}
 }
 
+func checkTextBytes(t RespType, b []byte) error {
+	if t == TypeInt {
+		if _, err := strconv.ParseInt(string(b), 10, 64); err != nil {
+			return errors.Trace(ErrBadRespInt)
+		}
+		return nil
+	}
+	if bytes.IndexByte(b, '\r') >= 0 {
+		return errors.Trace(ErrBadRespCRLFEnd)
+	}
+	return nil
+}
+
 func (d *Decoder) decodeTextString() (string, error) {
 	b, err := d.decodeTextBytes()
 	if err != nil {
@@ -156,6 +213,9 @@ func (d *Decoder) decodeBulkBytes() ([]byte, error) {
 	} else if n == -1 {
 		return nil, nil
 	}
+	if err := d.grow(n); err != nil {
+		return nil, err
+	}
 	b := make([]byte, n+2)
 	if _, err := io.ReadFull(d.Reader, b); err != nil {
 		return nil, errors.Trace(err)
@@ -176,6 +236,13 @@ func (d *Decoder) decodeArray(depth int) ([]*Resp, error) {
 	} else if n == -1 {
 		return nil, nil
 	}
+	// 在分配之前检查，避免一个很大的数组长度直接占用大量内存
+	if d.MaxSize != 0 && n > (d.MaxSize-d.size)/RespOverhead {
+		return nil, errors.Trace(ErrRespTooLarge)
+	}
+	if err := d.grow(n * RespOverhead); err != nil {
+		return nil, err
+	}
 	a := make([]*Resp, n)
 	for i := 0; i < len(a); i++ {
 		if a[i], err = d.decodeResp(depth + 1); err != nil {
@@ -4,10 +4,13 @@
 package redis
 
 import (
+	"bufio"
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 )
 
 func TestBtoi(t *testing.T) {
@@ -93,6 +96,64 @@ func TestDecodeBulkBytes(t *testing.T) {
 	assert.Must(bytes.Equal(s2.Value, []byte("mylist")))
 }
 
+func TestDecodeMaxSize(t *testing.T) {
+	// 3 个元素的开销，加上两个字符串的长度
+	test := "*2\r\n$4\r\nLLEN\r\n$6\r\nmylist\r\n"
+	d := NewDecoder(bufio.NewReader(strings.NewReader(test + test)))
+	d.MaxSize = RespOverhead*3 + 10
+	_, err := d.Decode()
+	assert.MustNoError(err)
+	// 每次 Decode 都会重新计算大小
+	_, err = d.Decode()
+	assert.MustNoError(err)
+
+	d = NewDecoder(bufio.NewReader(strings.NewReader(test)))
+	d.MaxSize = RespOverhead*3 + 9
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrRespTooLarge))
+
+	// 元素很多、每个元素都很小的数组，在读取元素之前就会返回错误
+	d = NewDecoder(bufio.NewReader(strings.NewReader("*100000\r\n:1\r\n")))
+	d.MaxSize = 1024 * 1024
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrRespTooLarge))
+
+	d = NewDecoder(bufio.NewReader(strings.NewReader("$9223372036854775807\r\n")))
+	d.MaxSize = 1024
+	_, err = d.Decode()
+	assert.Must(errors.Equal(err, ErrRespTooLarge))
+
+	d = NewDecoder(bufio.NewReader(strings.NewReader("*3\r\n+OK\r\n:12345\r\n-ERR\r\n")))
+	d.MaxSize = RespOverhead*4 + 10
+	_, err = d.Decode()
+	assert.MustNoError(err)
+}
+
+func TestDecodeStrict(t *testing.T) {
+	decode := func(s string, strict bool) error {
+		d := NewDecoder(bufio.NewReader(strings.NewReader(s)))
+		d.Strict = strict
+		_, err := d.Decode()
+		return err
+	}
+	for _, s := range []string{"+OK\r\n", ":-12\r\n", "-ERR x\r\n", "$-1\r\n", "*2\r\n:1\r\n$1\r\nx\r\n"} {
+		assert.MustNoError(decode(s, true))
+	}
+	for s, e := range map[string]error{
+		"OK\r\n":            ErrBadRespType,
+		":12a\r\n":          ErrBadRespInt,
+		":\r\n":             ErrBadRespInt,
+		"*1\r\n:1.5\r\n":    ErrBadRespInt,
+		"+O\rK\r\n":         ErrBadRespCRLFEnd,
+		"*1\r\n-ERR\rx\r\n": ErrBadRespCRLFEnd,
+	} {
+		assert.MustNoError(decode(s, false))
+		assert.Must(errors.Equal(decode(s, true), e))
+	}
+	// 数组中的类型错误总是返回错误，开启校验时是 ErrBadRespType
+	assert.Must(errors.Equal(decode("*1\r\n?\r\n", true), ErrBadRespType))
+}
+
 func TestDecoder(t *testing.T) {
 	test := []string{
 		"$6\r\nfoobar\r\n",
@@ -112,3 +173,31 @@ func TestDecoder(t *testing.T) {
 		assert.MustNoError(err)
 	}
 }
+
+func TestDecodeFromReader(t *testing.T) {
+	resp := NewArray([]*Resp{
+		NewBulkBytes([]byte("SET")),
+		NewBulkBytes([]byte("a")),
+		NewBulkBytes(nil),
+		NewInt([]byte("1")),
+	})
+	var b bytes.Buffer
+	assert.MustNoError(EncodeToWriter(&b, resp))
+	assert.MustNoError(EncodeToWriter(&b, NewString([]byte("OK"))))
+	assert.Must(b.String() == "*4\r\n$3\r\nSET\r\n$1\r\na\r\n$-1\r\n:1\r\n+OK\r\n")
+
+	// 使用同一个 *bufio.Reader 连续解析
+	br := bufio.NewReader(bytes.NewReader(b.Bytes()))
+	x, err := DecodeFromReader(br)
+	assert.MustNoError(err)
+	assert.Must(x.IsArray() && len(x.Array) == 4 && x.Array[2].Value == nil && string(x.Array[3].Value) == "1")
+	x, err = DecodeFromReader(br)
+	assert.MustNoError(err)
+	assert.Must(x.IsString() && string(x.Value) == "OK")
+
+	x, err = DecodeFromReader(strings.NewReader("-ERR bad\r\n"))
+	assert.MustNoError(err)
+	assert.Must(x.IsError() && string(x.Value) == "ERR bad")
+	_, err = DecodeFromReader(strings.NewReader("$5\r\nab"))
+	assert.Must(err != nil)
+}
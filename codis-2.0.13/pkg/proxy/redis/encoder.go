@@ -86,6 +86,11 @@ func Encode(bw *bufio.Writer, r *Resp, flush bool) error {
 	return NewEncoder(bw).Encode(r, flush)
 }
 
+// 将 r 编码后写入 w，和proxy发送请求和回复的实现相同，方便外部的工具使用
+func EncodeToWriter(w io.Writer, r *Resp) error {
+	return NewEncoderSize(w, 4096).Encode(r, true)
+}
+
 func EncodeToBytes(r *Resp) ([]byte, error) {
 	var b = &bytes.Buffer{}
 	err := Encode(bufio.NewWriter(b), r, true)
@@ -93,6 +98,12 @@ func EncodeToBytes(r *Resp) ([]byte, error) {
 }
 
 func (e *Encoder) encodeResp(r *Resp) error {
+	if r.encoded != nil {
+		if _, err := e.Write(r.encoded); err != nil {
+			return errors.Trace(err)
+		}
+		return nil
+	}
 	if err := e.WriteByte(byte(r.Type)); err != nil {
 		return errors.Trace(err)
 	}
@@ -79,6 +79,15 @@ func TestEncodeArray(t *testing.T) {
 	testEncodeAndCheck(t, resp, []byte("*3\r\n:0\r\n$-1\r\n$4\r\ntest\r\n"))
 }
 
+func TestEncodeStatic(t *testing.T) {
+	resp := NewStatic(NewString([]byte("PONG")))
+	testEncodeAndCheck(t, resp, []byte("+PONG\r\n"))
+	testEncodeAndCheck(t, NewStatic(NewBulkBytes(nil)), []byte("$-1\r\n"))
+	// 作为数组的元素时同样写入预先编码的结果
+	array := NewArray([]*Resp{resp, NewInt([]byte("1"))})
+	testEncodeAndCheck(t, array, []byte("*2\r\n+PONG\r\n:1\r\n"))
+}
+
 func testEncodeAndCheck(t *testing.T, resp *Resp, expect []byte) {
 	b, err := EncodeToBytes(resp)
 	assert.MustNoError(err)
@@ -33,11 +33,16 @@ func (t RespType) String() string {
 	}
 }
 
+// 一个redis请求或者回复，可以直接构造，也可以通过 New* 函数创建
 type Resp struct {
 	Type RespType
 
+	// 字符串、错误、整数和 bulk string 的内容，不包括类型和结尾的 \r\n，为nil表示 nil bulk string
 	Value []byte
+	// 数组的元素，为nil表示 nil array，空数组用长度为0的切片表示
 	Array []*Resp
+
+	encoded []byte // 预先编码的结果，不为空时直接写入
 }
 
 func (r *Resp) IsString() bool {
@@ -95,6 +100,16 @@ func NewArray(array []*Resp) *Resp {
 	}
 }
 
+// 预先编码 r，用于 +OK 和 +PONG 这样的固定回复，可以同时写给多个连接，之后不能再修改 r
+func NewStatic(r *Resp) *Resp {
+	b, err := EncodeToBytes(r)
+	if err != nil {
+		panic(err)
+	}
+	r.encoded = b
+	return r
+}
+
 func (r *Resp) Append(x *Resp) {
 	if r.Type == TypeArray {
 		r.Array = append(r.Array, x)
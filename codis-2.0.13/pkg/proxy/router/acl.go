@@ -0,0 +1,135 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 通过 AUTH <user> <password> 登录的用户，只能执行允许的命令，访问允许的key
+// 比 redis 的 ACL 简单，只按命令名和key的前缀限制，default 用户使用 password 配置的密码，没有限制
+type ACLUser struct {
+	Name     string
+	Password string
+	Commands []string // 允许的命令，* 表示所有命令
+	Keys     []string // 允许访问的key，以 * 结尾表示前缀，* 表示所有key
+
+	commands map[string]bool
+}
+
+// 解析 acl_users 中的一项，格式为 "name password get|set|del app1:*|app2:*"，省略key表示所有key
+func ParseACLUser(s string) (*ACLUser, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, errors.New("should be like \"name password get|set app:*\"")
+	}
+	u := &ACLUser{Name: fields[0], Password: fields[1], commands: make(map[string]bool)}
+	if u.Name == "default" {
+		return nil, errors.New("default user uses password and can't be restricted")
+	}
+	for _, c := range strings.Split(fields[2], "|") {
+		if c = strings.ToUpper(c); c != "" {
+			u.Commands = append(u.Commands, c)
+			u.commands[c] = true
+		}
+	}
+	if len(u.Commands) == 0 {
+		return nil, errors.New("no command is allowed")
+	}
+	if len(fields) == 4 {
+		for _, k := range strings.Split(fields[3], "|") {
+			if k != "" {
+				u.Keys = append(u.Keys, k)
+			}
+		}
+	}
+	return u, nil
+}
+
+var aclUsers map[string]*ACLUser
+
+// 需要在开始处理请求之前设置
+func SetACLUsers(users []*ACLUser) {
+	aclUsers = make(map[string]*ACLUser, len(users))
+	for _, u := range users {
+		aclUsers[u.Name] = u
+	}
+}
+
+// 和连接相关的命令总是允许执行
+var aclAlwaysAllowed = map[string]bool{
+	"PING": true, "SELECT": true, "CLIENT": true, "PROXY": true,
+}
+
+// 不允许时返回和redis相同的 NOPERM 错误
+// 命令表中没有key的命令，比如 KEYS 和 SCAN，不受key的限制
+func (u *ACLUser) checkPermission(opstr string, resp *redis.Resp) *redis.Resp {
+	if !u.commands["*"] && !u.commands[opstr] && !aclAlwaysAllowed[opstr] {
+		return redis.NewError([]byte(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", u.Name, strings.ToLower(opstr))))
+	}
+	if len(u.Keys) == 0 {
+		return nil
+	}
+	for _, key := range requestKeys(opstr, resp) {
+		if !u.allowKey(key) {
+			return redis.NewError([]byte("NOPERM No permissions to access a key"))
+		}
+	}
+	return nil
+}
+
+func (u *ACLUser) allowKey(key []byte) bool {
+	for _, k := range u.Keys {
+		switch {
+		case k == "*":
+			return true
+		case strings.HasSuffix(k, "*"):
+			if strings.HasPrefix(string(key), k[:len(k)-1]) {
+				return true
+			}
+		case string(key) == k:
+			return true
+		}
+	}
+	return false
+}
+
+// default 用户使用 password 配置的密码，没有配置密码时任意密码都可以登录
+func (s *Session) login(user, passwd string) bool {
+	if user == "default" {
+		if s.auth != "" && passwd != s.auth {
+			return false
+		}
+		s.user = nil
+		return true
+	}
+	u := aclUsers[user]
+	if u == nil || u.Password != passwd {
+		return false
+	}
+	s.user = u
+	return true
+}
+
+// 开启双向 TLS 时通过客户端证书识别客户端，需要在 Serve 之前调用
+// asApp 时 CN 作为应用名，PROXY APP 仍然可以修改；asUser 时 CN 是 acl_users 中的用户则不需要 AUTH 直接登录为这个用户
+// CN 不是 acl_users 中的用户时和没有证书一样，需要通过 AUTH 登录
+func (s *Session) SetClientCert(subject, cn string, asApp, asUser bool) {
+	s.cert = subject
+	if asApp && cn != "" && !strings.ContainsAny(cn, " \n") {
+		s.app = cn
+		s.updateAppStats()
+	}
+	if asUser {
+		if u := aclUsers[cn]; u != nil {
+			s.user, s.authorized = u, true
+			log.Infof("session [%d] logged in as %s by client certificate %s", s.id, u.Name, subject)
+		}
+	}
+}
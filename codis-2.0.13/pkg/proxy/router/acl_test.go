@@ -0,0 +1,116 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestParseACLUser(t *testing.T) {
+	u, err := ParseACLUser("reader secret get|mget app1:*|app2:*")
+	assert.MustNoError(err)
+	assert.Must(u.Name == "reader" && u.Password == "secret")
+	assert.Must(len(u.Commands) == 2 && u.Commands[0] == "GET" && len(u.Keys) == 2)
+
+	u, err = ParseACLUser("admin pw *")
+	assert.MustNoError(err)
+	assert.Must(len(u.Keys) == 0)
+
+	for _, s := range []string{"reader secret", "default pw *", "reader secret | a*", "a b c d e"} {
+		_, err := ParseACLUser(s)
+		assert.Must(err != nil)
+	}
+}
+
+func TestACLUsers(t *testing.T) {
+	reader, err := ParseACLUser("reader secret get|mget|eval app1:*|exact")
+	assert.MustNoError(err)
+	SetACLUsers([]*ACLUser{reader})
+	defer SetACLUsers(nil)
+
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewString([]byte("OK")), nil)}
+	s := &Session{auth: "pw"}
+	isError := func(resp *redis.Resp, prefix string) bool {
+		return resp.IsError() && strings.HasPrefix(string(resp.Value), prefix)
+	}
+
+	assert.Must(isError(doRequest(s, d, "AUTH", "reader", "wrong"), "WRONGPASS"))
+	assert.Must(isError(doRequest(s, d, "GET", "app1:a"), "NOAUTH"))
+	assert.Must(isError(doRequest(s, d, "AUTH", "nobody", "secret"), "WRONGPASS"))
+	assert.Must(doRequest(s, d, "AUTH", "reader", "secret").IsString())
+
+	n := ACLRejectCounts()
+	assert.Must(doRequest(s, d, "GET", "app1:a").IsString())
+	assert.Must(doRequest(s, d, "GET", "exact").IsString())
+	assert.Must(doRequest(s, d, "PING").IsString())
+	assert.Must(isError(doRequest(s, d, "SET", "app1:a", "b"), "NOPERM User reader has no permissions to run the 'set' command"))
+	assert.Must(isError(doRequest(s, d, "GET", "app2:a"), "NOPERM No permissions to access a key"))
+	assert.Must(isError(doRequest(s, d, "GET", "exact2"), "NOPERM"))
+	// 多key的命令检查全部的key
+	assert.Must(isError(doRequest(s, d, "MGET", "app1:a", "app2:b"), "NOPERM"))
+	assert.Must(isError(doRequest(s, d, "EVAL", "return 1", "2", "app1:a", "app2:b"), "NOPERM"))
+	assert.Must(doRequest(s, d, "EVAL", "return 1", "1", "app1:a", "app2:b").IsString())
+	assert.Must(ACLRejectCounts() == n+5)
+
+	// default 用户没有限制
+	assert.Must(doRequest(s, d, "AUTH", "default", "pw").IsString())
+	assert.Must(doRequest(s, d, "SET", "app2:a", "b").IsString())
+	assert.Must(doRequest(s, d, "HELLO", "2", "AUTH", "reader", "secret").IsArray())
+	assert.Must(isError(doRequest(s, d, "SET", "app1:a", "b"), "NOPERM"))
+	assert.Must(doRequest(s, d, "AUTH", "pw").IsString())
+	assert.Must(doRequest(s, d, "SET", "app1:a", "b").IsString())
+}
+
+// 默认开启 session_check_arity，AUTH <user> <password> 也要能够登录
+func TestACLLoginCheckArity(t *testing.T) {
+	reader, err := ParseACLUser("reader secret get app1:*")
+	assert.MustNoError(err)
+	SetACLUsers([]*ACLUser{reader})
+	defer SetACLUsers(nil)
+
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewString([]byte("OK")), nil)}
+	s := &Session{auth: "pw", CheckArity: true}
+	assert.Must(doRequest(s, d, "AUTH", "reader", "secret").IsString())
+	assert.Must(s.user == reader && s.authorized)
+	assert.Must(doRequest(s, d, "GET", "app1:a").IsString())
+	assert.Must(doRequest(s, d, "AUTH", "pw").IsString())
+	assert.Must(s.user == nil)
+	assert.Must(doRequest(s, d, "AUTH").IsError())
+	assert.Must(doRequest(s, d, "AUTH", "reader", "secret", "x").IsError())
+}
+
+func TestClientCert(t *testing.T) {
+	reader, err := ParseACLUser("reader secret get app1:*")
+	assert.MustNoError(err)
+	SetACLUsers([]*ACLUser{reader})
+	defer SetACLUsers(nil)
+
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewString([]byte("OK")), nil)}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "pw", 1024, 1800)
+	s.SetClientCert("CN=reader,O=example", "reader", true, true)
+	assert.Must(doRequest(s, d, "GET", "app1:a").IsString())
+	assert.Must(doRequest(s, d, "SET", "app1:a", "b").IsError())
+	x := s.ClientInfo()
+	assert.Must(x.Cert == "CN=reader,O=example" && x.App == "reader")
+
+	// 不是 acl_users 中的用户，或者没有开启 user 时仍然需要 AUTH
+	for _, asUser := range []bool{true, false} {
+		s = &Session{auth: "pw"}
+		cn := "nobody"
+		if !asUser {
+			cn = "reader"
+		}
+		s.SetClientCert("CN="+cn, cn, false, asUser)
+		assert.Must(s.app == "" && doRequest(s, d, "GET", "app1:a").IsError())
+		assert.Must(doRequest(s, d, "AUTH", "pw").IsString())
+		assert.Must(doRequest(s, d, "SET", "app1:a", "b").IsString())
+	}
+}
@@ -5,10 +5,14 @@ package router
 
 import (
 	"fmt"
+	"math/rand"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
@@ -19,7 +23,25 @@ type BackendConn struct {
 	auth string // 连接redis的密码
 	stop sync.Once
 
-	input chan *Request // 用于接收redis请求的通道
+	input  chan *Request // 用于接收redis请求的通道
+	urgent chan *Request // 用于接收高优先级请求的通道，没有设置 SetHighPriority 时为nil
+	waits  [2]queueWait  // 普通和高优先级的请求在队列中等待的时间，同样只在设置了优先级时统计
+
+	sessions sessionQueued // 每个会话在普通队列中的请求数，只在设置了优先级时统计
+
+	pending atomic2.Int64 // 已经加入队列还没有返回的请求数，包括已经发送给redis的
+	shed    atomic2.Int64 // 因为队列已满直接返回错误的请求数
+
+	keys *hyperLogLog // 估算不同key的数量，只有开启了 SetKeyCardinality 才会创建
+
+	mu      sync.Mutex
+	version string // 后端的 redis_version，只有开启了版本检查才会获取
+	lastErr error  // 最近一次建立连接失败的原因，连接成功后清空
+	phase   int    // 最近一次建立连接失败的阶段
+
+	unhealthy atomic2.Bool // 和 lastErr 不为空相同，转发请求时不需要加锁
+
+	setupFailures [numSetupPhases]atomic2.Int64 // 每个阶段建立连接失败的次数
 }
 
 // 建立和后端redis-server的连接，等待请求
@@ -28,6 +50,12 @@ func NewBackendConn(addr, auth string) *BackendConn {
 		addr: addr, auth: auth,
 		input: make(chan *Request, 1024),
 	}
+	if PriorityEnabled() {
+		bc.urgent = make(chan *Request, 1024)
+	}
+	if keyCardinality {
+		bc.keys = newHyperLogLog()
+	}
 	go bc.Run()
 	return bc
 }
@@ -42,14 +70,14 @@ func (bc *BackendConn) Run() {
 			break
 		} else {
 			// 由于后端redis的连接出现错误，对等待中的剩余的请求全部返回错误信息
-			for i := len(bc.input); i != 0; i-- {
-				r := <-bc.input
+			for i := bc.queued(); i != 0; i-- {
+				r, _ := bc.next()
 				bc.setResponse(r, nil, err)
 			}
 		}
-		// 休眠 50ms 后重连
+		// 休眠 50ms 加上随机的抖动后重连
 		log.WarnErrorf(err, "backend conn [%p] to %s, restart [%d]", bc, bc.addr, k)
-		time.Sleep(time.Millisecond * 50)
+		time.Sleep(reconnectDelay())
 	}
 	log.Infof("backend conn [%p] to %s, stop and exit", bc, bc.addr)
 }
@@ -62,21 +90,89 @@ func (bc *BackendConn) Addr() string {
 func (bc *BackendConn) Close() {
 	bc.stop.Do(func() {
 		close(bc.input)
+		if bc.urgent != nil {
+			close(bc.urgent)
+		}
 	})
 }
 
-// 将redis请求加入等待队列
+var reconnect struct {
+	sync.Mutex
+	jitter time.Duration
+	rand   *rand.Rand
+}
+
+func init() {
+	reconnect.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// 后端恢复时，多个proxy的连接同时出错后会在同一时刻重连，重连之前在 50ms 的基础上随机多等待 [0, jitter) 的时间
+// 每个proxy使用不同的随机数种子，需要在创建连接之前设置
+func SetReconnectJitter(jitter time.Duration) {
+	reconnect.Lock()
+	reconnect.jitter = jitter
+	reconnect.Unlock()
+}
+
+func reconnectDelay() time.Duration {
+	reconnect.Lock()
+	defer reconnect.Unlock()
+	d := time.Millisecond * 50
+	if reconnect.jitter > 0 {
+		d += time.Duration(reconnect.rand.Int63n(int64(reconnect.jitter)))
+	}
+	return d
+}
+
+// 每个后端等待返回的请求数上限，0表示不限制，需要在开始处理请求之前设置
+var maxQueue int64
+
+func SetMaxBackendQueue(n int) {
+	maxQueue = int64(n)
+}
+
+// 将redis请求加入等待队列，队列已满时直接返回错误，避免后端变慢时请求在proxy中无限堆积
 func (bc *BackendConn) PushBack(r *Request) {
 	if r.Wait != nil {
 		r.Wait.Add(1)
 	}
+	if n := bc.pending.Incr(); maxQueue != 0 && n > maxQueue {
+		bc.shed.Incr()
+		bc.setResponse(r, redis.NewError([]byte(fmt.Sprintf("ERR backend %s overloaded, %d requests are pending", bc.addr, maxQueue))), nil)
+		return
+	}
+	if bc.urgent != nil {
+		bc.pushPriority(r)
+		return
+	}
 	bc.input <- r
 }
 
+// 是否估算每个后端的不同key的数量，每个后端占用 16KB，需要在创建连接之前设置
+var keyCardinality bool
+
+func SetKeyCardinality(enabled bool) {
+	keyCardinality = enabled
+}
+
+// 记录发送给这个后端的key
+func (bc *BackendConn) addKey(key []byte) {
+	if bc.keys != nil && len(key) != 0 {
+		bc.keys.add(key)
+	}
+}
+
+// 清空不同key数量的估算，重新开始统计
+func (bc *BackendConn) ResetKeys() {
+	if bc.keys != nil {
+		bc.keys.reset()
+	}
+}
+
 // 向redis发送心跳包
 func (bc *BackendConn) KeepAlive() bool {
 	// 如果当前有redis请求，则没必要发心跳包
-	if len(bc.input) != 0 {
+	if bc.queued() != 0 {
 		return false
 	}
 	r := &Request{
@@ -87,6 +183,7 @@ func (bc *BackendConn) KeepAlive() bool {
 
 	select {
 	case bc.input <- r:
+		bc.pending.Incr()
 		return true
 	default:
 		return false
@@ -95,10 +192,42 @@ func (bc *BackendConn) KeepAlive() bool {
 
 var ErrFailedRequest = errors.New("discard failed request")
 
+var ErrReplyTooLarge = errors.New("backend conn closed, a previous reply is too large")
+
+// 后端返回结果的大小上限，0表示不限制，需要在创建连接之前设置
+var maxReplySize int64
+
+func SetMaxReplySize(n int64) {
+	maxReplySize = n
+}
+
+// 建立和后端连接的函数，nil 时使用tcp连接，测试时可以替换成内存中的连接，需要在创建连接之前设置
+var dialer func(addr string, timeout time.Duration) (net.Conn, error)
+
+func SetDialer(fn func(addr string, timeout time.Duration) (net.Conn, error)) {
+	dialer = fn
+}
+
+func dialBackend(addr string) (*redis.Conn, error) {
+	if dialer == nil {
+		c, err := redis.DialTimeout(addr, 1024*512, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		backendBuffers.Apply(c.Sock)
+		return c, nil
+	}
+	sock, err := dialer(addr, time.Second)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.NewConnSize(sock, 1024*512), nil
+}
+
 // 循环等待新的 redis 请求，发往后端 redis-server，并异步地等待redis返回内容后填充 request 的resp字段
 func (bc *BackendConn) loopWriter() error {
 	// 如果连接close，ok会返回false
-	r, ok := <-bc.input
+	r, ok := bc.next()
 	if ok {
 		// 创建一个循环处理从redis返回内容的协程，向request中设置返回的信息
 		c, tasks, err := bc.newBackendReader()
@@ -115,7 +244,7 @@ func (bc *BackendConn) loopWriter() error {
 		}
 		for ok {
 			// 如果后续没有等待中的请求了，强制刷新缓冲区
-			var flush = len(bc.input) == 0
+			var flush = bc.queued() == 0
 			if bc.canForward(r) {
 				if err := p.Encode(r.Resp, flush); err != nil {
 					return bc.setResponse(r, nil, err)
@@ -129,27 +258,79 @@ func (bc *BackendConn) loopWriter() error {
 				bc.setResponse(r, nil, ErrFailedRequest)
 			}
 
-			r, ok = <-bc.input
+			r, ok = bc.next()
 		}
+		bc.drain(c)
 	}
 	return nil
 }
 
+// 后端被移除时等待已经发送的请求返回的时间上限，超过之后强制关闭连接，0表示一直等待
+var drainTimeout time.Duration
+
+// 需要在开始处理请求之前设置
+func SetDrainTimeout(d time.Duration) {
+	drainTimeout = d
+}
+
+// 连接被关闭之后，等待已经发送给redis的请求返回，而不是直接断开让它们失败
+func (bc *BackendConn) drain(c *redis.Conn) {
+	start := time.Now()
+	for bc.pending.Get() > 0 {
+		if drainTimeout != 0 && time.Since(start) > drainTimeout {
+			incrDrainForced()
+			log.Warnf("backend conn [%p] to %s, force closed after %s, %d requests are pending", bc, bc.addr, drainTimeout, bc.pending.Get())
+			c.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	incrDrained()
+}
+
+// 建立连接的阶段，失败时在日志和 /status 中说明是哪个阶段出错
+const (
+	setupConnect = iota // 建立tcp连接
+	setupAuth           // 发送 AUTH 验证密码
+	setupVerify         // 开启后端检查时的 PING 和 INFO
+	numSetupPhases
+)
+
+var setupPhaseNames = [numSetupPhases]string{"connect", "auth", "verify"}
+
+// 建立连接的时间超过这个值时输出日志
+const slowSetup = time.Millisecond * 200
+
 // 创建一个循环处理从redis返回内容的协程，向request中设置返回的信息
 func (bc *BackendConn) newBackendReader() (*redis.Conn, chan<- *Request, error) {
+	start := time.Now()
 	// 建立和redis的连接
-	c, err := redis.DialTimeout(bc.addr, 1024*512, time.Second)
+	c, err := dialBackend(bc.addr)
 	if err != nil {
+		bc.setupFailed(setupConnect, time.Since(start), err)
 		return nil, nil, err
 	}
 	// redis超时时间
 	c.ReaderTimeout = time.Minute
 	c.WriterTimeout = time.Minute
+	c.Reader.MaxSize = maxReplySize
+	c.Reader.Strict = strictReplies
 
 	if err := bc.verifyAuth(c); err != nil {
 		c.Close()
+		bc.setupFailed(setupAuth, time.Since(start), err)
+		return nil, nil, err
+	}
+	version, err := bc.verifyBackend(c)
+	if err != nil {
+		c.Close()
+		bc.setupFailed(setupVerify, time.Since(start), err)
 		return nil, nil, err
 	}
+	bc.setHealthy(version)
+	if d := time.Since(start); d > slowSetup {
+		log.Warnf("backend conn [%p] to %s, slow setup, took %s", bc, bc.addr, d)
+	}
 
 	tasks := make(chan *Request, 4096)
 	go func() {
@@ -157,6 +338,31 @@ func (bc *BackendConn) newBackendReader() (*redis.Conn, chan<- *Request, error)
 		for r := range tasks {
 			// 向redis发送命令
 			resp, err := c.Reader.Decode()
+			// 返回结果太大时放弃读取，只给这条请求返回错误，之后的请求会因为连接被关闭而失败
+			if errors.Equal(err, redis.ErrRespTooLarge) {
+				incrOversizedReplies(bc.addr)
+				log.Warnf("backend conn [%p] to %s, reply is larger than %d bytes, close connection", bc, bc.addr, maxReplySize)
+				bc.setResponse(r, redis.NewError([]byte(fmt.Sprintf("ERR reply is larger than %d bytes", maxReplySize))), nil)
+				c.Reader.Err = errors.Trace(ErrReplyTooLarge)
+				c.Close()
+				continue
+			}
+			if strictReplies {
+				if err != nil && isMalformedReply(err) {
+					incrMalformedReplies()
+					log.WarnErrorf(err, "backend conn [%p] to %s, malformed reply to %s, close connection", bc, bc.addr, r.OpStr)
+				}
+				if err == nil {
+					if x := checkReplyType(r.OpStr, resp); x != nil {
+						incrMismatchedReplies()
+						log.Warnf("backend conn [%p] to %s, reply %s to %s doesn't match, close connection", bc, bc.addr, resp.Type, r.OpStr)
+						bc.setResponse(r, x, nil)
+						c.Reader.Err = errors.Trace(ErrReplyMismatch)
+						c.Close()
+						continue
+					}
+				}
+			}
 			// 设置redis返回的状态和信息，因为redis是单线程的，命令都是顺序执行，所以这里的 request 和 response 可以一一对应上
 			bc.setResponse(r, resp, err)
 			if err != nil {
@@ -199,6 +405,127 @@ func (bc *BackendConn) verifyAuth(c *redis.Conn) error {
 	}
 }
 
+// 建立连接时检查后端是否是redis，需要在创建连接之前设置
+var verifyconf struct {
+	ping    bool // 检查 PING 是否返回 PONG
+	version bool // 通过 INFO server 获取 redis_version
+}
+
+func SetVerifyBackend(ping, version bool) {
+	verifyconf.ping, verifyconf.version = ping, version
+}
+
+var ErrNotRedis = errors.New("backend is not a redis server")
+
+// 后端地址配置错误时，比如指向了其他的服务，尽早返回明确的错误，而不是在转发请求时返回难以理解的错误
+func (bc *BackendConn) verifyBackend(c *redis.Conn) (string, error) {
+	if verifyconf.ping {
+		resp, err := bc.roundTrip(c, "PING")
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("%s, PING failed: %s", ErrNotRedis, err))
+		}
+		if !resp.IsString() || string(resp.Value) != "PONG" {
+			return "", errors.New(fmt.Sprintf("%s, PING replied %s %q", ErrNotRedis, resp.Type, log.Truncate(resp.Value)))
+		}
+	}
+	if !verifyconf.version {
+		return "", nil
+	}
+	resp, err := bc.roundTrip(c, "INFO", "server")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("%s, INFO failed: %s", ErrNotRedis, err))
+	}
+	if resp.IsBulkBytes() {
+		for _, line := range strings.Split(string(resp.Value), "\n") {
+			if strings.HasPrefix(line, "redis_version:") {
+				return strings.TrimSpace(line[len("redis_version:"):]), nil
+			}
+		}
+	}
+	return "", errors.New(fmt.Sprintf("%s, no redis_version in INFO", ErrNotRedis))
+}
+
+// 在建立连接时发送一条命令并等待返回
+func (bc *BackendConn) roundTrip(c *redis.Conn, args ...string) (*redis.Resp, error) {
+	var array = make([]*redis.Resp, len(args))
+	for i, arg := range args {
+		array[i] = redis.NewBulkBytes([]byte(arg))
+	}
+	if err := c.Writer.Encode(redis.NewArray(array), true); err != nil {
+		return nil, err
+	}
+	resp, err := c.Reader.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("nil response")
+	}
+	return resp, nil
+}
+
+func (bc *BackendConn) setHealthy(version string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.version = version
+	bc.lastErr = nil
+	bc.unhealthy.Set(false)
+}
+
+// 记录建立连接失败的阶段和耗时，连续相同的错误只输出一次日志
+func (bc *BackendConn) setupFailed(phase int, elapsed time.Duration, err error) {
+	bc.setupFailures[phase].Incr()
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.lastErr == nil || bc.phase != phase || bc.lastErr.Error() != err.Error() {
+		log.WarnErrorf(err, "backend conn [%p] to %s, unhealthy, %s failed after %s",
+			bc, bc.addr, setupPhaseNames[phase], elapsed)
+	}
+	bc.lastErr, bc.phase = err, phase
+	bc.unhealthy.Set(true)
+}
+
+// 后端的状态，用于 /status
+type BackendStatus struct {
+	Addr    string `json:"addr"`
+	Version string `json:"version,omitempty"`
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+	Pending int64  `json:"pending"`        // 等待返回的请求数
+	Shed    int64  `json:"shed"`           // 因为队列已满直接返回错误的请求数
+	Keys    *int64 `json:"keys,omitempty"` // 估算的不同key的数量，没有开启时为空
+
+	Phase         string           `json:"phase,omitempty"`          // 最近一次建立连接失败的阶段
+	SetupFailures map[string]int64 `json:"setup_failures,omitempty"` // 每个阶段建立连接失败的次数
+
+	Disabled bool `json:"disabled,omitempty"` // 被手动下线
+	Persist  bool `json:"persist,omitempty"`  // 重新加载路由之后仍然保持下线
+}
+
+func (bc *BackendConn) Status() *BackendStatus {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	x := &BackendStatus{Addr: bc.addr, Version: bc.version, Healthy: bc.lastErr == nil}
+	x.Pending, x.Shed = bc.pending.Get(), bc.shed.Get()
+	if bc.keys != nil {
+		n := bc.keys.count()
+		x.Keys = &n
+	}
+	if bc.lastErr != nil {
+		x.Reason = bc.lastErr.Error()
+		x.Phase = setupPhaseNames[bc.phase]
+	}
+	for i := range bc.setupFailures {
+		if n := bc.setupFailures[i].Get(); n != 0 {
+			if x.SetupFailures == nil {
+				x.SetupFailures = make(map[string]int64)
+			}
+			x.SetupFailures[setupPhaseNames[i]] = n
+		}
+	}
+	return x
+}
+
 func (bc *BackendConn) canForward(r *Request) bool {
 	if r.Failed != nil && r.Failed.Get() {
 		return false
@@ -209,10 +536,8 @@ func (bc *BackendConn) canForward(r *Request) bool {
 
 // 设置请求返回状态和信息
 func (bc *BackendConn) setResponse(r *Request, resp *redis.Resp, err error) error {
-	r.Response.Resp, r.Response.Err = resp, err
-	if err != nil && r.Failed != nil {
-		r.Failed.Set(true)
-	}
+	bc.pending.Decr()
+	r.setResponse(resp, err)
 	if r.Wait != nil {
 		r.Wait.Done()
 	}
@@ -222,17 +547,96 @@ func (bc *BackendConn) setResponse(r *Request, resp *redis.Resp, err error) erro
 	return err
 }
 
+// 每个后端地址的共享连接数，需要在创建连接之前设置
+var backendPoolSize = 1
+
+func SetBackendPoolSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	backendPoolSize = n
+}
+
+// 有多个共享连接时，默认同一个会话发往同一个后端的请求总是使用同一个连接，保证命令的先后顺序不变
+// 关闭之后请求轮流使用所有的连接，吞吐更高，但是同一个会话的命令在后端执行的顺序可能和发送的顺序不同
+var affinityOff bool
+
+func SetBackendAffinity(enabled bool) {
+	affinityOff = !enabled
+}
+
+// 同一个会话发往同一个后端的请求是否总是使用同一个连接
+// 只有一个共享连接，或者每个会话使用自己的后端连接时，总是成立的
+func BackendAffinity() bool {
+	return !affinityOff || backendPoolSize == 1 || dedicatedConns
+}
+
 // 连接复用对象
 type SharedBackendConn struct {
 	*BackendConn
 	mu sync.Mutex
 
+	extra []*BackendConn // backendPoolSize 大于1时额外的连接
+	next  atomic2.Int64
+
+	disabled atomic2.Bool // 被手动下线
+
+	lag      atomic2.Int64 // 作为slave时的复制延迟，单位秒，-1表示未知或者和master断开
+	lagCheck atomic2.Bool  // 正在通过 INFO 获取复制延迟
+	keyCount atomic2.Int64 // 作为master时最近一次 DBSIZE 返回的key的数量，-1表示未知，只在开启 randomkey_weighted 时获取
+	keyCheck atomic2.Bool  // 正在通过 DBSIZE 获取key的数量
+
 	refcnt int
 }
 
 // 创建连接复用对象
 func NewSharedBackendConn(addr, auth string) *SharedBackendConn {
-	return &SharedBackendConn{BackendConn: NewBackendConn(addr, auth), refcnt: 1}
+	s := &SharedBackendConn{BackendConn: NewBackendConn(addr, auth), refcnt: 1}
+	s.lag.Set(-1)
+	s.keyCount.Set(-1)
+	for i := 1; i < backendPoolSize; i++ {
+		s.extra = append(s.extra, NewBackendConn(addr, auth))
+	}
+	return s
+}
+
+// 手动下线之后发送给这个后端的命令返回的错误
+func (s *SharedBackendConn) rejectDisabled() *redis.Resp {
+	incrDisabledRejects()
+	return redis.NewError([]byte(fmt.Sprintf("ERR backend %s is disabled by proxy admin", s.addr)))
+}
+
+// 选择发送请求的连接，开启 backend_affinity 时按照会话的编号固定使用其中一个
+func (s *SharedBackendConn) conn(r *Request) *BackendConn {
+	if len(s.extra) == 0 {
+		return s.BackendConn
+	}
+	var i int64
+	if affinityOff {
+		i = s.next.Incr()
+	} else {
+		i = r.session
+	}
+	if n := uint64(i) % uint64(len(s.extra)+1); n != 0 {
+		return s.extra[n-1]
+	}
+	return s.BackendConn
+}
+
+// 共享的连接数
+func (s *SharedBackendConn) Conns() int {
+	return len(s.extra) + 1
+}
+
+func (s *SharedBackendConn) all() []*BackendConn {
+	return append([]*BackendConn{s.BackendConn}, s.extra...)
+}
+
+func (s *SharedBackendConn) KeepAlive() bool {
+	for _, bc := range s.extra {
+		bc.KeepAlive()
+	}
+	return s.BackendConn.KeepAlive()
 }
 
 func (s *SharedBackendConn) Close() bool {
@@ -243,6 +647,9 @@ func (s *SharedBackendConn) Close() bool {
 	}
 	if s.refcnt == 1 {
 		s.BackendConn.Close()
+		for _, bc := range s.extra {
+			bc.Close()
+		}
 	}
 	s.refcnt--
 	return s.refcnt == 0
@@ -6,12 +6,14 @@ package router
 import (
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
 )
 
 func TestBackend(t *testing.T) {
@@ -58,3 +60,305 @@ func TestBackend(t *testing.T) {
 	}
 	assert.Must(n == cap(reqc))
 }
+
+func TestBackendReplyTooLarge(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET":  redis.NewBulkBytes(make([]byte, 4096)),
+		"PING": redis.NewString([]byte("PONG")),
+	}))
+	defer l.Close()
+
+	SetMaxReplySize(1024)
+	defer SetMaxReplySize(0)
+	bc := NewBackendConn(addr, "")
+	defer bc.Close()
+
+	n := OversizedReplyCounts()[addr]
+	var reqs []*Request
+	for _, op := range []string{"GET", "PING"} {
+		r := &Request{Resp: newRequestResp(op, "k"), Wait: &sync.WaitGroup{}}
+		bc.PushBack(r)
+		reqs = append(reqs, r)
+	}
+	for _, r := range reqs {
+		r.Wait.Wait()
+	}
+	// 返回结果过大的请求收到错误信息，连接被关闭后的请求失败
+	r := reqs[0]
+	assert.Must(r.Response.Err == nil && r.Response.Resp.IsError())
+	assert.Must(OversizedReplyCounts()[addr] == n+1)
+
+	// 连接重建之后可以继续使用
+	r = &Request{Resp: newRequestResp("PING"), Wait: &sync.WaitGroup{}}
+	for i := 0; i < 100; i++ {
+		bc.PushBack(r)
+		if r.Wait.Wait(); r.Response.Err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "PONG")
+}
+
+func TestWarmup(t *testing.T) {
+	l1, good := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"PING": redis.NewString([]byte("PONG")),
+	}))
+	defer l1.Close()
+
+	// 接受连接但是不返回
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l2.Close()
+	go func() {
+		for {
+			c, err := l2.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	silent := l2.Addr().String()
+
+	l3, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	refused := l3.Addr().String()
+	l3.Close()
+
+	s := New()
+	defer s.Close()
+	for i, addr := range []string{good, silent, refused} {
+		assert.MustNoError(s.FillSlot(i, addr, "", false))
+	}
+
+	start := time.Now()
+	failed := s.Warmup(1, time.Millisecond*500)
+	assert.Must(time.Since(start) < time.Second*2)
+	assert.Must(len(failed) == 2 && failed[good] == nil)
+	assert.Must(failed[silent] == ErrWarmupTimeout)
+	assert.Must(failed[refused] != nil && failed[refused] != ErrWarmupTimeout)
+	// 预热不会改变连接池中的连接
+	assert.Must(s.BackendConns() == 3)
+}
+
+func TestWarmupPool(t *testing.T) {
+	var accepted atomic2.Int64
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Incr()
+			go func() {
+				defer c.Close()
+				conn := redis.NewConn(c)
+				for {
+					if _, err := conn.Reader.Decode(); err != nil {
+						return
+					}
+					if err := conn.Writer.Encode(redis.NewString([]byte("PONG")), true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	SetBackendPoolSize(3)
+	defer SetBackendPoolSize(1)
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, l.Addr().String(), "", false))
+
+	// 只预热其中的两个共享连接
+	assert.Must(len(s.Warmup(2, time.Second)) == 0)
+	assert.Must(accepted.Get() == 2)
+	assert.Must(len(s.Warmup(5, time.Second)) == 0)
+	assert.Must(accepted.Get() == 3)
+}
+
+func TestVerifyBackend(t *testing.T) {
+	SetVerifyBackend(true, true)
+	defer SetVerifyBackend(false, false)
+
+	l1, good := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"PING": redis.NewString([]byte("PONG")),
+		"INFO": redis.NewBulkBytes([]byte("# Server\r\nredis_version:2.8.13\r\nredis_mode:standalone\r\n")),
+		"GET":  redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l1.Close()
+	// 不是redis的服务
+	l2, bad := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"PING": redis.NewString([]byte("OK")),
+		"GET":  redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, good, "", false))
+	assert.MustNoError(s.FillSlot(1, bad, "", false))
+
+	get := func(addr string) *Request {
+		r := &Request{OpStr: "GET", Resp: newRequestResp("GET", "k"), Wait: &sync.WaitGroup{}}
+		bc := s.pool[addr]
+		bc.PushBack(r)
+		r.Wait.Wait()
+		return r
+	}
+	r := get(good)
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "v")
+	r = get(bad)
+	assert.Must(r.Response.Err != nil && strings.Contains(r.Response.Err.Error(), ErrNotRedis.Error()))
+
+	var status = make(map[string]*BackendStatus)
+	for _, x := range s.BackendStatus() {
+		status[x.Addr] = x
+	}
+	assert.Must(status[good].Healthy && status[good].Version == "2.8.13")
+	assert.Must(!status[bad].Healthy && strings.Contains(status[bad].Reason, `PING replied <string> "OK"`))
+	assert.Must(status[bad].Phase == "verify" && status[bad].SetupFailures["verify"] == 1)
+	assert.Must(status[good].Phase == "" && status[good].SetupFailures == nil)
+}
+
+func TestBackendSetupPhases(t *testing.T) {
+	l, wrongAuth := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"AUTH": redis.NewError([]byte("ERR invalid password")),
+	}))
+	defer l.Close()
+	refused := downAddr()
+
+	s := NewWithAuth("secret")
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, wrongAuth, "", false))
+	assert.MustNoError(s.FillSlot(1, refused, "", false))
+
+	for _, addr := range []string{wrongAuth, refused, refused} {
+		r := &Request{OpStr: "GET", Resp: newRequestResp("GET", "k"), Wait: &sync.WaitGroup{}}
+		s.pool[addr].PushBack(r)
+		r.Wait.Wait()
+		assert.Must(r.Response.Err != nil)
+	}
+
+	// 区分密码错误和连接失败
+	var status = make(map[string]*BackendStatus)
+	for _, x := range s.BackendStatus() {
+		status[x.Addr] = x
+	}
+	x := status[wrongAuth]
+	assert.Must(!x.Healthy && x.Phase == "auth" && strings.Contains(x.Reason, "ERR invalid password"))
+	assert.Must(len(x.SetupFailures) == 1 && x.SetupFailures["auth"] == 1)
+	x = status[refused]
+	assert.Must(!x.Healthy && x.Phase == "connect")
+	assert.Must(len(x.SetupFailures) == 1 && x.SetupFailures["connect"] == 2)
+}
+
+func TestBackendQueueMax(t *testing.T) {
+	SetMaxBackendQueue(2)
+	defer SetMaxBackendQueue(0)
+
+	// 接受连接但是不返回
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "")
+	defer bc.Close()
+
+	var reqs = make([]*Request, 3)
+	for i := range reqs {
+		reqs[i] = &Request{OpStr: "GET", Resp: newRequestResp("GET", "k"), Wait: &sync.WaitGroup{}}
+		bc.PushBack(reqs[i])
+	}
+	// 第三个请求直接返回错误
+	reqs[2].Wait.Wait()
+	resp := reqs[2].Response.Resp
+	assert.Must(reqs[2].Response.Err == nil && resp.IsError())
+	assert.Must(strings.Contains(string(resp.Value), "overloaded"))
+
+	x := bc.Status()
+	assert.Must(x.Pending == 2 && x.Shed == 1)
+}
+
+func TestReconnectJitter(t *testing.T) {
+	defer SetReconnectJitter(0)
+
+	assert.Must(reconnectDelay() == time.Millisecond*50)
+
+	SetReconnectJitter(time.Millisecond * 20)
+	var seen = make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		d := reconnectDelay()
+		assert.Must(d >= time.Millisecond*50 && d < time.Millisecond*70)
+		seen[d] = true
+	}
+	// 随机的抖动让每次重连的时间不同
+	assert.Must(len(seen) > 100)
+}
+
+// 每条请求等待 delay 之后回复 +OK
+func replyAfter(delay time.Duration) replyFunc {
+	ok := mustEncode(redis.NewString([]byte("OK")))
+	return func(req *redis.Resp) []byte {
+		time.Sleep(delay)
+		return ok
+	}
+}
+
+func TestBackendDrain(t *testing.T) {
+	SetDrainTimeout(time.Second * 5)
+	defer SetDrainTimeout(0)
+
+	l, addr := fakeServer(replyAfter(time.Millisecond * 200))
+	defer l.Close()
+	drained, forced := DrainedConnCounts()
+
+	// 关闭之前已经发送的请求正常返回
+	bc := NewBackendConn(addr, "")
+	r := &Request{Resp: newRequestResp("GET", "a"), Wait: &sync.WaitGroup{}}
+	bc.PushBack(r)
+	bc.Close()
+	r.Wait.Wait()
+	assert.Must(r.Response.Err == nil && string(r.Response.Resp.Value) == "OK")
+	for n, _ := DrainedConnCounts(); n == drained; n, _ = DrainedConnCounts() {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, m := DrainedConnCounts()
+	assert.Must(m == forced)
+}
+
+func TestBackendDrainTimeout(t *testing.T) {
+	SetDrainTimeout(time.Millisecond * 100)
+	defer SetDrainTimeout(0)
+
+	l, addr := fakeServer(replyAfter(time.Second * 5))
+	defer l.Close()
+	_, forced := DrainedConnCounts()
+
+	// 超过 drain timeout 之后强制关闭，没有返回的请求失败
+	bc := NewBackendConn(addr, "")
+	r := &Request{Resp: newRequestResp("GET", "a"), Wait: &sync.WaitGroup{}}
+	bc.PushBack(r)
+	start := time.Now()
+	bc.Close()
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil && time.Since(start) < time.Second*2)
+	_, m := DrainedConnCounts()
+	assert.Must(m == forced+1)
+}
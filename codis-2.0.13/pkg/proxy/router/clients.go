@@ -0,0 +1,87 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sort"
+	"time"
+)
+
+// 客户端连接的状态，和 redis 的 CLIENT LIST 类似，用于排查卡住的客户端
+// 只包含命令名，不包含命令的参数
+// proxy不支持事务、订阅和阻塞命令，所以没有这些状态
+type ClientInfo struct {
+	Id   int64  `json:"id"`
+	Addr string `json:"addr"`
+	Name string `json:"name,omitempty"` // CLIENT SETNAME 设置的名称
+	App  string `json:"app,omitempty"`  // PROXY APP 设置的应用名，或者客户端证书的 CN
+	Cert string `json:"cert,omitempty"` // 开启双向 TLS 时客户端证书的 subject
+
+	Age  int64 `json:"age"`  // seconds，连接建立的时间
+	Idle int64 `json:"idle"` // seconds，距离最近一条命令的时间
+
+	// idle: 等待新的命令
+	// reading: 读到了一部分命令，等待客户端发送剩下的部分
+	// waiting: 有命令在等待后端返回，Waiting 是其中最早的一条
+	State string `json:"state"`
+
+	Ops         int64  `json:"ops"`
+	LastCmd     string `json:"last_cmd,omitempty"`
+	LastCmdUnix int64  `json:"last_cmd_time,omitempty"`
+	Inflight    int64  `json:"inflight"`
+	Waiting     string `json:"waiting,omitempty"`
+	WaitingMs   int64  `json:"waiting_ms,omitempty"` // 最早的一条命令已经等待的时间
+	Pinned      bool   `json:"pinned,omitempty"`     // 通过 PROXY PIN MASTER 固定从master读取
+}
+
+func (s *Session) ClientInfo() *ClientInfo {
+	now := time.Now()
+	x := &ClientInfo{
+		Id:       s.id,
+		Addr:     s.Conn.Sock.RemoteAddr().String(),
+		Cert:     s.cert,
+		Age:      now.Unix() - s.CreateUnix,
+		Inflight: s.Inflight.Get(),
+	}
+	s.mu.Lock()
+	x.Name, x.App, x.Pinned = s.name, s.app, s.pinned
+	x.Ops, x.LastCmd, x.LastCmdUnix = s.Ops, s.lastop, s.LastOpUnix
+	if r := s.waiting; r != nil {
+		x.Waiting = r.OpStr
+		x.WaitingMs = (microseconds() - r.Start) / 1e3
+	}
+	s.mu.Unlock()
+
+	if x.LastCmdUnix != 0 {
+		x.Idle = now.Unix() - x.LastCmdUnix
+	} else {
+		x.Idle = x.Age
+	}
+	switch {
+	case x.Inflight != 0:
+		x.State = "waiting"
+	case s.idleAt.Get() != s.sock.nread.Get():
+		x.State = "reading"
+	default:
+		x.State = "idle"
+	}
+	return x
+}
+
+// 返回所有客户端连接的状态，按照连接的编号排序
+func ClientList() []*ClientInfo {
+	all := allSessions()
+	var list = make([]*ClientInfo, len(all))
+	for i, s := range all {
+		list[i] = s.ClientInfo()
+	}
+	sort.Sort(clientInfoList(list))
+	return list
+}
+
+type clientInfoList []*ClientInfo
+
+func (l clientInfoList) Len() int           { return len(l) }
+func (l clientInfoList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+func (l clientInfoList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
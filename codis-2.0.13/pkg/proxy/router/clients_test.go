@@ -0,0 +1,92 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestClientList(t *testing.T) {
+	release := make(chan struct{})
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		r.Wait.Add(1)
+		go func() {
+			defer r.Wait.Done()
+			<-release
+			r.Response.Resp = redis.NewString([]byte("OK"))
+		}()
+	}}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+	go s.Serve(d, 16)
+	c2.SetDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(c2)
+
+	find := func() *ClientInfo {
+		// 等待会话处理完已经发送的数据
+		time.Sleep(time.Millisecond * 50)
+		for _, x := range ClientList() {
+			if x.Id == s.id {
+				return x
+			}
+		}
+		t.Fatal("session is not listed")
+		return nil
+	}
+	x := find()
+	assert.Must(x.State == "idle" && x.Ops == 0 && x.LastCmd == "")
+
+	_, err := c2.Write([]byte("CLIENT SETNAME worker\r\n"))
+	assert.MustNoError(err)
+	line, err := r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "+OK\r\n")
+
+	// 只包含命令名，不包含参数
+	_, err = c2.Write([]byte("SET password secret\r\n"))
+	assert.MustNoError(err)
+	x = find()
+	assert.Must(x.State == "waiting" && x.Waiting == "SET" && x.Inflight == 1)
+	assert.Must(x.Name == "worker" && x.Ops == 2 && x.LastCmd == "SET" && x.LastCmdUnix != 0)
+	b, err := json.Marshal(x)
+	assert.MustNoError(err)
+	assert.Must(!strings.Contains(string(b), "secret"))
+
+	close(release)
+	line, err = r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "+OK\r\n")
+	x = find()
+	assert.Must(x.State == "idle" && x.Waiting == "" && x.Inflight == 0)
+
+	_, err = c2.Write([]byte("*2\r\n$3\r\nGET\r\n"))
+	assert.MustNoError(err)
+	x = find()
+	assert.Must(x.State == "reading" && x.LastCmd == "SET")
+}
+
+func TestSessionId(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1 := NewSessionSize(c1, "", 1024, 1800)
+	s2 := NewSessionSize(c2, "", 1024, 1800)
+	assert.Must(s1.Id() > 0 && s2.Id() > s1.Id())
+
+	// 日志中输出的会话信息包含连接的编号
+	var o struct {
+		Id int64 `json:"id"`
+	}
+	assert.MustNoError(json.Unmarshal([]byte(s2.String()), &o))
+	assert.Must(o.Id == s2.Id())
+}
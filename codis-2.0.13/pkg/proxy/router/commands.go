@@ -0,0 +1,461 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// 命令的属性
+type CommandFlag int
+
+const (
+	FlagWrite    CommandFlag = 1 << iota // 会修改数据
+	FlagReadOnly                         // 只读命令
+	FlagAdmin                            // 管理类命令
+)
+
+// 命令表中的一项，和redis的 redisCommandTable 保持一致
+type Command struct {
+	Name  string
+	Arity int // 参数个数（包括命令本身），负数表示至少 -Arity 个
+	Flags CommandFlag
+
+	FirstKey int // 第一个key的位置，0表示没有key
+	LastKey  int // 最后一个key的位置，负数表示从末尾开始计算
+	KeyStep  int // key之间的间隔
+}
+
+func (c *Command) IsWrite() bool {
+	return c.Flags&FlagWrite != 0
+}
+
+func (c *Command) IsReadOnly() bool {
+	return c.Flags&FlagReadOnly != 0
+}
+
+// 命令是否可以在后端出错时安全地重试
+// 只有只读命令可以重试，写命令即使是幂等的（比如 SET）也不会重试，避免重复执行
+func (c *Command) IsRetryable() bool {
+	return c.IsReadOnly() && !c.IsWrite()
+}
+
+var commands = make(map[string]*Command)
+
+func init() {
+	const (
+		w = FlagWrite
+		r = FlagReadOnly
+		a = FlagAdmin
+	)
+	for _, c := range []*Command{
+		{"GET", 2, r, 1, 1, 1},
+		{"GETEX", -2, w, 1, 1, 1},
+		{"GETDEL", 2, w, 1, 1, 1},
+		{"SET", -3, w, 1, 1, 1},
+		{"SETNX", 3, w, 1, 1, 1},
+		{"SETEX", 4, w, 1, 1, 1},
+		{"PSETEX", 4, w, 1, 1, 1},
+		{"APPEND", 3, w, 1, 1, 1},
+		{"STRLEN", 2, r, 1, 1, 1},
+		{"DEL", -2, w, 1, -1, 1},
+		{"EXISTS", -2, r, 1, -1, 1},
+		{"SETBIT", 4, w, 1, 1, 1},
+		{"GETBIT", 3, r, 1, 1, 1},
+		{"SETRANGE", 4, w, 1, 1, 1},
+		{"GETRANGE", 4, r, 1, 1, 1},
+		{"SUBSTR", 4, r, 1, 1, 1},
+		{"INCR", 2, w, 1, 1, 1},
+		{"DECR", 2, w, 1, 1, 1},
+		{"MGET", -2, r, 1, -1, 1},
+		{"RPUSH", -3, w, 1, 1, 1},
+		{"LPUSH", -3, w, 1, 1, 1},
+		{"RPUSHX", -3, w, 1, 1, 1},
+		{"LPUSHX", -3, w, 1, 1, 1},
+		{"LINSERT", 5, w, 1, 1, 1},
+		{"RPOP", -2, w, 1, 1, 1},
+		{"LPOP", -2, w, 1, 1, 1},
+		{"BRPOP", -3, w, 1, -2, 1},
+		{"BRPOPLPUSH", 4, w, 1, 2, 1},
+		{"BLPOP", -3, w, 1, -2, 1},
+		{"LLEN", 2, r, 1, 1, 1},
+		{"LINDEX", 3, r, 1, 1, 1},
+		{"LSET", 4, w, 1, 1, 1},
+		{"LRANGE", 4, r, 1, 1, 1},
+		{"LTRIM", 4, w, 1, 1, 1},
+		{"LREM", 4, w, 1, 1, 1},
+		{"RPOPLPUSH", 3, w, 1, 2, 1},
+		{"LMOVE", 5, w, 1, 2, 1},
+		{"BLMOVE", 6, w, 1, 2, 1},
+		{"LMPOP", -4, w, 0, 0, 0},
+		{"BLMPOP", -5, w, 0, 0, 0},
+		{"SADD", -3, w, 1, 1, 1},
+		{"SREM", -3, w, 1, 1, 1},
+		{"SMOVE", 4, w, 1, 2, 1},
+		{"SISMEMBER", 3, r, 1, 1, 1},
+		{"SCARD", 2, r, 1, 1, 1},
+		{"SPOP", -2, w, 1, 1, 1},
+		{"SRANDMEMBER", -2, r, 1, 1, 1},
+		{"SINTER", -2, r, 1, -1, 1},
+		{"SINTERSTORE", -3, w, 1, -1, 1},
+		{"SUNION", -2, r, 1, -1, 1},
+		{"SUNIONSTORE", -3, w, 1, -1, 1},
+		{"SDIFF", -2, r, 1, -1, 1},
+		{"SDIFFSTORE", -3, w, 1, -1, 1},
+		{"SMEMBERS", 2, r, 1, 1, 1},
+		{"SMISMEMBER", -3, r, 1, 1, 1},
+		{"SINTERCARD", -3, r, 0, 0, 0},
+		{"SSCAN", -3, r, 1, 1, 1},
+		{"ZADD", -4, w, 1, 1, 1},
+		{"ZINCRBY", 4, w, 1, 1, 1},
+		{"ZREM", -3, w, 1, 1, 1},
+		{"ZREMRANGEBYSCORE", 4, w, 1, 1, 1},
+		{"ZREMRANGEBYRANK", 4, w, 1, 1, 1},
+		{"ZREMRANGEBYLEX", 4, w, 1, 1, 1},
+		{"ZUNIONSTORE", -4, w, 0, 0, 0},
+		{"ZINTERSTORE", -4, w, 0, 0, 0},
+		{"ZDIFFSTORE", -4, w, 0, 0, 0},
+		{"ZUNION", -3, r, 0, 0, 0},
+		{"ZINTER", -3, r, 0, 0, 0},
+		{"ZDIFF", -3, r, 0, 0, 0},
+		{"ZINTERCARD", -3, r, 0, 0, 0},
+		{"ZMPOP", -4, w, 0, 0, 0},
+		{"BZMPOP", -5, w, 0, 0, 0},
+		{"ZRANGESTORE", -5, w, 1, 2, 1},
+		{"ZRANGE", -4, r, 1, 1, 1},
+		{"ZRANGEBYSCORE", -4, r, 1, 1, 1},
+		{"ZREVRANGEBYSCORE", -4, r, 1, 1, 1},
+		{"ZRANGEBYLEX", -4, r, 1, 1, 1},
+		{"ZREVRANGEBYLEX", -4, r, 1, 1, 1},
+		{"ZCOUNT", 4, r, 1, 1, 1},
+		{"ZLEXCOUNT", 4, r, 1, 1, 1},
+		{"ZREVRANGE", -4, r, 1, 1, 1},
+		{"ZCARD", 2, r, 1, 1, 1},
+		{"ZSCORE", 3, r, 1, 1, 1},
+		{"ZRANK", -3, r, 1, 1, 1},
+		{"ZREVRANK", -3, r, 1, 1, 1},
+		{"ZSCAN", -3, r, 1, 1, 1},
+		{"HSET", -4, w, 1, 1, 1},
+		{"HSETNX", 4, w, 1, 1, 1},
+		{"HGET", 3, r, 1, 1, 1},
+		{"HMSET", -4, w, 1, 1, 1},
+		{"HMGET", -3, r, 1, 1, 1},
+		{"HINCRBY", 4, w, 1, 1, 1},
+		{"HINCRBYFLOAT", 4, w, 1, 1, 1},
+		{"HDEL", -3, w, 1, 1, 1},
+		{"HLEN", 2, r, 1, 1, 1},
+		{"HSTRLEN", 3, r, 1, 1, 1},
+		{"HKEYS", 2, r, 1, 1, 1},
+		{"HVALS", 2, r, 1, 1, 1},
+		{"HGETALL", 2, r, 1, 1, 1},
+		{"HEXISTS", 3, r, 1, 1, 1},
+		{"HSCAN", -3, r, 1, 1, 1},
+		{"INCRBY", 3, w, 1, 1, 1},
+		{"DECRBY", 3, w, 1, 1, 1},
+		{"INCRBYFLOAT", 3, w, 1, 1, 1},
+		{"GETSET", 3, w, 1, 1, 1},
+		{"MSET", -3, w, 1, -1, 2},
+		{"MSETNX", -3, w, 1, -1, 2},
+		{"RANDOMKEY", 1, r, 0, 0, 0},
+		{"SELECT", 2, 0, 0, 0, 0},
+		{"MOVE", 3, w, 1, 1, 1},
+		{"RENAME", 3, w, 1, 2, 1},
+		{"RENAMENX", 3, w, 1, 2, 1},
+		{"EXPIRE", -3, w, 1, 1, 1},
+		{"EXPIREAT", -3, w, 1, 1, 1},
+		{"PEXPIRE", -3, w, 1, 1, 1},
+		{"PEXPIREAT", -3, w, 1, 1, 1},
+		{"KEYS", 2, r, 0, 0, 0},
+		{"SCAN", -2, r, 0, 0, 0},
+		{"DBSIZE", 1, r, 0, 0, 0},
+		{"AUTH", -2, 0, 0, 0, 0},
+		{"HELLO", -1, 0, 0, 0, 0},
+		{"PING", -1, 0, 0, 0, 0},
+		{"ECHO", 2, 0, 0, 0, 0},
+		{"SAVE", 1, a, 0, 0, 0},
+		{"BGSAVE", -1, a, 0, 0, 0},
+		{"BGREWRITEAOF", 1, a, 0, 0, 0},
+		{"SHUTDOWN", -1, a, 0, 0, 0},
+		{"LASTSAVE", 1, 0, 0, 0, 0},
+		{"TYPE", 2, r, 1, 1, 1},
+		{"MULTI", 1, 0, 0, 0, 0},
+		{"EXEC", 1, 0, 0, 0, 0},
+		{"DISCARD", 1, 0, 0, 0, 0},
+		{"SYNC", 1, a, 0, 0, 0},
+		{"FLUSHDB", -1, w, 0, 0, 0},
+		{"FLUSHALL", -1, w, 0, 0, 0},
+		{"SORT", -2, w, 1, 1, 1},
+		{"INFO", -1, 0, 0, 0, 0},
+		{"MONITOR", 1, a, 0, 0, 0},
+		{"TTL", 2, r, 1, 1, 1},
+		{"PTTL", 2, r, 1, 1, 1},
+		{"EXPIRETIME", 2, r, 1, 1, 1},
+		{"PEXPIRETIME", 2, r, 1, 1, 1},
+		{"PERSIST", 2, w, 1, 1, 1},
+		{"SLAVEOF", 3, a, 0, 0, 0},
+		{"DEBUG", -1, a, 0, 0, 0},
+		{"CONFIG", -2, a, 0, 0, 0},
+		{"SUBSCRIBE", -2, 0, 0, 0, 0},
+		{"UNSUBSCRIBE", -1, 0, 0, 0, 0},
+		{"PSUBSCRIBE", -2, 0, 0, 0, 0},
+		{"PUNSUBSCRIBE", -1, 0, 0, 0, 0},
+		{"PUBLISH", 3, 0, 0, 0, 0},
+		{"WATCH", -2, 0, 1, -1, 1},
+		{"UNWATCH", 1, 0, 0, 0, 0},
+		{"RESTORE", -4, w, 1, 1, 1},
+		{"MIGRATE", -6, w, 0, 0, 0},
+		{"DUMP", 2, r, 1, 1, 1},
+		{"OBJECT", -2, r, 2, 2, 1},
+		{"CLIENT", -2, a, 0, 0, 0},
+		{"EVAL", -3, w, 0, 0, 0},
+		{"EVALSHA", -3, w, 0, 0, 0},
+		{"SLOWLOG", -2, a, 0, 0, 0},
+		{"SCRIPT", -2, 0, 0, 0, 0},
+		{"TIME", 1, 0, 0, 0, 0},
+		{"WAITAOF", 4, 0, 0, 0, 0},
+		{"BITOP", -4, w, 2, -1, 1},
+		{"BITCOUNT", -2, r, 1, 1, 1},
+		{"BITPOS", -3, r, 1, 1, 1},
+		{"PFADD", -2, w, 1, 1, 1},
+		{"PFCOUNT", -2, r, 1, -1, 1},
+		{"PFMERGE", -2, w, 1, -1, 1},
+		{"SLOTSINFO", -1, a, 0, 0, 0},
+		{"SLOTSDEL", -2, a, 0, 0, 0},
+		{"SLOTSMGRTSLOT", 5, a, 0, 0, 0},
+		{"SLOTSMGRTONE", 5, a, 0, 0, 0},
+		{"SLOTSMGRTTAGSLOT", 5, a, 0, 0, 0},
+		{"SLOTSMGRTTAGONE", 5, a, 0, 0, 0},
+		{"SLOTSCHECK", 1, a, 0, 0, 0},
+	} {
+		commands[c.Name] = c
+	}
+}
+
+// 获取命令表中的命令，不区分大小写，不存在时返回nil
+func GetCommand(opstr string) *Command {
+	return commands[strings.ToUpper(opstr)]
+}
+
+// 检查参数个数（包括命令本身）是否符合命令表，命令表中不存在的命令不检查
+func checkArity(opstr string, nargs int) bool {
+	c := commands[opstr]
+	switch {
+	case c == nil:
+		return true
+	case c.Arity < 0:
+		return nargs >= -c.Arity
+	default:
+		return nargs == c.Arity
+	}
+}
+
+// 按照命令表中key的位置计算 nargs 个参数中key的范围和间隔，没有key时 last 小于 first
+// countKeys 和 commandKeys 都通过这里计算，命令表中不存在的命令没有key
+func (c *Command) keyRange(nargs int) (first, last, step int) {
+	if c == nil || c.FirstKey <= 0 || c.KeyStep <= 0 {
+		return 1, 0, 1
+	}
+	last = c.LastKey
+	if last < 0 {
+		last += nargs
+	}
+	if last >= nargs {
+		last = nargs - 1
+	}
+	return c.FirstKey, last, c.KeyStep
+}
+
+// 按照命令表中key的位置计算命令的key的个数，命令表中不存在的命令返回0
+func countKeys(opstr string, nargs int) int {
+	first, last, step := commands[opstr].keyRange(nargs)
+	if last < first {
+		return 0
+	}
+	return (last-first)/step + 1
+}
+
+// 由参数指定key的个数的命令，值是key的个数所在的位置，key紧跟在后面
+var numKeysAt = map[string]int{
+	"EVAL": 2, "EVALSHA": 2,
+	"ZINTERSTORE": 2, "ZUNIONSTORE": 2, "ZDIFFSTORE": 2,
+	"ZINTER": 1, "ZUNION": 1, "ZDIFF": 1, "ZINTERCARD": 1, "SINTERCARD": 1,
+	"LMPOP": 1, "ZMPOP": 1, "BLMPOP": 2, "BZMPOP": 2,
+}
+
+// 命令的全部key，包括 EVAL 这样由参数指定key的个数的命令
+// 命令表中不存在的命令和转发时一样把第一个参数当作key
+func requestKeys(opstr string, resp *redis.Resp) [][]byte {
+	var keys [][]byte
+	eachKey(opstr, resp, func(key []byte) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// 按顺序对 requestKeys 中的每个key调用 fn，不需要分配内存
+// 由参数指定key的个数的命令，个数不合法时把后面的参数都当作key
+func eachKey(opstr string, resp *redis.Resp, fn func(key []byte)) {
+	var args = resp.Array
+	if i, ok := numKeysAt[opstr]; ok {
+		switch opstr {
+		case "ZINTERSTORE", "ZUNIONSTORE", "ZDIFFSTORE":
+			if len(args) < 2 {
+				return
+			}
+			fn(args[1].Value)
+		}
+		if len(args) <= i {
+			return
+		}
+		var rest = args[i+1:]
+		if n, ok := parseNumKeys(args, i); ok {
+			rest = rest[:n]
+		}
+		for _, x := range rest {
+			fn(x.Value)
+		}
+		return
+	}
+	c := commands[opstr]
+	if c == nil {
+		if len(args) > 1 {
+			fn(args[1].Value)
+		}
+		return
+	}
+	first, last, step := c.keyRange(len(args))
+	for i := first; i <= last; i += step {
+		fn(args[i].Value)
+	}
+}
+
+func parseNumKeys(args []*redis.Resp, i int) (int, bool) {
+	if len(args) <= i {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(args[i].Value))
+	if err != nil || n < 0 || n > len(args)-i-1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// 较新的多key命令，key不在同一个slot时和 redis cluster 一样返回 CROSSSLOT
+// 原有的多key命令仍然按第一个key转发，由使用者通过 hash tag 保证在同一个slot
+var crossSlotChecked = map[string]bool{
+	"SINTERCARD": true, "ZINTER": true, "ZUNION": true, "ZDIFF": true, "ZINTERCARD": true, "ZDIFFSTORE": true,
+	"LMPOP": true, "ZMPOP": true, "LMOVE": true, "ZRANGESTORE": true,
+}
+
+var replyCrossSlot = redis.NewStatic(redis.NewError([]byte("CROSSSLOT Keys in request don't hash to the same slot")))
+
+// key的个数不合法时不检查，由后端返回错误
+func isCrossSlot(opstr string, resp *redis.Resp) bool {
+	if !crossSlotChecked[opstr] {
+		return false
+	}
+	if i, ok := numKeysAt[opstr]; ok {
+		if _, ok := parseNumKeys(resp.Array, i); !ok {
+			return false
+		}
+	}
+	keys := requestKeys(opstr, resp)
+	for _, key := range keys {
+		if hashSlot(key) != hashSlot(keys[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 命令是否可以发送给slave执行
+func isReadOnly(opstr string) bool {
+	if c := commands[opstr]; c != nil {
+		return c.IsReadOnly() && !c.IsWrite()
+	}
+	return false
+}
+
+// 命令是否可以在后端出错时安全地重试，命令表中不存在的命令不会重试
+func isRetryable(opstr string) bool {
+	if c := commands[opstr]; c != nil {
+		return c.IsRetryable()
+	}
+	return false
+}
+
+// 由proxy自己处理或者需要特殊处理的命令，和 Session.handleRequest 保持一致
+var commandHandling = map[string]string{
+	"AUTH": "proxy", "HELLO": "proxy", "SELECT": "proxy", "PING": "proxy",
+	"CLIENT": "proxy", "INFO": "proxy", "SHUTDOWN": "proxy", "TIME": "proxy",
+	"MGET": "split", "MSET": "split", "DEL": "split", "EXISTS": "split",
+	"DBSIZE": "broadcast", "FLUSHALL": "broadcast", "RANDOMKEY": "broadcast",
+	"WAITAOF": "last-write",
+}
+
+// 命令表中的一项，以及配置对它的影响，用于 /commands 查看proxy如何处理每个命令
+type CommandInfo struct {
+	Name     string   `json:"name"`
+	Arity    int      `json:"arity"`
+	Flags    []string `json:"flags"`
+	FirstKey int      `json:"first_key"`
+	LastKey  int      `json:"last_key"`
+	KeyStep  int      `json:"key_step"`
+
+	// proxy: 由proxy回复，split: 按key拆分后发送给多个后端，broadcast: 发送给所有后端
+	// forward: 按第一个参数（EVAL 之类是第三个）所在的slot转发给一个后端，last-write: 按会话最近一次写入的key转发
+	Handling  string `json:"handling"`
+	ReadOnly  bool   `json:"readonly"`  // 开启 backend_read_replica 时可以发送给slave
+	Retryable bool   `json:"retryable"` // 开启 backend_retry_reads 时可以重试
+	Allowed   bool   `json:"allowed"`   // 不在黑名单中，或者通过 allow_commands 允许执行
+
+	// 通过 rename_commands 重命名后客户端使用的名字，Disabled 表示原来的名字不能再使用
+	Renamed  string `json:"renamed,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// 返回完整的命令表，包括黑名单和重命名的配置，按命令名排序
+func CommandTable() []*CommandInfo {
+	var rename = make(map[string]string, len(renamed))
+	for k, v := range renamed {
+		rename[v] = k
+	}
+	var list = make([]*CommandInfo, 0, len(commands))
+	for _, c := range commands {
+		x := &CommandInfo{
+			Name: c.Name, Arity: c.Arity, Flags: []string{},
+			FirstKey: c.FirstKey, LastKey: c.LastKey, KeyStep: c.KeyStep,
+			Handling:  commandHandling[c.Name],
+			ReadOnly:  isReadOnly(c.Name),
+			Retryable: c.IsRetryable(),
+			Allowed:   !isNotAllowed(c.Name),
+			Renamed:   rename[c.Name],
+			Disabled:  disabled[c.Name],
+		}
+		if x.Handling == "" || (c.Name == "TIME" && !localTime) {
+			x.Handling = "forward"
+		}
+		for _, f := range []struct {
+			flag CommandFlag
+			name string
+		}{{FlagWrite, "write"}, {FlagReadOnly, "readonly"}, {FlagAdmin, "admin"}} {
+			if c.Flags&f.flag != 0 {
+				x.Flags = append(x.Flags, f.name)
+			}
+		}
+		list = append(list, x)
+	}
+	sort.Sort(commandInfoList(list))
+	return list
+}
+
+type commandInfoList []*CommandInfo
+
+func (l commandInfoList) Len() int           { return len(l) }
+func (l commandInfoList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l commandInfoList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
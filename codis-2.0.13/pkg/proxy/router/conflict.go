@@ -0,0 +1,31 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// 标记slot的路由和其它group冲突，比如所在group的master同时是另一个group的master
+// 标记之后发往这个slot的命令直接返回错误，避免按照不一致的路由写到错误的后端
+func (s *Router) SetSlotConflict(i int, conflict bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isValidSlot(i) {
+		s.slots[i].conflict.Set(conflict)
+	}
+}
+
+func (s *Router) IsConflictSlot(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isValidSlot(i) && s.slots[i].conflict.Get()
+}
+
+func (s *Slot) rejectConflict() *redis.Resp {
+	incrConflictRejects()
+	return redis.NewError([]byte(fmt.Sprintf("ERR slot %d has conflicting routes, rejected by proxy", s.id)))
+}
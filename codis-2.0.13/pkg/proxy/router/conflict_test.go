@@ -0,0 +1,34 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestSlotConflict(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{"GET": redis.NewBulkBytes([]byte("b"))}))
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, addr, "", false))
+
+	s.SetSlotConflict(id, true)
+	n := ConflictRejectCounts()
+	resp, err := tryRequest(s, false, "GET", "a")
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && string(resp.Value) == fmt.Sprintf("ERR slot %d has conflicting routes, rejected by proxy", id))
+	assert.Must(ConflictRejectCounts() == n+1)
+
+	s.SetSlotConflict(id, false)
+	resp, err = tryRequest(s, false, "GET", "a")
+	assert.MustNoError(err)
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "b")
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+// 诊断用的缓冲区，比如最近失败的命令和等待导出的 span，它们共享 diagnostics_memory_budget
+// 实现时不能在持有自己的锁的时候调用 DiagAlloc，否则超过预算时调用 Evict 会死锁
+type DiagBuffer interface {
+	// 最早的一条记录的时间，单位 us，没有记录时返回 false
+	Oldest() (int64, bool)
+	// 丢弃最早的一条记录，返回释放的字节数
+	Evict() int64
+}
+
+var diagmem struct {
+	budget  int64 // 0表示不限制
+	used    atomic2.Int64
+	evicted atomic2.Int64
+
+	mu      sync.Mutex
+	buffers []DiagBuffer
+}
+
+// 设置所有诊断缓冲区的内存预算，同时清空注册的缓冲区，只保留最近失败的命令，需要在开始处理请求之前设置
+func SetDiagnosticsBudget(n int64) {
+	diagmem.mu.Lock()
+	defer diagmem.mu.Unlock()
+	diagmem.budget = n
+	diagmem.buffers = []DiagBuffer{failureBuffer{}}
+	diagmem.evicted.Set(0)
+}
+
+func RegisterDiagBuffer(b DiagBuffer) {
+	diagmem.mu.Lock()
+	defer diagmem.mu.Unlock()
+	diagmem.buffers = append(diagmem.buffers, b)
+}
+
+// 缓冲区增加了 n 字节的记录，超过预算时从所有缓冲区中按时间顺序丢弃最早的记录
+func DiagAlloc(n int64) {
+	if diagmem.used.Add(n) <= diagmem.budget || diagmem.budget == 0 {
+		return
+	}
+	diagmem.mu.Lock()
+	defer diagmem.mu.Unlock()
+	for diagmem.used.Get() > diagmem.budget {
+		var oldest DiagBuffer
+		var since int64
+		for _, b := range diagmem.buffers {
+			if t, ok := b.Oldest(); ok && (oldest == nil || t < since) {
+				oldest, since = b, t
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		diagmem.used.Sub(oldest.Evict())
+		diagmem.evicted.Incr()
+	}
+}
+
+// 缓冲区正常移除了 n 字节的记录
+func DiagFree(n int64) {
+	diagmem.used.Sub(n)
+}
+
+// 所有诊断缓冲区估算的内存占用
+func DiagnosticsMemory() int64 {
+	return diagmem.used.Get()
+}
+
+// 因为超过预算被丢弃的记录数
+func DiagEvictedCounts() int64 {
+	return diagmem.evicted.Get()
+}
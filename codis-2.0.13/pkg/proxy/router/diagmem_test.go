@@ -0,0 +1,72 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// 每条记录占用 100 字节
+type fakeDiagBuffer struct {
+	times []int64
+}
+
+func (b *fakeDiagBuffer) add(t int64) {
+	b.times = append(b.times, t)
+	DiagAlloc(100)
+}
+
+func (b *fakeDiagBuffer) Oldest() (int64, bool) {
+	if len(b.times) == 0 {
+		return 0, false
+	}
+	return b.times[0], true
+}
+
+func (b *fakeDiagBuffer) Evict() int64 {
+	b.times = b.times[1:]
+	return 100
+}
+
+func TestDiagnosticsBudget(t *testing.T) {
+	SetFailureLogSize(16)
+	defer SetFailureLogSize(0)
+	s := &Session{}
+	fail := func(key string) {
+		s.recordFailure(&Request{OpStr: "GET", Resp: newRequestResp("GET", key)}, "ERR x")
+	}
+	fail("0")
+	size := DiagnosticsMemory()
+	assert.Must(size > 0)
+	assert.Must(ResetFailures() == 1 && DiagnosticsMemory() == 0)
+
+	SetDiagnosticsBudget(size*4 + 50)
+	defer SetDiagnosticsBudget(0)
+	b := &fakeDiagBuffer{}
+	RegisterDiagBuffer(b)
+
+	// 先丢弃另一个缓冲区中更早的记录
+	b.add(microseconds() - 1)
+	for i := 0; i < 3; i++ {
+		fail(strconv.Itoa(i))
+	}
+	assert.Must(DiagnosticsMemory() == size*3+100 && DiagEvictedCounts() == 0)
+	fail("3")
+	assert.Must(len(b.times) == 0 && DiagEvictedCounts() == 1)
+	assert.Must(len(Failures()) == 4 && DiagnosticsMemory() == size*4)
+
+	// 然后按时间顺序丢弃最早失败的命令
+	b.add(microseconds())
+	list := Failures()
+	assert.Must(len(list) == 3 && list[0].Key == "1" && list[2].Key == "3")
+	assert.Must(len(b.times) == 1 && DiagEvictedCounts() == 2)
+	assert.Must(DiagnosticsMemory() == size*3+100)
+
+	// 清空时释放内存
+	ResetFailures()
+	assert.Must(DiagnosticsMemory() == 100)
+}
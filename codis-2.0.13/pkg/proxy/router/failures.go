@@ -0,0 +1,190 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 最近失败的命令，用于事后排查，只记录命令名和第一个key，不记录其它参数
+type Failure struct {
+	Time    string `json:"time"`
+	Session int64  `json:"session"`
+	Cmd     string `json:"cmd"`
+	Key     string `json:"key,omitempty"`
+	Backend string `json:"backend,omitempty"` // 由proxy拆分或者直接回复的命令为空
+	Error   string `json:"error"`
+
+	at   int64 // 单位 us
+	size int64 // 估算的内存占用
+}
+
+// 除了字符串之外一条记录占用的内存
+const failureOverhead = 128
+
+var failures struct {
+	mu    sync.Mutex
+	ring  []*Failure // 为空表示不记录
+	next  int
+	count int   // ring 中的记录数，最早的一条在 next-count 的位置
+	total int64 // 清空之后记录的失败命令数，包括已经被覆盖的
+}
+
+// 保留最近 n 条失败的命令，0表示不记录，需要在开始处理请求之前设置
+func SetFailureLogSize(n int) {
+	failures.mu.Lock()
+	freed := clearFailures()
+	failures.ring = make([]*Failure, n)
+	failures.total = 0
+	failures.mu.Unlock()
+	DiagFree(freed)
+}
+
+// 清空所有记录，返回释放的内存，需要持有 failures.mu
+func clearFailures() int64 {
+	var freed int64
+	for i, x := range failures.ring {
+		if x != nil {
+			freed += x.size
+			failures.ring[i] = nil
+		}
+	}
+	failures.next, failures.count = 0, 0
+	return freed
+}
+
+// 记录返回错误或者转发失败的命令
+func (s *Session) recordFailure(r *Request, reason string) {
+	cmdstats.failed.Incr()
+	failures.mu.Lock()
+	if len(failures.ring) == 0 {
+		failures.mu.Unlock()
+		return
+	}
+	x := &Failure{
+		Time:    time.Now().Format("2006-01-02 15:04:05.000"),
+		Session: s.id,
+		Cmd:     r.OpStr,
+		Backend: r.backend,
+		Error:   log.Truncate([]byte(reason)),
+		at:      microseconds(),
+	}
+	if key := failureKey(r.OpStr, r.Resp); key != nil {
+		x.Key = log.Truncate(key)
+	}
+	x.size = failureOverhead + int64(len(x.Time)+len(x.Cmd)+len(x.Key)+len(x.Backend)+len(x.Error))
+
+	// ring 满了的时候覆盖最早的一条
+	var freed int64
+	if old := failures.ring[failures.next]; old != nil {
+		freed = old.size
+	} else {
+		failures.count++
+	}
+	failures.ring[failures.next] = x
+	failures.next = (failures.next + 1) % len(failures.ring)
+	failures.total++
+	failures.mu.Unlock()
+
+	DiagFree(freed)
+	DiagAlloc(x.size)
+}
+
+// 开启后，后端出错或者返回错误时在日志中记录发送命令的客户端，需要在开始处理请求之前设置
+var logFailures bool
+
+func SetLogFailures(enable bool) {
+	logFailures = enable
+}
+
+// 只记录命令名，不记录key和其它参数，错误回复只记录 ERR、WRONGTYPE 这样的类型，因为 redis 的错误信息中可能带有参数
+func (s *Session) logFailure(r *Request, reason string, reply bool) {
+	if !logFailures {
+		return
+	}
+	if reply {
+		reason = errorPrefix(reason)
+	}
+	log.Warnf("session [%d] %s failed, client = %s, backend = %s, error = %s",
+		s.id, r.OpStr, s.Conn.Sock.RemoteAddr(), r.backend, log.Truncate([]byte(reason)))
+}
+
+func errorPrefix(reason string) string {
+	if i := strings.IndexByte(reason, ' '); i >= 0 {
+		return reason[:i]
+	}
+	return reason
+}
+
+// 只有命令表中有key的命令才记录key，避免记录 AUTH 的密码之类的参数
+func failureKey(opstr string, resp *redis.Resp) []byte {
+	c := GetCommand(opstr)
+	if c == nil || c.FirstKey <= 0 || c.FirstKey >= len(resp.Array) {
+		return nil
+	}
+	return resp.Array[c.FirstKey].Value
+}
+
+func oldestFailure() int {
+	n := len(failures.ring)
+	return (failures.next - failures.count + n) % n
+}
+
+// 按时间顺序返回最近失败的命令
+func Failures() []*Failure {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	var list = []*Failure{}
+	for i := 0; i < failures.count; i++ {
+		list = append(list, failures.ring[(oldestFailure()+i)%len(failures.ring)])
+	}
+	return list
+}
+
+// 清空记录，返回清空前记录的失败命令数
+func ResetFailures() int64 {
+	failures.mu.Lock()
+	n := failures.total
+	freed := clearFailures()
+	failures.total = 0
+	failures.mu.Unlock()
+	DiagFree(freed)
+	return n
+}
+
+func FailureCounts() int64 {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	return failures.total
+}
+
+// 最近失败的命令作为诊断缓冲区，超过内存预算时丢弃最早的记录
+type failureBuffer struct{}
+
+func (failureBuffer) Oldest() (int64, bool) {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	if failures.count == 0 {
+		return 0, false
+	}
+	return failures.ring[oldestFailure()].at, true
+}
+
+func (failureBuffer) Evict() int64 {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	if failures.count == 0 {
+		return 0
+	}
+	i := oldestFailure()
+	x := failures.ring[i]
+	failures.ring[i] = nil
+	failures.count--
+	return x.size
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestFailures(t *testing.T) {
+	SetFailureLogSize(2)
+	defer SetFailureLogSize(0)
+
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"INCR": redis.NewError([]byte("ERR value is not an integer or out of range")),
+	}))
+	defer l.Close()
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("a")), addr, "", false))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	session := NewSessionSize(c1, "secret", 1024, 1800)
+	session.CheckArity = true
+	do := func(args ...string) *redis.Resp {
+		r, err := session.handleRequest(newRequestResp(args...), s)
+		assert.MustNoError(err)
+		resp, err := session.handleResponse(r)
+		assert.MustNoError(err)
+		return resp
+	}
+
+	// 密码不会被记录
+	assert.Must(do("AUTH", "wrong").IsError())
+	list := Failures()
+	assert.Must(len(list) == 1 && list[0].Cmd == "AUTH" && list[0].Key == "" && list[0].Session == session.Id())
+
+	assert.Must(string(do("AUTH", "secret").Value) == "OK")
+	assert.Must(do("INCR", "a").IsError())
+	list = Failures()
+	assert.Must(len(list) == 2)
+	x := list[1]
+	assert.Must(x.Cmd == "INCR" && x.Key == "a" && x.Backend == addr && x.Error == "ERR value is not an integer or out of range")
+
+	// 只保留最近的记录，参数个数不对的命令由proxy直接返回错误
+	for i := 0; i < 3; i++ {
+		do("GETDEL", strconv.Itoa(i), "x")
+	}
+	list = Failures()
+	assert.Must(len(list) == 2 && list[0].Key == "1" && list[1].Key == "2")
+	assert.Must(FailureCounts() == 5)
+
+	assert.Must(ResetFailures() == 5)
+	assert.Must(len(Failures()) == 0 && FailureCounts() == 0)
+}
+
+func TestLogFailures(t *testing.T) {
+	SetLogFailures(true)
+	defer SetLogFailures(false)
+
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"INCR": redis.NewError([]byte("ERR value is not an integer or out of range")),
+	}))
+	defer l.Close()
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("a")), addr, "", false))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	session := NewSessionSize(c1, "", 1024, 1800)
+	r, err := session.handleRequest(newRequestResp("INCR", "a"), s)
+	assert.MustNoError(err)
+	resp, err := session.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && r.backend == addr)
+
+	// 错误回复只记录类型
+	assert.Must(errorPrefix("ERR value is not an integer or out of range") == "ERR")
+	assert.Must(errorPrefix("WRONGTYPE Operation against a key holding the wrong kind of value") == "WRONGTYPE")
+	assert.Must(errorPrefix("NOSCRIPT") == "NOSCRIPT")
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 所有正在服务的会话，proxy下线时用于通知客户端
+var sessions struct {
+	sync.Mutex
+	m map[*Session]struct{}
+
+	goodbye *redis.Resp // 下线时回复给空闲客户端的错误
+}
+
+func init() {
+	sessions.m = make(map[*Session]struct{})
+}
+
+func addSession(s *Session) {
+	sessions.Lock()
+	sessions.m[s] = struct{}{}
+	sessions.Unlock()
+}
+
+func removeSession(s *Session) {
+	sessions.Lock()
+	delete(sessions.m, s)
+	sessions.Unlock()
+}
+
+func allSessions() []*Session {
+	sessions.Lock()
+	defer sessions.Unlock()
+	var all = make([]*Session, 0, len(sessions.m))
+	for s := range sessions.m {
+		all = append(all, s)
+	}
+	return all
+}
+
+// 统计从客户端读取的字节数，用于判断是否已经读了一半的请求
+type countConn struct {
+	net.Conn
+	nread atomic2.Int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.nread.Add(int64(n))
+	return n, err
+}
+
+// 会话是否处于空闲状态：没有尚未返回的请求，也没有读到一半的请求
+// 只有这时候回复 goodbye 不会被客户端当作某个请求的结果
+func (s *Session) isIdle() bool {
+	return s.Inflight.Get() == 0 && s.idleAt.Get() == s.sock.nread.Get()
+}
+
+func getGoodbye() *redis.Resp {
+	sessions.Lock()
+	defer sessions.Unlock()
+	return sessions.goodbye
+}
+
+// 打断会话的读取，空闲时回复 goodbye 后关闭连接
+func (s *Session) wakeup() {
+	s.draining.Set(true)
+	s.Sock.SetReadDeadline(time.Now())
+}
+
+// 读取请求时被 wakeup 打断，返回true表示需要回复 goodbye 后关闭连接
+// 否则恢复读取，等待下一次通知，读到一半的请求无法恢复，直接返回错误
+func (s *Session) onWakeup(err error) (bool, error) {
+	if ne, ok := errors.Cause(err).(net.Error); !ok || !ne.Timeout() {
+		return false, err
+	}
+	if s.Reader.Buffered() != 0 || s.idleAt.Get() != s.sock.nread.Get() {
+		return false, err
+	}
+	if s.Inflight.Get() == 0 {
+		return true, nil
+	}
+	s.Reader.Err = nil
+	if err := s.Sock.SetReadDeadline(time.Time{}); err != nil {
+		return false, errors.Trace(err)
+	}
+	return false, nil
+}
+
+// proxy下线时，给空闲的客户端回复 goodbye 错误后关闭连接，客户端可以看到关闭的原因，而不是只看到连接断开
+// 正在执行请求的会话等到空闲之后再回复，超过 timeout 之后还没有结束的会话直接关闭
+// 返回没有回复 goodbye 直接关闭的会话数量
+func DrainSessions(goodbye string, timeout time.Duration) int {
+	sessions.Lock()
+	sessions.goodbye = redis.NewError([]byte(goodbye))
+	sessions.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		all := allSessions()
+		if len(all) == 0 {
+			return 0
+		}
+		if !time.Now().Before(deadline) {
+			for _, s := range all {
+				s.Close()
+			}
+			log.Warnf("drain sessions timeout, %d sessions closed without goodbye", len(all))
+			return len(all)
+		}
+		for _, s := range all {
+			if s.isIdle() {
+				s.wakeup()
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
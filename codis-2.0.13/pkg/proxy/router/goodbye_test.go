@@ -0,0 +1,82 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestDrainSessions(t *testing.T) {
+	// 第一个请求在 release 之后才返回
+	release := make(chan struct{})
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		r.Wait.Add(1)
+		go func() {
+			defer r.Wait.Done()
+			<-release
+			r.Response.Resp = redis.NewBulkBytes(r.Resp.Array[1].Value)
+		}()
+	}}
+	serve := func() (net.Conn, *bufio.Reader) {
+		c1, c2 := net.Pipe()
+		s := NewSessionSize(c1, "", 1024, 1800)
+		s.LocalPing = true
+		go s.Serve(d, 16)
+		c2.SetDeadline(time.Now().Add(time.Second * 5))
+		return c2, bufio.NewReader(c2)
+	}
+	expect := func(r *bufio.Reader, lines ...string) {
+		for _, expect := range lines {
+			line, err := r.ReadString('\n')
+			assert.MustNoError(err)
+			assert.Must(line == expect)
+		}
+		// 回复之后连接被关闭
+		_, err := r.ReadString('\n')
+		assert.Must(err != nil)
+	}
+
+	idle, r1 := serve()
+	defer idle.Close()
+	_, err := idle.Write([]byte("PING\r\n"))
+	assert.MustNoError(err)
+	line, err := r1.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "+PONG\r\n")
+
+	busy, r2 := serve()
+	defer busy.Close()
+	_, err = busy.Write([]byte("GET a\r\n"))
+	assert.MustNoError(err)
+
+	// 读到一半的请求不能回复 goodbye，超时后直接关闭
+	partial, r3 := serve()
+	defer partial.Close()
+	_, err = partial.Write([]byte("*2\r\n$3\r\nGET\r\n"))
+	assert.MustNoError(err)
+
+	// 等待读取完所有的请求
+	time.Sleep(time.Millisecond * 50)
+	goodbyes := GoodbyeCounts()
+	done := make(chan int)
+	go func() {
+		done <- DrainSessions("ERR proxy shutting down", time.Millisecond*500)
+	}()
+
+	expect(r1, "-ERR proxy shutting down\r\n")
+	// 等待中的请求先返回，之后才回复 goodbye
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	expect(r2, "$1\r\n", "a\r\n", "-ERR proxy shutting down\r\n")
+	expect(r3)
+
+	assert.Must(<-done == 1)
+	assert.Must(GoodbyeCounts()-goodbyes == 2)
+}
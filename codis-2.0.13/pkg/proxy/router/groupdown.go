@@ -0,0 +1,152 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// 一个group的全部后端都不可用时的处理
+const (
+	GroupDownFail = "fail" // 直接返回错误
+	GroupDownWait = "wait" // 等待后端恢复，超时之后返回错误
+)
+
+var groupDown struct {
+	wait    bool
+	timeout time.Duration
+}
+
+// 需要在开始处理请求之前设置
+func SetGroupDownPolicy(policy string, timeout time.Duration) {
+	groupDown.wait = policy == GroupDownWait
+	groupDown.timeout = timeout
+}
+
+// 等待时检查后端是否恢复的间隔
+const groupDownInterval = time.Millisecond * 50
+
+// slot所在group的master和slave是否都不可用，只有开启读slave时才知道slave的地址
+// 都不可用时触发重新建立连接，尽快发现后端恢复
+func (s *Slot) groupDown() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	bc := s.backend.bc
+	if bc == nil || bc.healthy() {
+		return false
+	}
+	for _, x := range s.replicas.bcs {
+		if x.healthy() {
+			return false
+		}
+	}
+	bc.KeepAlive()
+	for _, x := range s.replicas.bcs {
+		x.KeepAlive()
+	}
+	return true
+}
+
+// 按照 group_down_policy 等待后端恢复，返回 false 表示需要直接返回错误
+func (s *Slot) waitGroupUp() bool {
+	if !groupDown.wait {
+		return false
+	}
+	for deadline := time.Now().Add(groupDown.timeout); time.Now().Before(deadline); {
+		if d := deadline.Sub(time.Now()); d < groupDownInterval {
+			time.Sleep(d)
+		} else {
+			time.Sleep(groupDownInterval)
+		}
+		if !s.groupDown() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Slot) rejectGroupDown() *redis.Resp {
+	incrGroupDownRejects()
+	return redis.NewError([]byte(fmt.Sprintf("ERR group %d is unavailable, all of its backends are down", s.group.Get())))
+}
+
+// 后端最近一次建立连接是否成功，还没有建立过连接时认为是可用的
+func (bc *BackendConn) healthy() bool {
+	return !bc.unhealthy.Get()
+}
+
+// 共享的连接中有一个可用就认为后端是可用的
+func (s *SharedBackendConn) healthy() bool {
+	for _, bc := range s.all() {
+		if bc.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// 设置slot所在的group，用于错误信息和 /status
+func (s *Router) SetSlotGroup(i int, groupId int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isValidSlot(i) {
+		s.slots[i].group.Set(int64(groupId))
+	}
+}
+
+func (s *Router) SlotGroup(i int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isValidSlot(i) {
+		return 0
+	}
+	return int(s.slots[i].group.Get())
+}
+
+// group的状态，用于 /status
+type GroupStatus struct {
+	Id        int      `json:"id"`
+	Master    string   `json:"master"`
+	Replicas  []string `json:"replicas,omitempty"`
+	Available bool     `json:"available"` // master和slave是否有一个可用
+	Slots     int      `json:"slots"`
+}
+
+func (s *Router) GroupStatus() []*GroupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var groups = make(map[int64]*GroupStatus)
+	for _, slot := range s.slots {
+		id := slot.group.Get()
+		if id == 0 || slot.backend.bc == nil {
+			continue
+		}
+		x := groups[id]
+		if x == nil {
+			x = &GroupStatus{Id: int(id), Master: slot.backend.addr, Replicas: slot.replicas.addrs}
+			x.Available = slot.backend.bc.healthy()
+			for _, bc := range slot.replicas.bcs {
+				x.Available = x.Available || bc.healthy()
+			}
+			groups[id] = x
+		}
+		x.Slots++
+	}
+	var list = []*GroupStatus{}
+	for _, x := range groups {
+		list = append(list, x)
+	}
+	sort.Sort(groupStatusList(list))
+	return list
+}
+
+type groupStatusList []*GroupStatus
+
+func (l groupStatusList) Len() int           { return len(l) }
+func (l groupStatusList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+func (l groupStatusList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
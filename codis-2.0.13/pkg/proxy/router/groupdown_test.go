@@ -0,0 +1,109 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// 返回一个没有监听的地址，连接会被拒绝
+func downAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// 发送一条命令，返回结果或者转发时的错误，出错之后会话不能继续使用，所以每次使用新的会话
+func tryRequest(d Dispatcher, replica bool, args ...string) (*redis.Resp, error) {
+	s := &Session{ReadReplica: replica}
+	r, err := s.handleRequest(newRequestResp(args...), d)
+	assert.MustNoError(err)
+	r.Wait.Wait()
+	return r.Response.Resp, r.Response.Err
+}
+
+func TestGroupDownFail(t *testing.T) {
+	SetGroupDownPolicy(GroupDownFail, 0)
+	master, slave := downAddr(), downAddr()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, master, "", false))
+	assert.MustNoError(s.SetSlotReplicas(id, []string{slave}))
+	s.SetSlotGroup(id, 3)
+
+	// 建立连接失败之后才知道后端不可用
+	_, err := tryRequest(s, true, "SET", "a", "b")
+	assert.Must(err != nil)
+	_, err = tryRequest(s, true, "GET", "a")
+	assert.Must(err != nil)
+
+	n := GroupDownRejectCounts()
+	for _, args := range [][]string{{"SET", "a", "b"}, {"GET", "a"}} {
+		resp, err := tryRequest(s, true, args...)
+		assert.MustNoError(err)
+		assert.Must(resp.IsError() && string(resp.Value) == "ERR group 3 is unavailable, all of its backends are down")
+	}
+	assert.Must(GroupDownRejectCounts() == n+2)
+
+	list := s.GroupStatus()
+	assert.Must(len(list) == 1)
+	assert.Must(list[0].Id == 3 && list[0].Master == master && !list[0].Available && list[0].Slots == 1)
+}
+
+func TestGroupDownWait(t *testing.T) {
+	const timeout = time.Millisecond * 200
+	SetGroupDownPolicy(GroupDownWait, timeout)
+	defer SetGroupDownPolicy(GroupDownFail, 0)
+	addr := downAddr()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, addr, "", false))
+	s.SetSlotGroup(id, 1)
+
+	_, err := tryRequest(s, false, "GET", "a")
+	assert.Must(err != nil)
+
+	// 超时之后返回错误
+	start := time.Now()
+	resp, err := tryRequest(s, false, "GET", "a")
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && time.Since(start) >= timeout)
+
+	// 等待的过程中后端恢复
+	SetGroupDownPolicy(GroupDownWait, time.Second*5)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		l, err := net.Listen("tcp", addr)
+		assert.MustNoError(err)
+		conn := func() {
+			c, err := l.Accept()
+			assert.MustNoError(err)
+			x := redis.NewConn(c)
+			for {
+				if _, err := x.Reader.Decode(); err != nil {
+					return
+				}
+				if err := x.Writer.Encode(redis.NewBulkBytes([]byte("v")), true); err != nil {
+					return
+				}
+			}
+		}
+		defer l.Close()
+		conn()
+	}()
+	resp, err = tryRequest(s, false, "GET", "a")
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "v")
+	assert.Must(s.GroupStatus()[0].Available)
+}
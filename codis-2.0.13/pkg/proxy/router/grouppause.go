@@ -0,0 +1,139 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 维护一个group时暂停发往它的命令，命令在proxy中排队等待恢复，客户端看到的是延迟而不是错误
+// 每条命令最多等待暂停时指定的 timeout，超时之后仍然暂停则返回错误，暂停一直持续到 ResumeGroup
+var groupPauses struct {
+	mu     sync.Mutex
+	groups map[int]*groupPause
+	any    atomic2.Bool // 是否有暂停的group，没有时转发不需要加锁
+}
+
+type groupPause struct {
+	timeout time.Duration
+	since   time.Time
+	resumed chan struct{} // 恢复时关闭
+
+	queued  atomic2.Int64 // 正在等待的命令数
+	delayed atomic2.Int64 // 等待之后恢复转发的命令数
+	rejects atomic2.Int64 // 等待超时返回错误的命令数
+}
+
+// 每条命令最多等待的时间的上限，暂停只用于短时间的维护
+const MaxGroupPauseTimeout = time.Minute
+
+// 暂停发往group的命令，已经暂停时只更新 timeout
+func PauseGroup(id int, timeout time.Duration) error {
+	if id <= 0 {
+		return errors.Errorf("invalid group id %d", id)
+	}
+	if timeout <= 0 || timeout > MaxGroupPauseTimeout {
+		return errors.Errorf("invalid timeout %s, should be in (0, %s]", timeout, MaxGroupPauseTimeout)
+	}
+	groupPauses.mu.Lock()
+	defer groupPauses.mu.Unlock()
+	if groupPauses.groups == nil {
+		groupPauses.groups = make(map[int]*groupPause)
+	}
+	if p := groupPauses.groups[id]; p != nil {
+		p.timeout = timeout
+		return nil
+	}
+	groupPauses.groups[id] = &groupPause{timeout: timeout, since: time.Now(), resumed: make(chan struct{})}
+	groupPauses.any.Set(true)
+	return nil
+}
+
+// 恢复group，正在等待的命令立即转发，没有暂停时返回false
+func ResumeGroup(id int) bool {
+	groupPauses.mu.Lock()
+	defer groupPauses.mu.Unlock()
+	p := groupPauses.groups[id]
+	if p == nil {
+		return false
+	}
+	delete(groupPauses.groups, id)
+	groupPauses.any.Set(len(groupPauses.groups) != 0)
+	close(p.resumed)
+	return true
+}
+
+func pausedGroup(id int) (*groupPause, time.Duration) {
+	groupPauses.mu.Lock()
+	defer groupPauses.mu.Unlock()
+	if p := groupPauses.groups[id]; p != nil {
+		return p, p.timeout
+	}
+	return nil, 0
+}
+
+// slot所在的group暂停时等待恢复，超时之后返回错误，没有暂停时返回nil
+func (s *Slot) waitGroupPause() *redis.Resp {
+	if !groupPauses.any.Get() {
+		return nil
+	}
+	id := int(s.group.Get())
+	p, timeout := pausedGroup(id)
+	if p == nil {
+		return nil
+	}
+	p.queued.Incr()
+	defer p.queued.Decr()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.resumed:
+		p.delayed.Incr()
+		return nil
+	case <-timer.C:
+		p.rejects.Incr()
+		return redis.NewError([]byte(fmt.Sprintf("ERR group %d is paused by proxy, try again later", id)))
+	}
+}
+
+// 暂停的group的状态，用于 /status
+type GroupPauseStatus struct {
+	Id      int    `json:"id"`
+	Since   string `json:"since"`
+	Timeout string `json:"timeout"`
+	Queued  int64  `json:"queued"`
+	Delayed int64  `json:"delayed"`
+	Rejects int64  `json:"rejects"`
+}
+
+// 按编号排序，没有暂停的group时返回nil
+func PausedGroups() []*GroupPauseStatus {
+	groupPauses.mu.Lock()
+	defer groupPauses.mu.Unlock()
+	if len(groupPauses.groups) == 0 {
+		return nil
+	}
+	var list []*GroupPauseStatus
+	for id, p := range groupPauses.groups {
+		list = append(list, &GroupPauseStatus{
+			Id: id, Since: p.since.Format("2006-01-02 15:04:05"), Timeout: p.timeout.String(),
+			Queued: p.queued.Get(), Delayed: p.delayed.Get(), Rejects: p.rejects.Get(),
+		})
+	}
+	sort.Sort(groupPauseList(list))
+	return list
+}
+
+type groupPauseList []*GroupPauseStatus
+
+func (l groupPauseList) Len() int           { return len(l) }
+func (l groupPauseList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+func (l groupPauseList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
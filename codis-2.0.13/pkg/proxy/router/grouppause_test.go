@@ -0,0 +1,59 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestGroupPause(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{"GET": redis.NewBulkBytes([]byte("v"))}))
+	defer l.Close()
+	s := New()
+	defer s.Close()
+	a, b := hashSlot([]byte("a")), hashSlot([]byte("b"))
+	assert.MustNoError(s.FillSlot(a, addr, "", false))
+	assert.MustNoError(s.FillSlot(b, addr, "", false))
+	s.SetSlotGroup(a, 1)
+	s.SetSlotGroup(b, 2)
+
+	assert.Must(PauseGroup(0, time.Second) != nil)
+	assert.Must(PauseGroup(1, 0) != nil && PauseGroup(1, time.Hour) != nil)
+	assert.Must(PausedGroups() == nil && !ResumeGroup(1))
+
+	// 暂停期间排队，恢复之后转发
+	assert.MustNoError(PauseGroup(1, time.Second*5))
+	defer ResumeGroup(1)
+	done := make(chan *redis.Resp, 1)
+	go func() {
+		resp, err := tryRequest(s, false, "GET", "a")
+		assert.MustNoError(err)
+		done <- resp
+	}()
+	// 其它group不受影响
+	resp, err := tryRequest(s, false, "GET", "b")
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "v")
+	time.Sleep(time.Millisecond * 100)
+	assert.Must(len(done) == 0)
+	list := PausedGroups()
+	assert.Must(len(list) == 1 && list[0].Id == 1 && list[0].Queued == 1 && list[0].Timeout == "5s")
+
+	assert.Must(ResumeGroup(1))
+	resp = <-done
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "v")
+	assert.Must(PausedGroups() == nil)
+
+	// 超时之后仍然暂停就返回错误
+	assert.MustNoError(PauseGroup(1, time.Millisecond*50))
+	resp, err = tryRequest(s, false, "GET", "a")
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR group 1 is paused by proxy, try again later")
+	list = PausedGroups()
+	assert.Must(len(list) == 1 && list[0].Queued == 0 && list[0].Rejects == 1 && list[0].Delayed == 0)
+}
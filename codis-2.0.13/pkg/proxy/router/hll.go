@@ -0,0 +1,91 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"math"
+	"sync"
+)
+
+// HyperLogLog 的精度，2^14 个寄存器，占用 16KB，标准误差约 0.8%
+const hllPrecision = 14
+
+// 估算不同key的数量，内存占用固定，不需要保存key
+type hyperLogLog struct {
+	mu   sync.Mutex
+	regs []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{regs: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(key []byte) {
+	x := mix64(fnv64a(key))
+
+	// 高位选择寄存器，剩下的位中第一个 1 的位置作为 rank
+	i := x >> (64 - hllPrecision)
+	w := x<<hllPrecision | 1<<(hllPrecision-1)
+	var rank uint8 = 1
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+
+	h.mu.Lock()
+	if rank > h.regs[i] {
+		h.regs[i] = rank
+	}
+	h.mu.Unlock()
+}
+
+// 和 hash/fnv 的 64a 相同，避免每次分配
+func fnv64a(key []byte) uint64 {
+	var x uint64 = 14695981039346656037
+	for _, b := range key {
+		x ^= uint64(b)
+		x *= 1099511628211
+	}
+	return x
+}
+
+// fnv 的低位分布不够均匀，再混合一次
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// 估算的不同key的数量
+func (h *hyperLogLog) count() int64 {
+	h.mu.Lock()
+	var sum float64
+	var zeros int
+	for _, r := range h.regs {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	h.mu.Unlock()
+
+	m := float64(len(h.regs))
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// 数量较小时使用 linear counting 更准确
+	if e <= 2.5*m && zeros != 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(e + 0.5)
+}
+
+func (h *hyperLogLog) reset() {
+	h.mu.Lock()
+	for i := range h.regs {
+		h.regs[i] = 0
+	}
+	h.mu.Unlock()
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	h := newHyperLogLog()
+	assert.Must(h.count() == 0)
+
+	for _, n := range []int{10, 1000, 100000} {
+		h.reset()
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			// 重复的key不影响估算
+			h.add(key)
+			h.add(key)
+		}
+		e := h.count()
+		diff := float64(e-int64(n)) / float64(n)
+		if diff < -0.05 || diff > 0.05 {
+			t.Fatalf("count %d keys, estimate = %d", n, e)
+		}
+	}
+
+	h.reset()
+	assert.Must(h.count() == 0)
+}
+
+func TestBackendKeys(t *testing.T) {
+	bc := &BackendConn{addr: "backend"}
+	bc.addKey([]byte("foo"))
+	assert.Must(bc.Status().Keys == nil)
+
+	bc.keys = newHyperLogLog()
+	bc.addKey([]byte("foo"))
+	bc.addKey([]byte("bar"))
+	bc.addKey(nil)
+	assert.Must(*bc.Status().Keys == 2)
+
+	bc.ResetKeys()
+	assert.Must(*bc.Status().Keys == 0)
+}
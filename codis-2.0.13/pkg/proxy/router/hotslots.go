@@ -0,0 +1,59 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 每秒的只读命令数超过这个值的slot，只读命令轮流发送给所在group的slave，减轻master的压力
+// 写命令总是发送给master，0表示不开启，需要在处理请求之前设置
+var hotSlotReads int64
+
+func SetHotSlotReads(n int) {
+	hotSlotReads = int64(n)
+}
+
+// 分散到slave的热点slot
+type HotSlot struct {
+	Id       int      `json:"id"`
+	Reads    int64    `json:"reads"` // 每秒的只读命令数
+	Replicas []string `json:"replicas"`
+}
+
+// 根据上一次检查之后的只读命令数更新每个slot是否需要分散到slave，需要定期调用
+// 低于阈值的一半之后才停止分散，避免在阈值附近来回切换
+func (s *Router) CheckHotSlots(elapsed time.Duration) {
+	if hotSlotReads == 0 || elapsed <= 0 {
+		return
+	}
+	for _, slot := range s.slots {
+		rate := int64(float64(slot.hot.reads.Swap(0)) / elapsed.Seconds())
+		slot.hot.rate.Set(rate)
+		switch spread := slot.hot.spread.Get(); {
+		case !spread && rate >= hotSlotReads:
+			slot.hot.spread.Set(true)
+			log.Warnf("slot-%04d is hot, %d reads/s, spread reads to replicas", slot.id, rate)
+		case spread && rate < hotSlotReads/2:
+			slot.hot.spread.Set(false)
+			log.Infof("slot-%04d is not hot anymore, %d reads/s, read from master", slot.id, rate)
+		}
+	}
+}
+
+// 返回正在分散到slave的slot，没有slave的slot仍然从master读取
+func (s *Router) HotSlots() []*HotSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list = []*HotSlot{}
+	for _, slot := range s.slots {
+		if !slot.hot.spread.Get() {
+			continue
+		}
+		list = append(list, &HotSlot{Id: slot.id, Reads: slot.hot.rate.Get(), Replicas: slot.replicas.addrs})
+	}
+	return list
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestHotSlots(t *testing.T) {
+	SetHotSlotReads(10)
+	defer SetHotSlotReads(0)
+
+	l1, master := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("master")),
+		"SET": redis.NewBulkBytes([]byte("master")),
+	}))
+	defer l1.Close()
+	l2, slave := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("slave")),
+	}))
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, master, "", false))
+	assert.MustNoError(s.SetSlotReplicas(id, []string{slave}))
+
+	do := func(args ...string) string {
+		r, err := (&Session{}).handleRequest(newRequestResp(args...), s)
+		assert.MustNoError(err)
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return string(r.Response.Resp.Value)
+	}
+	assert.Must(do("GET", "a") == "master")
+
+	for i := 0; i < 20; i++ {
+		do("GET", "a")
+	}
+	s.CheckHotSlots(time.Second)
+	hot := s.HotSlots()
+	assert.Must(len(hot) == 1 && hot[0].Id == id && hot[0].Reads == 21 && hot[0].Replicas[0] == slave)
+
+	// 只有读命令分散到slave
+	assert.Must(do("GET", "a") == "slave")
+	assert.Must(do("SET", "a", "b") == "master")
+
+	// 低于阈值的一半之后恢复从master读取
+	for i := 0; i < 5; i++ {
+		do("GET", "a")
+	}
+	s.CheckHotSlots(time.Second)
+	assert.Must(len(s.HotSlots()) == 1)
+	s.CheckHotSlots(time.Second)
+	assert.Must(len(s.HotSlots()) == 0)
+	assert.Must(do("GET", "a") == "master")
+}
@@ -0,0 +1,304 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// INFO 命令的配置，由proxy在启动时设置
+var infoconf struct {
+	server   string // HELLO 和 INFO 返回的服务名
+	version  string
+	started  time.Time
+	backends bool          // 是否汇总所有后端的 INFO
+	cacheTTL time.Duration // 汇总结果的缓存时间，避免每次 INFO 都访问所有后端
+}
+
+var infocache struct {
+	sync.Mutex
+	info   *backendInfo
+	expire time.Time
+}
+
+func init() {
+	infoconf.server = "codis"
+	infoconf.started = time.Now()
+	infoconf.backends = true
+	infoconf.cacheTTL = time.Second
+}
+
+// 设置 INFO 命令返回的版本号，以及是否汇总后端的 INFO
+func SetInfo(version string, backends bool, cacheTTL time.Duration) {
+	infoconf.version = version
+	infoconf.backends = backends
+	infoconf.cacheTTL = cacheTTL
+	infocache.Lock()
+	infocache.info = nil
+	infocache.Unlock()
+}
+
+// 设置 HELLO 和 INFO 返回的服务名，有些客户端只认 redis，这时可以设置成 redis
+func SetServerName(name string) {
+	infoconf.server = name
+}
+
+// 所有后端 INFO 的汇总
+type backendInfo struct {
+	backends int
+	failed   int
+
+	usedMemory int64
+	keys       int64
+	expires    int64
+}
+
+// 解析一个后端返回的 INFO，累加到汇总结果中
+func (b *backendInfo) merge(resp *redis.Resp) error {
+	if !resp.IsBulkBytes() {
+		return errors.New(fmt.Sprintf("bad info resp: %s", resp.Type))
+	}
+	for _, line := range strings.Split(string(resp.Value), "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.IndexByte(line, ':')
+		if i < 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line[:i], line[i+1:]
+		switch {
+		case key == "used_memory":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("bad info resp: %s", line))
+			}
+			b.usedMemory += n
+		case strings.HasPrefix(key, "db"):
+			// db0:keys=1,expires=0,avg_ttl=0
+			for _, field := range strings.Split(value, ",") {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				n, err := strconv.ParseInt(kv[1], 10, 64)
+				if err != nil {
+					return errors.New(fmt.Sprintf("bad info resp: %s", line))
+				}
+				switch kv[0] {
+				case "keys":
+					b.keys += n
+				case "expires":
+					b.expires += n
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// INFO [section]，proxy自己回复，不转发给某一个后端
+func (s *Session) handleInfo(r *Request, d Dispatcher) (*Request, error) {
+	var section = "default"
+	switch len(r.Resp.Array) {
+	case 1:
+	case 2:
+		section = strings.ToLower(string(r.Resp.Array[1].Value))
+	default:
+		r.Response.Resp = staticReply(replySyntax)
+		return r, nil
+	}
+	if !infoconf.backends || !hasInfoSection(section, "backends") {
+		r.Response.Resp = redis.NewBulkBytes(formatInfo(section, nil))
+		return r, nil
+	}
+
+	infocache.Lock()
+	b, expire := infocache.info, infocache.expire
+	infocache.Unlock()
+	if b != nil && time.Now().Before(expire) {
+		r.Response.Resp = redis.NewBulkBytes(formatInfo(section, b))
+		return r, nil
+	}
+
+	x := &Request{
+		OpStr:  r.OpStr,
+		Start:  r.Start,
+		Resp:   redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("INFO"))}),
+		Wait:   r.Wait,
+		Failed: r.Failed,
+	}
+	subs, err := d.Broadcast(x)
+	if err != nil {
+		r.Response.Resp = redis.NewBulkBytes(formatInfo(section, &backendInfo{}))
+		return r, nil
+	}
+	r.Coalesce = func() error {
+		var b = &backendInfo{backends: len(subs)}
+		for _, x := range subs {
+			resp, err := x.Response.Resp, x.Response.Err
+			if err == nil && resp == nil {
+				err = ErrRespIsRequired
+			}
+			if err == nil {
+				err = b.merge(resp)
+			}
+			if err != nil {
+				b.failed++
+			}
+		}
+		// 有后端失败时不缓存，下一次 INFO 重新获取
+		if b.failed == 0 {
+			infocache.Lock()
+			infocache.info, infocache.expire = b, time.Now().Add(infoconf.cacheTTL)
+			infocache.Unlock()
+		}
+		r.Response.Resp = redis.NewBulkBytes(formatInfo(section, b))
+		return nil
+	}
+	return r, nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// proxy只支持 RESP2，不转发给后端，否则会切换共享的后端连接的协议
+func (s *Session) handleHello(r *Request) (*Request, error) {
+	var args = r.Resp.Array[1:]
+	if len(args) != 0 {
+		ver, err := strconv.Atoi(string(args[0].Value))
+		if err != nil {
+			r.Response.Resp = redis.NewError([]byte("ERR Protocol version is not an integer or out of range"))
+			return r, nil
+		}
+		if ver != 2 {
+			r.Response.Resp = redis.NewError([]byte("NOPROTO unsupported protocol version"))
+			return r, nil
+		}
+		args = args[1:]
+	}
+	var auth, name *redis.Resp
+	var user, passwd string
+	for len(args) != 0 {
+		opt := strings.ToUpper(string(args[0].Value))
+		switch {
+		case opt == "AUTH" && len(args) >= 3:
+			user, passwd = string(args[1].Value), string(args[2].Value)
+			auth, args = args[0], args[3:]
+		case opt == "SETNAME" && len(args) >= 2:
+			name, args = args[1], args[2:]
+		default:
+			r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[0].Value)))
+			return r, nil
+		}
+	}
+	// password 对应 default 用户，其他用户来自 acl_users
+	if auth != nil {
+		if !s.login(user, passwd) {
+			r.Response.Resp = redis.NewError([]byte("WRONGPASS invalid username-password pair or user is disabled."))
+			return r, nil
+		}
+		s.authorized = true
+	}
+	if !s.authorized && s.auth != "" {
+		r.Response.Resp = redis.NewError([]byte("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"))
+		return r, nil
+	}
+	s.authorized = true
+	if name != nil {
+		if resp := s.setName(string(name.Value)); resp != nil {
+			r.Response.Resp = resp
+			return r, nil
+		}
+		r.appstats = s.appstats
+	}
+	r.Response.Resp = redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte("server")),
+		redis.NewBulkBytes([]byte(infoconf.server)),
+		redis.NewBulkBytes([]byte("version")),
+		redis.NewBulkBytes([]byte(infoconf.version)),
+		redis.NewBulkBytes([]byte("proto")),
+		redis.NewInt([]byte("2")),
+		redis.NewBulkBytes([]byte("id")),
+		redis.NewInt([]byte(strconv.FormatInt(s.id, 10))),
+		redis.NewBulkBytes([]byte("mode")),
+		redis.NewBulkBytes([]byte("standalone")),
+		redis.NewBulkBytes([]byte("role")),
+		redis.NewBulkBytes([]byte("master")),
+		redis.NewBulkBytes([]byte("modules")),
+		redis.NewArray([]*redis.Resp{}),
+	})
+	return r, nil
+}
+
+// 和redis一样，all、everything 和 default 包含所有的段
+func hasInfoSection(section, name string) bool {
+	switch section {
+	case "all", "everything", "default":
+		return true
+	}
+	return section == name
+}
+
+func formatInfo(section string, b *backendInfo) []byte {
+	var buf bytes.Buffer
+	add := func(name string, lines ...string) {
+		if !hasInfoSection(section, strings.ToLower(name)) {
+			return
+		}
+		if buf.Len() != 0 {
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(&buf, "# %s\r\n", name)
+		for _, line := range lines {
+			buf.WriteString(line)
+			buf.WriteString("\r\n")
+		}
+	}
+	uptime := int64(time.Since(infoconf.started) / time.Second)
+	add("Server",
+		fmt.Sprintf("codis_version:%s", infoconf.version),
+		fmt.Sprintf("server_name:%s", infoconf.server),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("uptime_in_seconds:%d", uptime),
+		fmt.Sprintf("uptime_in_days:%d", uptime/86400),
+	)
+	add("Clients",
+		fmt.Sprintf("connected_clients:%d", SessionCounts()),
+	)
+	add("Stats",
+		fmt.Sprintf("total_commands_processed:%d", OpCounts()),
+		fmt.Sprintf("total_broadcasts:%d", BroadcastCounts()),
+	)
+	if b != nil {
+		add("Backends",
+			fmt.Sprintf("backends:%d", b.backends),
+			fmt.Sprintf("backends_failed:%d", b.failed),
+			fmt.Sprintf("used_memory:%d", b.usedMemory),
+			fmt.Sprintf("used_memory_human:%s", bytesToHuman(b.usedMemory)),
+			fmt.Sprintf("keys:%d", b.keys),
+			fmt.Sprintf("expires:%d", b.expires),
+		)
+	}
+	return buf.Bytes()
+}
+
+// 和redis的 used_memory_human 格式一致
+func bytesToHuman(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", float64(n)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", float64(n)/(1024*1024*1024))
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+func backendInfoReply(usedMemory, keys string) func(r *Request) {
+	s := "# Memory\r\nused_memory:" + usedMemory + "\r\n\r\n# Keyspace\r\ndb0:" + keys + "\r\n"
+	return replyWith(redis.NewBulkBytes([]byte(s)), nil)
+}
+
+func TestInfoSections(t *testing.T) {
+	SetInfo("test", false, 0)
+	defer SetInfo("", true, time.Second)
+
+	resp := doRequest(&Session{}, &fakeDispatcher{}, "INFO")
+	assert.Must(resp.IsBulkBytes())
+	info := string(resp.Value)
+	assert.Must(strings.HasPrefix(info, "# Server\r\ncodis_version:test\r\n"))
+	assert.Must(strings.Contains(info, "# Clients\r\n") && strings.Contains(info, "# Stats\r\n"))
+	assert.Must(!strings.Contains(info, "# Backends"))
+
+	resp = doRequest(&Session{}, &fakeDispatcher{}, "INFO", "CLIENTS")
+	assert.Must(strings.HasPrefix(string(resp.Value), "# Clients\r\nconnected_clients:"))
+	assert.Must(!strings.Contains(string(resp.Value), "# Server"))
+
+	// 不存在的段返回空，和redis一致
+	resp = doRequest(&Session{}, &fakeDispatcher{}, "INFO", "nothing")
+	assert.Must(resp.IsBulkBytes() && len(resp.Value) == 0)
+
+	resp = doRequest(&Session{}, &fakeDispatcher{}, "INFO", "a", "b")
+	assert.Must(resp.IsError())
+}
+
+func TestInfoBackends(t *testing.T) {
+	SetInfo("test", true, time.Hour)
+	defer SetInfo("", true, time.Second)
+
+	var calls int
+	count := func(fn func(r *Request)) func(r *Request) {
+		return func(r *Request) {
+			calls++
+			assert.Must(len(r.Resp.Array) == 1 && string(r.Resp.Array[0].Value) == "INFO")
+			fn(r)
+		}
+	}
+	d := &fakeDispatcher{backends: map[string]func(r *Request){
+		"127.0.0.1:6379": count(backendInfoReply("1048576", "keys=3,expires=1,avg_ttl=0")),
+		"127.0.0.1:6380": count(backendInfoReply("524288", "keys=4,expires=0,avg_ttl=0")),
+	}}
+	resp := doRequest(&Session{}, d, "INFO", "backends")
+	assert.Must(resp.IsBulkBytes())
+	info := string(resp.Value)
+	for _, line := range []string{"backends:2", "backends_failed:0", "used_memory:1572864", "used_memory_human:1.50M", "keys:7", "expires:1"} {
+		assert.Must(strings.Contains(info, line+"\r\n"))
+	}
+	assert.Must(calls == 2)
+
+	// 缓存有效期内不会再访问后端
+	resp = doRequest(&Session{}, d, "INFO")
+	assert.Must(strings.Contains(string(resp.Value), "keys:7\r\n") && calls == 2)
+
+	// 有后端失败时不缓存
+	SetInfo("test", true, time.Hour)
+	d.backends["127.0.0.1:6381"] = count(replyWith(nil, errors.New("connection refused")))
+	resp = doRequest(&Session{}, d, "INFO", "backends")
+	assert.Must(strings.Contains(string(resp.Value), "backends:3\r\nbackends_failed:1\r\n") && calls == 5)
+	doRequest(&Session{}, d, "INFO", "backends")
+	assert.Must(calls == 8)
+
+	// 只请求proxy自己的段时不访问后端
+	doRequest(&Session{}, d, "INFO", "server")
+	assert.Must(calls == 8)
+}
+
+func TestHello(t *testing.T) {
+	SetInfo("test", false, 0)
+	defer SetInfo("", true, time.Second)
+	SetServerName("redis")
+	defer SetServerName("codis")
+
+	fields := func(resp *redis.Resp) map[string]string {
+		assert.Must(resp.IsArray() && len(resp.Array)%2 == 0)
+		var m = make(map[string]string)
+		for i := 0; i < len(resp.Array); i += 2 {
+			m[string(resp.Array[i].Value)] = string(resp.Array[i+1].Value)
+		}
+		return m
+	}
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		t.Fatal("HELLO should not be forwarded")
+	}}
+
+	s := &Session{id: 7}
+	m := fields(doRequest(s, d, "HELLO"))
+	assert.Must(m["server"] == "redis" && m["version"] == "test" && m["proto"] == "2" && m["id"] == "7")
+
+	// INFO 中的服务名和 HELLO 一致
+	resp := doRequest(s, d, "INFO", "server")
+	assert.Must(strings.Contains(string(resp.Value), "\r\nserver_name:redis\r\n"))
+
+	resp = doRequest(s, d, "HELLO", "3")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOPROTO"))
+	resp = doRequest(s, d, "HELLO", "x")
+	assert.Must(resp.IsError())
+	resp = doRequest(s, d, "HELLO", "2", "SETNAME")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "ERR Syntax error"))
+
+	// 需要密码时可以通过 HELLO 认证
+	s = &Session{auth: "foobar"}
+	resp = doRequest(s, d, "HELLO", "2")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOAUTH"))
+	resp = doRequest(s, d, "HELLO", "2", "AUTH", "default", "wrong")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "WRONGPASS") && !s.authorized)
+	m = fields(doRequest(s, d, "HELLO", "2", "AUTH", "default", "foobar", "SETNAME", "worker"))
+	assert.Must(m["server"] == "redis" && s.authorized && s.name == "worker")
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "sort"
+
+// 内部队列的长度，用于排查 proxy 卡住的原因
+// 只是不加锁读取通道的长度和计数，各个数值不是同一时刻的快照
+type QueueLen struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+type BackendQueues struct {
+	Addr  string `json:"addr"`
+	Conns int    `json:"conns"`
+	// 等待发送给后端的请求数，一直接近 cap 说明后端或者网络太慢，新的请求会被拒绝
+	Queued   int `json:"queued"`
+	QueueCap int `json:"queue_cap"`
+	// 已经发送、等待后端回复的请求数，一直不变并且不为0说明后端没有回复
+	Sent int64 `json:"sent"`
+	// 设置了优先级时每个优先级的队列，Queued 和 QueueCap 是两个队列的和
+	Priority map[string]*PriorityQueue `json:"priority,omitempty"`
+}
+
+type SessionQueues struct {
+	Sessions int   `json:"sessions"`
+	Inflight int64 `json:"inflight"` // 所有会话已经读取、还没有发送回复的请求数
+	Waiting  int   `json:"waiting"`  // 正在等待后端回复的会话数
+	Unsent   int64 `json:"unsent"`   // 已经从后端返回、还没有发送给客户端的回复的字节数，只有开启 max_response_buffer 时统计
+}
+
+// 连接池中每个后端的队列，按地址排序，连接池大于1时是所有连接的和
+func (s *Router) BackendQueues() []*BackendQueues {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs = make([]string, 0, len(s.pool))
+	for addr := range s.pool {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var all = make([]*BackendQueues, len(addrs))
+	for i, addr := range addrs {
+		x := &BackendQueues{Addr: addr, Conns: s.pool[addr].Conns()}
+		if PriorityEnabled() {
+			x.Priority = map[string]*PriorityQueue{"high": {}, "low": {}}
+		}
+		for _, bc := range s.pool[addr].all() {
+			n := bc.queued()
+			x.Queued += n
+			x.QueueCap += cap(bc.input) + cap(bc.urgent)
+			x.Sent += bc.pending.Get() - int64(n)
+			if x.Priority != nil && bc.urgent != nil {
+				x.Priority["high"].add(bc.urgent, &bc.waits[1])
+				x.Priority["low"].add(bc.input, &bc.waits[0])
+			}
+		}
+		for _, q := range x.Priority {
+			q.average()
+		}
+		all[i] = x
+	}
+	return all
+}
+
+// 所有会话的请求和回复的汇总，会话的 pipeline 通道只会在会话自己的协程中访问，用 Inflight 代替
+func SessionQueueStats() *SessionQueues {
+	all := allSessions()
+	x := &SessionQueues{Sessions: len(all)}
+	for _, s := range all {
+		x.Inflight += s.Inflight.Get()
+		x.Unsent += s.unsent.Get()
+		s.mu.Lock()
+		if s.waiting != nil {
+			x.Waiting++
+		}
+		s.mu.Unlock()
+	}
+	return x
+}
+
+// 等待复制到影子集群的命令数，没有开启时返回nil
+func ShadowQueue() *QueueLen {
+	if shadow.queue == nil {
+		return nil
+	}
+	return &QueueLen{Len: len(shadow.queue), Cap: cap(shadow.queue)}
+}
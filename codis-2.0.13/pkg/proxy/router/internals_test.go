@@ -0,0 +1,65 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestBackendQueues(t *testing.T) {
+	l, addr := fakeServer(replyAfter(time.Millisecond * 300))
+	defer l.Close()
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, addr, "", false))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		r := &Request{OpStr: "GET", Resp: newRequestResp("GET", "k"), Wait: &wg}
+		s.pool[addr].PushBack(r)
+	}
+	all := s.BackendQueues()
+	assert.Must(len(all) == 1 && all[0].Addr == addr && all[0].Conns == 1)
+	assert.Must(all[0].Queued+int(all[0].Sent) == 3 && all[0].QueueCap == 1024)
+
+	wg.Wait()
+	all = s.BackendQueues()
+	assert.Must(all[0].Queued == 0 && all[0].Sent == 0)
+}
+
+func TestSessionQueueStats(t *testing.T) {
+	c, _, slow := serveSlowBackend(0)
+	defer c.Close()
+	before := SessionQueueStats()
+	_, err := c.Write([]byte("GET slow\r\nGET fast\r\n"))
+	assert.MustNoError(err)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		x := SessionQueueStats()
+		if x.Waiting == before.Waiting+1 && x.Inflight == before.Inflight+2 {
+			break
+		}
+		assert.Must(time.Now().Before(deadline))
+		time.Sleep(time.Millisecond * 10)
+	}
+	close(slow)
+
+	r := bufio.NewReader(c)
+	for i := 0; i < 4; i++ {
+		_, err := r.ReadString('\n')
+		assert.MustNoError(err)
+	}
+}
+
+func TestShadowQueue(t *testing.T) {
+	assert.Must(ShadowQueue() == nil)
+	SetShadow(downAddr(), "", 8)
+	defer SetShadow("", "", 0)
+	assert.Must(ShadowQueue().Cap == 8)
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// 转发之前检查命令的key，默认和redis一样允许空的key，不限制长度
+var keyPolicy struct {
+	rejectEmpty bool // 拒绝空的key
+	maxLength   int  // key的长度上限，0表示不限制
+}
+
+// 需要在开始处理请求之前设置
+func SetKeyPolicy(rejectEmpty bool, maxLength int) {
+	keyPolicy.rejectEmpty, keyPolicy.maxLength = rejectEmpty, maxLength
+}
+
+var replyEmptyKey = redis.NewError([]byte("ERR empty keys are not allowed by proxy"))
+
+// 按命令表检查全部的key，不符合时返回错误，没有开启时不解析key
+func checkKeys(opstr string, resp *redis.Resp) *redis.Resp {
+	if !keyPolicy.rejectEmpty && keyPolicy.maxLength == 0 {
+		return nil
+	}
+	for _, key := range requestKeys(opstr, resp) {
+		switch {
+		case keyPolicy.rejectEmpty && len(key) == 0:
+			incrKeyRejects()
+			return staticReply(replyEmptyKey)
+		case keyPolicy.maxLength != 0 && len(key) > keyPolicy.maxLength:
+			incrKeyRejects()
+			return redis.NewError([]byte(fmt.Sprintf("ERR key is too long for '%s' command, max = %d", strings.ToLower(opstr), keyPolicy.maxLength)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+const DefaultMaintenanceMessage = "ERR proxy is under maintenance"
+
+// 维护模式下仍然接受连接，但是除了 QUIT 之外的命令都直接返回错误，客户端可以看到维护的原因，而不是连接失败
+// 运行时通过 http 接口开启和关闭，http 接口不受影响
+var maintenance struct {
+	on      atomic2.Bool
+	rejects atomic2.Int64
+
+	mu    sync.Mutex
+	reply *redis.Resp
+	since time.Time
+}
+
+type MaintenanceStatus struct {
+	Message string `json:"message"`
+	Since   string `json:"since"`
+	Rejects int64  `json:"rejects"` // 开启之后返回了错误的命令数
+}
+
+// 开启或者关闭维护模式，msg 为空时使用 DefaultMaintenanceMessage
+func SetMaintenance(on bool, msg string) {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	if on {
+		if msg == "" {
+			msg = DefaultMaintenanceMessage
+		}
+		if !maintenance.on.Get() {
+			maintenance.since = time.Now()
+			maintenance.rejects.Set(0)
+		}
+		maintenance.reply = redis.NewError([]byte(msg))
+	}
+	maintenance.on.Set(on)
+}
+
+// 没有开启时返回nil
+func Maintenance() *MaintenanceStatus {
+	if !maintenance.on.Get() {
+		return nil
+	}
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	return &MaintenanceStatus{
+		Message: string(maintenance.reply.Value),
+		Since:   maintenance.since.Format("2006-01-02 15:04:05"),
+		Rejects: maintenance.rejects.Get(),
+	}
+}
+
+// 回复是所有会话共用的，只会被读取
+func maintenanceReply() *redis.Resp {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	maintenance.rejects.Incr()
+	return maintenance.reply
+}
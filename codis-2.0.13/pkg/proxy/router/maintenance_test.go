@@ -0,0 +1,45 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	var forwarded int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		forwarded++
+		r.Response.Resp = redis.NewBulkBytes([]byte("v"))
+	}}
+	s := &Session{}
+	assert.Must(Maintenance() == nil)
+
+	SetMaintenance(true, "")
+	defer SetMaintenance(false, "")
+	for _, args := range [][]string{{"GET", "a"}, {"PING"}, {"NOSUCHCMD"}, {"AUTH", "x"}} {
+		resp := doRequest(s, d, args...)
+		assert.Must(resp.IsError() && string(resp.Value) == DefaultMaintenanceMessage)
+	}
+	assert.Must(forwarded == 0 && Maintenance().Rejects == 4)
+
+	// 修改错误信息不会清空计数
+	SetMaintenance(true, "ERR upgrading, back at 10:00")
+	resp := doRequest(s, d, "GET", "a")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR upgrading, back at 10:00")
+	assert.Must(Maintenance().Rejects == 5)
+
+	// QUIT 仍然可以正常退出
+	resp = doRequest(s, d, "QUIT")
+	assert.Must(resp.IsString() && s.quit)
+
+	SetMaintenance(false, "")
+	assert.Must(Maintenance() == nil)
+	s = &Session{}
+	resp = doRequest(s, d, "GET", "a")
+	assert.Must(string(resp.Value) == "v" && forwarded == 1)
+}
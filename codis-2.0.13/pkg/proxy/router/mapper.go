@@ -5,6 +5,7 @@ package router
 
 import (
 	"bytes"
+	"fmt"
 	"hash/crc32"
 	"strings"
 
@@ -32,10 +33,10 @@ func init() {
 	// 不支持的命令列表
 	for _, s := range []string{
 		"KEYS", "MOVE", "OBJECT", "RENAME", "RENAMENX", "SCAN", "BITOP", "MSETNX", "MIGRATE", "RESTORE",
-		"BLPOP", "BRPOP", "BRPOPLPUSH", "PSUBSCRIBE", "PUBLISH", "PUNSUBSCRIBE", "SUBSCRIBE", "RANDOMKEY",
+		"BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE", "BLMPOP", "BZMPOP", "PSUBSCRIBE", "PUBLISH", "PUNSUBSCRIBE", "SUBSCRIBE",
 		"UNSUBSCRIBE", "DISCARD", "EXEC", "MULTI", "UNWATCH", "WATCH", "SCRIPT",
-		"BGREWRITEAOF", "BGSAVE", "CLIENT", "CONFIG", "DBSIZE", "DEBUG", "FLUSHALL", "FLUSHDB",
-		"LASTSAVE", "MONITOR", "SAVE", "SHUTDOWN", "SLAVEOF", "SLOWLOG", "SYNC", "TIME",
+		"BGREWRITEAOF", "BGSAVE", "CONFIG", "DEBUG", "FLUSHALL", "FLUSHDB",
+		"LASTSAVE", "MONITOR", "SAVE", "SLAVEOF", "SLOWLOG", "SYNC",
 		"SLOTSINFO", "SLOTSDEL", "SLOTSMGRTSLOT", "SLOTSMGRTONE", "SLOTSMGRTTAGSLOT", "SLOTSMGRTTAGONE", "SLOTSCHECK",
 	} {
 		blacklist[s] = true
@@ -47,6 +48,61 @@ func isNotAllowed(opstr string) bool {
 	return blacklist[opstr]
 }
 
+// 将命令从黑名单中移除，需要在处理请求之前调用
+func AllowCommands(opstrs ...string) {
+	for _, s := range opstrs {
+		delete(blacklist, strings.ToUpper(s))
+	}
+}
+
+var (
+	renamed  = make(map[string]string) // 重命名之后的名字 -> 原来的名字
+	disabled = make(map[string]bool)   // 被重命名或者禁用的原来的名字
+)
+
+// 和redis的 rename-command 一样，重命名或者禁用一个命令，rename 为空表示禁用
+// 客户端只能使用新的名字，转发给后端时使用原来的名字，命令表和统计信息也都使用原来的名字
+// 需要在处理请求之前调用
+func RenameCommand(name, rename string) error {
+	name, rename = strings.ToUpper(name), strings.ToUpper(rename)
+	if name == "" {
+		return errors.New("rename command: empty command name")
+	}
+	if disabled[name] {
+		// 重复设置相同的名字时忽略
+		var last string
+		for k, v := range renamed {
+			if v == name {
+				last = k
+			}
+		}
+		if last == rename {
+			return nil
+		}
+		return errors.New(fmt.Sprintf("rename command: %s is renamed twice", name))
+	}
+	if rename != "" {
+		if _, ok := renamed[rename]; ok || commands[rename] != nil {
+			return errors.New(fmt.Sprintf("rename command: %s -> %s, %s is already a command", name, rename, rename))
+		}
+		renamed[rename] = name
+	}
+	disabled[name] = true
+	return nil
+}
+
+// 将客户端使用的命令名换成原来的名字，原来的名字已经被重命名或者禁用时返回false
+func renameOpStr(resp *redis.Resp, opstr string) (string, bool) {
+	if len(disabled) == 0 {
+		return opstr, true
+	}
+	if name, ok := renamed[opstr]; ok {
+		resp.Array[0] = redis.NewBulkBytes([]byte(name))
+		return name, true
+	}
+	return opstr, !disabled[opstr]
+}
+
 var (
 	ErrBadRespType = errors.New("bad resp type for command")
 	ErrBadOpStrLen = errors.New("bad command length, too short or too long")
@@ -96,9 +152,8 @@ func hashSlot(key []byte) int {
 
 func getHashKey(resp *redis.Resp, opstr string) []byte {
 	var index = 1
-	switch opstr {
-	case "ZINTERSTORE", "ZUNIONSTORE", "EVAL", "EVALSHA":
-		index = 3
+	if i, ok := numKeysAt[opstr]; ok {
+		index = i + 1
 	}
 	if index < len(resp.Array) {
 		return resp.Array[index].Value
@@ -163,3 +163,71 @@ func TestHashSlot(t *testing.T) {
 		assert.Must(i == j)
 	}
 }
+
+func TestRenameCommand(t *testing.T) {
+	defer func() {
+		renamed = make(map[string]string)
+		disabled = make(map[string]bool)
+	}()
+	assert.MustNoError(RenameCommand("get", "myget"))
+	assert.MustNoError(RenameCommand("DEL", ""))
+	// 重复设置相同的名字没有影响
+	assert.MustNoError(RenameCommand("GET", "MYGET"))
+	assert.Must(RenameCommand("GET", "MYGET2") != nil)
+	assert.Must(RenameCommand("SET", "MYGET") != nil)
+	assert.Must(RenameCommand("SET", "GET") != nil)
+	assert.Must(RenameCommand("", "X") != nil)
+
+	var sent []string
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		sent = append(sent, r.OpStr+" "+string(r.Resp.Array[0].Value))
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}
+	s := &Session{}
+
+	// 转发给后端时使用原来的名字
+	resp := doRequest(s, d, "myget", "foo")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	assert.Must(len(sent) == 1 && sent[0] == "GET GET")
+
+	// 原来的名字和被禁用的命令都作为未知命令，不会关闭连接
+	resp = doRequest(s, d, "get", "foo")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR unknown command 'get'")
+	resp = doRequest(s, d, "DEL", "foo")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR unknown command 'DEL'")
+	assert.Must(len(sent) == 1)
+
+	// 命令表使用原来的名字检查参数个数
+	s.CheckArity = true
+	resp = doRequest(s, d, "MYGET")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR wrong number of arguments for 'get' command")
+
+	resp = doRequest(s, d, "SET", "foo", "bar")
+	assert.Must(resp.IsString() && len(sent) == 2 && sent[1] == "SET SET")
+}
+
+func TestCommandTable(t *testing.T) {
+	defer func() {
+		renamed = make(map[string]string)
+		disabled = make(map[string]bool)
+	}()
+	assert.MustNoError(RenameCommand("CONFIG", "MYCONFIG"))
+	assert.MustNoError(RenameCommand("DEBUG", ""))
+
+	var m = make(map[string]*CommandInfo)
+	list := CommandTable()
+	for i, x := range list {
+		assert.Must(i == 0 || list[i-1].Name < x.Name)
+		m[x.Name] = x
+	}
+	assert.Must(len(m) == len(commands))
+
+	x := m["GET"]
+	assert.Must(x.Arity == 2 && x.FirstKey == 1 && len(x.Flags) == 1 && x.Flags[0] == "readonly")
+	assert.Must(x.Handling == "forward" && x.ReadOnly && x.Retryable && x.Allowed && !x.Disabled)
+	assert.Must(m["MSET"].Handling == "split" && !m["MSET"].ReadOnly)
+	assert.Must(m["DBSIZE"].Handling == "broadcast" && m["PING"].Handling == "proxy")
+	assert.Must(!m["KEYS"].Allowed)
+	assert.Must(m["CONFIG"].Renamed == "MYCONFIG" && m["CONFIG"].Disabled)
+	assert.Must(m["DEBUG"].Renamed == "" && m["DEBUG"].Disabled)
+}
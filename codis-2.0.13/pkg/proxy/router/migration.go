@@ -0,0 +1,103 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// 正在迁移中的slot的信息
+// 迁移本身是由dashboard发送 SLOTSMGRTTAGSLOT 完成的，proxy只能看到访问时由自己迁移的key
+// 剩余的key数量通过向原redis-server发送 SLOTSINFO 获取
+type SlotMigration struct {
+	Id    int    `json:"slot"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Since string `json:"since"`
+
+	KeysMigrated  int64 `json:"keys_migrated_by_proxy"`
+	KeysRemaining int64 `json:"keys_remaining"` // -1 表示没有获取或者获取失败
+}
+
+// 获取全部正在迁移中的slot，remaining 为 true 时会查询原redis-server上剩余的key数量
+func (s *Router) MigrationStatus(remaining bool) []*SlotMigration {
+	var list []*SlotMigration
+	var bcs []*SharedBackendConn
+	s.mu.Lock()
+	for _, slot := range s.slots {
+		if slot.migrate.bc == nil {
+			continue
+		}
+		list = append(list, &SlotMigration{
+			Id:            slot.id,
+			From:          slot.migrate.from,
+			To:            slot.backend.addr,
+			Since:         slot.migrate.since.String(),
+			KeysMigrated:  slot.migrate.keys.Get(),
+			KeysRemaining: -1,
+		})
+		if remaining {
+			// 持有连接的引用，避免查询过程中连接被关闭
+			slot.migrate.bc.IncrRefcnt()
+			bcs = append(bcs, slot.migrate.bc)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(bcs) == 0 {
+		return list
+	}
+	var wait sync.WaitGroup
+	var reqs = make([]*Request, len(bcs))
+	for i, bc := range bcs {
+		reqs[i] = &Request{
+			Resp: redis.NewArray([]*redis.Resp{
+				redis.NewBulkBytes([]byte("SLOTSINFO")),
+				redis.NewBulkBytes([]byte(strconv.Itoa(list[i].Id))),
+				redis.NewBulkBytes([]byte("1")),
+			}),
+			Wait: &wait,
+		}
+		bc.PushBack(reqs[i])
+	}
+	wait.Wait()
+
+	s.mu.Lock()
+	for _, bc := range bcs {
+		s.putBackendConn(bc)
+	}
+	s.mu.Unlock()
+
+	for i, r := range reqs {
+		if n, ok := parseSlotsInfo(r, list[i].Id); ok {
+			list[i].KeysRemaining = n
+		}
+	}
+	return list
+}
+
+// SLOTSINFO 只返回非空的slot，格式为 [[slot, keys], ...]
+func parseSlotsInfo(r *Request, id int) (int64, bool) {
+	resp := r.Response.Resp
+	if r.Response.Err != nil || resp == nil || !resp.IsArray() {
+		return 0, false
+	}
+	for _, x := range resp.Array {
+		if !x.IsArray() || len(x.Array) != 2 {
+			return 0, false
+		}
+		if string(x.Array[0].Value) != strconv.Itoa(id) {
+			continue
+		}
+		n, err := strconv.ParseInt(string(x.Array[1].Value), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, true
+}
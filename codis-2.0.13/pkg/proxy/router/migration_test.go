@@ -0,0 +1,159 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// 根据请求返回回复的编码，返回 nil 时关闭连接
+type replyFunc func(req *redis.Resp) []byte
+
+// 模拟的redis-server，每个请求的回复由 reply 生成
+func fakeServer(reply replyFunc) (net.Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					b := reply(req)
+					if b == nil {
+						return
+					}
+					if _, err := c.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l, l.Addr().String()
+}
+
+func mustEncode(resp *redis.Resp) []byte {
+	b, err := redis.EncodeToBytes(resp)
+	assert.MustNoError(err)
+	return b
+}
+
+// 按照命令名称返回固定结果，未知的命令返回错误
+func replyByCommand(replies map[string]*redis.Resp) replyFunc {
+	return func(req *redis.Resp) []byte {
+		opstr, err := getOpStr(req)
+		assert.MustNoError(err)
+		reply := replies[opstr]
+		if reply == nil {
+			reply = redis.NewError([]byte("ERR unknown command"))
+		}
+		return mustEncode(reply)
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+	const id = 5
+	var key []byte
+	for i := 0; key == nil; i++ {
+		if k := []byte(strconv.Itoa(i)); hashSlot(k) == id {
+			key = k
+		}
+	}
+
+	l1, from := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"SLOTSMGRTTAGONE": redis.NewInt([]byte("2")),
+		"SLOTSINFO": redis.NewArray([]*redis.Resp{
+			redis.NewArray([]*redis.Resp{redis.NewInt([]byte("5")), redis.NewInt([]byte("42"))}),
+		}),
+	}))
+	defer l1.Close()
+	l2, to := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	assert.Must(len(s.MigrationStatus(true)) == 0)
+	assert.MustNoError(s.FillSlot(id, to, from, false))
+
+	r := &Request{
+		OpStr: "GET",
+		Resp:  newRequestResp("GET", string(key)),
+		Wait:  &sync.WaitGroup{},
+	}
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+
+	// 迁移的源地址没有变化，已迁移的key数量不会被清空
+	assert.MustNoError(s.FillSlot(id, to, from, false))
+
+	list := s.MigrationStatus(true)
+	assert.Must(len(list) == 1)
+	m := list[0]
+	assert.Must(m.Id == id && m.From == from && m.To == to)
+	assert.Must(m.KeysMigrated == 2 && m.KeysRemaining == 42)
+
+	assert.MustNoError(s.FillSlot(id, to, "", false))
+	assert.Must(len(s.MigrationStatus(true)) == 0)
+}
+
+func TestReadReplica(t *testing.T) {
+	l1, master := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("master")),
+	}))
+	defer l1.Close()
+	l2, slave := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("slave")),
+	}))
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, master, "", false))
+		assert.MustNoError(s.SetSlotReplicas(i, []string{slave}))
+	}
+
+	get := func(replica bool) string {
+		r := &Request{
+			OpStr:   "GET",
+			Resp:    newRequestResp("GET", "k"),
+			Wait:    &sync.WaitGroup{},
+			replica: replica,
+		}
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return string(r.Response.Resp.Value)
+	}
+	assert.Must(get(true) == "slave" && get(false) == "master")
+
+	// 迁移中的slot只从master读取
+	l3, from := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"SLOTSMGRTTAGONE": redis.NewInt([]byte("0")),
+	}))
+	defer l3.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, master, from, false))
+	}
+	assert.Must(get(true) == "master")
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 默认所有会话的请求都通过 pipeline 复用每个后端地址上的一个连接，后端的连接数和客户端的数量无关
+// 关闭之后每个会话使用自己的后端连接，后端的连接数随客户端的数量增长，需要在处理请求之前设置
+var dedicatedConns bool
+
+func SetBackendMultiplex(enabled bool) {
+	dedicatedConns = !enabled
+}
+
+// 会话独占的后端连接的数量
+var dedicatedConnCount atomic2.Int64
+
+var ErrClosedSessionConns = errors.New("use of closed session backend conns")
+
+// 不复用后端连接时，一个会话到每个后端地址的连接，在第一次发送请求时建立，会话结束时关闭
+// 同一个会话发往同一个后端的请求总是使用同一个连接，所以命令的先后顺序不会改变
+type sessionConns struct {
+	mu     sync.Mutex
+	m      map[string]*BackendConn
+	closed bool
+}
+
+func newSessionConns() *sessionConns {
+	return &sessionConns{m: make(map[string]*BackendConn)}
+}
+
+// 把请求发送到会话自己的、和 bc 地址相同的连接上
+func (c *sessionConns) pushBack(bc *SharedBackendConn, r *Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosedSessionConns
+	}
+	x := c.m[bc.addr]
+	if x == nil {
+		x = NewBackendConn(bc.addr, bc.auth)
+		c.m[bc.addr] = x
+		dedicatedConnCount.Incr()
+	}
+	x.PushBack(r)
+	return nil
+}
+
+// 关闭会话的后端连接，已经加入队列的请求仍然会发送给后端并返回
+func (c *sessionConns) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, x := range c.m {
+		x.Close()
+	}
+	dedicatedConnCount.Add(-int64(len(c.m)))
+}
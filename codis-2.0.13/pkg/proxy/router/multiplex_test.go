@@ -0,0 +1,94 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestBackendMultiplex(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, addr, "", false))
+	}
+	serve := func() (net.Conn, *bufio.Reader) {
+		c1, c2 := net.Pipe()
+		go NewSessionSize(c1, "", 1024, 1800).Serve(s, 16)
+		c2.SetDeadline(time.Now().Add(time.Second * 5))
+		return c2, bufio.NewReader(c2)
+	}
+	get := func(c net.Conn, r *bufio.Reader) {
+		_, err := c.Write([]byte("GET a\r\nGET b\r\n"))
+		assert.MustNoError(err)
+		for _, expect := range []string{"$1\r\n", "v\r\n", "$1\r\n", "v\r\n"} {
+			line, err := r.ReadString('\n')
+			assert.MustNoError(err)
+			assert.Must(line == expect)
+		}
+	}
+	// 等待会话结束，关闭独占的连接
+	wait := func(n int) {
+		for i := 0; i < 100 && s.BackendConns() != n; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Must(s.BackendConns() == n)
+	}
+
+	c1, r1 := serve()
+	get(c1, r1)
+	c2, r2 := serve()
+	get(c2, r2)
+	assert.Must(s.BackendConns() == 1)
+	c1.Close()
+	c2.Close()
+
+	SetBackendMultiplex(false)
+	defer SetBackendMultiplex(true)
+	c1, r1 = serve()
+	get(c1, r1)
+	c2, r2 = serve()
+	get(c2, r2)
+	assert.Must(s.BackendConns() == 3)
+	c1.Close()
+	wait(2)
+	c2.Close()
+	wait(1)
+}
+
+func TestBackendAffinity(t *testing.T) {
+	SetBackendPoolSize(3)
+	defer SetBackendPoolSize(1)
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, "backend:6379", "", false))
+	bc := s.slots[0].backend.bc
+	assert.Must(bc.Conns() == 3 && s.BackendConns() == 3 && BackendAffinity())
+
+	// 同一个会话总是使用同一个连接
+	var used = make(map[*BackendConn]bool)
+	for i := 0; i < 3; i++ {
+		used[bc.conn(&Request{session: 7})] = true
+	}
+	assert.Must(len(used) == 1)
+
+	SetBackendAffinity(false)
+	defer SetBackendAffinity(true)
+	assert.Must(!BackendAffinity())
+	for i := 0; i < 3; i++ {
+		used[bc.conn(&Request{session: 7})] = true
+	}
+	assert.Must(len(used) == 3)
+}
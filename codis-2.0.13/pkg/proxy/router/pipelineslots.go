@@ -0,0 +1,63 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "sync"
+
+// 客户端一次连续发送的命令，即同一批 pipeline 中，已经转发的请求所在的 slot
+// 同时发往的 slot 超过 MaxPipelineSlots 时，等待之前的请求全部返回之后再转发，相当于把 pipeline 拆成几段依次执行
+type pipelineSlots struct {
+	slots map[int]bool
+	waits []*sync.WaitGroup
+	hit   bool // 当前 pipeline 已经达到过上限，只计数一次
+}
+
+// 在转发请求之前调用，需要等待时阻塞到之前的请求全部返回
+// 没有key的命令，比如广播的命令，不受限制；一条命令本身超过上限时只是单独执行
+func (s *Session) limitPipelineSlots(r *Request) {
+	p := s.pipeline
+	if p == nil {
+		p = &pipelineSlots{slots: make(map[int]bool)}
+		s.pipeline = p
+	}
+	var slots []int
+	for _, key := range requestKeys(r.OpStr, r.Resp) {
+		if i := hashSlot(key); !p.slots[i] && !hasSlot(slots, i) {
+			slots = append(slots, i)
+		}
+	}
+	if len(slots) == 0 {
+		return
+	}
+	if len(p.slots) != 0 && len(p.slots)+len(slots) > s.MaxPipelineSlots {
+		if !p.hit {
+			p.hit = true
+			incrPipelineSlotLimits()
+		}
+		for _, w := range p.waits {
+			w.Wait()
+		}
+		p.slots, p.waits = make(map[int]bool), nil
+	}
+	for _, i := range slots {
+		p.slots[i] = true
+	}
+	p.waits = append(p.waits, r.Wait)
+}
+
+func hasSlot(slots []int, i int) bool {
+	for _, x := range slots {
+		if x == i {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端发送的命令都处理完之后，下一批命令是新的 pipeline
+func (p *pipelineSlots) reset() {
+	if len(p.slots) != 0 || p.hit {
+		p.slots, p.waits, p.hit = make(map[int]bool), nil, false
+	}
+}
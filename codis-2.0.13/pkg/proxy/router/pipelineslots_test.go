@@ -0,0 +1,72 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestPipelineSlots(t *testing.T) {
+	// 后端在测试释放之前不返回
+	var dispatched = make(chan *Request, 16)
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		r.Wait.Add(1)
+		r.Response.Resp = redis.NewString([]byte("OK"))
+		dispatched <- r
+	}}
+	s := &Session{MaxPipelineSlots: 2}
+	n := PipelineSlotLimitCounts()
+	send := func(args ...string) {
+		_, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+	}
+
+	// 同一个 slot 的请求和没有key的命令不受限制
+	send("SET", "{a}1", "x")
+	send("SET", "{a}2", "x")
+	send("GET", "{b}1")
+	send("ECHO", "x")
+	assert.Must(len(dispatched) == 4)
+	r1, r2, r3 := <-dispatched, <-dispatched, <-dispatched
+	(<-dispatched).Wait.Done()
+
+	// 第三个 slot 需要等待之前的请求全部返回
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send("GET", "{c}1")
+		send("GET", "{c}2")
+	}()
+	time.Sleep(time.Millisecond * 50)
+	assert.Must(len(dispatched) == 0)
+	r1.Wait.Done()
+	r2.Wait.Done()
+	time.Sleep(time.Millisecond * 50)
+	assert.Must(len(dispatched) == 0)
+	r3.Wait.Done()
+	<-done
+	assert.Must(len(dispatched) == 2 && PipelineSlotLimitCounts() == n+1)
+	(<-dispatched).Wait.Done()
+	(<-dispatched).Wait.Done()
+
+	// 同一批 pipeline 中再次达到上限不重复计数
+	send("GET", "{a}1")
+	(<-dispatched).Wait.Done()
+	send("GET", "{b}1")
+	(<-dispatched).Wait.Done()
+	assert.Must(PipelineSlotLimitCounts() == n+1)
+
+	// 新的 pipeline 重新开始
+	s.pipeline.reset()
+	send("MGET", "{d}1", "{d}2")
+	send("GET", "{e}1")
+	assert.Must(len(dispatched) == 3 && PipelineSlotLimitCounts() == n+1)
+	for i := 0; i < 3; i++ {
+		(<-dispatched).Wait.Done()
+	}
+}
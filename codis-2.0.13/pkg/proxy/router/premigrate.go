@@ -0,0 +1,54 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// slot处于预迁移状态时的处理，dashboard 在等待所有proxy确认新的路由，这时命令应该发往哪个group还不确定
+const (
+	PreMigrateWait     = "wait"     // 阻塞直到slot开始迁移
+	PreMigrateTryAgain = "tryagain" // 重试几次之后返回 TRYAGAIN 错误，由客户端重试
+)
+
+var preMigrate struct {
+	tryagain bool
+	retries  int
+	delay    time.Duration
+}
+
+// 需要在开始处理请求之前设置
+func SetPreMigratePolicy(policy string, retries int, delay time.Duration) {
+	preMigrate.tryagain = policy == PreMigrateTryAgain
+	preMigrate.retries = retries
+	preMigrate.delay = delay
+}
+
+// 预迁移状态下是否直接返回错误，不等待slot的阻塞结束
+func (s *Slot) rejectPreMigrate() bool {
+	if !s.premigrate.Get() {
+		return false
+	}
+	incrPreMigrateHits()
+	if !preMigrate.tryagain {
+		return false
+	}
+	for i := 0; i < preMigrate.retries; i++ {
+		time.Sleep(preMigrate.delay)
+		if !s.premigrate.Get() {
+			return false
+		}
+	}
+	incrPreMigrateRejects()
+	return true
+}
+
+// 和 redis cluster 一样使用 TRYAGAIN 前缀，客户端可以据此重试
+func (s *Slot) tryAgain() *redis.Resp {
+	return redis.NewError([]byte(fmt.Sprintf("TRYAGAIN slot %d is being migrated, try again later", s.id)))
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+)
+
+// 高优先级的命令在每个后端连接的队列中先于其它命令发送，后端拥塞时保护对延迟敏感的请求
+// 已经发送给后端的请求不受影响，后端仍然按照收到的顺序执行
+// 只会越过其它会话的请求，同一个会话在普通队列中还有请求时仍然排在后面，保证同一个会话的命令按顺序执行
+var priority struct {
+	commands map[string]bool // 高优先级的命令
+	users    map[string]bool // acl_users 中的用户，登录为这些用户的会话的全部命令都是高优先级
+}
+
+// 需要在创建后端连接之前设置，都为空时所有命令的优先级相同，和原来一样只有一个队列
+func SetHighPriority(commands, users []string) {
+	priority.commands = make(map[string]bool, len(commands))
+	for _, name := range commands {
+		priority.commands[strings.ToUpper(name)] = true
+	}
+	priority.users = make(map[string]bool, len(users))
+	for _, name := range users {
+		priority.users[name] = true
+	}
+}
+
+func PriorityEnabled() bool {
+	return len(priority.commands) != 0 || len(priority.users) != 0
+}
+
+func (s *Session) isUrgent(opstr string) bool {
+	if !PriorityEnabled() {
+		return false
+	}
+	if s.user != nil && priority.users[s.user.Name] {
+		return true
+	}
+	return priority.commands[opstr]
+}
+
+// 每个优先级的请求在后端队列中等待的时间
+type queueWait struct {
+	requests atomic2.Int64
+	usecs    atomic2.Int64
+}
+
+func (w *queueWait) add(r *Request) {
+	if r.queued != 0 {
+		w.requests.Incr()
+		w.usecs.Add(microseconds() - r.queued)
+	}
+}
+
+type PriorityQueue struct {
+	Queued   int   `json:"queued"`
+	QueueCap int   `json:"queue_cap"`
+	Requests int64 `json:"requests"`    // 从队列中取出的请求数
+	WaitUs   int64 `json:"avg_wait_us"` // 在队列中的平均等待时间
+}
+
+func (q *PriorityQueue) add(input chan *Request, w *queueWait) {
+	q.Queued += len(input)
+	q.QueueCap += cap(input)
+	q.Requests += w.requests.Get()
+	q.WaitUs += w.usecs.Get()
+}
+
+func (q *PriorityQueue) average() {
+	if q.Requests != 0 {
+		q.WaitUs /= q.Requests
+	}
+}
+
+// 每个会话在普通队列中等待发送的请求数，包括因为排在后面而没有放入高优先级队列的请求
+type sessionQueued struct {
+	sync.Mutex
+	m map[int64]int
+}
+
+// 设置了优先级时把请求放入其中一个队列
+// 会话在普通队列中还有请求时，高优先级的请求也放入普通队列，否则会先于之前的请求发送，比如 pipeline 中 SET 之后的 GET 会读到旧的值
+func (bc *BackendConn) pushPriority(r *Request) {
+	r.queued = microseconds()
+	q := &bc.sessions
+	q.Lock()
+	if r.urgent && q.m[r.session] == 0 {
+		q.Unlock()
+		bc.urgent <- r
+		return
+	}
+	if q.m == nil {
+		q.m = make(map[int64]int)
+	}
+	q.m[r.session]++
+	q.Unlock()
+	bc.input <- r
+}
+
+// 从普通队列中取出了请求
+func (bc *BackendConn) popNormal(r *Request) {
+	bc.waits[0].add(r)
+	q := &bc.sessions
+	q.Lock()
+	if q.m[r.session]--; q.m[r.session] <= 0 {
+		delete(q.m, r.session)
+	}
+	q.Unlock()
+}
+
+// 下一个需要发送的请求，先取高优先级的队列，关闭之后两个队列都取完时返回false
+func (bc *BackendConn) next() (*Request, bool) {
+	if bc.urgent == nil {
+		r, ok := <-bc.input
+		return r, ok
+	}
+	select {
+	case r, ok := <-bc.urgent:
+		if ok {
+			bc.waits[1].add(r)
+			return r, true
+		}
+	default:
+	}
+	select {
+	case r, ok := <-bc.urgent:
+		if ok {
+			bc.waits[1].add(r)
+			return r, true
+		}
+		if r, ok = <-bc.input; ok {
+			bc.popNormal(r)
+		}
+		return r, ok
+	case r, ok := <-bc.input:
+		if ok {
+			bc.popNormal(r)
+			return r, true
+		}
+		if r, ok = <-bc.urgent; ok {
+			bc.waits[1].add(r)
+		}
+		return r, ok
+	}
+}
+
+// 两个队列中等待发送的请求数
+func (bc *BackendConn) queued() int {
+	if bc.urgent == nil {
+		return len(bc.input)
+	}
+	return len(bc.input) + len(bc.urgent)
+}
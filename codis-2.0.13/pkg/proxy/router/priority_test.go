@@ -0,0 +1,82 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	SetHighPriority([]string{"get"}, []string{"monitor"})
+	defer SetHighPriority(nil, nil)
+
+	s := &Session{}
+	assert.Must(s.isUrgent("GET") && !s.isUrgent("SET"))
+	s.user = &ACLUser{Name: "monitor"}
+	assert.Must(s.isUrgent("SET"))
+
+	bc := &BackendConn{input: make(chan *Request, 4), urgent: make(chan *Request, 4)}
+	low, high := []*Request{{OpStr: "SET", session: 1}, {OpStr: "SET", session: 1}}, &Request{OpStr: "GET", session: 2, urgent: true}
+	bc.PushBack(low[0])
+	bc.PushBack(low[1])
+	bc.PushBack(high)
+	assert.Must(bc.queued() == 3 && len(bc.urgent) == 1)
+
+	// 高优先级的请求先取出，之后按加入的顺序
+	for _, x := range []*Request{high, low[0], low[1]} {
+		r, ok := bc.next()
+		assert.Must(ok && r == x)
+	}
+	assert.Must(bc.waits[1].requests.Get() == 1 && bc.waits[0].requests.Get() == 2)
+
+	// 关闭之后取完两个队列中剩下的请求
+	bc.PushBack(low[0])
+	bc.PushBack(high)
+	bc.Close()
+	for _, x := range []*Request{high, low[0]} {
+		r, ok := bc.next()
+		assert.Must(ok && r == x)
+	}
+	_, ok := bc.next()
+	assert.Must(!ok)
+}
+
+// 高优先级的请求不会越过同一个会话排在前面的请求
+func TestPrioritySessionOrder(t *testing.T) {
+	SetHighPriority([]string{"get"}, nil)
+	defer SetHighPriority(nil, nil)
+
+	bc := &BackendConn{input: make(chan *Request, 8), urgent: make(chan *Request, 8)}
+	set := &Request{OpStr: "SET", session: 1}
+	get := &Request{OpStr: "GET", session: 1, urgent: true}
+	other := &Request{OpStr: "GET", session: 2, urgent: true}
+	bc.PushBack(set)
+	bc.PushBack(get)
+	bc.PushBack(other)
+	assert.Must(len(bc.urgent) == 1 && len(bc.input) == 2)
+	for _, x := range []*Request{other, set, get} {
+		r, ok := bc.next()
+		assert.Must(ok && r == x)
+	}
+	assert.Must(len(bc.sessions.m) == 0)
+
+	// 普通队列中没有这个会话的请求之后，又可以先发送
+	bc.PushBack(&Request{OpStr: "SET", session: 2})
+	bc.PushBack(get)
+	assert.Must(len(bc.urgent) == 1)
+}
+
+func TestPriorityDisabled(t *testing.T) {
+	SetHighPriority(nil, nil)
+	assert.Must(!PriorityEnabled() && !(&Session{}).isUrgent("GET"))
+
+	bc := &BackendConn{input: make(chan *Request, 4)}
+	r := &Request{OpStr: "GET", urgent: true}
+	bc.PushBack(r)
+	assert.Must(r.queued == 0 && len(bc.input) == 1)
+	x, ok := bc.next()
+	assert.Must(ok && x == r)
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 客户端在窗口内的错误超过上限之后的处理
+const (
+	QuarantineClose    = "close"    // 关闭连接
+	QuarantineThrottle = "throttle" // 暂停读取这个连接的请求
+)
+
+var quarantine struct {
+	errors   int64 // 窗口内允许的错误数，超过之后隔离，0表示不开启
+	window   int64 // 单位 us
+	action   string
+	duration time.Duration // throttle 暂停读取的时间，也是来源ip留在黑名单中的时间
+	denylist bool
+
+	mu     sync.Mutex
+	denied map[string]time.Time // 来源ip -> 移出黑名单的时间
+}
+
+// 客户端在 window 内出现超过 errors 次协议错误或者非法命令时按 action 隔离，开启 denylist 时来源ip在 duration 内不能建立新连接
+func SetQuarantine(errors int, window time.Duration, action string, duration time.Duration, denylist bool) {
+	quarantine.errors = int64(errors)
+	quarantine.window = int64(window / time.Microsecond)
+	quarantine.action = action
+	quarantine.duration = duration
+	quarantine.denylist = denylist
+	quarantine.mu.Lock()
+	quarantine.denied = make(map[string]time.Time)
+	quarantine.mu.Unlock()
+}
+
+// 记录一次由客户端导致的错误，超过上限时标记会话需要隔离
+func (s *Session) clientError() {
+	if quarantine.errors == 0 {
+		return
+	}
+	if now := microseconds(); now-s.errsince > quarantine.window {
+		s.errsince, s.errcount = now, 0
+	}
+	if s.errcount++; s.errcount > quarantine.errors {
+		s.quarantined = true
+	}
+}
+
+// 读取请求时的协议错误，连接断开和超时不算
+func isProtocolError(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case net.Error:
+		return false
+	default:
+		return err != io.EOF && err != io.ErrUnexpectedEOF
+	}
+}
+
+// 隔离当前会话，closing 表示连接已经因为出错要关闭了，只需要计数和加入黑名单
+// 关闭连接时和 QUIT 一样，先把已经读取的命令的结果返回给客户端
+func (s *Session) quarantine(closing bool) {
+	incrQuarantines()
+	log.Warnf("session [%d] quarantined: %s, more than %d errors in %s, action = %s",
+		s.id, s, quarantine.errors, time.Duration(quarantine.window)*time.Microsecond, quarantine.action)
+	if quarantine.denylist {
+		if host, _, err := net.SplitHostPort(s.Sock.RemoteAddr().String()); err == nil {
+			quarantine.mu.Lock()
+			quarantine.denied[host] = time.Now().Add(quarantine.duration)
+			quarantine.mu.Unlock()
+		}
+	}
+	s.quarantined, s.errcount = false, 0
+	switch {
+	case closing:
+	case quarantine.action == QuarantineThrottle:
+		time.Sleep(quarantine.duration)
+		s.errsince = microseconds()
+	default:
+		s.quit = true
+	}
+}
+
+// 新连接的来源ip是否在黑名单中，在的话计数并返回 true，由调用方关闭连接
+func IsDenied(addr net.Addr) bool {
+	if !quarantine.denylist {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	quarantine.mu.Lock()
+	defer quarantine.mu.Unlock()
+	until, ok := quarantine.denied[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(quarantine.denied, host)
+		return false
+	}
+	incrDeniedConns()
+	return true
+}
+
+// 黑名单中的来源ip
+type DeniedClient struct {
+	Addr  string `json:"addr"`
+	Until string `json:"until"`
+}
+
+func DeniedClients() []*DeniedClient {
+	quarantine.mu.Lock()
+	defer quarantine.mu.Unlock()
+	var list []*DeniedClient
+	var now = time.Now()
+	for host, until := range quarantine.denied {
+		if now.After(until) {
+			delete(quarantine.denied, host)
+			continue
+		}
+		list = append(list, &DeniedClient{Addr: host, Until: until.String()})
+	}
+	sort.Sort(deniedClients(list))
+	return list
+}
+
+type deniedClients []*DeniedClient
+
+func (l deniedClients) Len() int           { return len(l) }
+func (l deniedClients) Less(i, j int) bool { return l[i].Addr < l[j].Addr }
+func (l deniedClients) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
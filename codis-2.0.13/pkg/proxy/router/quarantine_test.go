@@ -0,0 +1,69 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// 检查参数个数并且直接回复 PING 的会话
+func checkedSession(s *Session) {
+	s.CheckArity = true
+	s.LocalPing = true
+}
+
+func TestQuarantineClose(t *testing.T) {
+	SetQuarantine(2, time.Minute, QuarantineClose, time.Minute, true)
+	defer SetQuarantine(0, 0, QuarantineClose, 0, false)
+
+	n := QuarantineCounts()
+	c, _, _ := serveSession(&fakeDispatcher{}, checkedSession)
+	defer c.Close()
+
+	_, err := c.Write([]byte("GET\r\nGET\r\nGET\r\nPING\r\n"))
+	assert.MustNoError(err)
+	r := bufio.NewReader(c)
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		assert.MustNoError(err)
+		assert.Must(line == "-ERR wrong number of arguments for 'get' command\r\n")
+	}
+	// 第三个非法命令之后连接被关闭，PING 不会被处理
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = r.ReadString('\n')
+	assert.Must(err != nil)
+	assert.Must(QuarantineCounts() == n+1)
+
+	// 来源ip在黑名单中
+	assert.Must(IsDenied(c.LocalAddr()))
+	list := DeniedClients()
+	assert.Must(len(list) == 1 && list[0].Addr == "127.0.0.1")
+}
+
+func TestQuarantineThrottle(t *testing.T) {
+	const duration = time.Millisecond * 200
+	SetQuarantine(1, time.Minute, QuarantineThrottle, duration, false)
+	defer SetQuarantine(0, 0, QuarantineClose, 0, false)
+
+	c, _, _ := serveSession(&fakeDispatcher{}, checkedSession)
+	defer c.Close()
+
+	start := time.Now()
+	_, err := c.Write([]byte("GET\r\nGET\r\nPING\r\n"))
+	assert.MustNoError(err)
+	r := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		_, err := r.ReadString('\n')
+		assert.MustNoError(err)
+	}
+	// 暂停读取之后连接继续工作
+	line, err := r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "+PONG\r\n" && time.Since(start) >= duration)
+	assert.Must(!IsDenied(c.LocalAddr()))
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 开启之后 RANDOMKEY 按照每个后端的 DBSIZE 选择后端，需要在处理请求之前设置
+// DBSIZE 由事件循环定期获取，不会在每次 RANDOMKEY 时发送
+var randomKeyWeighted bool
+
+func SetRandomKeyWeighted(enabled bool) {
+	randomKeyWeighted = enabled
+}
+
+// randomkey命令只发送给随机选择的一个后端，返回nil时再尝试下一个，全部为空时返回nil
+// 返回的是某一个后端中随机的key，不是所有key中均匀随机的，开启 randomKeyWeighted 时按照最近获取的key的数量选择后端，
+// 这样每个key被返回的概率大致相同
+func (s *Session) handleRequestRandomKey(r *Request, d Dispatcher) (*Request, error) {
+	if len(r.Resp.Array) != 1 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'RANDOMKEY' command"))
+		return r, nil
+	}
+	addrs := randomBackends(d.Backends())
+	if len(addrs) == 0 {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s", ErrNoBackend)))
+		return r, nil
+	}
+	r.Wait.Add(1)
+	go func() {
+		defer r.Wait.Done()
+		for _, addr := range addrs {
+			x := &Request{
+				OpStr: r.OpStr,
+				Start: r.Start,
+				Resp:  r.Resp,
+				Wait:  &sync.WaitGroup{},
+
+				session: r.session,
+				urgent:  r.urgent,
+			}
+			if err := d.DispatchTo(addr, x); err != nil {
+				r.setResponse(redis.NewError([]byte(fmt.Sprintf("ERR %s", err))), nil)
+				return
+			}
+			x.Wait.Wait()
+			resp, err := x.Response.Resp, x.Response.Err
+			switch {
+			case err != nil:
+				resp = redis.NewError([]byte(fmt.Sprintf("ERR RANDOMKEY failed on %s, %s", addr, err)))
+			case resp == nil:
+				resp = redis.NewError([]byte(fmt.Sprintf("ERR RANDOMKEY failed on %s, %s", addr, ErrRespIsRequired)))
+			case resp.IsBulkBytes() && resp.Value == nil:
+				continue
+			}
+			r.setResponse(resp, nil)
+			return
+		}
+		r.setResponse(staticReply(replyNil), nil)
+	}()
+	return r, nil
+}
+
+// 尝试后端的顺序，按照key的数量加权随机排列，key的数量未知或者为0时权重为1
+func randomBackends(keys map[string]int64) []string {
+	var addrs = make([]string, 0, len(keys))
+	for addr := range keys {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var weights = make([]int64, len(addrs))
+	var total int64
+	for i, addr := range addrs {
+		w := int64(1)
+		if randomKeyWeighted && keys[addr] > 0 {
+			w = keys[addr]
+		}
+		weights[i] = w
+		total += w
+	}
+	var order = make([]string, 0, len(addrs))
+	for len(addrs) != 0 {
+		n := rand.Int63n(total)
+		i := 0
+		for ; n >= weights[i]; i++ {
+			n -= weights[i]
+		}
+		order = append(order, addrs[i])
+		total -= weights[i]
+		addrs = append(addrs[:i], addrs[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return order
+}
+
+// 通过 DBSIZE 获取每个master的key的数量，每个后端同时只有一个 DBSIZE 请求
+// 开启 randomkey_weighted 时由事件循环定期调用，不等待结果返回
+func (s *Router) CheckKeyCounts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	var seen = make(map[*SharedBackendConn]bool)
+	for _, slot := range s.slots {
+		bc := slot.backend.bc
+		if bc == nil || seen[bc] {
+			continue
+		}
+		seen[bc] = true
+		if bc.keyCheck.CompareAndSwap(false, true) {
+			go bc.checkKeyCount()
+		}
+	}
+}
+
+func (s *SharedBackendConn) checkKeyCount() {
+	defer s.keyCheck.Set(false)
+	r := &Request{
+		OpStr: "DBSIZE",
+		Resp:  redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("DBSIZE"))}),
+		Wait:  &sync.WaitGroup{},
+	}
+	s.BackendConn.PushBack(r)
+	r.Wait.Wait()
+
+	n := int64(-1)
+	if resp := r.Response.Resp; r.Response.Err == nil && resp != nil && resp.IsInt() {
+		if v, err := strconv.ParseInt(string(resp.Value), 10, 64); err == nil {
+			n = v
+		}
+	}
+	if old := s.keyCount.Swap(n); old != n && (old < 0 || n < 0) {
+		log.Infof("backend conn [%p] to %s, key count = %d -> %d", s, s.addr, old, n)
+	}
+}
+
+// 所有slot所在的master，值是最近一次获取的key的数量，-1表示还没有获取、获取失败或者没有开启 randomkey_weighted
+func (s *Router) Backends() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m = make(map[string]int64)
+	for _, slot := range s.slots {
+		if bc := slot.backend.bc; bc != nil {
+			m[bc.addr] = bc.keyCount.Get()
+		}
+	}
+	return m
+}
+
+// 将请求发送给指定地址的后端，用于只需要一个后端回复的命令，比如 RANDOMKEY
+func (s *Router) DispatchTo(addr string, r *Request) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosedRouter
+	}
+	bc := s.pool[addr]
+	if bc == nil {
+		s.mu.Unlock()
+		return ErrNoBackend
+	}
+	// 持有连接的引用，避免发送过程中连接被关闭
+	bc.IncrRefcnt()
+	s.mu.Unlock()
+
+	if bc.disabled.Get() {
+		r.setResponse(bc.rejectDisabled(), nil)
+	} else {
+		bc.PushBack(r)
+	}
+
+	s.mu.Lock()
+	s.putBackendConn(bc)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestRandomKeyBackends(t *testing.T) {
+	l1, empty := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"RANDOMKEY": redis.NewBulkBytes(nil),
+		"DBSIZE":    redis.NewInt([]byte("0")),
+	}))
+	defer l1.Close()
+	l2, full := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"RANDOMKEY": redis.NewBulkBytes([]byte("k")),
+		"DBSIZE":    redis.NewInt([]byte("42")),
+	}))
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		addr := empty
+		if i%2 == 1 {
+			addr = full
+		}
+		assert.MustNoError(s.FillSlot(i, addr, "", false))
+	}
+	keys := s.Backends()
+	assert.Must(len(keys) == 2 && keys[empty] == -1 && keys[full] == -1)
+
+	// 空的后端返回nil之后再发送给另一个后端
+	c := &Session{}
+	for i := 0; i < 4; i++ {
+		assert.Must(string(doRequest(c, s, "RANDOMKEY").Value) == "k")
+	}
+
+	s.CheckKeyCounts()
+	for i := 0; s.Backends()[empty] < 0 || s.Backends()[full] < 0; i++ {
+		assert.Must(i < 100)
+		time.Sleep(time.Millisecond * 10)
+	}
+	keys = s.Backends()
+	assert.Must(keys[empty] == 0 && keys[full] == 42)
+	assert.Must(s.DispatchTo("127.0.0.1:1", &Request{}) == ErrNoBackend)
+}
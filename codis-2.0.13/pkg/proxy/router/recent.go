@@ -0,0 +1,67 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "github.com/CodisLabs/codis/pkg/proxy/redis"
+
+// 每个会话最多记录的最近写入的key数量
+const MaxRecentWrites = 1024
+
+// 会话最近写入的key，在 window 之内读取这些key时发送给master，避免slave的同步延迟导致读不到刚写入的数据
+type recentWrites struct {
+	window int64            // usecs
+	keys   map[string]int64 // key的最后写入时间
+	all    int64            // 记录的key超过上限时的时间，在这之后 window 之内的读取全部发送给master
+}
+
+func newRecentWrites(window int64) *recentWrites {
+	return &recentWrites{window: window, keys: make(map[string]int64)}
+}
+
+// 记录写命令的全部key
+func (w *recentWrites) add(c *Command, resp *redis.Resp, usnow int64) {
+	for _, key := range commandKeys(c, resp) {
+		if len(w.keys) >= MaxRecentWrites {
+			w.expire(usnow)
+		}
+		// 过期之后仍然太多，不再逐个记录
+		if len(w.keys) >= MaxRecentWrites {
+			w.keys = make(map[string]int64)
+			w.all = usnow
+			return
+		}
+		w.keys[string(key)] = usnow
+	}
+}
+
+func (w *recentWrites) expire(usnow int64) {
+	for key, t := range w.keys {
+		if usnow-t >= w.window {
+			delete(w.keys, key)
+		}
+	}
+}
+
+// 是否有key在 window 之内被写入过
+func (w *recentWrites) has(c *Command, resp *redis.Resp, usnow int64) bool {
+	if usnow-w.all < w.window {
+		return true
+	}
+	for _, key := range commandKeys(c, resp) {
+		if t, ok := w.keys[string(key)]; ok && usnow-t < w.window {
+			return true
+		}
+	}
+	return false
+}
+
+// 按照命令表中key的位置获取命令的全部key
+func commandKeys(c *Command, resp *redis.Resp) [][]byte {
+	var keys [][]byte
+	first, last, step := c.keyRange(len(resp.Array))
+	for i := first; i <= last; i += step {
+		keys = append(keys, resp.Array[i].Value)
+	}
+	return keys
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 开启读slave时，只读命令允许的slave复制延迟，单位秒，延迟超过时发送给master
+// 没有配置的命令不受限制，和原来一样可以读任意的slave
+var replicaLag struct {
+	commands map[string]int64 // 命令 -> 允许的延迟，* 表示其它只读命令
+	users    map[string]int64 // acl_users 中的用户 -> 允许的延迟，优先于命令的配置，default 表示没有登录为 acl 用户的会话
+}
+
+// 需要在开始处理请求之前设置
+func SetReplicaLagTolerance(commands, users map[string]int) {
+	replicaLag.commands = make(map[string]int64, len(commands))
+	for name, n := range commands {
+		replicaLag.commands[strings.ToUpper(name)] = int64(n)
+	}
+	replicaLag.users = make(map[string]int64, len(users))
+	for name, n := range users {
+		replicaLag.users[name] = int64(n)
+	}
+}
+
+// 是否需要定期获取slave的复制延迟
+func ReplicaLagEnabled() bool {
+	return len(replicaLag.commands) != 0 || len(replicaLag.users) != 0
+}
+
+// 请求允许的slave复制延迟，没有限制时返回false
+func (s *Session) maxReplicaLag(opstr string) (int64, bool) {
+	if !ReplicaLagEnabled() {
+		return 0, false
+	}
+	user := "default"
+	if s.user != nil {
+		user = s.user.Name
+	}
+	if n, ok := replicaLag.users[user]; ok {
+		return n, true
+	}
+	if n, ok := replicaLag.commands[opstr]; ok {
+		return n, true
+	}
+	n, ok := replicaLag.commands["*"]
+	return n, ok
+}
+
+// slave的复制延迟不超过 max 秒，还没有获取到延迟或者和master断开时返回false
+func (s *SharedBackendConn) isFresh(max int64) bool {
+	lag := s.lag.Get()
+	return lag >= 0 && lag <= max
+}
+
+// 通过 INFO replication 获取所有slave的复制延迟，每个slave同时只有一个 INFO 请求
+// 由事件循环定期调用，不等待结果返回
+func (s *Router) CheckReplicaLag() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	var seen = make(map[*SharedBackendConn]bool)
+	for _, slot := range s.slots {
+		for _, bc := range slot.replicas.bcs {
+			if seen[bc] {
+				continue
+			}
+			seen[bc] = true
+			if bc.lagCheck.CompareAndSwap(false, true) {
+				go bc.checkLag()
+			}
+		}
+	}
+}
+
+func (s *SharedBackendConn) checkLag() {
+	defer s.lagCheck.Set(false)
+	r := &Request{
+		OpStr: "INFO",
+		Resp: redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("INFO")),
+			redis.NewBulkBytes([]byte("replication")),
+		}),
+		Wait: &sync.WaitGroup{},
+	}
+	s.BackendConn.PushBack(r)
+	r.Wait.Wait()
+
+	lag := int64(-1)
+	if resp := r.Response.Resp; r.Response.Err == nil && resp != nil && resp.IsBulkBytes() {
+		lag = parseReplicaLag(string(resp.Value))
+	}
+	if old := s.lag.Swap(lag); old != lag && (old < 0 || lag < 0) {
+		log.Warnf("backend conn [%p] to %s, replica lag = %d -> %d", s, s.addr, old, lag)
+	}
+}
+
+// 使用 master_last_io_seconds_ago 作为复制延迟，不是slave或者和master断开时返回-1
+func parseReplicaLag(info string) int64 {
+	var slave, up bool
+	var lag int64 = -1
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key, value := line[:i], line[i+1:]
+		switch key {
+		case "role":
+			slave = value == "slave"
+		case "master_link_status":
+			up = value == "up"
+		case "master_last_io_seconds_ago":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				lag = n
+			}
+		}
+	}
+	if !slave || !up {
+		return -1
+	}
+	return lag
+}
+
+// 所有slave最近一次获取的复制延迟，单位秒，-1表示未知或者和master断开
+func (s *Router) ReplicaLags() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m = make(map[string]int64)
+	for _, slot := range s.slots {
+		for _, bc := range slot.replicas.bcs {
+			m[bc.addr] = bc.lag.Get()
+		}
+	}
+	return m
+}
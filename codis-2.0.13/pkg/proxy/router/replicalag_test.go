@@ -0,0 +1,79 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestParseReplicaLag(t *testing.T) {
+	info := "# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:3\r\n"
+	assert.Must(parseReplicaLag(info) == 3)
+	assert.Must(parseReplicaLag("# Replication\r\nrole:master\r\nconnected_slaves:1\r\n") == -1)
+	assert.Must(parseReplicaLag("role:slave\r\nmaster_link_status:down\r\nmaster_last_io_seconds_ago:-1\r\n") == -1)
+	assert.Must(parseReplicaLag("role:slave\r\nmaster_link_status:up\r\n") == -1)
+}
+
+func replicaServer(name string, lag string) (func(), string) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET":  redis.NewBulkBytes([]byte(name)),
+		"TTL":  redis.NewBulkBytes([]byte(name)),
+		"INFO": redis.NewBulkBytes([]byte("role:slave\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:" + lag + "\r\n")),
+	}))
+	return func() { l.Close() }, addr
+}
+
+func TestReplicaLag(t *testing.T) {
+	close1, master := replicaServer("master", "0")
+	defer close1()
+	close2, fresh := replicaServer("fresh", "1")
+	defer close2()
+	close3, stale := replicaServer("stale", "20")
+	defer close3()
+
+	reader, err := ParseACLUser("reader secret *")
+	assert.MustNoError(err)
+	SetACLUsers([]*ACLUser{reader})
+	defer SetACLUsers(nil)
+	SetReplicaLagTolerance(map[string]int{"get": 5, "TTL": 0}, map[string]int{"reader": 30})
+	defer SetReplicaLagTolerance(nil, nil)
+	assert.Must(ReplicaLagEnabled())
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, master, "", false))
+		assert.MustNoError(s.SetSlotReplicas(i, []string{fresh, stale}))
+	}
+	// 获取到延迟之前都从master读取
+	c := &Session{ReadReplica: true}
+	assert.Must(string(doRequest(c, s, "GET", "k").Value) == "master")
+
+	s.CheckReplicaLag()
+	for i := 0; s.ReplicaLags()[stale] < 0 || s.ReplicaLags()[fresh] < 0; i++ {
+		assert.Must(i < 100)
+		time.Sleep(time.Millisecond * 10)
+	}
+	lags := s.ReplicaLags()
+	assert.Must(lags[fresh] == 1 && lags[stale] == 20)
+
+	n := ReplicaLagRedirectCounts()
+	for i := 0; i < 4; i++ {
+		assert.Must(string(doRequest(c, s, "GET", "k").Value) == "fresh")
+	}
+	assert.Must(string(doRequest(c, s, "TTL", "k").Value) == "master")
+	assert.Must(ReplicaLagRedirectCounts() == n+1)
+
+	// 用户的配置优先于命令的配置
+	c.user = reader
+	var seen = make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[string(doRequest(c, s, "TTL", "k").Value)] = true
+	}
+	assert.Must(seen["fresh"] && seen["stale"] && !seen["master"])
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var replyBuffer struct {
+	max   int64         // 每个会话已经从后端返回、还没有发送给客户端的回复的大小上限，0表示不限制
+	grace time.Duration // 超过上限持续这么久之后关闭连接，0表示只暂停处理新的请求
+}
+
+// 客户端不读取回复时回复会堆积在proxy中，超过 max 之后暂停处理这个客户端的新的请求，持续超过 grace 之后关闭连接
+// 需要在开始处理请求之前设置
+func SetMaxResponseBuffer(max int64, grace time.Duration) {
+	replyBuffer.max, replyBuffer.grace = max, grace
+}
+
+var ErrResponseBufferFull = errors.New("client is not reading replies")
+
+// 一条请求已经返回的回复的大小，拆分出的子请求和重试的请求共用，发送给客户端之后从会话的统计中减去
+type replyBytes struct {
+	n       atomic2.Int64
+	session *atomic2.Int64
+}
+
+func (b *replyBytes) add(resp *redis.Resp) {
+	if b == nil || resp == nil {
+		return
+	}
+	n := respSize(resp)
+	b.n.Add(n)
+	b.session.Add(n)
+}
+
+func (b *replyBytes) release() {
+	if b != nil {
+		b.session.Sub(b.n.Get())
+	}
+}
+
+// 和 redis.Decoder 统计 Resp 的大小的方法相同
+func respSize(resp *redis.Resp) int64 {
+	n := int64(redis.RespOverhead + len(resp.Value))
+	for _, x := range resp.Array {
+		n += respSize(x)
+	}
+	return n
+}
+
+// 回复超过上限时暂停读取新的请求，直到降到上限以下，超过 grace 之后返回错误关闭连接
+func (s *Session) waitResponseBuffer() error {
+	if replyBuffer.max == 0 || s.unsent.Get() <= replyBuffer.max {
+		return nil
+	}
+	incrBufferThrottles()
+	log.Warnf("session [%d] throttled: %s, %d bytes of replies are not sent", s.id, s, s.unsent.Get())
+	start := time.Now()
+	for s.unsent.Get() > replyBuffer.max {
+		// 发送回复的协程已经出错退出了，读取请求时会失败
+		if s.wstopped.Get() {
+			return nil
+		}
+		if replyBuffer.grace != 0 && time.Since(start) > replyBuffer.grace {
+			incrBufferCloses()
+			return errors.Trace(ErrResponseBufferFull)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// 客户端不读取时回复会一直留在proxy中，缩小发送缓存避免回复都被内核缓存
+func serveSlowClient(value []byte) (net.Conn, *Session, <-chan struct{}) {
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewBulkBytes(value), nil)}
+	c, s, done := serveSession(d, func(s *Session) {
+		s.sock.Conn.(*net.TCPConn).SetWriteBuffer(4096)
+	})
+	_, err := c.Write([]byte(strings.Repeat("GET a\r\n", 8)))
+	assert.MustNoError(err)
+	return c, s, done
+}
+
+func TestResponseBufferClose(t *testing.T) {
+	SetMaxResponseBuffer(1024*1024, time.Millisecond*200)
+	defer SetMaxResponseBuffer(0, 0)
+
+	n, m := BufferThrottleCounts(), BufferCloseCounts()
+	c, _, done := serveSlowClient(make([]byte, 256*1024))
+	defer c.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("session not closed")
+	}
+	assert.Must(BufferThrottleCounts() == n+1 && BufferCloseCounts() == m+1)
+}
+
+func TestResponseBufferThrottle(t *testing.T) {
+	SetMaxResponseBuffer(1024*1024, 0)
+	defer SetMaxResponseBuffer(0, 0)
+
+	n, m := BufferThrottleCounts(), BufferCloseCounts()
+	value := make([]byte, 256*1024)
+	c, s, done := serveSlowClient(value)
+	for BufferThrottleCounts() == n {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// 超过上限之后不再处理新的请求，没有 grace 时也不会关闭连接
+	time.Sleep(time.Millisecond * 100)
+	s.mu.Lock()
+	ops := s.Ops
+	s.mu.Unlock()
+	assert.Must(s.unsent.Get() > 1024*1024 && ops < 8)
+
+	// 客户端开始读取之后继续处理剩下的请求
+	dec := redis.NewDecoderSize(c, 1024)
+	for i := 0; i < 8; i++ {
+		resp, err := dec.Decode()
+		assert.MustNoError(err)
+		assert.Must(len(resp.Value) == len(value))
+	}
+	c.Close()
+	<-done
+	assert.Must(s.unsent.Get() == 0 && BufferCloseCounts() == m)
+}
@@ -13,6 +13,12 @@ import (
 // 封装的redis的请求
 type Dispatcher interface {
 	Dispatch(r *Request) error
+	// 将请求发送给所有后端redis，返回每个后端地址对应的子请求
+	Broadcast(r *Request) (map[string]*Request, error)
+	// 所有slot所在的master的地址，值是最近获取的key的数量，-1表示未知
+	Backends() map[string]int64
+	// 将请求发送给指定地址的后端
+	DispatchTo(addr string, r *Request) error
 }
 
 type Request struct {
@@ -31,4 +37,44 @@ type Request struct {
 	slot *sync.WaitGroup // 命令可能涉及到多个slot，等待所有slot完成操作
 
 	Failed *atomic2.Bool // 请求是否失败
+
+	retry   func() *Request // 后端出错时调用，安排一次重试，只有开启 RetryReads 的只读命令才有
+	retried *Request        // 出错后安排的重试请求
+
+	conns   *sessionConns // 不复用后端连接时，会话自己的后端连接
+	session int64         // 会话的编号，开启 backend_affinity 时用于选择共享连接
+
+	replica bool // 只读命令，可以发送给slave
+	spread  bool // 只读命令，所在slot访问过多时可以分散到slave
+	first   bool // 命令表中没有的命令，按照 unknown_command_action 发送给 slot 0 所在的后端
+	urgent  bool // 高优先级的命令，在后端连接的队列中先发送
+
+	queued int64 // 加入后端队列的时间，只在设置了优先级时记录
+
+	lagLimited bool  // 是否限制发送给slave时的复制延迟
+	maxLag     int64 // 允许的复制延迟，单位秒
+
+	span *Span // 被采样的命令，为nil表示不需要导出
+
+	hkey []byte // 不为nil时按照这个key选择slot，比如 WAITAOF 按照最近一次写入的key
+
+	backend string // 转发的后端地址，用于记录失败的命令
+
+	reply *replyBytes // 开启 max_response_buffer 时统计回复的大小
+
+	appstats *AppStats // 读取请求时会话所属应用的统计，会话之后修改应用名不影响这个请求
+}
+
+// 设置请求的返回结果，出错时标记请求失败，并安排重试
+func (r *Request) setResponse(resp *redis.Resp, err error) {
+	r.Response.Resp, r.Response.Err = resp, err
+	r.reply.add(resp)
+	if err != nil {
+		if r.Failed != nil {
+			r.Failed.Set(true)
+		}
+		if r.retry != nil {
+			r.retried = r.retry()
+		}
+	}
 }
@@ -4,10 +4,14 @@
 package router
 
 import (
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
@@ -21,11 +25,26 @@ type Router struct {
 	auth string                        // 访问redis密码
 	pool map[string]*SharedBackendConn // 访问redis的共享连接池
 
+	disabled map[string]bool // 手动下线的后端地址 -> 重新加载路由之后是否保留
+
 	slots [MaxSlotNum]*Slot // slot信息
 
 	closed bool // 结束标志
 }
 
+// 路由信息可能已经过期，比如和zk失去连接太久，设置之后会话会直接拒绝需要转发的命令
+var tableStale atomic2.Bool
+
+var ErrTableStale = errors.New("ERR routing table stale, coordinator is unreachable")
+
+func SetTableStale(stale bool) {
+	tableStale.Set(stale)
+}
+
+func IsTableStale() bool {
+	return tableStale.Get()
+}
+
 func New() *Router {
 	return NewWithAuth("")
 }
@@ -35,6 +54,8 @@ func NewWithAuth(auth string) *Router {
 	s := &Router{
 		auth: auth,
 		pool: make(map[string]*SharedBackendConn),
+
+		disabled: make(map[string]bool),
 	}
 	for i := 0; i < len(s.slots); i++ {
 		s.slots[i] = &Slot{id: i}
@@ -78,6 +99,86 @@ func (s *Router) FillSlot(i int, addr, from string, lock bool) error {
 	return nil
 }
 
+// 返回指定slot当前的后端地址、迁移源地址，以及是否处于阻塞状态
+func (s *Router) GetSlotRoute(i int) (addr, from string, lock bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isValidSlot(i) {
+		return "", "", false
+	}
+	slot := s.slots[i]
+	return slot.backend.addr, slot.migrate.from, slot.lock.hold
+}
+
+// 标记slot没有分配group，发往这个slot的命令由 default_group 服务并计数，重新填充slot之后需要再次设置
+func (s *Router) SetSlotFallback(i int, fallback bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isValidSlot(i) {
+		s.slots[i].fallback.Set(fallback)
+	}
+}
+
+func (s *Router) IsFallbackSlot(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isValidSlot(i) && s.slots[i].fallback.Get()
+}
+
+// 由 default_group 服务的slot
+func (s *Router) FallbackSlots() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var slots []int
+	for i, slot := range s.slots {
+		if slot.fallback.Get() {
+			slots = append(slots, i)
+		}
+	}
+	return slots
+}
+
+// 设置slot所在group的slave地址，开启读slave之后只读命令会轮流发送给这些slave
+func (s *Router) SetSlotReplicas(i int, addrs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	if !s.isValidSlot(i) {
+		return nil
+	}
+	slot := s.slots[i]
+	// 预迁移状态下slot已经被阻塞了，更新之后需要保持阻塞
+	held := slot.lock.hold
+	slot.blockAndWait()
+
+	// 先获取新的连接再释放旧的，避免相同地址的连接被关闭重建
+	var bcs = make([]*SharedBackendConn, len(addrs))
+	for j, addr := range addrs {
+		bcs[j] = s.getBackendConn(addr)
+	}
+	for _, bc := range slot.replicas.bcs {
+		s.putBackendConn(bc)
+	}
+	slot.replicas.addrs = addrs
+	slot.replicas.bcs = bcs
+
+	if !held {
+		slot.unblock()
+	}
+	return nil
+}
+
+func (s *Router) GetSlotReplicas(i int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isValidSlot(i) {
+		return nil
+	}
+	return s.slots[i].replicas.addrs
+}
+
 // 对后端所有redis连接发送心跳包
 func (s *Router) KeepAlive() error {
 	s.mu.Lock()
@@ -93,11 +194,265 @@ func (s *Router) KeepAlive() error {
 
 // 基于路由规则，将指定的redis-client发过来的请求，转发给这个key所在slot对应的redis-server的连接
 func (s *Router) Dispatch(r *Request) error {
-	hkey := getHashKey(r.Resp, r.OpStr)
+	if r.first {
+		return s.slots[0].forward(r, nil)
+	}
+	hkey := r.hkey
+	if hkey == nil {
+		hkey = getHashKey(r.Resp, r.OpStr)
+	}
 	slot := s.slots[hashSlot(hkey)]
 	return slot.forward(r, hkey)
 }
 
+// 广播时同时等待返回的后端数量上限
+const MaxBroadcastConcurrency = 16
+
+var ErrNoBackend = errors.New("no backend available")
+
+// 将请求发送给所有后端redis，每个后端对应一个子请求
+// 最多同时向 MaxBroadcastConcurrency 个后端发送，全部完成后 r.Wait 才会返回
+func (s *Router) Broadcast(r *Request) (map[string]*Request, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errClosedRouter
+	}
+	// 持有连接的引用，避免广播过程中连接被关闭
+	var bcs = make(map[string]*SharedBackendConn)
+	for _, slot := range s.slots {
+		if bc := slot.backend.bc; bc != nil && bcs[bc.Addr()] == nil {
+			bc.IncrRefcnt()
+			bcs[bc.Addr()] = bc
+		}
+	}
+	s.mu.Unlock()
+
+	if len(bcs) == 0 {
+		return nil, ErrNoBackend
+	}
+	incrBroadcasts()
+
+	var subs = make(map[string]*Request, len(bcs))
+	for addr := range bcs {
+		subs[addr] = &Request{
+			OpStr: r.OpStr,
+			Start: r.Start,
+			Resp:  r.Resp,
+			reply: r.reply,
+
+			session: r.session,
+			urgent:  r.urgent,
+		}
+	}
+
+	r.Wait.Add(1)
+	go func() {
+		defer r.Wait.Done()
+		var batch sync.WaitGroup
+		var n int
+		for addr, bc := range bcs {
+			x := subs[addr]
+			if bc.disabled.Get() {
+				x.setResponse(bc.rejectDisabled(), nil)
+				continue
+			}
+			x.Wait = &batch
+			bc.PushBack(x)
+			if n++; n%MaxBroadcastConcurrency == 0 {
+				batch.Wait()
+			}
+		}
+		batch.Wait()
+
+		s.mu.Lock()
+		for _, bc := range bcs {
+			s.putBackendConn(bc)
+		}
+		s.mu.Unlock()
+	}()
+	return subs, nil
+}
+
+// 当前和后端redis-server之间的连接数，包括会话独占的连接
+// 复用连接时每个地址只有一个连接，所有会话的请求都通过 pipeline 发送到这个连接上，并且按照发送的顺序返回
+// 所以同一个会话中命令的先后顺序不会改变
+func (s *Router) BackendConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n = int(dedicatedConnCount.Get())
+	for _, bc := range s.pool {
+		n += bc.Conns()
+	}
+	return n
+}
+
+// 获取连接池中所有后端的状态，按地址排序
+func (s *Router) BackendStatus() []*BackendStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs = make([]string, 0, len(s.pool))
+	for addr := range s.pool {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var all = make([]*BackendStatus, len(addrs))
+	for i, addr := range addrs {
+		all[i] = s.pool[addr].Status()
+		if persist, ok := s.disabled[addr]; ok {
+			all[i].Disabled, all[i].Persist = true, persist
+		}
+	}
+	return all
+}
+
+var ErrUnknownBackend = errors.New("backend is not used by any slot")
+
+// 手动下线一个后端，只读命令不再发送给下线的slave，发送给下线的master的命令直接返回错误
+// 重新加载路由之后恢复，除非 persist 为 true
+func (s *Router) DisableBackend(addr string, persist bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	bc := s.pool[addr]
+	if bc == nil {
+		return ErrUnknownBackend
+	}
+	s.disabled[addr] = persist
+	bc.disabled.Set(true)
+	log.Warnf("backend %s is disabled, persist = %v", addr, persist)
+	return nil
+}
+
+// 恢复手动下线的后端
+func (s *Router) EnableBackend(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	_, disabled := s.disabled[addr]
+	bc := s.pool[addr]
+	if bc == nil && !disabled {
+		return ErrUnknownBackend
+	}
+	delete(s.disabled, addr)
+	if bc != nil {
+		bc.disabled.Set(false)
+	}
+	log.Warnf("backend %s is enabled", addr)
+	return nil
+}
+
+// 重新加载路由之后恢复没有要求保留的下线后端，返回恢复的数量
+func (s *Router) ResetDisabledBackends() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for addr, persist := range s.disabled {
+		if persist {
+			continue
+		}
+		delete(s.disabled, addr)
+		if bc := s.pool[addr]; bc != nil {
+			bc.disabled.Set(false)
+		}
+		log.Warnf("backend %s is enabled after reload", addr)
+		n++
+	}
+	return n
+}
+
+// 清空所有后端的不同key数量的估算，返回清空的后端数量
+func (s *Router) ResetBackendKeys() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, bc := range s.pool {
+		bc.ResetKeys()
+	}
+	return len(s.pool)
+}
+
+var ErrWarmupTimeout = errors.New("warmup timeout")
+
+// 连接是在第一次发送请求时才建立的，启动时通过连接池中每个后端的 n 个共享连接发送 PING，提前建立连接
+// n 超过共享连接数时预热全部的共享连接，最多等待 timeout，返回失败的后端和对应的错误
+func (s *Router) Warmup(n int, timeout time.Duration) map[string]error {
+	s.mu.Lock()
+	var bcs = make(map[string]*SharedBackendConn, len(s.pool))
+	for addr, bc := range s.pool {
+		bc.IncrRefcnt()
+		bcs[addr] = bc
+	}
+	s.mu.Unlock()
+
+	type result struct {
+		addr string
+		err  error
+	}
+	var results = make(chan result, len(bcs))
+	for addr, bc := range bcs {
+		var reqs []*Request
+		for i, c := range bc.all() {
+			if i == n {
+				break
+			}
+			r := &Request{
+				OpStr: "PING",
+				Start: microseconds(),
+				Resp:  redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("PING"))}),
+				Wait:  &sync.WaitGroup{},
+			}
+			c.PushBack(r)
+			reqs = append(reqs, r)
+		}
+		go func(addr string) {
+			var err error
+			for _, r := range reqs {
+				r.Wait.Wait()
+				if err == nil {
+					err = r.Response.Err
+				}
+				if resp := r.Response.Resp; err == nil && resp != nil && resp.IsError() {
+					err = errors.New(string(resp.Value))
+				}
+			}
+			results <- result{addr, err}
+		}(addr)
+	}
+
+	var failed = make(map[string]error)
+	var pending = make(map[string]bool, len(bcs))
+	for addr := range bcs {
+		pending[addr] = true
+	}
+	deadline := time.After(timeout)
+	for len(pending) != 0 {
+		select {
+		case x := <-results:
+			delete(pending, x.addr)
+			if x.err != nil {
+				failed[x.addr] = x.err
+			}
+			log.Infof("warmup backend %s, %d/%d backends done", x.addr, len(bcs)-len(pending), len(bcs))
+		case <-deadline:
+			for addr := range pending {
+				failed[addr] = ErrWarmupTimeout
+			}
+			pending = nil
+		}
+	}
+
+	s.mu.Lock()
+	for _, bc := range bcs {
+		s.putBackendConn(bc)
+	}
+	s.mu.Unlock()
+	return failed
+}
+
 // 从连接池中获取地址为 addr 的连接，引用计数加1，没有就新建一个并加入连接池中
 func (s *Router) getBackendConn(addr string) *SharedBackendConn {
 	bc := s.pool[addr]
@@ -105,6 +460,8 @@ func (s *Router) getBackendConn(addr string) *SharedBackendConn {
 		bc.IncrRefcnt()
 	} else {
 		bc = NewSharedBackendConn(addr, s.auth)
+		_, disabled := s.disabled[addr]
+		bc.disabled.Set(disabled)
 		s.pool[addr] = bc
 	}
 	return bc
@@ -133,6 +490,12 @@ func (s *Router) resetSlot(i int) {
 	s.putBackendConn(slot.migrate.bc)
 	slot.reset()
 
+	for _, bc := range slot.replicas.bcs {
+		s.putBackendConn(bc)
+	}
+	slot.replicas.addrs = nil
+	slot.replicas.bcs = nil
+
 	slot.unblock()
 }
 
@@ -144,6 +507,9 @@ func (s *Router) fillSlot(i int, addr, from string, lock bool) {
 	slot := s.slots[i]
 	slot.blockAndWait()
 
+	// 迁移的源地址没有变化时，保留迁移的开始时间和已迁移的key数量
+	oldFrom, since, keys := slot.migrate.from, slot.migrate.since, slot.migrate.keys.Get()
+
 	// 将原来的连接放回连接池
 	s.putBackendConn(slot.backend.bc)
 	s.putBackendConn(slot.migrate.bc)
@@ -166,10 +532,18 @@ func (s *Router) fillSlot(i int, addr, from string, lock bool) {
 	if len(from) != 0 {
 		slot.migrate.from = from
 		slot.migrate.bc = s.getBackendConn(from)
+		if from == oldFrom {
+			slot.migrate.since = since
+			slot.migrate.keys.Set(keys)
+		} else {
+			slot.migrate.since = time.Now()
+		}
 	}
 
 	if !lock {
 		slot.unblock()
+	} else {
+		slot.premigrate.Set(true)
 	}
 
 	if slot.migrate.bc != nil {
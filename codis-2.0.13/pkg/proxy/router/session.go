@@ -6,8 +6,11 @@ package router
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +31,57 @@ type Session struct {
 
 	auth       string
 	authorized bool
+	user       *ACLUser // 通过 AUTH <user> <password> 登录的用户，为nil表示 default 用户，没有限制
+	cert       string   // 开启双向 TLS 时客户端证书的 subject
+
+	id   int64  // CLIENT ID 返回的编号
+	name string // CLIENT SETNAME 设置的名称
+	app  string // PROXY APP 设置的应用名，没有设置时使用 name 作为应用名
+
+	appstats *AppStats // 按应用统计命令，没有开启时为nil
+
+	MaxInflight int           // 同时发往后端的请求数上限，0表示不限制
+	LocalPing   bool          // 由proxy直接回复 PING
+	RetryReads  bool          // 后端出错时重试只读命令
+	ReadReplica bool          // 只读命令发送给slave
+	CheckArity  bool          // 转发前按命令表检查参数个数
+	MaxArgs     int           // 单条命令的参数个数上限，0表示不限制
+	MaxKeys     int           // 单条命令的key的个数上限，在拆分多key命令之前检查，0表示不限制
+	Inflight    atomic2.Int64 // 当前发往后端尚未完成的请求数
+	inflight    chan struct{}
+
+	HandshakeTimeout time.Duration // 建立连接后完成认证或者发送第一条命令的时间上限，0表示不限制
+	MaxRequestSize   int64         // 单条命令的大小上限，和 max_reply_size 的计算方式相同，0表示不限制
+	MaxPipelineSlots int           // 一批 pipeline 同时转发到的 slot 个数上限，超过时等待之前的请求返回，0表示不限制
+	ReadTimeout      time.Duration // 读到一条命令的第一个字节之后读完整条命令的时间上限，0表示不限制
+	FlushDelay       time.Duration // 合并发送回复时最多等待的时间，0表示没有后续的回复时立即发送
+	FlushSize        int           // 合并发送回复时最多缓存的回复数
+	ReadAfterWrite   time.Duration // 开启读slave时，写入之后这段时间内读取同一个key会发送给master，0表示不开启
+	recent           *recentWrites
+	pipeline         *pipelineSlots
+	aof              aofWrites
+
+	pinned bool          // 通过 PROXY PIN MASTER 固定从master读取
+	trace  *traceContext // 通过 PROXY TRACE 传入的 trace context，为nil表示不生成 span
+
+	mu      sync.Mutex // 保护 ClientList 读取的字段，只在会话自己的协程中修改
+	lastop  string     // 最近一条命令的名字
+	waiting *Request   // 正在等待后端返回的请求
+
+	sock     *countConn    // 统计读取的字节数
+	idleAt   atomic2.Int64 // 开始等待下一条请求时已经读取的字节数，-1表示有尚未处理完的数据
+	draining atomic2.Bool  // proxy下线时被 DrainSessions 打断读取
+	goodbye  bool          // 退出前回复 goodbye
+	gone     atomic2.Bool  // 客户端已经断开连接，之后的回复直接丢弃
+	dropped  atomic2.Int64 // 因为客户端断开而丢弃的回复数
+	unsent   atomic2.Int64 // 已经从后端返回、还没有发送给客户端的回复的大小，只有开启 max_response_buffer 时统计
+	wstopped atomic2.Bool  // 发送回复的协程已经退出
+
+	conns *sessionConns // 不复用后端连接时，会话自己的后端连接
+
+	errsince    int64 // 当前错误计数窗口的开始时间，单位 us
+	errcount    int64 // 窗口内协议错误和非法命令的次数
+	quarantined bool  // 错误次数超过上限，需要隔离
 
 	quit   bool // 退出标志
 	failed atomic2.Bool
@@ -36,13 +90,18 @@ type Session struct {
 // 返回string格式session信息
 func (s *Session) String() string {
 	o := &struct {
-		Ops        int64  `json:"ops"`    // 此会话的ops
-		LastOpUnix int64  `json:"lastop"` // 最近一次操作时间戳
-		CreateUnix int64  `json:"create"` // 会话创建时间戳
-		RemoteAddr string `json:"remote"` // redis客户端的ip地址
+		Id         int64  `json:"id"`       // 连接的编号，和 CLIENT ID 相同
+		Ops        int64  `json:"ops"`      // 此会话的ops
+		LastOpUnix int64  `json:"lastop"`   // 最近一次操作时间戳
+		CreateUnix int64  `json:"create"`   // 会话创建时间戳
+		RemoteAddr string `json:"remote"`   // redis客户端的ip地址
+		Name       string `json:"name"`     // CLIENT SETNAME 设置的名称
+		Inflight   int64  `json:"inflight"` // 尚未完成的请求数
 	}{
-		s.Ops, s.LastOpUnix, s.CreateUnix,
+		s.id, s.Ops, s.LastOpUnix, s.CreateUnix,
 		s.Conn.Sock.RemoteAddr().String(),
+		s.name,
+		s.Inflight.Get(),
 	}
 	b, _ := json.Marshal(o)
 	return string(b)
@@ -52,53 +111,141 @@ func NewSession(c net.Conn, auth string) *Session {
 	return NewSessionSize(c, auth, 1024*32, 1800)
 }
 
+// 用于生成会话的编号
+var sessionId atomic2.Int64
+
 // 返回一个redis-client的连接对象
 func NewSessionSize(c net.Conn, auth string, bufsize int, timeout int) *Session {
-	s := &Session{CreateUnix: time.Now().Unix(), auth: auth}
-	s.Conn = redis.NewConnSize(c, bufsize)
+	s := &Session{CreateUnix: time.Now().Unix(), auth: auth, id: sessionId.Incr()}
+	s.sock = &countConn{Conn: c}
+	s.Conn = redis.NewConnSize(s.sock, bufsize)
 	s.Conn.ReaderTimeout = time.Second * time.Duration(timeout)
 	s.Conn.WriterTimeout = time.Second * 30
-	log.Infof("session [%p] create: %s", s, s)
+	log.Infof("session [%d] create: %s", s.id, s)
 	return s
 }
 
+// 连接的编号，进程内单调递增，日志中用来关联同一个连接的记录
+func (s *Session) Id() int64 {
+	return s.id
+}
+
 func (s *Session) Close() error {
 	return s.Conn.Close()
 }
 
 // 针对一个redis-client连接的处理函数
 func (s *Session) Serve(d Dispatcher, maxPipeline int) {
+	cmdstats.sessions.Incr()
+	defer cmdstats.sessions.Decr()
+	defer s.unpin()
+	if dedicatedConns {
+		s.conns = newSessionConns()
+		defer s.conns.close()
+	}
+	addSession(s)
+	defer removeSession(s)
+
 	var errlist errors.ErrorList
 	defer func() {
 		// 非正常结束
-		if err := errlist.First(); err != nil {
-			log.Infof("session [%p] closed: %s, error = %s", s, s, err)
+		if n := s.dropped.Get(); n != 0 {
+			log.Infof("session [%d] closed: %s, client gone before %d replies", s.id, s, n)
+		} else if err := errlist.First(); err != nil {
+			log.Infof("session [%d] closed: %s, error = %s", s.id, s, err)
+		} else if s.goodbye {
+			log.Infof("session [%d] closed: %s, goodbye", s.id, s)
 		} else {
 			// 连接正常结束
-			log.Infof("session [%p] closed: %s, quit", s, s)
+			log.Infof("session [%d] closed: %s, quit", s.id, s)
 		}
 		s.Close()
 	}()
 
 	// 利用通道的缓冲区实现对pipeline上限的限制
 	tasks := make(chan *Request, maxPipeline)
+	// 同理，限制同时发往后端的请求数
+	if s.MaxInflight > 0 {
+		s.inflight = make(chan struct{}, s.MaxInflight)
+	}
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer func() {
 			for _ = range tasks {
+				s.releaseInflight()
 			}
 		}()
 		// 请求处理结束后返回给 redis-client 的协程
-		if err := s.loopWriter(tasks); err != nil {
+		err := s.loopWriter(tasks)
+		s.wstopped.Set(true)
+		if err != nil {
 			errlist.PushBack(err)
+			s.Close()
 		}
-		s.Close()
 	}()
 
-	defer close(tasks)
 	// 循环从 redis-client 读取请求命令，转发给后端 redis-server，获取返回后通过 tasks 通道返回给client
-	if err := s.loopReader(tasks, d); err != nil {
+	err := s.loopReader(tasks, d)
+	close(tasks)
+	if err != nil {
 		errlist.PushBack(err)
+		// 客户端断开时等待已经转发的请求从后端读取完回复再关闭，这些回复会被丢弃
+		if s.gone.Get() {
+			<-done
+		}
+		// 读取命令超时，发送完之前的回复之后告诉客户端关闭的原因
+		if errors.Equal(err, ErrReadTimeout) {
+			<-done
+			if errlist.Len() == 1 {
+				s.Writer.Encode(replyReadTimeout, true)
+			}
+		}
+		// 命令太大时和 redis 一样回复协议错误之后关闭
+		if errors.Equal(err, redis.ErrRespTooLarge) {
+			<-done
+			if errlist.Len() == 1 {
+				s.Writer.Encode(replyRequestTooLarge, true)
+			}
+		}
+	} else {
+		// 收到 QUIT 之后，等待之前的请求和 QUIT 的结果都返回给客户端再关闭连接
+		<-done
+		if s.goodbye && errlist.First() == nil {
+			if err := s.Writer.Encode(getGoodbye(), true); err != nil {
+				errlist.PushBack(err)
+			} else {
+				incrGoodbyes()
+			}
+		}
+	}
+}
+
+var (
+	ErrReadTimeout   = errors.New("read command timeout")
+	replyReadTimeout = redis.NewError([]byte("ERR Protocol error: timeout reading command"))
+
+	replyRequestTooLarge = redis.NewError([]byte("ERR Protocol error: command is too large"))
+)
+
+// 开启 ReadTimeout 时，等待命令的第一个字节仍然使用空闲的超时时间，之后必须在 ReadTimeout 内读完整条命令
+// 握手阶段使用握手的截止时间
+func (s *Session) readRequest(handshake bool) (*redis.Resp, error) {
+	if s.ReadTimeout == 0 || handshake {
+		return s.Reader.Decode()
+	}
+	if s.Reader.Buffered() == 0 {
+		if _, err := s.Reader.Peek(1); err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
+	s.Conn.ReaderDeadline = time.Now().Add(s.ReadTimeout)
+	resp, err := s.Reader.Decode()
+	s.Conn.ReaderDeadline = time.Time{}
+	if err != nil && redis.IsTimeout(err) {
+		return nil, errors.Trace(ErrReadTimeout)
+	}
+	return resp, err
 }
 
 // 循环从 redis-client 读取请求命令，转发给后端 redis-server，获取返回后通过 tasks 通道返回给client
@@ -106,26 +253,128 @@ func (s *Session) loopReader(tasks chan<- *Request, d Dispatcher) error {
 	if d == nil {
 		return errors.New("nil dispatcher")
 	}
+	// 握手阶段使用一个固定的截止时间，而不是每次读取之后重新计算
+	// 避免客户端建立连接之后一直不发送完整的命令，或者每次只发送几个字节来占用连接
+	var handshake, timeout = s.HandshakeTimeout != 0, s.Conn.ReaderTimeout
+	s.Reader.MaxSize = s.MaxRequestSize
+	if handshake {
+		s.Conn.ReaderTimeout = 0
+		if err := s.Sock.SetReadDeadline(time.Now().Add(s.HandshakeTimeout)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	// 缓存中的数据处理完之前读到的命令数，即客户端一次连续发送的命令数
+	var batch int
+	defer func() {
+		if batch != 0 {
+			incrBatches(batch)
+		}
+	}()
 	for !s.quit {
+		// 客户端不读取回复时暂停处理新的请求
+		if err := s.waitResponseBuffer(); err != nil {
+			return err
+		}
+		// 没有缓存的数据时，在读到新的字节之前会话是空闲的
+		if s.Reader.Buffered() == 0 {
+			if batch != 0 {
+				incrBatches(batch)
+				batch = 0
+			}
+			if s.pipeline != nil {
+				s.pipeline.reset()
+			}
+			s.idleAt.Set(s.sock.nread.Get())
+		} else {
+			s.idleAt.Set(-1)
+		}
 		// 从redis-client读取请求，并解析成 Resp 格式的对象
-		resp, err := s.Reader.Decode()
+		resp, err := s.readRequest(handshake)
+		if err != nil && s.draining.Get() {
+			goodbye, err := s.onWakeup(err)
+			if err != nil {
+				return err
+			}
+			if goodbye {
+				s.goodbye = true
+				return nil
+			}
+			continue
+		}
 		if err != nil {
+			if isClientGone(err) {
+				s.gone.Set(true)
+			}
+			if handshake && redis.IsTimeout(err) {
+				incrHandshakeTimeouts()
+				log.Warnf("session [%d] handshake timeout after %s", s.id, s.HandshakeTimeout)
+			}
+			if errors.Equal(err, ErrReadTimeout) {
+				incrReadTimeouts()
+				log.Warnf("session [%d] read timeout after %s, command is not completed", s.id, s.ReadTimeout)
+			}
+			if errors.Equal(err, redis.ErrRespTooLarge) {
+				incrOversizedRequests()
+				log.Warnf("session [%d] command is larger than %d bytes", s.id, s.MaxRequestSize)
+			}
+			if isProtocolError(err) {
+				s.clientError()
+			}
+			if s.quarantined {
+				s.quarantine(true)
+			}
 			return err
 		}
+		batch++
+		// 超过同时处理请求数上限时阻塞，直到有请求完成
+		s.acquireInflight()
 		// 处理一条redis-client的请求
 		r, err := s.handleRequest(resp, d)
 		if err != nil {
+			s.releaseInflight()
+			if s.quarantined {
+				s.quarantine(true)
+			}
 			return err
 		} else {
 			// 将请求处理结果通过task通道返回
 			tasks <- r
 		}
+		// 非法命令太多，关闭连接或者暂停读取
+		if s.quarantined {
+			s.quarantine(false)
+		}
+		// 认证通过，或者不需要认证的情况下收到了第一条命令，恢复正常的读超时
+		if handshake && s.authorized {
+			handshake = false
+			s.Conn.ReaderTimeout = timeout
+			if err := s.Sock.SetReadDeadline(time.Time{}); err != nil {
+				return errors.Trace(err)
+			}
+		}
 	}
 	return nil
 }
 
+func (s *Session) acquireInflight() {
+	if s.inflight != nil {
+		s.inflight <- struct{}{}
+	}
+	s.Inflight.Incr()
+}
+
+func (s *Session) releaseInflight() {
+	s.Inflight.Decr()
+	if s.inflight != nil {
+		<-s.inflight
+	}
+}
+
 // 请求处理结束后返回给 redis-client 的协程
 func (s *Session) loopWriter(tasks <-chan *Request) error {
+	if s.FlushDelay != 0 {
+		return s.loopWriterCoalesce(tasks)
+	}
 	p := &FlushPolicy{
 		Encoder:     s.Writer,
 		MaxBuffered: 32,
@@ -138,9 +387,91 @@ func (s *Session) loopWriter(tasks <-chan *Request) error {
 			return err
 		}
 		// 发送给 redis-client
-		if err := p.Encode(resp, len(tasks) == 0); err != nil {
+		if err := s.writeReply(p, resp, len(tasks) == 0); err != nil {
+			return err
+		}
+		r.reply.release()
+	}
+	return nil
+}
+
+// 发送一条回复，客户端已经断开时丢弃回复并计数，不作为错误返回
+func (s *Session) writeReply(p *FlushPolicy, resp *redis.Resp, force bool) error {
+	if !s.gone.Get() {
+		err := p.Encode(resp, force)
+		if err == nil || !isClientGone(err) {
 			return err
 		}
+		s.gone.Set(true)
+	}
+	s.dropped.Incr()
+	incrClientGone()
+	return nil
+}
+
+// 客户端已经断开了连接，读取时遇到 EOF，或者写入时连接已经被关闭或者重置，超时不算
+func isClientGone(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case net.Error:
+		return !err.Timeout()
+	default:
+		return err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe
+	}
+}
+
+// 合并发送回复，没有后续的回复时最多等待 FlushDelay，用延迟换取更少的系统调用
+// 缓存的回复在距离上一次发送超过 FlushDelay，或者超过 FlushSize 个之后一定会发送
+func (s *Session) loopWriterCoalesce(tasks <-chan *Request) error {
+	p := &FlushPolicy{
+		Encoder:     s.Writer,
+		MaxBuffered: s.FlushSize,
+		MaxInterval: int64(s.FlushDelay / time.Microsecond),
+	}
+	for {
+		var r *Request
+		var ok bool
+		select {
+		case r, ok = <-tasks:
+		default:
+			if p.nbuffered == 0 {
+				r, ok = <-tasks
+				break
+			}
+			wait := time.Duration(p.lastflush+p.MaxInterval-microseconds()) * time.Microsecond
+			timer := time.NewTimer(wait)
+			select {
+			case r, ok = <-tasks:
+				timer.Stop()
+			case <-timer.C:
+				if err := s.flushReplies(p); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !ok {
+			return s.flushReplies(p)
+		}
+		resp, err := s.handleResponse(r)
+		if err != nil {
+			return err
+		}
+		if err := s.writeReply(p, resp, false); err != nil {
+			return err
+		}
+		r.reply.release()
+	}
+}
+
+func (s *Session) flushReplies(p *FlushPolicy) error {
+	if s.gone.Get() {
+		return nil
+	}
+	if err := p.Flush(true); err != nil {
+		if !isClientGone(err) {
+			return err
+		}
+		s.gone.Set(true)
 	}
 	return nil
 }
@@ -149,40 +480,130 @@ var ErrRespIsRequired = errors.New("resp is required")
 
 // 处理redis-server执行完命令后返回的结果
 func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
+	s.mu.Lock()
+	s.waiting = r
+	s.mu.Unlock()
 	r.Wait.Wait()
+	s.mu.Lock()
+	s.waiting = nil
+	s.mu.Unlock()
+	if r.Coalesce == nil && r.Response.Err != nil {
+		s.waitRetry(r)
+	}
+	s.releaseInflight()
 	// 如果有聚合函数，对结果进行聚合后返回
 	if r.Coalesce != nil {
 		if err := r.Coalesce(); err != nil {
+			s.recordFailure(r, err.Error())
 			return nil, err
 		}
 	}
 	resp, err := r.Response.Resp, r.Response.Err
+	if r.span != nil {
+		finishSpan(r.span, resp, err)
+	}
 	if err != nil {
+		s.recordFailure(r, err.Error())
+		s.logFailure(r, err.Error(), false)
 		return nil, err
 	}
 	if resp == nil {
 		return nil, ErrRespIsRequired
 	}
+	if resp.IsError() {
+		s.recordFailure(r, string(resp.Value))
+		if r.backend != "" {
+			s.logFailure(r, string(resp.Value), true)
+		}
+	}
+	if shadow.queue != nil {
+		mirrorWrite(r, resp)
+	}
+	// 之前失败的请求都已经重试成功，并且没有其他尚未完成的请求，后续的请求可以继续转发
+	// 还有尚未完成的请求时不能清除，否则后续的请求可能先于排在前面的重试执行
+	if s.failed.Get() && s.Inflight.Get() == 0 {
+		s.failed.Set(false)
+	}
 	// 更新统计信息
-	incrOpStats(r.OpStr, microseconds()-r.Start)
+	usecs := microseconds() - r.Start
+	incrOpStats(r.OpStr, usecs)
+	s.checkSlowlog(r, usecs)
+	if r.appstats != nil {
+		r.appstats.incrOpStats(r.OpStr, usecs)
+	}
 	return resp, nil
 }
 
+// 重试前等待后端连接重建的时间
+const retryDelay = time.Millisecond * 100
+
+// 只有只读命令会在开启 RetryReads 时重试一次，写命令无论如何都不会重试，出错后连接会被关闭，由客户端决定是否重新执行
+// 重试是在原请求返回错误的时候安排的，延迟 retryDelay 之后发出，不会阻塞返回结果的协程，同一时刻只会有一个请求在后端执行
+func (s *Session) scheduleRetry(r *Request, d Dispatcher) func() *Request {
+	return func() *Request {
+		x := &Request{
+			OpStr: r.OpStr,
+			Start: r.Start,
+			Resp:  r.Resp,
+			Wait:  &sync.WaitGroup{},
+			conns: r.conns,
+			reply: r.reply,
+
+			session: r.session,
+			urgent:  r.urgent,
+		}
+		x.Wait.Add(1)
+		time.AfterFunc(retryDelay, func() {
+			defer x.Wait.Done()
+			if err := d.Dispatch(x); err != nil {
+				x.Response.Err = err
+			}
+		})
+		return x
+	}
+}
+
+// 后端出错时等待重试的结果，由返回结果的协程按顺序调用
+// 出错之后会话被标记为失败，后续的请求都不会再转发，只读命令会在出错时安排重试
+func (s *Session) waitRetry(r *Request) {
+	x := r.retried
+	if x == nil {
+		if c := commands[r.OpStr]; c == nil || c.IsWrite() {
+			incrWritesNotRetried()
+		}
+		return
+	}
+	x.Wait.Wait()
+	incrRetries()
+
+	log.Infof("session [%d] retry %s, error = %v, retry error = %v", s.id, r.OpStr, r.Response.Err, x.Response.Err)
+	if x.Response.Err == nil {
+		r.Response = x.Response
+	}
+}
+
 // 处理一条redis-client的请求
 func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error) {
 	// 获取操作命令字符串
 	opstr, err := getOpStr(resp)
 	if err != nil {
+		s.clientError()
 		return nil, err
 	}
+	// 重命名之后的命令换成原来的名字，原来的名字作为未知命令
+	opstr, known := renameOpStr(resp, opstr)
 	// 检查redis命令是否不支持
-	if isNotAllowed(opstr) {
+	if known && isNotAllowed(opstr) {
+		s.clientError()
 		return nil, errors.New(fmt.Sprintf("command <%s> is not allowed", opstr))
 	}
 
 	usnow := microseconds()
+	s.mu.Lock()
 	s.LastOpUnix = usnow / 1e6
 	s.Ops++
+	s.lastop = opstr
+	s.mu.Unlock()
 
 	// 构造request对象
 	r := &Request{
@@ -191,6 +612,65 @@ func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error
 		Resp:   resp,
 		Wait:   &sync.WaitGroup{},
 		Failed: &s.failed,
+		conns:  s.conns,
+
+		session: s.id,
+		replica: s.ReadReplica && !s.pinned && isReadOnly(opstr),
+		spread:  hotSlotReads != 0 && !s.pinned && isReadOnly(opstr),
+		urgent:  s.isUrgent(opstr),
+
+		appstats: s.appstats,
+	}
+	r.maxLag, r.lagLimited = s.maxReplicaLag(opstr)
+	if s.RetryReads && isRetryable(opstr) {
+		r.retry = s.scheduleRetry(r, d)
+	}
+	if replyBuffer.max != 0 {
+		r.reply = &replyBytes{session: &s.unsent}
+	}
+	if s.trace != nil {
+		r.span = s.trace.newSpan(r, s.Conn.Sock.RemoteAddr().String())
+	}
+	// 维护模式下只允许 QUIT
+	if maintenance.on.Get() && opstr != "QUIT" {
+		r.Response.Resp = maintenanceReply()
+		return r, nil
+	}
+	if !known {
+		s.clientError()
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR unknown command '%s'", resp.Array[0].Value)))
+		return r, nil
+	}
+
+	// 参数个数不对的命令不转发给后端，和redis一样在检查认证之前返回错误
+	nargs := len(resp.Array)
+	if s.MaxArgs != 0 && nargs > s.MaxArgs {
+		s.clientError()
+		incrArityRejects()
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR too many arguments for '%s' command, max = %d", strings.ToLower(opstr), s.MaxArgs)))
+		return r, nil
+	}
+	if s.CheckArity && !checkArity(opstr, nargs) {
+		s.clientError()
+		incrArityRejects()
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(opstr))))
+		return r, nil
+	}
+	// key太多的命令在拆分之前拒绝，避免一条命令压垮后端
+	if s.MaxKeys != 0 && nargs > s.MaxKeys+1 && countKeys(opstr, nargs) > s.MaxKeys {
+		s.clientError()
+		incrMaxKeysRejects()
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR too many keys for '%s' command, max = %d", strings.ToLower(opstr), s.MaxKeys)))
+		return r, nil
+	}
+	if resp := checkKeys(opstr, resp); resp != nil {
+		s.clientError()
+		r.Response.Resp = resp
+		return r, nil
+	}
+	if isCrossSlot(opstr, resp) {
+		r.Response.Resp = staticReply(replyCrossSlot)
+		return r, nil
 	}
 
 	// 特殊命令的处理
@@ -201,40 +681,126 @@ func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error
 	if opstr == "AUTH" {
 		return s.handleAuth(r)
 	}
+	if opstr == "HELLO" {
+		return s.handleHello(r)
+	}
 
 	if !s.authorized {
 		if s.auth != "" {
-			r.Response.Resp = redis.NewError([]byte("NOAUTH Authentication required."))
+			s.clientError()
+			r.Response.Resp = staticReply(replyNoAuth)
 			return r, nil
 		}
 		s.authorized = true
 	}
+	if s.user != nil {
+		if resp := s.user.checkPermission(opstr, resp); resp != nil {
+			s.clientError()
+			incrACLRejects()
+			r.Response.Resp = resp
+			return r, nil
+		}
+	}
 
 	switch opstr {
 	case "SELECT":
 		return s.handleSelect(r)
 	case "PING":
-		return s.handlePing(r)
+		return s.handlePing(r, d)
+	case "CLIENT":
+		return s.handleClient(r)
+	case "COMMAND":
+		// 其他子命令和之前一样转发给后端
+		if len(resp.Array) >= 2 && strings.ToUpper(string(resp.Array[1].Value)) == "GETKEYS" {
+			return s.handleCommandGetKeys(r)
+		}
+	case "PROXY":
+		return s.handleProxy(r)
+	case "INFO":
+		return s.handleInfo(r, d)
+	case "SHUTDOWN":
+		return s.handleShutdown(r)
+	case "TIME":
+		if localTime {
+			return s.handleTime(r)
+		}
+	}
+	// 路由信息过期时不转发，返回明确的错误
+	if IsTableStale() {
+		incrStaleRejects()
+		r.Response.Resp = redis.NewError([]byte(ErrTableStale.Error()))
+		return r, nil
+	}
+	if (s.ReadReplica || hotSlotReads != 0) && s.ReadAfterWrite != 0 {
+		s.checkRecentWrites(r, usnow)
+	}
+	if s.MaxPipelineSlots != 0 {
+		s.limitPipelineSlots(r)
+	}
+	if commands[opstr] == nil {
+		return s.handleUnknown(r, d)
+	}
+	if commands[opstr].IsWrite() {
+		s.recordWrite(opstr, resp)
+	}
+	switch opstr {
+	case "WAITAOF":
+		return s.handleWaitAOF(r, d)
 	case "MGET":
 		return s.handleRequestMGet(r, d)
 	case "MSET":
 		return s.handleRequestMSet(r, d)
 	case "DEL":
 		return s.handleRequestMDel(r, d)
+	case "EXISTS":
+		return s.handleRequestExists(r, d)
+	case "DBSIZE":
+		return s.handleRequestDbsize(r, d)
+	case "FLUSHALL":
+		return s.handleRequestFlushAll(r, d)
+	case "RANDOMKEY":
+		return s.handleRequestRandomKey(r, d)
 	}
 	// 基于路由规则，将指定的redis-client发过来的请求，转发给这个key所在slot对应的redis-server的连接
 	return r, d.Dispatch(r)
 }
 
+// 由proxy直接回复的固定结果，预先编码好，所有会话共用，不能修改
+var (
+	replyOK       = redis.NewStatic(redis.NewString([]byte("OK")))
+	replyPong     = redis.NewStatic(redis.NewString([]byte("PONG")))
+	replyNil      = redis.NewStatic(redis.NewBulkBytes(nil))
+	replyNoAuth   = redis.NewStatic(redis.NewError([]byte("NOAUTH Authentication required.")))
+	replySyntax   = redis.NewStatic(redis.NewError([]byte("ERR syntax error")))
+	replyPingArgs = redis.NewStatic(redis.NewError([]byte("ERR wrong number of arguments for 'PING' command")))
+)
+
+var staticReplies = true
+
+// 关闭之后每次回复都重新分配和编码
+func SetStaticReplies(enabled bool) {
+	staticReplies = enabled
+}
+
+func staticReply(x *redis.Resp) *redis.Resp {
+	if staticReplies {
+		return x
+	}
+	return &redis.Resp{Type: x.Type, Value: x.Value}
+}
+
 // 退出命令，这里截获请求，返回ok，断开连接
 func (s *Session) handleQuit(r *Request) (*Request, error) {
 	s.quit = true
-	r.Response.Resp = redis.NewString([]byte("OK"))
+	r.Response.Resp = staticReply(replyOK)
 	return r, nil
 }
 
 // auth命令
 func (s *Session) handleAuth(r *Request) (*Request, error) {
+	if len(r.Resp.Array) == 3 {
+		return s.handleAuthUser(r)
+	}
 	if len(r.Resp.Array) != 2 {
 		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'AUTH' command"))
 		return r, nil
@@ -245,15 +811,235 @@ func (s *Session) handleAuth(r *Request) (*Request, error) {
 	}
 	if s.auth != string(r.Resp.Array[1].Value) {
 		s.authorized = false
+		s.clientError()
 		r.Response.Resp = redis.NewError([]byte("ERR invalid password"))
 		return r, nil
 	} else {
 		s.authorized = true
-		r.Response.Resp = redis.NewString([]byte("OK"))
+		s.user = nil
+		r.Response.Resp = staticReply(replyOK)
 		return r, nil
 	}
 }
 
+// AUTH <user> <password>，用户来自 acl_users
+func (s *Session) handleAuthUser(r *Request) (*Request, error) {
+	if !s.login(string(r.Resp.Array[1].Value), string(r.Resp.Array[2].Value)) {
+		s.authorized = false
+		s.clientError()
+		r.Response.Resp = redis.NewError([]byte("WRONGPASS invalid username-password pair or user is disabled."))
+		return r, nil
+	}
+	s.authorized = true
+	r.Response.Resp = staticReply(replyOK)
+	return r, nil
+}
+
+// CLIENT 命令只在proxy上处理，不会转发给后端，因为后端的连接是所有会话共享的
+// 支持 ID、SETNAME、GETNAME、INFO、SETINFO、NO-EVICT 和 NO-TOUCH，SETINFO、NO-EVICT 和 NO-TOUCH 不做任何处理
+// 其他只对单个后端连接有意义的子命令，比如 LIST、KILL、REPLY 都会返回错误
+func (s *Session) handleClient(r *Request) (*Request, error) {
+	if len(r.Resp.Array) < 2 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'CLIENT' command"))
+		return r, nil
+	}
+	var args = r.Resp.Array[2:]
+	var sub = strings.ToUpper(string(r.Resp.Array[1].Value))
+	switch {
+	case sub == "ID" && len(args) == 0:
+		r.Response.Resp = redis.NewInt([]byte(strconv.FormatInt(s.id, 10)))
+	case sub == "GETNAME" && len(args) == 0:
+		if s.name == "" {
+			r.Response.Resp = staticReply(replyNil)
+		} else {
+			r.Response.Resp = redis.NewBulkBytes([]byte(s.name))
+		}
+	case sub == "SETNAME" && len(args) == 1:
+		if resp := s.setName(string(args[0].Value)); resp != nil {
+			r.Response.Resp = resp
+			return r, nil
+		}
+		r.appstats = s.appstats
+		r.Response.Resp = staticReply(replyOK)
+	case sub == "INFO" && len(args) == 0:
+		info := fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d\n", s.id, s.Conn.Sock.RemoteAddr(), s.name,
+			time.Now().Unix()-s.CreateUnix, time.Now().Unix()-s.LastOpUnix)
+		r.Response.Resp = redis.NewBulkBytes([]byte(info))
+	case sub == "SETINFO" && len(args) == 2:
+		r.Response.Resp = staticReply(replyOK)
+	case (sub == "NO-EVICT" || sub == "NO-TOUCH") && len(args) == 1:
+		switch strings.ToUpper(string(args[0].Value)) {
+		case "ON", "OFF":
+			r.Response.Resp = staticReply(replyOK)
+		default:
+			r.Response.Resp = staticReply(replySyntax)
+		}
+	case sub == "LIST", sub == "KILL", sub == "PAUSE", sub == "UNPAUSE", sub == "REPLY",
+		sub == "TRACKING", sub == "TRACKINGINFO", sub == "CACHING", sub == "GETREDIR", sub == "UNBLOCK":
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR CLIENT %s is not supported by proxy", sub)))
+	default:
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'", sub)))
+	}
+	return r, nil
+}
+
+// COMMAND GETKEYS 按照proxy的命令表获取命令的key，和proxy转发时使用的key一致
+func (s *Session) handleCommandGetKeys(r *Request) (*Request, error) {
+	var args = r.Resp.Array[2:]
+	if len(args) == 0 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'command|getkeys' command"))
+		return r, nil
+	}
+	opstr := strings.ToUpper(string(args[0].Value))
+	switch {
+	case commands[opstr] == nil:
+		r.Response.Resp = redis.NewError([]byte("ERR Invalid command specified"))
+		return r, nil
+	case !checkArity(opstr, len(args)):
+		r.Response.Resp = redis.NewError([]byte("ERR Invalid number of arguments specified for command"))
+		return r, nil
+	}
+	keys := requestKeys(opstr, redis.NewArray(args))
+	if len(keys) == 0 {
+		r.Response.Resp = redis.NewError([]byte("ERR The command has no key arguments"))
+		return r, nil
+	}
+	var array = make([]*redis.Resp, len(keys))
+	for i, key := range keys {
+		array[i] = redis.NewBulkBytes(key)
+	}
+	r.Response.Resp = redis.NewArray(array)
+	return r, nil
+}
+
+// proxy的扩展命令
+// PROXY PIN MASTER: 之后的全部命令都发送给master，用于需要读到自己刚写入的数据的场景
+// PROXY UNPIN: 取消 PIN，开启读slave时只读命令重新发送给slave
+// PROXY APP name: 设置应用名，用于按应用统计命令，优先于 CLIENT SETNAME 设置的名称
+// PROXY TRACE traceparent: 之后的命令作为这个 W3C trace context 的子 span 导出，PROXY TRACE OFF 停止
+func (s *Session) handleProxy(r *Request) (*Request, error) {
+	var args = make([]string, len(r.Resp.Array)-1)
+	for i := range args {
+		args[i] = strings.ToUpper(string(r.Resp.Array[i+1].Value))
+	}
+	switch {
+	case len(args) == 2 && args[0] == "PIN" && args[1] == "MASTER":
+		if !s.pinned {
+			s.mu.Lock()
+			s.pinned = true
+			s.mu.Unlock()
+			cmdstats.pinned.Incr()
+		}
+		r.Response.Resp = staticReply(replyOK)
+	case len(args) == 1 && args[0] == "UNPIN":
+		s.unpin()
+		r.Response.Resp = staticReply(replyOK)
+	case len(args) == 2 && args[0] == "APP":
+		app := string(r.Resp.Array[2].Value)
+		if strings.ContainsAny(app, " \n") {
+			r.Response.Resp = redis.NewError([]byte("ERR app names cannot contain spaces or newlines"))
+			return r, nil
+		}
+		s.mu.Lock()
+		s.app = app
+		s.mu.Unlock()
+		s.updateAppStats()
+		// 设置应用名的命令本身按新的应用统计，之前的请求仍然按原来的应用
+		r.appstats = s.appstats
+		r.Response.Resp = staticReply(replyOK)
+	case len(args) == 2 && args[0] == "TRACE":
+		if args[1] == "OFF" {
+			s.trace = nil
+			r.Response.Resp = staticReply(replyOK)
+			return r, nil
+		}
+		if !TracingEnabled() {
+			r.Response.Resp = redis.NewError([]byte("ERR tracing is disabled by proxy"))
+			return r, nil
+		}
+		t, err := parseTraceparent(string(r.Resp.Array[2].Value))
+		if err != nil {
+			r.Response.Resp = redis.NewError([]byte(err.Error()))
+			return r, nil
+		}
+		s.trace = t
+		r.Response.Resp = staticReply(replyOK)
+	default:
+		r.Response.Resp = redis.NewError([]byte("ERR syntax error, try PROXY PIN MASTER, PROXY UNPIN, PROXY APP name or PROXY TRACE traceparent"))
+	}
+	return r, nil
+}
+
+// 读取当前会话最近写入过的key时发送给master
+func (s *Session) checkRecentWrites(r *Request, usnow int64) {
+	c := commands[r.OpStr]
+	if c == nil {
+		return
+	}
+	if s.recent == nil {
+		s.recent = newRecentWrites(int64(s.ReadAfterWrite / time.Microsecond))
+	}
+	switch {
+	case c.IsWrite():
+		s.recent.add(c, r.Resp, usnow)
+	case (r.replica || r.spread) && s.recent.has(c, r.Resp, usnow):
+		r.replica, r.spread = false, false
+		incrReadAfterWrites()
+	}
+}
+
+// CLIENT SETNAME 和 HELLO SETNAME 设置名称，名称不合法时返回错误
+func (s *Session) setName(name string) *redis.Resp {
+	if strings.ContainsAny(name, " \n") {
+		return redis.NewError([]byte("ERR Client names cannot contain spaces, newlines or special characters."))
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+	s.updateAppStats()
+	return nil
+}
+
+// 应用名改变之后重新获取对应的统计信息
+func (s *Session) updateAppStats() {
+	app := s.app
+	if app == "" {
+		app = s.name
+	}
+	s.appstats = getAppStats(app)
+}
+
+func (s *Session) unpin() {
+	if s.pinned {
+		s.mu.Lock()
+		s.pinned = false
+		s.mu.Unlock()
+		cmdstats.pinned.Decr()
+	}
+}
+
+// SHUTDOWN 不会转发给后端，即使在 allow_commands 中也不会，否则会关闭某一个后端redis
+// 只有开启了 proxy_shutdown 并且proxy设置了密码时才会关闭proxy自己，否则返回错误
+func (s *Session) handleShutdown(r *Request) (*Request, error) {
+	if shutdown == nil || s.auth == "" {
+		r.Response.Resp = redis.NewError([]byte("ERR SHUTDOWN disabled by proxy"))
+		return r, nil
+	}
+	log.Warnf("session [%d] shutdown proxy: %s", s.id, s)
+	s.quit = true
+	r.Response.Resp = staticReply(replyOK)
+	go shutdown()
+	return r, nil
+}
+
+// SHUTDOWN 时关闭proxy的函数，为nil时不允许通过 SHUTDOWN 关闭proxy
+var shutdown func()
+
+// 允许通过 SHUTDOWN 命令关闭proxy，需要在开始处理请求之前调用
+func SetShutdown(fn func()) {
+	shutdown = fn
+}
+
 // 检查select命令
 func (s *Session) handleSelect(r *Request) (*Request, error) {
 	// 参数数量不正确
@@ -269,18 +1055,58 @@ func (s *Session) handleSelect(r *Request) (*Request, error) {
 		r.Response.Resp = redis.NewError([]byte("ERR invalid DB index, only accept DB 0"))
 		return r, nil
 	} else {
-		r.Response.Resp = redis.NewString([]byte("OK"))
+		r.Response.Resp = staticReply(replyOK)
 		return r, nil
 	}
 }
 
-// 检查 ping 命令，不转发给后端redis了
-func (s *Session) handlePing(r *Request) (*Request, error) {
+// 检查 ping 命令，开启 LocalPing 时不转发给后端redis了
+// 和 redis 一样，PING <message> 以 bulk string 返回 message
+// PING DEEP 总是会转发给后端redis，用于检查后端是否可用
+func (s *Session) handlePing(r *Request, d Dispatcher) (*Request, error) {
+	switch len(r.Resp.Array) {
+	case 1:
+		if s.LocalPing {
+			incrLocalPings()
+			r.Response.Resp = staticReply(replyPong)
+			return r, nil
+		}
+	case 2:
+		if !strings.EqualFold(string(r.Resp.Array[1].Value), "DEEP") {
+			if s.LocalPing {
+				incrLocalPings()
+				r.Response.Resp = redis.NewBulkBytes(r.Resp.Array[1].Value)
+				return r, nil
+			}
+			break
+		}
+		r.Resp = redis.NewArray([]*redis.Resp{r.Resp.Array[0]})
+	default:
+		r.Response.Resp = staticReply(replyPingArgs)
+		return r, nil
+	}
+	return r, d.Dispatch(r)
+}
+
+// 开启后由proxy用自己的时钟回复 TIME，否则和没有key的命令一样转发给一个后端，返回的是那个后端的时钟
+var localTime = true
+
+// 需要在开始处理请求之前设置
+func SetLocalTime(enabled bool) {
+	localTime = enabled
+}
+
+// 和 redis 一样返回秒和微秒两个 bulk string
+func (s *Session) handleTime(r *Request) (*Request, error) {
 	if len(r.Resp.Array) != 1 {
-		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'PING' command"))
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'time' command"))
 		return r, nil
 	}
-	r.Response.Resp = redis.NewString([]byte("PONG"))
+	now := time.Now()
+	r.Response.Resp = redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte(strconv.FormatInt(now.Unix(), 10))),
+		redis.NewBulkBytes([]byte(strconv.Itoa(now.Nanosecond() / 1000))),
+	})
 	return r, nil
 }
 
@@ -301,6 +1127,16 @@ func (s *Session) handleRequestMGet(r *Request, d Dispatcher) (*Request, error)
 			}),
 			Wait:   r.Wait,
 			Failed: r.Failed,
+			conns:  r.conns,
+			reply:  r.reply,
+
+			session: r.session,
+			urgent:  r.urgent,
+			replica: r.replica,
+			spread:  r.spread,
+
+			lagLimited: r.lagLimited,
+			maxLag:     r.maxLag,
 		}
 		if err := d.Dispatch(sub[i]); err != nil {
 			return nil, err
@@ -350,6 +1186,11 @@ func (s *Session) handleRequestMSet(r *Request, d Dispatcher) (*Request, error)
 			}),
 			Wait:   r.Wait,
 			Failed: r.Failed,
+			conns:  r.conns,
+			reply:  r.reply,
+
+			session: r.session,
+			urgent:  r.urgent,
 		}
 		if err := d.Dispatch(sub[i]); err != nil {
 			return nil, err
@@ -391,6 +1232,11 @@ func (s *Session) handleRequestMDel(r *Request, d Dispatcher) (*Request, error)
 			}),
 			Wait:   r.Wait,
 			Failed: r.Failed,
+			conns:  r.conns,
+			reply:  r.reply,
+
+			session: r.session,
+			urgent:  r.urgent,
 		}
 		if err := d.Dispatch(sub[i]); err != nil {
 			return nil, err
@@ -419,6 +1265,144 @@ func (s *Session) handleRequestMDel(r *Request, d Dispatcher) (*Request, error)
 	return r, nil
 }
 
+// 多个key的 EXISTS 同 Mdel 一样拆分成单个key的任务，返回结果求和
+// 重复的key会被计算多次，和redis的行为一致
+func (s *Session) handleRequestExists(r *Request, d Dispatcher) (*Request, error) {
+	nkeys := len(r.Resp.Array) - 1
+	if nkeys <= 1 {
+		return r, d.Dispatch(r)
+	}
+	var sub = make([]*Request, nkeys)
+	for i := 0; i < len(sub); i++ {
+		sub[i] = &Request{
+			OpStr: r.OpStr,
+			Start: r.Start,
+			Resp: redis.NewArray([]*redis.Resp{
+				r.Resp.Array[0],
+				r.Resp.Array[i+1],
+			}),
+			Wait:   r.Wait,
+			Failed: r.Failed,
+			conns:  r.conns,
+			reply:  r.reply,
+
+			session: r.session,
+			urgent:  r.urgent,
+			replica: r.replica,
+			spread:  r.spread,
+
+			lagLimited: r.lagLimited,
+			maxLag:     r.maxLag,
+		}
+		if err := d.Dispatch(sub[i]); err != nil {
+			return nil, err
+		}
+	}
+	r.Coalesce = func() error {
+		var n int
+		for _, x := range sub {
+			if err := x.Response.Err; err != nil {
+				return err
+			}
+			resp := x.Response.Resp
+			if resp == nil {
+				return ErrRespIsRequired
+			}
+			if !resp.IsInt() {
+				return errors.New(fmt.Sprintf("bad exists resp: %s", resp.Type))
+			}
+			v, err := strconv.Atoi(string(resp.Value))
+			if err != nil {
+				return errors.New(fmt.Sprintf("bad exists resp: value = %s", resp.Value))
+			}
+			n += v
+		}
+		r.Response.Resp = redis.NewInt([]byte(strconv.Itoa(n)))
+		return nil
+	}
+	return r, nil
+}
+
+// dbsize命令会发送给所有后端，返回结果求和
+func (s *Session) handleRequestDbsize(r *Request, d Dispatcher) (*Request, error) {
+	if len(r.Resp.Array) != 1 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'DBSIZE' command"))
+		return r, nil
+	}
+	subs, err := d.Broadcast(r)
+	if err != nil {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s", err)))
+		return r, nil
+	}
+	r.Coalesce = func() error {
+		var n int64
+		return coalesceBroadcast(r, subs, func(resp *redis.Resp) error {
+			if !resp.IsInt() {
+				return errors.New(fmt.Sprintf("bad dbsize resp: %s", resp.Type))
+			}
+			v, err := strconv.ParseInt(string(resp.Value), 10, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("bad dbsize resp: %s", resp.Value))
+			}
+			n += v
+			r.Response.Resp = redis.NewInt([]byte(strconv.FormatInt(n, 10)))
+			return nil
+		})
+	}
+	return r, nil
+}
+
+// flushall命令会发送给所有后端，全部成功才返回ok
+func (s *Session) handleRequestFlushAll(r *Request, d Dispatcher) (*Request, error) {
+	subs, err := d.Broadcast(r)
+	if err != nil {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s", err)))
+		return r, nil
+	}
+	r.Coalesce = func() error {
+		return coalesceBroadcast(r, subs, func(resp *redis.Resp) error {
+			if !resp.IsString() {
+				return errors.New(fmt.Sprintf("bad flushall resp: %s", resp.Type))
+			}
+			r.Response.Resp = resp
+			return nil
+		})
+	}
+	return r, nil
+}
+
+// 汇总广播请求的结果，有后端失败时返回的错误信息中会列出这些后端
+func coalesceBroadcast(r *Request, subs map[string]*Request, merge func(resp *redis.Resp) error) error {
+	var addrs = make([]string, 0, len(subs))
+	for addr := range subs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var failed []string
+	for _, addr := range addrs {
+		x := subs[addr]
+		resp, err := x.Response.Resp, x.Response.Err
+		switch {
+		case err != nil:
+		case resp == nil:
+			err = ErrRespIsRequired
+		case resp.IsError():
+			err = errors.New(string(resp.Value))
+		default:
+			err = merge(resp)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", addr, err))
+		}
+	}
+	if len(failed) != 0 {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s failed on %d of %d backends, %s",
+			r.OpStr, len(failed), len(subs), strings.Join(failed, "; "))))
+	}
+	return nil
+}
+
 // 返回精确到毫秒的时间戳
 func microseconds() int64 {
 	return time.Now().UnixNano() / int64(time.Microsecond)
@@ -0,0 +1,1541 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 直接设置返回结果的分发器
+type fakeDispatcher struct {
+	backends map[string]func(r *Request)
+	dispatch func(r *Request)
+	keys     map[string]int64 // Backends 返回的key的数量，没有的后端为-1
+}
+
+func (d *fakeDispatcher) Dispatch(r *Request) error {
+	d.dispatch(r)
+	return nil
+}
+
+func (d *fakeDispatcher) Broadcast(r *Request) (map[string]*Request, error) {
+	if len(d.backends) == 0 {
+		return nil, ErrNoBackend
+	}
+	var subs = make(map[string]*Request)
+	for addr, fn := range d.backends {
+		x := &Request{OpStr: r.OpStr, Start: r.Start, Resp: r.Resp}
+		fn(x)
+		subs[addr] = x
+	}
+	return subs, nil
+}
+
+func (d *fakeDispatcher) Backends() map[string]int64 {
+	var m = make(map[string]int64)
+	for addr := range d.backends {
+		m[addr] = -1
+		if n, ok := d.keys[addr]; ok {
+			m[addr] = n
+		}
+	}
+	return m
+}
+
+func (d *fakeDispatcher) DispatchTo(addr string, r *Request) error {
+	fn := d.backends[addr]
+	if fn == nil {
+		return ErrNoBackend
+	}
+	fn(r)
+	return nil
+}
+
+func newRequestResp(args ...string) *redis.Resp {
+	var array = make([]*redis.Resp, len(args))
+	for i, arg := range args {
+		array[i] = redis.NewBulkBytes([]byte(arg))
+	}
+	return redis.NewArray(array)
+}
+
+// 通过 tcp 连接运行一个会话，setup 在开始处理请求之前调整会话，返回客户端的连接和会话结束的通知
+func serveSession(d Dispatcher, setup func(s *Session)) (net.Conn, *Session, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.MustNoError(err)
+	x, err := l.Accept()
+	assert.MustNoError(err)
+	s := NewSessionSize(x, "", 1024, 1800)
+	if setup != nil {
+		setup(s)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(d, 16)
+	}()
+	return c, s, done
+}
+
+func doRequest(s *Session, d Dispatcher, args ...string) *redis.Resp {
+	r, err := s.handleRequest(newRequestResp(args...), d)
+	assert.MustNoError(err)
+	r.Wait.Wait()
+	if r.Coalesce != nil {
+		assert.MustNoError(r.Coalesce())
+	}
+	assert.MustNoError(r.Response.Err)
+	return r.Response.Resp
+}
+
+func replyWith(resp *redis.Resp, err error) func(r *Request) {
+	return func(r *Request) {
+		r.setResponse(resp, err)
+	}
+}
+
+func TestBroadcastDbsize(t *testing.T) {
+	d := &fakeDispatcher{backends: map[string]func(r *Request){
+		"127.0.0.1:6379": replyWith(redis.NewInt([]byte("3")), nil),
+		"127.0.0.1:6380": replyWith(redis.NewInt([]byte("4")), nil),
+	}}
+	resp := doRequest(&Session{}, d, "DBSIZE")
+	assert.Must(resp.IsInt() && string(resp.Value) == "7")
+}
+
+func TestBroadcastPartialFailure(t *testing.T) {
+	defer saveBlacklist()()
+	AllowCommands("FLUSHALL")
+	d := &fakeDispatcher{backends: map[string]func(r *Request){
+		"127.0.0.1:6379": replyWith(redis.NewString([]byte("OK")), nil),
+		"127.0.0.1:6380": replyWith(nil, errors.New("connection refused")),
+		"127.0.0.1:6381": replyWith(redis.NewError([]byte("ERR busy")), nil),
+	}}
+	resp := doRequest(&Session{}, d, "FLUSHALL")
+	assert.Must(resp.IsError())
+	msg := string(resp.Value)
+	assert.Must(strings.HasPrefix(msg, "ERR FLUSHALL failed on 2 of 3 backends"))
+	assert.Must(strings.Contains(msg, "127.0.0.1:6380: connection refused"))
+	assert.Must(strings.Contains(msg, "127.0.0.1:6381: ERR busy"))
+	assert.Must(!strings.Contains(msg, "127.0.0.1:6379"))
+
+	resp = doRequest(&Session{}, d, "DBSIZE")
+	assert.Must(resp.IsError())
+	assert.Must(strings.HasPrefix(string(resp.Value), "ERR DBSIZE failed on 3 of 3 backends"))
+
+	resp = doRequest(&Session{}, &fakeDispatcher{}, "DBSIZE")
+	assert.Must(resp.IsError())
+}
+
+func TestLocalPing(t *testing.T) {
+	var forwarded []string
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		forwarded = append(forwarded, string(r.Resp.Array[0].Value))
+		if len(r.Resp.Array) == 2 {
+			r.Response.Resp = redis.NewBulkBytes(r.Resp.Array[1].Value)
+			return
+		}
+		r.Response.Resp = redis.NewString([]byte("PONG"))
+	}}
+
+	s := &Session{LocalPing: true}
+	n := LocalPingCounts()
+	resp := doRequest(s, d, "PING")
+	assert.Must(resp.IsString() && string(resp.Value) == "PONG")
+	assert.Must(len(forwarded) == 0 && LocalPingCounts() == n+1)
+
+	resp = doRequest(s, d, "PING", "deep")
+	assert.Must(resp.IsString() && string(resp.Value) == "PONG")
+	assert.Must(len(forwarded) == 1)
+
+	// PING <message> 返回 message
+	for _, msg := range []string{"hello", "", "a b\r\n"} {
+		resp = doRequest(s, d, "PING", msg)
+		assert.Must(resp.IsBulkBytes() && string(resp.Value) == msg)
+	}
+	assert.Must(len(forwarded) == 1 && LocalPingCounts() == n+4)
+	resp = doRequest(s, d, "PING", "a", "b")
+	assert.Must(resp.IsError() && len(forwarded) == 1)
+
+	s.LocalPing = false
+	doRequest(s, d, "PING")
+	assert.Must(len(forwarded) == 2 && LocalPingCounts() == n+4)
+	resp = doRequest(s, d, "PING", "hello")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "hello")
+	assert.Must(len(forwarded) == 3 && LocalPingCounts() == n+4)
+}
+
+func TestLocalTime(t *testing.T) {
+	var forwarded int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		forwarded++
+		r.Response.Resp = redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("1")), redis.NewBulkBytes([]byte("2")),
+		})
+	}}
+	s := &Session{}
+	before := time.Now().Unix()
+	resp := doRequest(s, d, "TIME")
+	assert.Must(resp.IsArray() && len(resp.Array) == 2 && forwarded == 0)
+	for _, x := range resp.Array {
+		assert.Must(x.IsBulkBytes())
+	}
+	secs, err := strconv.ParseInt(string(resp.Array[0].Value), 10, 64)
+	assert.MustNoError(err)
+	usecs, err := strconv.ParseInt(string(resp.Array[1].Value), 10, 64)
+	assert.MustNoError(err)
+	assert.Must(secs >= before && secs <= time.Now().Unix() && usecs >= 0 && usecs < 1e6)
+	assert.Must(doRequest(s, d, "TIME", "x").IsError() && forwarded == 0)
+
+	SetLocalTime(false)
+	defer SetLocalTime(true)
+	resp = doRequest(s, d, "time")
+	assert.Must(forwarded == 1 && string(resp.Array[0].Value) == "1")
+}
+
+func TestRetryReads(t *testing.T) {
+	var calls atomic2.Int64
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		if n := calls.Incr(); n == 1 {
+			replyWith(nil, errors.New("connection reset"))(r)
+		} else {
+			replyWith(redis.NewBulkBytes([]byte(strconv.FormatInt(n, 10))), nil)(r)
+		}
+	}}
+	s := &Session{RetryReads: true}
+	do := func(args ...string) *Request {
+		s.acquireInflight()
+		r, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+		return r
+	}
+
+	// 第一个请求出错时就安排了重试，第二个请求在出错之前已经转发
+	r1, r2 := do("GET", "k"), do("GET", "k")
+	assert.Must(r1.retried != nil && s.failed.Get())
+	resp, err := s.handleResponse(r1)
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "3" && calls.Get() == 3)
+	// 还有尚未返回的请求，不能恢复转发
+	assert.Must(s.failed.Get())
+	resp, err = s.handleResponse(r2)
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "2" && !s.failed.Get())
+
+	n := WritesNotRetriedCounts()
+	calls.Set(0)
+	r := do("SET", "k", "v")
+	_, err = s.handleResponse(r)
+	assert.Must(err != nil && calls.Get() == 1 && WritesNotRetriedCounts() == n+1)
+}
+
+func TestRetryReadsNotBlocking(t *testing.T) {
+	var calls atomic2.Int64
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		if calls.Incr() <= 3 {
+			replyWith(nil, errors.New("connection reset"))(r)
+		} else {
+			replyWith(redis.NewBulkBytes([]byte("v")), nil)(r)
+		}
+	}}
+	s := &Session{RetryReads: true}
+	var list []*Request
+	for i := 0; i < 3; i++ {
+		s.acquireInflight()
+		r, err := s.handleRequest(newRequestResp("GET", "k"), d)
+		assert.MustNoError(err)
+		list = append(list, r)
+	}
+	// 多个出错的请求同时重试，而不是每个请求依次等待 retryDelay
+	start := time.Now()
+	for _, r := range list {
+		resp, err := s.handleResponse(r)
+		assert.MustNoError(err)
+		assert.Must(string(resp.Value) == "v")
+	}
+	assert.Must(time.Since(start) < retryDelay*2 && calls.Get() == 6)
+}
+
+func benchmarkHandleResponse(b *testing.B, enabled bool) {
+	defer func(v bool) {
+		statsEnabled = v
+	}(statsEnabled)
+	statsEnabled = enabled
+
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewString([]byte("OK")), nil)}
+	b.ResetTimer()
+	// 多个连接同时更新统计信息时的开销
+	b.RunParallel(func(pb *testing.PB) {
+		s := &Session{}
+		for pb.Next() {
+			r, err := s.handleRequest(newRequestResp("SET", "k", "v"), d)
+			assert.MustNoError(err)
+			_, err = s.handleResponse(r)
+			assert.MustNoError(err)
+		}
+	})
+}
+
+func BenchmarkHandleResponseStats(b *testing.B) {
+	benchmarkHandleResponse(b, true)
+}
+
+func BenchmarkHandleResponseNoStats(b *testing.B) {
+	benchmarkHandleResponse(b, false)
+}
+
+func TestStaticReplies(t *testing.T) {
+	s := &Session{LocalPing: true}
+	d := &fakeDispatcher{}
+	// 所有会话共用同一个预先编码的回复
+	x := doRequest(s, d, "PING")
+	assert.Must(x == replyPong && doRequest(s, d, "PING") == x)
+	assert.Must(doRequest(s, d, "PING", "a", "b") == replyPingArgs)
+
+	SetStaticReplies(false)
+	defer SetStaticReplies(true)
+	y := doRequest(s, d, "PING")
+	assert.Must(y != replyPong && y.IsString() && string(y.Value) == "PONG")
+	b1, err := redis.EncodeToBytes(x)
+	assert.MustNoError(err)
+	b2, err := redis.EncodeToBytes(y)
+	assert.MustNoError(err)
+	assert.Must(string(b1) == "+PONG\r\n" && string(b2) == string(b1))
+}
+
+// 由proxy直接回复的 PING，包括编码回复的开销
+func benchmarkLocalPing(b *testing.B, static bool) {
+	SetStaticReplies(static)
+	defer SetStaticReplies(true)
+
+	s := &Session{LocalPing: true}
+	d := &fakeDispatcher{}
+	e := redis.NewEncoderSize(ioutil.Discard, 1024)
+	req := newRequestResp("PING")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := s.handleRequest(req, d)
+		assert.MustNoError(err)
+		resp, err := s.handleResponse(r)
+		assert.MustNoError(err)
+		assert.MustNoError(e.Encode(resp, false))
+	}
+}
+
+func BenchmarkLocalPingStatic(b *testing.B) {
+	benchmarkLocalPing(b, true)
+}
+
+func BenchmarkLocalPingAlloc(b *testing.B) {
+	benchmarkLocalPing(b, false)
+}
+
+func TestClientGone(t *testing.T) {
+	// 后端在客户端断开之后才返回
+	reply := make(chan struct{})
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		r.Wait.Add(1)
+		go func() {
+			<-reply
+			r.setResponse(redis.NewBulkBytes([]byte("v")), nil)
+			r.Wait.Done()
+		}()
+	}}
+	c, s, done := serveSession(d, nil)
+
+	n := ClientGoneCounts()
+	_, err := c.Write([]byte("GET a\r\nGET b\r\n"))
+	assert.MustNoError(err)
+	for s.Inflight.Get() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+	for !s.gone.Get() {
+		time.Sleep(time.Millisecond)
+	}
+	// 会话等待两个回复都返回之后丢弃，不会写入已经断开的连接
+	close(reply)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("session not closed")
+	}
+	assert.Must(s.dropped.Get() == 2 && ClientGoneCounts() == n+2)
+	assert.Must(s.Inflight.Get() == 0)
+}
+
+func TestPipelineBatches(t *testing.T) {
+	before := PipelineBatches()
+	c, _, _ := serveSession(&fakeDispatcher{}, checkedSession)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for _, n := range []int{1, 5, 1, 20} {
+		_, err := c.Write([]byte(strings.Repeat("PING\r\n", n)))
+		assert.MustNoError(err)
+		for i := 0; i < n; i++ {
+			line, err := r.ReadString('\n')
+			assert.MustNoError(err)
+			assert.Must(line == "+PONG\r\n")
+		}
+	}
+	// 读取完缓存中的命令之后才会计数
+	expect := map[string]int64{"1": 2, "2-10": 1, "11-100": 1, "100+": 0}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		after, ok := PipelineBatches(), true
+		for k, v := range expect {
+			ok = ok && after[k]-before[k] == v
+		}
+		if ok {
+			break
+		}
+		assert.Must(time.Now().Before(deadline))
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// key 为 slow 的请求等到关闭 slow 之后才返回，其他请求直接返回并计数
+func serveSlowBackend(maxInflight int) (net.Conn, *atomic2.Int64, chan struct{}) {
+	var fast atomic2.Int64
+	slow := make(chan struct{})
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		key := r.Resp.Array[1].Value
+		if string(key) != "slow" {
+			r.setResponse(redis.NewBulkBytes(key), nil)
+			fast.Incr()
+			return
+		}
+		r.Wait.Add(1)
+		go func() {
+			<-slow
+			r.setResponse(redis.NewBulkBytes(key), nil)
+			r.Wait.Done()
+		}()
+	}}
+	c, _, _ := serveSession(d, func(s *Session) {
+		s.MaxInflight = maxInflight
+	})
+	return c, &fast, slow
+}
+
+// 慢的后端不会阻塞同一个 pipeline 中发往其他后端的命令，回复仍然按请求的顺序返回
+func TestPipelineSlowBackend(t *testing.T) {
+	c, fast, slow := serveSlowBackend(0)
+	defer c.Close()
+	var b []byte
+	b = append(b, "GET slow\r\n"...)
+	for i := 0; i < 8; i++ {
+		b = append(b, fmt.Sprintf("GET fast%d\r\n", i)...)
+	}
+	_, err := c.Write(b)
+	assert.MustNoError(err)
+	deadline := time.Now().Add(time.Second * 5)
+	for fast.Get() != 8 {
+		assert.Must(time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+	close(slow)
+
+	r := bufio.NewReader(c)
+	expect := []string{"slow"}
+	for i := 0; i < 8; i++ {
+		expect = append(expect, fmt.Sprintf("fast%d", i))
+	}
+	for _, key := range expect {
+		line, err := r.ReadString('\n')
+		assert.MustNoError(err)
+		assert.Must(line == fmt.Sprintf("$%d\r\n", len(key)))
+		line, err = r.ReadString('\n')
+		assert.MustNoError(err)
+		assert.Must(line == key+"\r\n")
+	}
+}
+
+func TestPipelineWindow(t *testing.T) {
+	// 最多同时转发3个命令，慢的命令返回之前只能提前转发2个
+	c, fast, slow := serveSlowBackend(3)
+	defer c.Close()
+	_, err := c.Write([]byte("GET slow\r\n" + strings.Repeat("GET fast\r\n", 8)))
+	assert.MustNoError(err)
+	time.Sleep(time.Millisecond * 100)
+	assert.Must(fast.Get() == 2)
+	close(slow)
+
+	r := bufio.NewReader(c)
+	for i := 0; i < 9*2; i++ {
+		_, err := r.ReadString('\n')
+		assert.MustNoError(err)
+	}
+	assert.Must(fast.Get() == 8)
+}
+
+func TestMultiKeyExists(t *testing.T) {
+	// 模拟分布在不同后端的key
+	var backends = make(map[string]map[string]bool)
+	for key, addr := range map[string]string{
+		"a": "127.0.0.1:6379", "b": "127.0.0.1:6380", "c": "127.0.0.1:6381",
+	} {
+		if backends[addr] == nil {
+			backends[addr] = make(map[string]bool)
+		}
+		backends[addr][key] = true
+	}
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		assert.Must(len(r.Resp.Array) == 2)
+		key := string(r.Resp.Array[1].Value)
+		for _, keys := range backends {
+			if keys[key] {
+				replyWith(redis.NewInt([]byte("1")), nil)(r)
+				return
+			}
+		}
+		replyWith(redis.NewInt([]byte("0")), nil)(r)
+	}}
+	for _, args := range [][]string{
+		{"EXISTS", "a", "b", "c", "x", "a"},
+		{"EXISTS", "x", "a", "c", "a", "b"},
+		{"EXISTS", "a", "a", "b", "c", "x"},
+	} {
+		resp := doRequest(&Session{}, d, args...)
+		assert.Must(resp.IsInt() && string(resp.Value) == "4")
+	}
+	resp := doRequest(&Session{}, d, "EXISTS", "x")
+	assert.Must(resp.IsInt() && string(resp.Value) == "0")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+	s.HandshakeTimeout = time.Millisecond * 100
+	n := HandshakeTimeoutCounts()
+	go s.Serve(&fakeDispatcher{}, 16)
+
+	// 只发送了半条命令
+	_, err := c2.Write([]byte("*1\r\n$4\r\n"))
+	assert.MustNoError(err)
+	c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = c2.Read(make([]byte, 1))
+	assert.Must(err != nil && HandshakeTimeoutCounts() == n+1)
+}
+
+func TestHandshakeDone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+	s.LocalPing = true
+	s.HandshakeTimeout = time.Millisecond * 100
+	go s.Serve(&fakeDispatcher{}, 16)
+
+	r := bufio.NewReader(c2)
+	for i := 0; i < 2; i++ {
+		_, err := c2.Write([]byte("PING\r\n"))
+		assert.MustNoError(err)
+		line, err := r.ReadString('\n')
+		assert.MustNoError(err)
+		assert.Must(line == "+PONG\r\n")
+		// 握手完成之后，超过握手超时时间的空闲不会导致连接被关闭
+		time.Sleep(s.HandshakeTimeout * 2)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+	s.LocalPing = true
+	s.ReadTimeout = time.Millisecond * 100
+	n := ReadTimeoutCounts()
+	go s.Serve(&fakeDispatcher{}, 16)
+
+	r := bufio.NewReader(c2)
+	c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+	// 完整的命令之间的空闲不受限制
+	for i := 0; i < 2; i++ {
+		_, err := c2.Write([]byte("PING\r\n"))
+		assert.MustNoError(err)
+		line, err := r.ReadString('\n')
+		assert.MustNoError(err)
+		assert.Must(line == "+PONG\r\n")
+		time.Sleep(s.ReadTimeout * 2)
+	}
+	assert.Must(ReadTimeoutCounts() == n)
+
+	// 分几次发送，在超时之前发送完也可以
+	for _, b := range []string{"*1\r\n", "$4\r\n", "PI", "NG\r\n"} {
+		_, err := c2.Write([]byte(b))
+		assert.MustNoError(err)
+		time.Sleep(s.ReadTimeout / 5)
+	}
+	line, err := r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "+PONG\r\n")
+
+	// 半条命令超时之后回复错误并关闭连接
+	_, err = c2.Write([]byte("*1\r\n$4\r\n"))
+	assert.MustNoError(err)
+	line, err = r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "-ERR Protocol error: timeout reading command\r\n")
+	_, err = r.ReadByte()
+	assert.Must(err != nil && ReadTimeoutCounts() == n+1)
+}
+
+func TestTableStale(t *testing.T) {
+	SetTableStale(true)
+	defer SetTableStale(false)
+
+	var calls int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		calls++
+		replyWith(redis.NewString([]byte("OK")), nil)(r)
+	}}
+	n := StaleRejectCounts()
+	resp := doRequest(&Session{}, d, "SET", "k", "v")
+	assert.Must(resp.IsError() && strings.Contains(string(resp.Value), "stale"))
+	assert.Must(calls == 0 && StaleRejectCounts() == n+1)
+
+	resp = doRequest(&Session{LocalPing: true}, d, "PING")
+	assert.Must(resp.IsString() && string(resp.Value) == "PONG")
+}
+
+func TestClientCommand(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+	defer s.Close()
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		t.Fatalf("CLIENT %s should not be forwarded", r.Resp.Array[1].Value)
+	}}
+
+	resp := doRequest(s, d, "CLIENT", "ID")
+	assert.Must(resp.IsInt() && string(resp.Value) == strconv.FormatInt(s.id, 10))
+
+	resp = doRequest(s, d, "CLIENT", "GETNAME")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+	resp = doRequest(s, d, "client", "setname", "worker-1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = doRequest(s, d, "CLIENT", "GETNAME")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "worker-1")
+	resp = doRequest(s, d, "CLIENT", "SETNAME", "bad name")
+	assert.Must(resp.IsError())
+
+	resp = doRequest(s, d, "CLIENT", "INFO")
+	assert.Must(resp.IsBulkBytes() && strings.Contains(string(resp.Value), "name=worker-1"))
+
+	for _, args := range [][]string{
+		{"CLIENT", "SETINFO", "LIB-NAME", "redis-py"},
+		{"CLIENT", "NO-EVICT", "on"},
+		{"CLIENT", "NO-EVICT", "OFF"},
+		{"CLIENT", "NO-TOUCH", "on"},
+		{"CLIENT", "NO-TOUCH", "OFF"},
+	} {
+		resp = doRequest(s, d, args...)
+		assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	}
+
+	for _, sub := range []string{"LIST", "KILL", "REPLY", "PAUSE", "TRACKING"} {
+		resp = doRequest(s, d, "CLIENT", sub)
+		assert.Must(resp.IsError() && strings.Contains(string(resp.Value), "not supported by proxy"))
+	}
+	for _, args := range [][]string{
+		{"CLIENT", "FOO"},
+		{"CLIENT", "ID", "1"},
+		{"CLIENT", "SETNAME"},
+	} {
+		resp = doRequest(s, d, args...)
+		assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "ERR Unknown subcommand"))
+	}
+	resp = doRequest(s, d, "CLIENT", "NO-EVICT", "maybe")
+	assert.Must(resp.IsError())
+	resp = doRequest(s, d, "CLIENT", "NO-TOUCH")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "ERR Unknown subcommand"))
+	resp = doRequest(s, d, "CLIENT")
+	assert.Must(resp.IsError())
+}
+
+func TestProxyPinMaster(t *testing.T) {
+	var replica bool
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		replica = r.replica
+		replyWith(redis.NewBulkBytes([]byte("v")), nil)(r)
+	}}
+	s := &Session{ReadReplica: true}
+	n := PinnedSessionCounts()
+
+	doRequest(s, d, "GET", "k")
+	assert.Must(replica)
+	doRequest(s, d, "SET", "k", "v")
+	assert.Must(!replica)
+
+	resp := doRequest(s, d, "PROXY", "PIN", "MASTER")
+	assert.Must(resp.IsString() && PinnedSessionCounts() == n+1)
+	doRequest(s, d, "GET", "k")
+	assert.Must(!replica)
+
+	resp = doRequest(s, d, "proxy", "unpin")
+	assert.Must(resp.IsString() && PinnedSessionCounts() == n)
+	doRequest(s, d, "GET", "k")
+	assert.Must(replica)
+
+	resp = doRequest(s, d, "PROXY", "PIN")
+	assert.Must(resp.IsError())
+}
+
+func TestCheckArity(t *testing.T) {
+	var calls int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		calls++
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}
+	s := &Session{CheckArity: true}
+
+	n := ArityRejectCounts()
+	// 固定参数个数的命令，多或者少都会被拒绝
+	for _, args := range [][]string{{"GET"}, {"GET", "a", "b"}, {"SETEX", "a", "10"}} {
+		resp := doRequest(s, d, args...)
+		assert.Must(resp.IsError())
+		assert.Must(string(resp.Value) == fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(args[0])))
+	}
+	// 可变参数个数的命令只检查下限
+	resp := doRequest(s, d, "SADD", "a")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR wrong number of arguments for 'sadd' command")
+	assert.Must(calls == 0 && ArityRejectCounts() == n+4)
+
+	for _, args := range [][]string{{"GET", "a"}, {"SADD", "a", "b"}, {"SADD", "a", "b", "c", "d"}, {"SET", "a", "b", "EX", "10"}} {
+		resp := doRequest(s, d, args...)
+		assert.Must(resp.IsString())
+	}
+	assert.Must(calls == 4 && ArityRejectCounts() == n+4)
+
+	// 关闭之后交给后端检查
+	resp = doRequest(&Session{}, d, "GET")
+	assert.Must(resp.IsString() && calls == 5)
+}
+
+func TestExpireOptions(t *testing.T) {
+	var keys []string
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		keys = append(keys, string(getHashKey(r.Resp, r.OpStr)))
+		r.Response.Resp = redis.NewInt([]byte("1"))
+	}}
+	s := &Session{CheckArity: true}
+
+	// EXPIRE 系列的 NX/XX/GT/LT 选项，以及 SET 的 KEEPTTL/EXAT/PXAT/GET 选项，都按第一个key路由
+	for _, args := range [][]string{
+		{"EXPIRE", "a", "10", "NX"},
+		{"PEXPIRE", "a", "10000", "XX"},
+		{"EXPIREAT", "a", "1700000000", "GT"},
+		{"PEXPIREAT", "a", "1700000000000", "LT"},
+		{"SET", "a", "b", "KEEPTTL"},
+		{"SET", "a", "b", "EXAT", "1700000000", "NX"},
+		{"SET", "a", "b", "PXAT", "1700000000000", "GET"},
+		{"GETEX", "a", "PERSIST"},
+		{"GETEX", "a"},
+	} {
+		assert.Must(!doRequest(s, d, args...).IsError())
+		assert.Must(keys[len(keys)-1] == "a")
+		assert.Must(GetCommand(args[0]).IsWrite())
+	}
+	assert.Must(len(keys) == 9)
+	assert.Must(doRequest(s, d, "EXPIRE", "a").IsError())
+	assert.Must(doRequest(s, d, "GETDEL", "a", "b").IsError())
+}
+
+func TestVariadicArity(t *testing.T) {
+	var keys []string
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		keys = append(keys, string(getHashKey(r.Resp, r.OpStr)))
+		r.Response.Resp = redis.NewInt([]byte("1"))
+	}}
+	s := &Session{CheckArity: true}
+
+	// 新版本redis中可以带多个参数或者可选参数的命令，都按第一个key路由
+	for _, args := range [][]string{
+		{"HSET", "h", "f1", "v1", "f2", "v2"},
+		{"LPOP", "l", "2"},
+		{"RPOP", "l", "2"},
+		{"LPUSHX", "l", "a", "b"},
+		{"RPUSHX", "l", "a", "b"},
+		{"ZRANK", "z", "m", "WITHSCORE"},
+		{"ZREVRANK", "z", "m", "WITHSCORE"},
+	} {
+		assert.Must(!doRequest(s, d, args...).IsError())
+		assert.Must(keys[len(keys)-1] == args[1])
+	}
+	assert.Must(len(keys) == 7)
+	assert.Must(doRequest(s, d, "HSET", "h", "f").IsError())
+	assert.Must(doRequest(s, d, "LPOP").IsError())
+	assert.Must(doRequest(s, d, "LPUSHX", "l").IsError())
+	assert.Must(doRequest(s, d, "ZRANK", "z").IsError())
+	assert.Must(len(keys) == 7)
+
+	for _, args := range [][]string{{"FLUSHDB", "ASYNC"}, {"AUTH", "user", "passwd"}, {"OBJECT", "HELP"}} {
+		assert.Must(checkArity(args[0], len(args)))
+	}
+}
+
+func TestStringWrites(t *testing.T) {
+	var reqs []*Request
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		reqs = append(reqs, r)
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}
+	s := &Session{CheckArity: true, ReadReplica: true, RetryReads: true}
+
+	// 旧客户端常用的 SETNX/SETEX/PSETEX 等命令都是单key的写命令，不能发送给slave，出错时也不能重试
+	for _, args := range [][]string{
+		{"SETNX", "a", "b"},
+		{"SETEX", "a", "10", "b"},
+		{"PSETEX", "a", "10000", "b"},
+		{"GETSET", "a", "b"},
+		{"INCR", "a"},
+		{"DECR", "a"},
+		{"INCRBY", "a", "2"},
+		{"DECRBY", "a", "2"},
+		{"INCRBYFLOAT", "a", "1.5"},
+		{"HINCRBYFLOAT", "a", "f", "1.5"},
+	} {
+		assert.Must(!doRequest(s, d, args...).IsError())
+		r := reqs[len(reqs)-1]
+		assert.Must(r.OpStr == args[0] && string(getHashKey(r.Resp, r.OpStr)) == "a")
+		assert.Must(!r.replica && r.retry == nil)
+		c := GetCommand(args[0])
+		assert.Must(c.IsWrite() && !c.IsReadOnly() && countKeys(args[0], len(args)) == 1)
+	}
+	assert.Must(len(reqs) == 10)
+	assert.Must(doRequest(s, d, "SETEX", "a", "b").IsError())
+	assert.Must(doRequest(s, d, "SETNX", "a").IsError())
+	assert.Must(len(reqs) == 10)
+}
+
+func TestRandomKey(t *testing.T) {
+	var calls int
+	backend := func(key string) func(r *Request) {
+		return func(r *Request) {
+			calls++
+			if key == "" {
+				r.setResponse(redis.NewBulkBytes(nil), nil)
+			} else {
+				r.setResponse(redis.NewBulkBytes([]byte(key)), nil)
+			}
+		}
+	}
+	s := &Session{}
+
+	// 只发送给一个后端，返回nil时再尝试另一个
+	d := &fakeDispatcher{backends: map[string]func(r *Request){
+		"127.0.0.1:6379": backend(""),
+		"127.0.0.1:6380": backend("k"),
+	}}
+	for i := 0; i < 10; i++ {
+		calls = 0
+		resp := doRequest(s, d, "RANDOMKEY")
+		assert.Must(resp.IsBulkBytes() && string(resp.Value) == "k")
+		assert.Must(calls == 1 || calls == 2)
+	}
+	d.backends["127.0.0.1:6379"] = backend("a")
+	calls = 0
+	for i := 0; i < 10; i++ {
+		assert.Must(doRequest(s, d, "RANDOMKEY").Value != nil)
+	}
+	assert.Must(calls == 10)
+
+	// 全部为空
+	d.backends["127.0.0.1:6379"] = backend("")
+	d.backends["127.0.0.1:6380"] = backend("")
+	calls = 0
+	resp := doRequest(s, d, "RANDOMKEY")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil && calls == 2)
+
+	// 出错时直接返回错误，不再尝试其它后端
+	d.backends = map[string]func(r *Request){
+		"127.0.0.1:6379": replyWith(redis.NewError([]byte("ERR down")), nil),
+	}
+	assert.Must(doRequest(s, d, "RANDOMKEY").IsError())
+	d.backends["127.0.0.1:6379"] = replyWith(nil, errors.New("broken"))
+	resp = doRequest(s, d, "RANDOMKEY")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR RANDOMKEY failed on 127.0.0.1:6379, broken")
+	assert.Must(doRequest(s, d, "RANDOMKEY", "x").IsError())
+	d.backends = nil
+	assert.Must(doRequest(s, d, "RANDOMKEY").IsError())
+
+	// 按照key的数量选择后端
+	SetRandomKeyWeighted(true)
+	defer SetRandomKeyWeighted(false)
+	d.backends = map[string]func(r *Request){
+		"127.0.0.1:6379": backend("a"),
+		"127.0.0.1:6380": backend("b"),
+	}
+	d.keys = map[string]int64{"127.0.0.1:6379": 1, "127.0.0.1:6380": 1000}
+	var n int
+	for i := 0; i < 200; i++ {
+		if string(doRequest(s, d, "RANDOMKEY").Value) == "a" {
+			n++
+		}
+	}
+	assert.Must(n < 20)
+}
+
+func TestMaxArgs(t *testing.T) {
+	var calls int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		calls++
+		r.Response.Resp = redis.NewInt([]byte("1"))
+	}}
+	s := &Session{CheckArity: true, MaxArgs: 4}
+
+	resp := doRequest(s, d, "SADD", "a", "b", "c")
+	assert.Must(resp.IsInt() && calls == 1)
+
+	resp = doRequest(s, d, "SADD", "a", "b", "c", "d")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR too many arguments for 'sadd' command, max = 4")
+	assert.Must(calls == 1)
+}
+
+func TestMaxKeys(t *testing.T) {
+	var calls int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		calls++
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}
+	s := &Session{MaxKeys: 2}
+	rejects := MaxKeysRejectCounts()
+
+	// 多个参数但只有一个key的命令不受影响
+	resp := doRequest(s, d, "SADD", "a", "b", "c", "d")
+	assert.Must(resp.IsString() && calls == 1)
+	resp = doRequest(s, d, "MSET", "a", "1", "b", "2")
+	assert.Must(resp.IsString() && calls == 3)
+
+	// 在拆分之前拒绝，不会发送任何子请求
+	resp = doRequest(s, d, "MGET", "a", "b", "c")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR too many keys for 'mget' command, max = 2")
+	resp = doRequest(s, d, "MSET", "a", "1", "b", "2", "c", "3")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR too many keys for 'mset' command, max = 2")
+	resp = doRequest(s, d, "DEL", "a", "b", "c")
+	assert.Must(resp.IsError())
+	assert.Must(calls == 3 && MaxKeysRejectCounts()-rejects == 3)
+
+	assert.Must(countKeys("MSET", 7) == 3 && countKeys("GET", 2) == 1 && countKeys("PING", 1) == 0)
+	assert.Must(countKeys("UNKNOWN", 3) == 0)
+
+	// 和 commandKeys 取得的key的个数一致
+	for name, c := range commands {
+		for n := 1; n <= 8; n++ {
+			args := []string{name}
+			for i := 1; i < n; i++ {
+				args = append(args, strconv.Itoa(i))
+			}
+			assert.Must(countKeys(name, n) == len(commandKeys(c, newRequestResp(args...))))
+		}
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	var calls int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		calls++
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}
+	s := &Session{}
+
+	// 默认和redis一样允许空的key
+	assert.Must(doRequest(s, d, "SET", "", "v").IsString() && calls == 1)
+
+	SetKeyPolicy(true, 4)
+	defer SetKeyPolicy(false, 0)
+	rejects := KeyRejectCounts()
+	resp := doRequest(s, d, "SET", "", "v")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR empty keys are not allowed by proxy")
+	resp = doRequest(s, d, "MGET", "a", "toolong")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR key is too long for 'mget' command, max = 4")
+	assert.Must(doRequest(s, d, "EVAL", "return 1", "1", "abcde").IsError())
+	assert.Must(calls == 1 && KeyRejectCounts()-rejects == 3)
+
+	// 只检查key，值和没有key的命令不受影响
+	assert.Must(doRequest(s, d, "SET", "abcd", "").IsString())
+	assert.Must(doRequest(s, d, "EVAL", "return 'a long script'", "0").IsString())
+	assert.Must(calls == 3)
+}
+
+func TestQuit(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+
+	// 后端延迟返回，QUIT 之前的请求仍然要返回给客户端
+	var calls int
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		calls++
+		r.Wait.Add(1)
+		go func() {
+			defer r.Wait.Done()
+			time.Sleep(time.Millisecond * 50)
+			r.Response.Resp = redis.NewBulkBytes(r.Resp.Array[1].Value)
+		}()
+	}}
+	go s.Serve(d, 16)
+
+	go c2.Write([]byte("GET a\r\nGET b\r\nQUIT\r\nGET c\r\n"))
+	c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(c2)
+	for _, expect := range []string{"$1\r\n", "a\r\n", "$1\r\n", "b\r\n", "+OK\r\n"} {
+		line, err := r.ReadString('\n')
+		assert.MustNoError(err)
+		assert.Must(line == expect)
+	}
+	// QUIT 之后的命令不会被执行，连接被关闭
+	_, err := r.ReadString('\n')
+	assert.Must(err != nil && calls == 2)
+}
+
+func TestAppStats(t *testing.T) {
+	SetMaxApps(2)
+	defer SetMaxApps(0)
+
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewString([]byte("OK")), nil)}
+	do := func(s *Session, args ...string) {
+		r, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+		_, err = s.handleResponse(r)
+		assert.MustNoError(err)
+	}
+	calls := func() map[string]int64 {
+		var m = make(map[string]int64)
+		for _, a := range GetAllAppStats() {
+			m[a.App()] = a.Calls()
+		}
+		return m
+	}
+
+	s1, s2, s3, s4 := &Session{}, &Session{}, &Session{}, &Session{}
+	do(s1, "SET", "k", "v")
+	assert.Must(len(calls()) == 0)
+
+	do(s1, "CLIENT", "SETNAME", "a")
+	do(s1, "SET", "k", "v")
+	// PROXY APP 优先于 CLIENT SETNAME
+	do(s2, "PROXY", "APP", "b")
+	do(s2, "CLIENT", "SETNAME", "x")
+	do(s2, "SET", "k", "v")
+	do(s2, "GET", "k")
+	// 超过上限之后合并统计
+	do(s3, "PROXY", "APP", "c")
+	do(s4, "PROXY", "APP", "d")
+	do(s3, "SET", "k", "v")
+	do(s4, "SET", "k", "v")
+
+	m := calls()
+	assert.Must(len(m) == 3 && m["x"] == 0)
+	// 设置名称的命令本身也会被统计
+	assert.Must(m["a"] == 2 && m["b"] == 4 && m[AppOther] == 4)
+	for _, a := range GetAllAppStats() {
+		if a.App() == "b" {
+			assert.Must(len(a.GetAllOpStats()) == 4)
+		}
+	}
+}
+
+// 修改应用名之前读取的请求，回复在修改之后返回时仍然按原来的应用统计
+func TestAppStatsPipelined(t *testing.T) {
+	SetMaxApps(2)
+	defer SetMaxApps(0)
+
+	d := &fakeDispatcher{dispatch: replyWith(redis.NewString([]byte("OK")), nil)}
+	s := &Session{}
+	var reqs []*Request
+	for _, args := range [][]string{{"PROXY", "APP", "a"}, {"SET", "k", "v"}, {"PROXY", "APP", "b"}, {"GET", "k"}} {
+		r, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+		reqs = append(reqs, r)
+	}
+	for _, r := range reqs {
+		_, err := s.handleResponse(r)
+		assert.MustNoError(err)
+	}
+	var m = make(map[string]int64)
+	for _, a := range GetAllAppStats() {
+		m[a.App()] = a.Calls()
+	}
+	assert.Must(len(m) == 2 && m["a"] == 2 && m["b"] == 2)
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	var replica = make(map[string]bool)
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		replica[string(r.Resp.Array[1].Value)] = r.replica
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}
+	s := &Session{ReadReplica: true, ReadAfterWrite: time.Millisecond * 100}
+
+	n := ReadAfterWriteCounts()
+	doRequest(s, d, "SET", "a", "1")
+	doRequest(s, d, "GET", "a")
+	doRequest(s, d, "GET", "b")
+	assert.Must(!replica["a"] && replica["b"] && ReadAfterWriteCounts() == n+1)
+
+	// 超过时间之后重新从slave读取
+	time.Sleep(s.ReadAfterWrite)
+	doRequest(s, d, "GET", "a")
+	assert.Must(replica["a"])
+
+	// 记录的key太多时，全部发送给master
+	s = &Session{ReadReplica: true, ReadAfterWrite: time.Hour}
+	for i := 0; i <= MaxRecentWrites; i++ {
+		doRequest(s, d, "SET", strconv.Itoa(i), "1")
+	}
+	doRequest(s, d, "GET", "b")
+	assert.Must(!replica["b"] && len(s.recent.keys) == 0)
+}
+
+func TestCommandKeys(t *testing.T) {
+	keys := func(args ...string) string {
+		var s []string
+		for _, key := range commandKeys(commands[args[0]], newRequestResp(args...)) {
+			s = append(s, string(key))
+		}
+		return strings.Join(s, " ")
+	}
+	assert.Must(keys("SET", "a", "1") == "a")
+	assert.Must(keys("MSET", "a", "1", "b", "2") == "a b")
+	assert.Must(keys("DEL", "a", "b", "c") == "a b c")
+	assert.Must(keys("BLPOP", "a", "b", "0") == "a b")
+	assert.Must(keys("PING") == "")
+}
+
+func TestRequestKeys(t *testing.T) {
+	keys := func(args ...string) string {
+		var s []string
+		for _, k := range requestKeys(strings.ToUpper(args[0]), newRequestResp(args...)) {
+			s = append(s, string(k))
+		}
+		return strings.Join(s, ",")
+	}
+	assert.Must(keys("GET", "a") == "a")
+	assert.Must(keys("MSET", "a", "1", "b", "2") == "a,b")
+	assert.Must(keys("ZUNIONSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2") == "d,a,b")
+	assert.Must(keys("EVALSHA", "sha", "x", "a", "b") == "a,b")
+	assert.Must(keys("KEYS", "*") == "")
+	assert.Must(keys("MYCMD", "a", "b") == "a")
+
+	// 由 numkeys 指定key的个数的新命令
+	assert.Must(keys("SINTERCARD", "2", "a", "b", "LIMIT", "5") == "a,b")
+	assert.Must(keys("SINTERCARD", "1", "a") == "a")
+	assert.Must(keys("ZINTERCARD", "2", "a", "b") == "a,b")
+	assert.Must(keys("LMPOP", "2", "a", "b", "LEFT", "COUNT", "3") == "a,b")
+	assert.Must(keys("ZMPOP", "1", "a", "MIN") == "a")
+	assert.Must(keys("BLMPOP", "5", "2", "a", "b", "RIGHT") == "a,b")
+	assert.Must(keys("BZMPOP", "0.5", "1", "a", "MAX") == "a")
+	assert.Must(keys("ZUNION", "2", "a", "b", "WITHSCORES") == "a,b")
+	assert.Must(keys("ZDIFFSTORE", "d", "2", "a", "b") == "d,a,b")
+	assert.Must(keys("LMOVE", "a", "b", "LEFT", "RIGHT") == "a,b")
+	assert.Must(keys("ZRANGESTORE", "d", "a", "0", "-1") == "d,a")
+	assert.Must(keys("SMISMEMBER", "a", "m1", "m2") == "a")
+	// numkeys 不合法时把后面的参数都当作key
+	assert.Must(keys("SINTERCARD", "3", "a", "b") == "a,b")
+	assert.Must(keys("LMPOP", "x", "a", "LEFT") == "a,LEFT")
+	assert.Must(keys("ZMPOP") == "")
+}
+
+func TestNumKeysRouting(t *testing.T) {
+	hkey := func(args ...string) string {
+		return string(getHashKey(newRequestResp(args...), args[0]))
+	}
+	// 按第一个key转发，而不是 numkeys
+	assert.Must(hkey("SINTERCARD", "2", "a", "b") == "a")
+	assert.Must(hkey("LMPOP", "1", "a", "LEFT") == "a")
+	assert.Must(hkey("ZMPOP", "1", "a", "MIN") == "a")
+	assert.Must(hkey("ZDIFFSTORE", "d", "2", "a", "b") == "a")
+	assert.Must(hkey("ZUNIONSTORE", "d", "2", "a", "b") == "a")
+	assert.Must(hkey("EVAL", "script", "1", "a") == "a")
+	assert.Must(hkey("SMISMEMBER", "a", "m") == "a")
+	assert.Must(hkey("LMPOP", "1") == "")
+}
+
+func TestCrossSlot(t *testing.T) {
+	var forwarded []string
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		forwarded = append(forwarded, r.OpStr)
+		r.Response.Resp = redis.NewInt([]byte("1"))
+	}}
+	s := &Session{}
+	crossslot := func(args ...string) bool {
+		resp := doRequest(s, d, args...)
+		if resp.IsError() {
+			assert.Must(string(resp.Value) == "CROSSSLOT Keys in request don't hash to the same slot")
+			return true
+		}
+		return false
+	}
+	assert.Must(hashSlot([]byte("a")) != hashSlot([]byte("b")))
+	assert.Must(crossslot("SINTERCARD", "2", "a", "b"))
+	assert.Must(crossslot("LMPOP", "2", "a", "b", "LEFT"))
+	assert.Must(crossslot("ZMPOP", "2", "a", "b", "MIN"))
+	assert.Must(crossslot("ZDIFFSTORE", "d", "1", "a"))
+	assert.Must(crossslot("LMOVE", "a", "b", "LEFT", "LEFT"))
+	assert.Must(len(forwarded) == 0)
+
+	// 通过 hash tag 放在同一个slot
+	assert.Must(!crossslot("SINTERCARD", "2", "{u}a", "{u}b", "LIMIT", "1"))
+	assert.Must(!crossslot("LMPOP", "2", "{u}a", "{u}b", "LEFT"))
+	assert.Must(!crossslot("ZMPOP", "1", "a", "MIN"))
+	assert.Must(!crossslot("LMOVE", "{u}a", "{u}b", "LEFT", "LEFT"))
+	assert.Must(!crossslot("SMISMEMBER", "a", "b", "c"))
+	// numkeys 不合法时转发，由后端返回错误
+	assert.Must(!crossslot("SINTERCARD", "3", "a", "b"))
+	// 原有的多key命令不检查
+	assert.Must(!crossslot("SINTER", "a", "b"))
+	assert.Must(len(forwarded) == 7)
+}
+
+// 测试结束之后恢复修改之前的黑名单
+func saveBlacklist() func() {
+	saved := make(map[string]bool, len(blacklist))
+	for opstr, v := range blacklist {
+		saved[opstr] = v
+	}
+	return func() {
+		blacklist = saved
+	}
+}
+
+func TestShutdownNotForwarded(t *testing.T) {
+	// 即使在 allow_commands 中也不会转发
+	defer saveBlacklist()()
+	AllowCommands("SHUTDOWN")
+	var forwarded int
+	d := &fakeDispatcher{
+		dispatch: func(r *Request) {
+			forwarded++
+			r.Response.Resp = redis.NewString([]byte("OK"))
+		},
+		backends: map[string]func(r *Request){
+			"127.0.0.1:6379": func(r *Request) { forwarded++ },
+		},
+	}
+	for _, args := range [][]string{{"SHUTDOWN"}, {"SHUTDOWN", "NOSAVE"}, {"shutdown", "save"}} {
+		resp := doRequest(&Session{}, d, args...)
+		assert.Must(resp.IsError() && string(resp.Value) == "ERR SHUTDOWN disabled by proxy")
+	}
+
+	var done = make(chan struct{}, 1)
+	SetShutdown(func() { done <- struct{}{} })
+	defer SetShutdown(nil)
+	// 没有设置密码时不允许关闭proxy
+	resp := doRequest(&Session{}, d, "SHUTDOWN")
+	assert.Must(resp.IsError())
+
+	s := &Session{auth: "secret"}
+	resp = doRequest(s, d, "SHUTDOWN")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOAUTH"))
+	doRequest(s, d, "AUTH", "secret")
+	resp = doRequest(s, d, "SHUTDOWN")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK" && s.quit)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("shutdown is not called")
+	}
+	assert.Must(forwarded == 0)
+}
+
+// 统计写入次数的连接，每次写入对应一次刷新
+type writeCountConn struct {
+	net.Conn
+	writes atomic2.Int64
+}
+
+func (c *writeCountConn) Write(b []byte) (int, error) {
+	c.writes.Incr()
+	return c.Conn.Write(b)
+}
+
+func doneRequest(value string) *Request {
+	r := &Request{OpStr: "GET", Start: microseconds(), Wait: &sync.WaitGroup{}}
+	r.Response.Resp = redis.NewBulkBytes([]byte(value))
+	return r
+}
+
+func TestReplyFlushCoalesce(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	w := &writeCountConn{Conn: c1}
+	s := NewSessionSize(w, "", 1024, 1800)
+	s.FlushDelay = time.Millisecond * 50
+	s.FlushSize = 32
+
+	replies := make(chan string, 16)
+	go func() {
+		dec := redis.NewDecoder(bufio.NewReader(c2))
+		for {
+			resp, err := dec.Decode()
+			if err != nil {
+				close(replies)
+				return
+			}
+			replies <- string(resp.Value)
+		}
+	}()
+
+	tasks := make(chan *Request, 16)
+	for _, v := range []string{"a", "b", "c"} {
+		tasks <- doneRequest(v)
+	}
+	go s.loopWriter(tasks)
+
+	// 第一个回复立即发送，后面两个合并之后不超过 FlushDelay 发送
+	start := time.Now()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.Must(<-replies == v)
+	}
+	assert.Must(time.Since(start) < time.Second && w.writes.Get() == 2)
+
+	// 距离上一次发送超过 FlushDelay 之后，新的回复立即发送
+	time.Sleep(s.FlushDelay * 2)
+	start = time.Now()
+	tasks <- doneRequest("d")
+	assert.Must(<-replies == "d")
+	assert.Must(time.Since(start) < s.FlushDelay && w.writes.Get() == 3)
+
+	// 关闭之前发送缓存的回复
+	tasks <- doneRequest("e")
+	tasks <- doneRequest("f")
+	close(tasks)
+	assert.Must(<-replies == "e" && <-replies == "f")
+}
+
+// 客户端 pipeline 很深、后端的回复陆续返回时，合并发送减少系统调用
+func benchmarkReplyFlush(b *testing.B, delay time.Duration) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 64*1024)
+		for {
+			if _, err := c.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.MustNoError(err)
+	s := NewSessionSize(c, "", 1024*32, 1800)
+	defer s.Close()
+	s.FlushDelay = delay
+	s.FlushSize = 32
+
+	// 回复一个一个地完成，写协程每次都看不到后续的回复
+	tasks := make(chan *Request)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.loopWriter(tasks)
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tasks <- doneRequest("value")
+	}
+	close(tasks)
+	assert.MustNoError(<-done)
+}
+
+func BenchmarkReplyFlushImmediate(b *testing.B) {
+	benchmarkReplyFlush(b, 0)
+}
+
+func BenchmarkReplyFlushCoalesce(b *testing.B) {
+	benchmarkReplyFlush(b, time.Microsecond*200)
+}
+
+// 回复的游标就是请求中的游标，用于检查游标在请求和回复中都没有被修改
+func echoCursor(req *redis.Resp) []byte {
+	return mustEncode(redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes(req.Array[2].Value),
+		redis.NewArray([]*redis.Resp{redis.NewBulkBytes(req.Array[1].Value)}),
+	}))
+}
+
+func TestScanCursors(t *testing.T) {
+	// 带key的 SCAN 命令按key转发，可以发送给slave和重试，不带key的 SCAN 默认被禁用
+	for _, opstr := range []string{"HSCAN", "SSCAN", "ZSCAN"} {
+		assert.Must(isReadOnly(opstr) && isRetryable(opstr) && !isNotAllowed(opstr))
+		assert.Must(countKeys(opstr, 5) == 1 && string(getHashKey(newRequestResp(opstr, "k", "0"), opstr)) == "k")
+	}
+	assert.Must(isNotAllowed("SCAN"))
+
+	l, addr := fakeServer(echoCursor)
+	defer l.Close()
+	router := New()
+	defer router.Close()
+	assert.MustNoError(router.FillSlot(hashSlot([]byte("key")), addr, "", false))
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go NewSessionSize(c1, "", 1024, 1800).Serve(router, 16)
+	r := bufio.NewReader(c2)
+	for _, opstr := range []string{"HSCAN", "SSCAN", "ZSCAN"} {
+		for _, cursor := range []string{"0", "007", "18446744073709551615", "-1"} {
+			_, err := fmt.Fprintf(c2, "*3\r\n$5\r\n%s\r\n$3\r\nkey\r\n$%d\r\n%s\r\n", opstr, len(cursor), cursor)
+			assert.MustNoError(err)
+			expect := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*1\r\n$3\r\nkey\r\n", len(cursor), cursor)
+			b := make([]byte, len(expect))
+			_, err = io.ReadFull(r, b)
+			assert.MustNoError(err)
+			assert.Must(string(b) == expect)
+		}
+	}
+	// 不带key的 SCAN 不会转发，和其他被禁用的命令一样关闭连接
+	_, err := c2.Write([]byte("SCAN 0\r\n"))
+	assert.MustNoError(err)
+	_, err = r.ReadByte()
+	assert.Must(err == io.EOF)
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	var forwarded []string
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		forwarded = append(forwarded, r.OpStr)
+		r.setResponse(redis.NewArray(nil), nil)
+	}}
+	s := &Session{}
+	getkeys := func(args ...string) string {
+		resp := doRequest(s, d, append([]string{"COMMAND", "GETKEYS"}, args...)...)
+		if resp.IsError() {
+			return string(resp.Value)
+		}
+		var keys []string
+		for _, x := range resp.Array {
+			keys = append(keys, string(x.Value))
+		}
+		return strings.Join(keys, " ")
+	}
+	// 固定位置的key
+	assert.Must(getkeys("GET", "a") == "a")
+	assert.Must(getkeys("set", "a", "1", "EX", "10") == "a")
+	assert.Must(getkeys("RENAME", "a", "b") == "a b")
+	// 可变个数的key
+	assert.Must(getkeys("MSET", "a", "1", "b", "2") == "a b")
+	assert.Must(getkeys("MGET", "a", "b", "c") == "a b c")
+	assert.Must(getkeys("BLPOP", "a", "b", "0") == "a b")
+	assert.Must(getkeys("EVAL", "return 1", "2", "a", "b", "arg") == "a b")
+	assert.Must(getkeys("ZUNIONSTORE", "d", "2", "a", "b") == "d a b")
+	// 可选或者重复参数的命令，和 session_check_arity 无关，按照命令表检查参数个数
+	assert.Must(getkeys("HSET", "h", "f", "v", "f2", "v2") == "h")
+	assert.Must(getkeys("LPOP", "l", "2") == "l")
+	assert.Must(getkeys("RPUSHX", "l", "a", "b") == "l")
+	assert.Must(getkeys("ZRANK", "z", "m", "WITHSCORE") == "z")
+	assert.Must(getkeys("HSET", "h", "f") == "ERR Invalid number of arguments specified for command")
+	// 没有key的命令和出错的情况
+	assert.Must(getkeys("PING") == "ERR The command has no key arguments")
+	assert.Must(getkeys("DBSIZE") == "ERR The command has no key arguments")
+	assert.Must(getkeys("NOSUCHCMD", "a") == "ERR Invalid command specified")
+	assert.Must(getkeys("GET") == "ERR Invalid number of arguments specified for command")
+	assert.Must(getkeys() == "ERR wrong number of arguments for 'command|getkeys' command")
+
+	// 不会转发给后端，其他子命令仍然转发
+	assert.Must(len(forwarded) == 0)
+	doRequest(s, d, "COMMAND", "COUNT")
+	assert.Must(len(forwarded) == 1 && forwarded[0] == "COMMAND")
+}
+
+func TestDumpRestore(t *testing.T) {
+	// 默认不支持 RESTORE，需要加入 allow_commands
+	_, err := (&Session{}).handleRequest(newRequestResp("RESTORE", "k", "0", "v"), &fakeDispatcher{})
+	assert.Must(err != nil)
+	AllowCommands("RESTORE")
+	defer func() { blacklist["RESTORE"] = true }()
+
+	assert.Must(GetCommand("DUMP").IsReadOnly() && !GetCommand("RESTORE").IsReadOnly())
+	assert.Must(!isRetryable("RESTORE"))
+
+	// 序列化的值包含任意字节
+	payload := "\x00\x03foo\r\n$3\r\nbar\x09\x00\xff\xfe"
+	var forwarded []*Request
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		forwarded = append(forwarded, r)
+		r.Response.Resp = redis.NewBulkBytes([]byte(payload))
+	}}
+	resp := doRequest(&Session{}, d, "DUMP", "{tag}k")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == payload)
+	for _, args := range [][]string{
+		{"RESTORE", "{tag}k", "0", payload},
+		{"RESTORE", "{tag}k", "1700000000000", payload, "REPLACE", "ABSTTL"},
+		{"restore", "{tag}k", "0", payload, "IDLETIME", "100"},
+		{"RESTORE", "{tag}k", "0", payload, "REPLACE", "FREQ", "5"},
+	} {
+		doRequest(&Session{}, d, args...)
+	}
+	assert.Must(len(forwarded) == 5)
+	for i, r := range forwarded {
+		assert.Must(hashSlot(getHashKey(r.Resp, r.OpStr)) == hashSlot([]byte("tag")))
+		if i != 0 {
+			assert.Must(r.OpStr == "RESTORE" && string(r.Resp.Array[3].Value) == payload)
+		}
+	}
+
+	// 参数个数不对时不转发
+	s := &Session{CheckArity: true}
+	resp = doRequest(s, d, "RESTORE", "{tag}k", "0")
+	assert.Must(resp.IsError() && len(forwarded) == 5)
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	AllowCommands("RESTORE")
+	defer func() { blacklist["RESTORE"] = true }()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSessionSize(c1, "", 1024, 1800)
+	s.MaxRequestSize = 4096
+	n := OversizedRequestCounts()
+	var payloads = make(chan string, 1)
+	go s.Serve(&fakeDispatcher{dispatch: func(r *Request) {
+		payloads <- string(r.Resp.Array[3].Value)
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	}}, 16)
+
+	r := bufio.NewReader(c2)
+	c2.SetDeadline(time.Now().Add(time.Second * 5))
+	restore := func(payload string) error {
+		_, err := fmt.Fprintf(c2, "*4\r\n$7\r\nRESTORE\r\n$1\r\nk\r\n$1\r\n0\r\n$%d\r\n%s\r\n", len(payload), payload)
+		return err
+	}
+	small := strings.Repeat("\x00\r\n\xff", 256)
+	assert.MustNoError(restore(small))
+	line, err := r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "+OK\r\n" && <-payloads == small)
+	assert.Must(OversizedRequestCounts() == n)
+
+	// 超过上限之后回复错误并关闭连接，剩下的内容不再读取，写入会失败
+	go restore(strings.Repeat("x", 8192))
+	line, err = r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == "-ERR Protocol error: command is too large\r\n")
+	_, err = r.ReadByte()
+	assert.Must(err != nil && OversizedRequestCounts() == n+1)
+	assert.Must(len(payloads) == 0)
+}
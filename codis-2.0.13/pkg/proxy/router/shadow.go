@@ -0,0 +1,155 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 把写命令复制一份异步地发送给另一个集群的proxy，用于迁移之前的验证
+// 复制是尽力而为的，每条命令最多发送一次：队列满了直接丢弃，出错也不会重试，影子集群的回复只用来比较，不会返回给客户端
+var shadow struct {
+	addr  string
+	queue chan *shadowRequest // 为nil表示不开启
+	done  chan struct{}
+
+	success    atomic2.Int64 // 和主集群回复相同的命令数
+	errors     atomic2.Int64 // 影子集群出错或者返回错误的命令数
+	mismatches atomic2.Int64 // 和主集群回复不同的命令数
+	dropped    atomic2.Int64 // 队列已满没有复制的命令数
+}
+
+type shadowRequest struct {
+	r       *Request
+	primary *redis.Resp // 主集群的回复
+}
+
+// 开启后，主集群执行成功的写命令同时发送给 addr，等待复制的命令超过 queue 条时丢弃，addr 为空表示关闭
+// 需要在开始处理请求之前设置
+func SetShadow(addr, auth string, queue int) {
+	if shadow.queue != nil {
+		close(shadow.queue)
+		<-shadow.done
+		shadow.queue = nil
+	}
+	shadow.addr = addr
+	shadow.success.Set(0)
+	shadow.errors.Set(0)
+	shadow.mismatches.Set(0)
+	shadow.dropped.Set(0)
+	if addr == "" {
+		return
+	}
+	shadow.queue = make(chan *shadowRequest, queue)
+	shadow.done = make(chan struct{})
+	go runShadow(NewBackendConn(addr, auth), shadow.queue, shadow.done)
+}
+
+// 按顺序发送给影子集群，另一个协程按相同的顺序等待回复并比较
+func runShadow(bc *BackendConn, queue <-chan *shadowRequest, done chan<- struct{}) {
+	defer close(done)
+	pending := make(chan *shadowRequest, cap(queue))
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for x := range pending {
+			x.r.Wait.Wait()
+			checkShadow(x)
+		}
+	}()
+	for x := range queue {
+		bc.PushBack(x.r)
+		pending <- x
+	}
+	close(pending)
+	<-checked
+	bc.Close()
+}
+
+// 复制主集群执行成功的写命令，主集群返回错误的命令没有修改数据，不需要复制，不会阻塞会话
+func mirrorWrite(r *Request, resp *redis.Resp) {
+	if c := commands[r.OpStr]; c == nil || !c.IsWrite() || resp.IsError() {
+		return
+	}
+	x := &shadowRequest{
+		r: &Request{
+			OpStr: r.OpStr,
+			Start: microseconds(),
+			Resp:  r.Resp,
+			Wait:  &sync.WaitGroup{},
+		},
+		primary: resp,
+	}
+	select {
+	case shadow.queue <- x:
+	default:
+		shadow.dropped.Incr()
+	}
+}
+
+func checkShadow(x *shadowRequest) {
+	resp, err := x.r.Response.Resp, x.r.Response.Err
+	switch {
+	case err != nil:
+		shadow.errors.Incr()
+		log.Warnf("shadow %s to %s failed, error = %s", x.r.OpStr, shadow.addr, err)
+	case resp == nil || resp.IsError():
+		shadow.errors.Incr()
+		log.Warnf("shadow %s to %s failed, reply = %s", x.r.OpStr, shadow.addr, shadowString(resp))
+	case !sameResp(resp, x.primary):
+		shadow.mismatches.Incr()
+		log.Warnf("shadow %s to %s mismatch, primary = %s, shadow = %s",
+			x.r.OpStr, shadow.addr, shadowString(x.primary), shadowString(resp))
+	default:
+		shadow.success.Incr()
+	}
+}
+
+func sameResp(a, b *redis.Resp) bool {
+	if a.Type != b.Type || !bytes.Equal(a.Value, b.Value) || len(a.Array) != len(b.Array) {
+		return false
+	}
+	for i := range a.Array {
+		if !sameResp(a.Array[i], b.Array[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func shadowString(resp *redis.Resp) string {
+	if resp == nil {
+		return "nil"
+	}
+	b, _ := redis.EncodeToBytes(resp)
+	return strconv.Quote(log.Truncate(b))
+}
+
+type ShadowStatus struct {
+	Addr       string `json:"addr"`
+	Success    int64  `json:"success"`
+	Errors     int64  `json:"errors"`
+	Mismatches int64  `json:"mismatches"`
+	Dropped    int64  `json:"dropped"`
+}
+
+// 没有开启时返回nil
+func ShadowStats() *ShadowStatus {
+	if shadow.queue == nil {
+		return nil
+	}
+	return &ShadowStatus{
+		Addr:       shadow.addr,
+		Success:    shadow.success.Get(),
+		Errors:     shadow.errors.Get(),
+		Mismatches: shadow.mismatches.Get(),
+		Dropped:    shadow.dropped.Get(),
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestShadow(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"SET":  redis.NewString([]byte("OK")),
+		"INCR": redis.NewInt([]byte("5")),
+	}))
+	defer l.Close()
+	SetShadow(addr, "", 16)
+	defer SetShadow("", "", 0)
+
+	primary := map[string]*redis.Resp{
+		"SET":  redis.NewString([]byte("OK")),
+		"INCR": redis.NewInt([]byte("1")),
+		"DEL":  redis.NewInt([]byte("1")),
+		"GET":  redis.NewBulkBytes([]byte("v")),
+		"HSET": redis.NewError([]byte("WRONGTYPE Operation against a key holding the wrong kind of value")),
+	}
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		r.setResponse(primary[r.OpStr], nil)
+	}}
+	s := &Session{}
+	do := func(args ...string) *redis.Resp {
+		r, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+		resp, err := s.handleResponse(r)
+		assert.MustNoError(err)
+		return resp
+	}
+	// 影子集群的回复不会影响返回给客户端的结果
+	assert.Must(string(do("INCR", "a").Value) == "1")
+	do("SET", "a", "b")
+	do("DEL", "a")
+	// 只读命令和主集群返回错误的写命令不会复制
+	do("GET", "a")
+	do("HSET", "a", "f", "v")
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		x := ShadowStats()
+		if x.Success+x.Errors+x.Mismatches == 3 {
+			assert.Must(x.Addr == addr && x.Success == 1 && x.Mismatches == 1 && x.Errors == 1 && x.Dropped == 0)
+			break
+		}
+		assert.Must(time.Now().Before(deadline))
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestShadowDropped(t *testing.T) {
+	SetShadow(downAddr(), "", 1)
+	defer SetShadow("", "", 0)
+
+	r := &Request{OpStr: "SET", Resp: newRequestResp("SET", "a", "b")}
+	ok := redis.NewString([]byte("OK"))
+	// 队列满了直接丢弃，不会阻塞
+	for i := 0; i < 100; i++ {
+		mirrorWrite(r, ok)
+	}
+	assert.Must(ShadowStats().Dropped > 0)
+
+	SetShadow("", "", 0)
+	assert.Must(ShadowStats() == nil)
+}
@@ -5,9 +5,12 @@ package router
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
@@ -25,10 +28,34 @@ type Slot struct {
 	}
 	// slot迁移时，原redis-server的连接
 	migrate struct {
-		from string
-		bc   *SharedBackendConn
+		from  string
+		bc    *SharedBackendConn
+		since time.Time     // 开始迁移的时间
+		keys  atomic2.Int64 // 由此proxy在访问时迁移的key数量
+	}
+
+	// slot所在group的slave的连接，只用于只读命令
+	replicas struct {
+		addrs []string
+		bcs   []*SharedBackendConn
+		next  atomic2.Int64
+	}
+	// 只读命令的访问频率，超过 hotSlotReads 时分散到slave
+	hot struct {
+		reads  atomic2.Int64 // 上一次检查之后的只读命令数
+		rate   atomic2.Int64 // 上一次检查时每秒的只读命令数
+		spread atomic2.Bool  // 只读命令是否分散到slave
 	}
 
+	// slot没有分配group，由 default_group 代为服务
+	fallback atomic2.Bool
+	// 所在group的编号，0表示未知
+	group atomic2.Int64
+	// 处于预迁移状态，转发的命令会阻塞在 lock 上
+	premigrate atomic2.Bool
+	// 路由和其它group冲突，转发的命令直接返回错误
+	conflict atomic2.Bool
+
 	wait sync.WaitGroup
 	lock struct {
 		hold bool
@@ -49,6 +76,7 @@ func (s *Slot) unblock() {
 		return
 	}
 	s.lock.hold = false
+	s.premigrate.Set(false)
 	s.lock.Unlock()
 }
 
@@ -59,10 +87,32 @@ func (s *Slot) reset() {
 	s.backend.bc = nil
 	s.migrate.from = ""
 	s.migrate.bc = nil
+	s.migrate.since = time.Time{}
+	s.migrate.keys.Set(0)
+	s.fallback.Set(false)
 }
 
 // 对redis-client的请求进行转发
 func (s *Slot) forward(r *Request, key []byte) error {
+	if s.conflict.Get() {
+		r.setResponse(s.rejectConflict(), nil)
+		return nil
+	}
+	// 所在的group被暂停时排队等待恢复
+	if resp := s.waitGroupPause(); resp != nil {
+		r.setResponse(resp, nil)
+		return nil
+	}
+	// 按照 pre_migrate_policy 阻塞等待或者返回 TRYAGAIN 错误，需要在检查 group 之前，否则会阻塞在 lock 上
+	if s.rejectPreMigrate() {
+		r.setResponse(s.tryAgain(), nil)
+		return nil
+	}
+	// group的全部后端都不可用时，按照 group_down_policy 直接返回错误或者等待恢复
+	if s.groupDown() && !s.waitGroupUp() {
+		r.setResponse(s.rejectGroupDown(), nil)
+		return nil
+	}
 	s.lock.RLock()
 	// 执行redis命令前的准备工作，检查和后端redis连接是否存在，检查slot是否处于迁移状态中，如果是，强制迁移指定key到新的redis-server
 	bc, err := s.prepare(r, key)
@@ -70,8 +120,25 @@ func (s *Slot) forward(r *Request, key []byte) error {
 	if err != nil {
 		return err
 	} else {
-		// 转发redis命令
-		bc.PushBack(r)
+		// 转发redis命令，不复用后端连接时发送到会话自己的连接上
+		// 手动下线的master直接返回错误，不发送给后端
+		r.backend = bc.Addr()
+		if bc.disabled.Get() {
+			r.setResponse(bc.rejectDisabled(), nil)
+			r.slot.Done()
+			return nil
+		}
+		if s.fallback.Get() {
+			incrFallbacks()
+		}
+		bc.addKey(key)
+		if r.span != nil {
+			r.span.Slot, r.span.Backend = s.id, bc.Addr()
+		}
+		if r.conns != nil {
+			return r.conns.pushBack(bc, r)
+		}
+		bc.conn(r).PushBack(r)
 		return nil
 	}
 }
@@ -81,17 +148,39 @@ var ErrSlotIsNotReady = errors.New("slot is not ready, may be offline")
 // 执行redis命令前的准备工作，检查和后端redis连接是否存在，检查slot是否处于迁移状态中，如果是，强制迁移指定key到新的redis-server
 func (s *Slot) prepare(r *Request, key []byte) (*SharedBackendConn, error) {
 	if s.backend.bc == nil {
-		log.Infof("slot-%04d is not ready: key = %s", s.id, key)
+		log.Infof("slot-%04d is not ready: session = %d, key = %s", s.id, r.session, log.Truncate(key))
 		return nil, ErrSlotIsNotReady
 	}
 	if err := s.slotsmgrt(r, key); err != nil {
-		log.Warnf("slot-%04d migrate from = %s to %s failed: key = %s, error = %s",
-			s.id, s.migrate.from, s.backend.addr, key, err)
+		log.Warnf("slot-%04d migrate from = %s to %s failed: session = %d, key = %s, error = %s",
+			s.id, s.migrate.from, s.backend.addr, r.session, log.Truncate(key), err)
 		return nil, err
 	} else {
 		// 操作可能涉及多个slot，需要等待所有slot完成操作
 		r.slot = &s.wait
 		r.slot.Add(1)
+		if r.spread {
+			s.hot.reads.Incr()
+		}
+		// 迁移中的slot在slave上可能读不到还没有迁移的key，只从master读取
+		if (r.replica || (r.spread && s.hot.spread.Get())) && s.migrate.bc == nil {
+			// 跳过手动下线的slave，以及复制延迟超过命令允许的值的slave，全部跳过时从master读取
+			bcs, next := s.replicas.bcs, uint64(s.replicas.next.Incr())
+			var stale bool
+			for i := range bcs {
+				switch bc := bcs[int((next+uint64(i))%uint64(len(bcs)))]; {
+				case bc.disabled.Get():
+				case r.lagLimited && !bc.isFresh(r.maxLag):
+					stale = true
+				default:
+					incrReplicaReads()
+					return bc, nil
+				}
+			}
+			if stale {
+				incrReplicaLagRedirects()
+			}
+		}
 		return s.backend.bc, nil
 	}
 }
@@ -131,7 +220,11 @@ func (s *Slot) slotsmgrt(r *Request, key []byte) error {
 	}
 	if resp.IsInt() {
 		log.Debugf("slot-%04d migrate from %s to %s: key = %s, resp = %s",
-			s.id, s.migrate.from, s.backend.addr, key, resp.Value)
+			s.id, s.migrate.from, s.backend.addr, log.Truncate(key), resp.Value)
+		// 返回的是迁移的key的数量，包括相同tag的key
+		if n, err := strconv.ParseInt(string(resp.Value), 10, 64); err == nil {
+			s.migrate.keys.Add(n)
+		}
 		return nil
 	} else {
 		return errors.New(fmt.Sprintf("error resp: should be integer, but got %s", resp.Type))
@@ -2,3 +2,125 @@
 // Licensed under the MIT (MIT-LICENSE.txt) license.
 
 package router
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestDisableBackend(t *testing.T) {
+	l1, master := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("master")),
+		"SET": redis.NewString([]byte("OK")),
+	}))
+	defer l1.Close()
+	l2, slave := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("slave")),
+	}))
+	defer l2.Close()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, master, "", false))
+	assert.MustNoError(s.SetSlotReplicas(id, []string{slave}))
+
+	session := &Session{ReadReplica: true}
+	do := func(args ...string) string {
+		return string(doRequest(session, s, args...).Value)
+	}
+	assert.Must(do("GET", "a") == "slave")
+
+	assert.Must(s.DisableBackend("127.0.0.1:1", false) == ErrUnknownBackend)
+	assert.MustNoError(s.DisableBackend(slave, false))
+	assert.Must(do("GET", "a") == "master")
+
+	// 下线的master直接返回错误，读命令仍然可以发送给slave
+	n := DisabledRejectCounts()
+	assert.MustNoError(s.EnableBackend(slave))
+	assert.MustNoError(s.DisableBackend(master, true))
+	assert.Must(do("SET", "a", "b") == "ERR backend "+master+" is disabled by proxy admin")
+	assert.Must(do("GET", "a") == "slave")
+	assert.Must(DisabledRejectCounts() == n+1)
+	for _, x := range s.BackendStatus() {
+		assert.Must(x.Disabled == (x.Addr == master) && x.Persist == (x.Addr == master))
+	}
+
+	// 重新加载路由之后只保留 persist 的
+	assert.MustNoError(s.DisableBackend(slave, false))
+	assert.Must(s.ResetDisabledBackends() == 1)
+	assert.Must(do("GET", "a") == "slave")
+	assert.Must(do("SET", "a", "b") != "OK")
+	assert.MustNoError(s.EnableBackend(master))
+	assert.Must(do("SET", "a", "b") == "OK")
+}
+
+func TestFallbackSlot(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, addr, "", false))
+	s.SetSlotFallback(id, true)
+	assert.Must(s.IsFallbackSlot(id))
+	assert.Must(len(s.FallbackSlots()) == 1 && s.FallbackSlots()[0] == id)
+
+	session := &Session{}
+	n := FallbackCounts()
+	assert.Must(string(doRequest(session, s, "GET", "a").Value) == "v")
+	assert.Must(FallbackCounts() == n+1)
+
+	// 重新填充之后不再计数
+	assert.MustNoError(s.FillSlot(id, addr, "", false))
+	assert.Must(!s.IsFallbackSlot(id))
+	assert.Must(string(doRequest(session, s, "GET", "a").Value) == "v")
+	assert.Must(FallbackCounts() == n+1)
+}
+
+func TestPreMigrate(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	session := &Session{}
+	do := func() string {
+		return string(doRequest(session, s, "GET", "a").Value)
+	}
+
+	// 重试之后仍然处于预迁移状态，返回 TRYAGAIN
+	SetPreMigratePolicy(PreMigrateTryAgain, 2, time.Millisecond*10)
+	defer SetPreMigratePolicy(PreMigrateWait, 0, 0)
+	assert.MustNoError(s.FillSlot(id, addr, "", true))
+	n, m := PreMigrateHitCounts(), PreMigrateRejectCounts()
+	assert.Must(strings.HasPrefix(do(), "TRYAGAIN "))
+	assert.Must(PreMigrateHitCounts() == n+1 && PreMigrateRejectCounts() == m+1)
+
+	// 重试期间开始迁移
+	SetPreMigratePolicy(PreMigrateTryAgain, 100, time.Millisecond*10)
+	time.AfterFunc(time.Millisecond*50, func() {
+		assert.MustNoError(s.FillSlot(id, addr, "", false))
+	})
+	assert.Must(do() == "v")
+	assert.Must(PreMigrateHitCounts() == n+2 && PreMigrateRejectCounts() == m+1)
+
+	// 默认一直等待
+	SetPreMigratePolicy(PreMigrateWait, 0, 0)
+	assert.MustNoError(s.FillSlot(id, addr, "", true))
+	time.AfterFunc(time.Millisecond*50, func() {
+		assert.MustNoError(s.FillSlot(id, addr, "", false))
+	})
+	assert.Must(do() == "v")
+	assert.Must(PreMigrateHitCounts() == n+3 && PreMigrateRejectCounts() == m+1)
+}
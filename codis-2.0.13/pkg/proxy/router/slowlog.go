@@ -0,0 +1,39 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 执行时间超过阈值的命令记录到日志中，单位 us，0表示不记录，运行时可以通过 http 接口修改
+var slowlogThreshold atomic2.Int64
+
+// 设置新的阈值，返回原来的阈值
+func SetSlowlogThreshold(d time.Duration) time.Duration {
+	old := slowlogThreshold.Get()
+	slowlogThreshold.Set(int64(d / time.Microsecond))
+	return time.Duration(old) * time.Microsecond
+}
+
+func SlowlogThreshold() time.Duration {
+	return time.Duration(slowlogThreshold.Get()) * time.Microsecond
+}
+
+// 和 /failures 一样只记录命令名和第一个key
+func (s *Session) checkSlowlog(r *Request, usecs int64) {
+	if t := slowlogThreshold.Get(); t == 0 || usecs < t {
+		return
+	}
+	incrSlowCommands()
+	var key string
+	if k := failureKey(r.OpStr, r.Resp); k != nil {
+		key = log.Truncate(k)
+	}
+	log.Warnf("session [%d] slow %s, key = %s, backend = %s, took %s",
+		s.id, r.OpStr, key, r.backend, time.Duration(usecs)*time.Microsecond)
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestSlowlog(t *testing.T) {
+	assert.Must(SetSlowlogThreshold(time.Millisecond*50) == 0)
+	defer SetSlowlogThreshold(0)
+	assert.Must(SlowlogThreshold() == time.Millisecond*50)
+
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		if string(r.Resp.Array[1].Value) == "slow" {
+			time.Sleep(time.Millisecond * 60)
+		}
+		r.setResponse(redis.NewBulkBytes([]byte("v")), nil)
+	}}
+	s := &Session{}
+	do := func(args ...string) {
+		r, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+		_, err = s.handleResponse(r)
+		assert.MustNoError(err)
+	}
+	n := SlowCommandCounts()
+	do("GET", "fast")
+	assert.Must(SlowCommandCounts() == n)
+	do("GET", "slow")
+	assert.Must(SlowCommandCounts() == n+1)
+
+	// 运行时修改阈值，0表示不记录
+	assert.Must(SetSlowlogThreshold(0) == time.Millisecond*50)
+	do("GET", "slow")
+	assert.Must(SlowCommandCounts() == n+1)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// tcp 连接的发送和接收缓冲区大小，单位字节，0表示使用系统默认值
+// 内核可能会限制设置的大小，第一个连接设置之后在日志中输出实际生效的大小，被限制时输出警告
+type SocketBuffers struct {
+	Name string // client 或者 backend，用于日志
+	Send int
+	Recv int
+
+	once sync.Once
+}
+
+func NewSocketBuffers(name string, send, recv int) *SocketBuffers {
+	b := &SocketBuffers{Name: name, Send: send, Recv: recv}
+	if b.Send != 0 || b.Recv != 0 {
+		maxSend, maxRecv := socketBufferMax()
+		if maxSend != 0 && b.Send > maxSend {
+			log.Warnf("%s socket send buffer %d is larger than net.core.wmem_max = %d, it will be capped by kernel", name, b.Send, maxSend)
+		}
+		if maxRecv != 0 && b.Recv > maxRecv {
+			log.Warnf("%s socket receive buffer %d is larger than net.core.rmem_max = %d, it will be capped by kernel", name, b.Recv, maxRecv)
+		}
+	}
+	return b
+}
+
+// 不是 tcp 连接时忽略，比如测试中使用的内存中的连接
+func (b *SocketBuffers) Apply(c net.Conn) {
+	if b == nil || (b.Send == 0 && b.Recv == 0) {
+		return
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if b.Send != 0 {
+		if err := tc.SetWriteBuffer(b.Send); err != nil {
+			log.WarnErrorf(err, "set %s socket send buffer to %d failed", b.Name, b.Send)
+		}
+	}
+	if b.Recv != 0 {
+		if err := tc.SetReadBuffer(b.Recv); err != nil {
+			log.WarnErrorf(err, "set %s socket receive buffer to %d failed", b.Name, b.Recv)
+		}
+	}
+	b.once.Do(func() {
+		b.logEffective(tc)
+	})
+}
+
+func (b *SocketBuffers) logEffective(tc *net.TCPConn) {
+	send, recv, err := socketBufferSizes(tc)
+	if err != nil {
+		log.Infof("%s socket buffers set to send = %d, receive = %d, effective sizes are unknown: %s", b.Name, b.Send, b.Recv, err)
+		return
+	}
+	log.Infof("%s socket buffers set to send = %d, receive = %d, effective send = %d, receive = %d", b.Name, b.Send, b.Recv, send, recv)
+	if b.Send != 0 && send < b.Send*kernelBufferFactor {
+		log.Warnf("%s socket send buffer %d is capped by kernel to %d", b.Name, b.Send, send/kernelBufferFactor)
+	}
+	if b.Recv != 0 && recv < b.Recv*kernelBufferFactor {
+		log.Warnf("%s socket receive buffer %d is capped by kernel to %d", b.Name, b.Recv, recv/kernelBufferFactor)
+	}
+}
+
+// 后端连接的缓冲区大小，需要在创建连接之前设置
+var backendBuffers *SocketBuffers
+
+func SetBackendSocketBuffers(send, recv int) {
+	backendBuffers = NewSocketBuffers("backend", send, recv)
+}
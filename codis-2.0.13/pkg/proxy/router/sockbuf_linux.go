@@ -0,0 +1,60 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+//go:build linux
+// +build linux
+
+package router
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// linux 会把设置的大小加倍，用于内核自己的开销，getsockopt 返回的是加倍之后的值
+const kernelBufferFactor = 2
+
+// 实际生效的发送和接收缓冲区大小
+func socketBufferSizes(tc *net.TCPConn) (int, int, error) {
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var send, recv int
+	var serr, rerr error
+	if err := raw.Control(func(fd uintptr) {
+		send, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		recv, rerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	if serr != nil {
+		return 0, 0, errors.Trace(serr)
+	}
+	if rerr != nil {
+		return 0, 0, errors.Trace(rerr)
+	}
+	return send, recv, nil
+}
+
+// 内核允许设置的缓冲区大小上限，无法获取时返回 0
+func socketBufferMax() (int, int) {
+	return readSysctl("/proc/sys/net/core/wmem_max"), readSysctl("/proc/sys/net/core/rmem_max")
+}
+
+func readSysctl(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,25 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+//go:build !linux
+// +build !linux
+
+package router
+
+import (
+	"net"
+	"runtime"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+const kernelBufferFactor = 1
+
+// 只有 linux 上获取实际生效的大小
+func socketBufferSizes(tc *net.TCPConn) (int, int, error) {
+	return 0, 0, errors.Errorf("not supported on %s", runtime.GOOS)
+}
+
+func socketBufferMax() (int, int) {
+	return 0, 0
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestSocketBuffers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.MustNoError(err)
+	defer c.Close()
+
+	b := NewSocketBuffers("test", 64*1024, 32*1024)
+	b.Apply(c)
+	send, recv, err := socketBufferSizes(c.(*net.TCPConn))
+	if err == nil {
+		assert.Must(send >= b.Send && recv >= b.Recv)
+		assert.Must(send <= b.Send*kernelBufferFactor && recv <= b.Recv*kernelBufferFactor)
+	}
+
+	// 不是 tcp 连接或者没有设置时忽略
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	b.Apply(c1)
+	var none *SocketBuffers
+	none.Apply(c)
+	NewSocketBuffers("test", 0, 0).Apply(c)
+}
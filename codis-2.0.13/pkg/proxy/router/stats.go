@@ -48,14 +48,100 @@ func (s *OpStats) MarshalJSON() ([]byte, error) {
 
 // 命令执行统计信息
 var cmdstats struct {
-	requests atomic2.Int64
+	requests   atomic2.Int64
+	failed     atomic2.Int64 // 返回错误或者转发失败的命令数
+	broadcasts atomic2.Int64 // 广播到所有后端的命令次数
+	localpings atomic2.Int64 // 由proxy直接回复的 PING 次数
+	sessions   atomic2.Int64 // 当前的客户端连接数
+
+	retries          atomic2.Int64 // 后端出错后重试的只读命令次数
+	writesNotRetried atomic2.Int64 // 后端出错后没有重试的写命令次数
+
+	handshakeTimeouts atomic2.Int64 // 握手超时被关闭的连接数
+	readTimeouts      atomic2.Int64 // 读取命令超时被关闭的连接数
+	oversizedRequests atomic2.Int64 // 命令超过 max_request_size 被关闭的连接数
+	pipelineLimits    atomic2.Int64 // 转发到的 slot 超过 max_slots_per_pipeline 而分段执行的 pipeline 数
+	staleRejects      atomic2.Int64 // 路由信息过期时拒绝的命令数
+	arityRejects      atomic2.Int64 // 参数个数不对被拒绝的命令数
+	maxKeysRejects    atomic2.Int64 // key的个数超过上限被拒绝的命令数
+	keyRejects        atomic2.Int64 // key为空或者太长被拒绝的命令数
+	aclRejects        atomic2.Int64 // 用户没有权限执行被拒绝的命令数
+	goodbyes          atomic2.Int64 // 下线时回复了 goodbye 后关闭的连接数
+	clientGone        atomic2.Int64 // 客户端在回复之前断开连接而丢弃的回复数
+	bufferThrottles   atomic2.Int64 // 回复堆积超过 max_response_buffer 暂停处理请求的次数
+	bufferCloses      atomic2.Int64 // 回复堆积超过 max_response_buffer 太久被关闭的连接数
+	slowCommands      atomic2.Int64 // 执行时间超过 slowlog_threshold 的命令数
+	drained           atomic2.Int64 // 后端被移除后，等待请求全部返回才关闭的连接数
+	drainForced       atomic2.Int64 // 后端被移除后，超过 backend_drain_timeout 被强制关闭的连接数
+	quarantines       atomic2.Int64 // 错误太多被隔离的连接数
+	disabledRejects   atomic2.Int64 // 因为master被手动下线直接返回错误的命令数
+	deniedConns       atomic2.Int64 // 来源ip在黑名单中被拒绝的连接数
+	fallbacks         atomic2.Int64 // 发往没有分配group的slot，由 default_group 服务的命令数
+	groupDownRejects  atomic2.Int64 // 因为group的全部后端都不可用返回错误的命令数
+	malformedReplies  atomic2.Int64 // 开启 strict_reply_validation 时格式错误的后端回复数
+	mismatchedReplies atomic2.Int64 // 开启 strict_reply_validation 时类型和命令不符的后端回复数
+	conflictRejects   atomic2.Int64 // 因为slot的路由冲突返回错误的命令数
+	preMigrateHits    atomic2.Int64 // 发往预迁移状态的slot的命令数
+	preMigrateRejects atomic2.Int64 // 因为slot处于预迁移状态返回 TRYAGAIN 的命令数
+
+	replicaReads    atomic2.Int64 // 发送给slave的只读命令数
+	lagRedirects    atomic2.Int64 // slave的复制延迟太大而发送给master的只读命令数
+	pinned          atomic2.Int64 // 当前固定从master读取的会话数
+	readAfterWrites atomic2.Int64 // 因为最近写入过而发送给master的只读命令数
+
+	batches [len(batchBuckets)]atomic2.Int64 // 客户端每次连续发送的命令数的分布
 
 	opmap map[string]*OpStats
 	rwlck sync.RWMutex
+
+	oversized struct {
+		sync.Mutex
+		m map[string]int64 // 每个后端返回结果过大被中断的次数
+	}
 }
 
 func init() {
 	cmdstats.opmap = make(map[string]*OpStats)
+	cmdstats.oversized.m = make(map[string]int64)
+}
+
+// 是否统计每个命令的调用次数和耗时，只能在启动时关闭，用于测试转发本身的性能
+var statsEnabled = true
+
+// 关闭命令统计，需要在开始处理请求之前调用
+func DisableStats() {
+	statsEnabled = false
+}
+
+func StatsEnabled() bool {
+	return statsEnabled
+}
+
+// 客户端一次连续发送的命令数的分桶，每个值是桶的上限，最后一个桶没有上限
+var batchBuckets = [...]struct {
+	name string
+	max  int
+}{{"1", 1}, {"2-10", 10}, {"11-100", 100}, {"100+", 0}}
+
+func incrBatches(n int) {
+	if !statsEnabled {
+		return
+	}
+	for i, b := range batchBuckets {
+		if n <= b.max || b.max == 0 {
+			cmdstats.batches[i].Incr()
+			return
+		}
+	}
+}
+
+// 按命令数分桶的 pipeline 次数，没有使用 pipeline 的客户端都在 "1" 中
+func PipelineBatches() map[string]int64 {
+	var m = make(map[string]int64, len(batchBuckets))
+	for i, b := range batchBuckets {
+		m[b.name] = cmdstats.batches[i].Get()
+	}
+	return m
 }
 
 // 获取总的请求次数
@@ -63,6 +149,322 @@ func OpCounts() int64 {
 	return cmdstats.requests.Get()
 }
 
+// 获取返回错误或者转发失败的命令数，不受 failure_log_size 的影响
+func FailedCounts() int64 {
+	return cmdstats.failed.Get()
+}
+
+// 获取广播到所有后端的命令次数
+func BroadcastCounts() int64 {
+	return cmdstats.broadcasts.Get()
+}
+
+func incrBroadcasts() {
+	cmdstats.broadcasts.Incr()
+}
+
+// 获取由proxy直接回复的 PING 次数
+func LocalPingCounts() int64 {
+	return cmdstats.localpings.Get()
+}
+
+func incrLocalPings() {
+	cmdstats.localpings.Incr()
+}
+
+// 获取当前的客户端连接数
+func SessionCounts() int64 {
+	return cmdstats.sessions.Get()
+}
+
+// 获取后端出错后重试的只读命令次数
+func RetryCounts() int64 {
+	return cmdstats.retries.Get()
+}
+
+func incrRetries() {
+	cmdstats.retries.Incr()
+}
+
+// 获取后端出错后没有重试的写命令次数
+func WritesNotRetriedCounts() int64 {
+	return cmdstats.writesNotRetried.Get()
+}
+
+func incrWritesNotRetried() {
+	cmdstats.writesNotRetried.Incr()
+}
+
+// 获取握手超时被关闭的连接数
+func HandshakeTimeoutCounts() int64 {
+	return cmdstats.handshakeTimeouts.Get()
+}
+
+func incrHandshakeTimeouts() {
+	cmdstats.handshakeTimeouts.Incr()
+}
+
+// 获取读取命令超时被关闭的连接数
+func ReadTimeoutCounts() int64 {
+	return cmdstats.readTimeouts.Get()
+}
+
+func incrReadTimeouts() {
+	cmdstats.readTimeouts.Incr()
+}
+
+// 获取命令超过大小上限被关闭的连接数
+func OversizedRequestCounts() int64 {
+	return cmdstats.oversizedRequests.Get()
+}
+
+func incrOversizedRequests() {
+	cmdstats.oversizedRequests.Incr()
+}
+
+// 获取转发到的 slot 超过上限而分段执行的 pipeline 数
+func PipelineSlotLimitCounts() int64 {
+	return cmdstats.pipelineLimits.Get()
+}
+
+func incrPipelineSlotLimits() {
+	cmdstats.pipelineLimits.Incr()
+}
+
+// 获取下线时回复了 goodbye 后关闭的连接数
+func GoodbyeCounts() int64 {
+	return cmdstats.goodbyes.Get()
+}
+
+func incrGoodbyes() {
+	cmdstats.goodbyes.Incr()
+}
+
+// 获取客户端在回复之前断开连接而丢弃的回复数
+func ClientGoneCounts() int64 {
+	return cmdstats.clientGone.Get()
+}
+
+func incrClientGone() {
+	cmdstats.clientGone.Incr()
+}
+
+func BufferThrottleCounts() int64 {
+	return cmdstats.bufferThrottles.Get()
+}
+
+func incrBufferThrottles() {
+	cmdstats.bufferThrottles.Incr()
+}
+
+func BufferCloseCounts() int64 {
+	return cmdstats.bufferCloses.Get()
+}
+
+func incrBufferCloses() {
+	cmdstats.bufferCloses.Incr()
+}
+
+func SlowCommandCounts() int64 {
+	return cmdstats.slowCommands.Get()
+}
+
+func incrSlowCommands() {
+	cmdstats.slowCommands.Incr()
+}
+
+// 获取后端被移除后关闭的连接数，等待请求全部返回的和被强制关闭的分别统计
+func DrainedConnCounts() (drained, forced int64) {
+	return cmdstats.drained.Get(), cmdstats.drainForced.Get()
+}
+
+func incrDrained() {
+	cmdstats.drained.Incr()
+}
+
+func incrDrainForced() {
+	cmdstats.drainForced.Incr()
+}
+
+// 获取路由信息过期时拒绝的命令数
+func StaleRejectCounts() int64 {
+	return cmdstats.staleRejects.Get()
+}
+
+func incrStaleRejects() {
+	cmdstats.staleRejects.Incr()
+}
+
+// 获取参数个数不对被拒绝的命令数
+func ArityRejectCounts() int64 {
+	return cmdstats.arityRejects.Get()
+}
+
+func incrArityRejects() {
+	cmdstats.arityRejects.Incr()
+}
+
+// 获取key的个数超过上限被拒绝的命令数
+func MaxKeysRejectCounts() int64 {
+	return cmdstats.maxKeysRejects.Get()
+}
+
+func incrMaxKeysRejects() {
+	cmdstats.maxKeysRejects.Incr()
+}
+
+// 获取key为空或者太长被拒绝的命令数
+func KeyRejectCounts() int64 {
+	return cmdstats.keyRejects.Get()
+}
+
+func incrKeyRejects() {
+	cmdstats.keyRejects.Incr()
+}
+
+// 获取因为用户没有权限被拒绝的命令数
+func ACLRejectCounts() int64 {
+	return cmdstats.aclRejects.Get()
+}
+
+func incrACLRejects() {
+	cmdstats.aclRejects.Incr()
+}
+
+// 获取错误太多被隔离的连接数
+func QuarantineCounts() int64 {
+	return cmdstats.quarantines.Get()
+}
+
+func incrQuarantines() {
+	cmdstats.quarantines.Incr()
+}
+
+// 获取因为master被手动下线直接返回错误的命令数
+func DisabledRejectCounts() int64 {
+	return cmdstats.disabledRejects.Get()
+}
+
+func incrDisabledRejects() {
+	cmdstats.disabledRejects.Incr()
+}
+
+// 获取来源ip在黑名单中被拒绝的连接数
+func FallbackCounts() int64 {
+	return cmdstats.fallbacks.Get()
+}
+
+func incrFallbacks() {
+	cmdstats.fallbacks.Incr()
+}
+
+func GroupDownRejectCounts() int64 {
+	return cmdstats.groupDownRejects.Get()
+}
+
+func incrGroupDownRejects() {
+	cmdstats.groupDownRejects.Incr()
+}
+
+// 获取因为slot的路由冲突返回错误的命令数
+func ConflictRejectCounts() int64 {
+	return cmdstats.conflictRejects.Get()
+}
+
+func incrConflictRejects() {
+	cmdstats.conflictRejects.Incr()
+}
+
+// 获取开启 strict_reply_validation 时格式错误和类型不符的后端回复数
+func MalformedReplyCounts() int64 {
+	return cmdstats.malformedReplies.Get()
+}
+
+func MismatchedReplyCounts() int64 {
+	return cmdstats.mismatchedReplies.Get()
+}
+
+func incrMalformedReplies() {
+	cmdstats.malformedReplies.Incr()
+}
+
+func incrMismatchedReplies() {
+	cmdstats.mismatchedReplies.Incr()
+}
+
+func PreMigrateHitCounts() int64 {
+	return cmdstats.preMigrateHits.Get()
+}
+
+func incrPreMigrateHits() {
+	cmdstats.preMigrateHits.Incr()
+}
+
+func PreMigrateRejectCounts() int64 {
+	return cmdstats.preMigrateRejects.Get()
+}
+
+func incrPreMigrateRejects() {
+	cmdstats.preMigrateRejects.Incr()
+}
+
+func DeniedConnCounts() int64 {
+	return cmdstats.deniedConns.Get()
+}
+
+func incrDeniedConns() {
+	cmdstats.deniedConns.Incr()
+}
+
+// 获取发送给slave的只读命令数
+func ReplicaReadCounts() int64 {
+	return cmdstats.replicaReads.Get()
+}
+
+func incrReplicaReads() {
+	cmdstats.replicaReads.Incr()
+}
+
+// 获取因为slave的复制延迟太大而发送给master的只读命令数
+func ReplicaLagRedirectCounts() int64 {
+	return cmdstats.lagRedirects.Get()
+}
+
+func incrReplicaLagRedirects() {
+	cmdstats.lagRedirects.Incr()
+}
+
+// 获取因为最近写入过同一个key而发送给master的只读命令数
+func ReadAfterWriteCounts() int64 {
+	return cmdstats.readAfterWrites.Get()
+}
+
+func incrReadAfterWrites() {
+	cmdstats.readAfterWrites.Incr()
+}
+
+// 获取当前通过 PROXY PIN MASTER 固定从master读取的会话数
+func PinnedSessionCounts() int64 {
+	return cmdstats.pinned.Get()
+}
+
+// 获取每个后端返回结果过大被中断的次数
+func OversizedReplyCounts() map[string]int64 {
+	cmdstats.oversized.Lock()
+	defer cmdstats.oversized.Unlock()
+	var m = make(map[string]int64, len(cmdstats.oversized.m))
+	for addr, n := range cmdstats.oversized.m {
+		m[addr] = n
+	}
+	return m
+}
+
+func incrOversizedReplies(addr string) {
+	cmdstats.oversized.Lock()
+	cmdstats.oversized.m[addr]++
+	cmdstats.oversized.Unlock()
+}
+
 // 获取指定命令的统计信息
 func GetOpStats(opstr string, create bool) *OpStats {
 	cmdstats.rwlck.RLock()
@@ -83,6 +485,108 @@ func GetOpStats(opstr string, create bool) *OpStats {
 	return s
 }
 
+// 按应用统计的命令信息，应用名由客户端通过 PROXY APP 或者 CLIENT SETNAME 设置
+type AppStats struct {
+	app   string
+	calls atomic2.Int64
+	opmap map[string]*OpStats
+	rwlck sync.RWMutex
+}
+
+func (a *AppStats) App() string {
+	return a.app
+}
+
+func (a *AppStats) Calls() int64 {
+	return a.calls.Get()
+}
+
+func (a *AppStats) GetAllOpStats() []*OpStats {
+	a.rwlck.RLock()
+	var all = make([]*OpStats, 0, len(a.opmap))
+	for _, s := range a.opmap {
+		all = append(all, s)
+	}
+	a.rwlck.RUnlock()
+	return all
+}
+
+func (a *AppStats) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["app"] = a.app
+	m["calls"] = a.calls.Get()
+	m["cmds"] = a.GetAllOpStats()
+	return json.Marshal(m)
+}
+
+func (a *AppStats) incrOpStats(opstr string, usecs int64) {
+	if !statsEnabled {
+		return
+	}
+	a.rwlck.RLock()
+	s := a.opmap[opstr]
+	a.rwlck.RUnlock()
+	if s == nil {
+		a.rwlck.Lock()
+		if s = a.opmap[opstr]; s == nil {
+			s = &OpStats{opstr: opstr}
+			a.opmap[opstr] = s
+		}
+		a.rwlck.Unlock()
+	}
+	s.calls.Incr()
+	s.usecs.Add(usecs)
+	a.calls.Incr()
+}
+
+// 超过应用数量上限之后，新的应用都合并统计到这里
+const AppOther = "_other"
+
+var appstats struct {
+	sync.Mutex
+	max int // 最多统计的应用数量，0表示不按应用统计
+	m   map[string]*AppStats
+}
+
+// 设置按应用统计时的应用数量上限，避免客户端使用过多不同的名称，需要在开始处理请求之前调用
+func SetMaxApps(n int) {
+	appstats.Lock()
+	defer appstats.Unlock()
+	appstats.max = n
+	appstats.m = make(map[string]*AppStats)
+}
+
+func getAppStats(app string) *AppStats {
+	appstats.Lock()
+	defer appstats.Unlock()
+	if appstats.max == 0 || app == "" {
+		return nil
+	}
+	if a := appstats.m[app]; a != nil {
+		return a
+	}
+	if len(appstats.m) >= appstats.max {
+		app = AppOther
+		if a := appstats.m[app]; a != nil {
+			return a
+		}
+	}
+	a := &AppStats{app: app, opmap: make(map[string]*OpStats)}
+	appstats.m[app] = a
+	return a
+}
+
+// 获取全部应用的统计信息
+func GetAllAppStats() []*AppStats {
+	appstats.Lock()
+	defer appstats.Unlock()
+	var all = make([]*AppStats, 0, len(appstats.m))
+	for _, a := range appstats.m {
+		all = append(all, a)
+	}
+	return all
+}
+
 // 获取全部命令的统计信息
 func GetAllOpStats() []*OpStats {
 	var all = make([]*OpStats, 0, 128)
@@ -94,8 +598,25 @@ func GetAllOpStats() []*OpStats {
 	return all
 }
 
+// 返回全部命令的统计信息并清零，每个计数器都是原子地交换为0，之后的调用计入下一次的结果，不会丢失或者重复计数
+// 同一条命令的 calls 和 usecs 不是同时交换的，正在完成的命令可能 calls 计入这一次而 usecs 计入下一次
+func SnapshotAndResetOpStats() []*OpStats {
+	var all = GetAllOpStats()
+	var snap = make([]*OpStats, len(all))
+	for i, s := range all {
+		x := &OpStats{opstr: s.opstr}
+		x.calls.Set(s.calls.Swap(0))
+		x.usecs.Set(s.usecs.Swap(0))
+		snap[i] = x
+	}
+	return snap
+}
+
 // 更新指定命令的统计信息
 func incrOpStats(opstr string, usecs int64) {
+	if !statsEnabled {
+		return
+	}
 	s := GetOpStats(opstr, true)
 	// 调用次数
 	s.calls.Incr()
@@ -0,0 +1,71 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestSnapshotAndResetOpStats(t *testing.T) {
+	const opstr = "SNAPSHOT-TEST"
+	snapshot := func() (calls, usecs int64) {
+		for _, s := range SnapshotAndResetOpStats() {
+			if s.OpStr() == opstr {
+				calls, usecs = s.Calls(), s.USecs()
+			}
+		}
+		return
+	}
+	incrOpStats(opstr, 10)
+	calls, usecs := snapshot()
+	assert.Must(calls == 1 && usecs == 10)
+	calls, _ = snapshot()
+	assert.Must(calls == 0 && GetOpStats(opstr, false).Calls() == 0)
+
+	// 和 cmds 的格式相同
+	incrOpStats(opstr, 10)
+	b, err := json.Marshal(SnapshotAndResetOpStats())
+	assert.MustNoError(err)
+	var list []map[string]interface{}
+	assert.MustNoError(json.Unmarshal(b, &list))
+	var found bool
+	for _, m := range list {
+		if m["cmd"] == opstr {
+			found = m["calls"].(float64) == 1 && m["usecs"].(float64) == 10 && m["usecs_percall"].(float64) == 10
+		}
+	}
+	assert.Must(found)
+
+	// 并发的调用不会丢失或者重复计数
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				incrOpStats(opstr, 2)
+			}
+		}()
+	}
+	var total, totalUsecs int64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for stop := false; !stop; {
+		select {
+		case <-done:
+			stop = true
+		default:
+		}
+		calls, usecs := snapshot()
+		total, totalUsecs = total+calls, totalUsecs+usecs
+	}
+	assert.Must(total == 8000 && totalUsecs == 16000)
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 校验后端的回复，用于排查后端数据损坏或者proxy的bug，有额外的开销，默认关闭
+// 回复需要是完整格式的 RESP，已知回复类型的命令还需要类型相符，不符时关闭连接，避免之后的回复和请求错位
+var strictReplies bool
+
+// 需要在创建后端连接之前设置
+func SetStrictReplyValidation(enabled bool) {
+	strictReplies = enabled
+}
+
+var ErrReplyMismatch = errors.New("backend conn closed, a previous reply doesn't match its command")
+
+// 命令的回复类型，错误回复总是允许的，没有列出的命令不检查
+// 有多种回复的命令列出全部类型，比如 SET 带 GET 参数时返回 bulk
+var replyTypes = make(map[string][]redis.RespType)
+
+func init() {
+	const (
+		s = redis.TypeString
+		i = redis.TypeInt
+		b = redis.TypeBulkBytes
+		a = redis.TypeArray
+	)
+	for t, names := range map[redis.RespType][]string{
+		s: {"MSET", "SETEX", "PSETEX", "HMSET", "LSET", "LTRIM", "TYPE", "RESTORE"},
+		i: {"DEL", "UNLINK", "EXISTS", "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL", "PERSIST", "TOUCH",
+			"INCR", "DECR", "INCRBY", "DECRBY", "APPEND", "STRLEN", "SETNX", "SETRANGE", "SETBIT", "GETBIT", "BITCOUNT",
+			"HSET", "HSETNX", "HDEL", "HLEN", "HEXISTS", "HINCRBY", "HSTRLEN",
+			"LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LLEN", "LREM", "LINSERT",
+			"SADD", "SREM", "SCARD", "SISMEMBER", "ZCARD", "ZCOUNT", "ZREM", "ZLEXCOUNT", "PFADD", "PFCOUNT"},
+		b: {"GET", "GETDEL", "GETEX", "GETSET", "GETRANGE", "SUBSTR", "HGET", "LINDEX", "ZSCORE", "ZINCRBY",
+			"INCRBYFLOAT", "HINCRBYFLOAT", "ECHO", "DUMP"},
+		a: {"MGET", "HMGET", "HGETALL", "HKEYS", "HVALS", "LRANGE", "SMEMBERS", "SINTER", "SUNION", "SDIFF",
+			"ZRANGE", "ZREVRANGE", "ZRANGEBYSCORE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX"},
+	} {
+		for _, name := range names {
+			replyTypes[name] = []redis.RespType{t}
+		}
+	}
+	replyTypes["SET"] = []redis.RespType{s, b}
+	for _, name := range []string{"LPOP", "RPOP", "SPOP", "SRANDMEMBER"} {
+		replyTypes[name] = []redis.RespType{b, a}
+	}
+}
+
+// 回复的类型和命令不符时返回返回给客户端的错误
+func checkReplyType(opstr string, resp *redis.Resp) *redis.Resp {
+	types := replyTypes[opstr]
+	if len(types) == 0 || resp.IsError() {
+		return nil
+	}
+	for _, t := range types {
+		if resp.Type == t {
+			return nil
+		}
+	}
+	return redis.NewError([]byte(fmt.Sprintf("ERR backend replied %s to %s, expected %s", resp.Type, opstr, types[0])))
+}
+
+// 解析回复的错误中，除了连接断开、超时和回复太大，都是格式错误
+func isMalformedReply(err error) bool {
+	switch e := errors.Cause(err); {
+	case e == io.EOF || e == io.ErrUnexpectedEOF || errors.Equal(e, redis.ErrRespTooLarge):
+		return false
+	default:
+		_, ok := e.(net.Error)
+		return !ok
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+// 按命令回复固定的字节，可以是格式错误的回复
+func replyRaw(replies map[string]string) replyFunc {
+	return func(req *redis.Resp) []byte {
+		opstr, err := getOpStr(req)
+		assert.MustNoError(err)
+		return []byte(replies[opstr])
+	}
+}
+
+func TestStrictReplyValidation(t *testing.T) {
+	SetStrictReplyValidation(true)
+	defer SetStrictReplyValidation(false)
+
+	l, addr := fakeServer(replyRaw(map[string]string{
+		"GET":  "$1\r\nb\r\n",
+		"SET":  "+OK\r\n",
+		"INCR": ":12x\r\n",
+		"DEL":  "$1\r\n1\r\n",
+		"ECHO": "hello\r\n",
+	}))
+	defer l.Close()
+	bc := NewBackendConn(addr, "")
+	defer bc.Close()
+
+	send := func(args ...string) *Request {
+		r := &Request{OpStr: args[0], Resp: newRequestResp(args...), Wait: &sync.WaitGroup{}}
+		bc.PushBack(r)
+		r.Wait.Wait()
+		return r
+	}
+	r := send("GET", "a")
+	assert.Must(r.Response.Err == nil && string(r.Response.Resp.Value) == "b")
+	r = send("SET", "a", "b")
+	assert.Must(r.Response.Err == nil && r.Response.Resp.IsString())
+
+	// 类型不符时返回错误，并且关闭连接
+	n := MismatchedReplyCounts()
+	r = send("DEL", "a")
+	assert.Must(r.Response.Err == nil && r.Response.Resp.IsError())
+	assert.Must(string(r.Response.Resp.Value) == "ERR backend replied <bulkbytes> to DEL, expected <int>")
+	assert.Must(MismatchedReplyCounts() == n+1)
+
+	// 格式错误的回复
+	for _, args := range [][]string{{"INCR", "a"}, {"ECHO", "hello"}} {
+		n := MalformedReplyCounts()
+		// 上一次关闭连接之后，重新连接之前的请求会失败
+		for i := 0; i < 10 && MalformedReplyCounts() == n; i++ {
+			r = send(args...)
+			assert.Must(r.Response.Err != nil)
+		}
+		assert.Must(MalformedReplyCounts() == n+1)
+	}
+
+	// 重新建立连接之后正常转发
+	for i := 0; i < 10; i++ {
+		if r = send("GET", "a"); r.Response.Err == nil {
+			break
+		}
+	}
+	assert.Must(r.Response.Err == nil && string(r.Response.Resp.Value) == "b")
+}
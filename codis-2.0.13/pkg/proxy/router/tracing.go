@@ -0,0 +1,108 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+// 客户端通过 PROXY TRACE 传入的 W3C trace context
+type traceContext struct {
+	traceId [16]byte
+	spanId  [8]byte
+}
+
+// 一条命令在proxy中的处理过程，作为客户端 span 的子 span 导出
+type Span struct {
+	Name     string   // redis命令
+	TraceId  [16]byte // 和客户端的 trace 相同
+	SpanId   [8]byte
+	ParentId [8]byte // 客户端传入的 span
+
+	Start int64 // 单位 us
+	End   int64
+
+	Client  string // 客户端地址
+	Session int64  // 客户端连接的编号
+	Slot    int    // 命令所在的slot，由proxy拆分或者直接回复的命令为 -1
+	Backend string // 执行命令的后端地址
+	Error   string // 命令返回的错误
+}
+
+var ErrBadTraceparent = errors.New("ERR invalid traceparent, should be like 00-<32 hex trace id>-<16 hex span id>-<2 hex flags>")
+
+var (
+	traceExport func(s *Span) // 为nil表示没有开启
+	traceRate   float64
+)
+
+// 开启后 PROXY TRACE 传入 trace context 的会话按 rate 采样命令，生成的 span 交给 export 导出，export 不能阻塞
+func SetTracing(rate float64, export func(s *Span)) {
+	traceRate, traceExport = rate, export
+}
+
+func TracingEnabled() bool {
+	return traceExport != nil
+}
+
+// 解析 traceparent，客户端没有采样的 trace 返回 nil
+func parseTraceparent(s string) (*traceContext, error) {
+	p := strings.Split(s, "-")
+	if len(p) != 4 || len(p[0]) != 2 || len(p[1]) != 32 || len(p[2]) != 16 || len(p[3]) != 2 || p[0] == "ff" {
+		return nil, ErrBadTraceparent
+	}
+	var version, flags [1]byte
+	var t = &traceContext{}
+	for _, x := range []struct {
+		dst []byte
+		src string
+	}{{version[:], p[0]}, {t.traceId[:], p[1]}, {t.spanId[:], p[2]}, {flags[:], p[3]}} {
+		// 和 W3C 的要求一样只接受小写
+		if x.src != strings.ToLower(x.src) {
+			return nil, ErrBadTraceparent
+		}
+		if _, err := hex.Decode(x.dst, []byte(x.src)); err != nil {
+			return nil, ErrBadTraceparent
+		}
+	}
+	if t.traceId == [16]byte{} || t.spanId == [8]byte{} {
+		return nil, ErrBadTraceparent
+	}
+	if flags[0]&1 == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// 按采样率决定是否为这条命令生成 span
+func (t *traceContext) newSpan(r *Request, client string) *Span {
+	if traceRate < 1 && rand.Float64() >= traceRate {
+		return nil
+	}
+	sp := &Span{Name: r.OpStr, TraceId: t.traceId, ParentId: t.spanId, Start: r.Start, Client: client, Session: r.session, Slot: -1}
+	for i := 0; i < len(sp.SpanId); i += 4 {
+		v := rand.Uint32() | 1
+		sp.SpanId[i], sp.SpanId[i+1], sp.SpanId[i+2], sp.SpanId[i+3] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+	}
+	return sp
+}
+
+// 命令返回之后导出 span
+func finishSpan(sp *Span, resp *redis.Resp, err error) {
+	sp.End = microseconds()
+	switch {
+	case err != nil:
+		sp.Error = err.Error()
+	case resp != nil && resp.IsError():
+		sp.Error = string(resp.Value)
+	}
+	if export := traceExport; export != nil {
+		export(sp)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	x, err := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.MustNoError(err)
+	assert.Must(hex.EncodeToString(x.traceId[:]) == "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Must(hex.EncodeToString(x.spanId[:]) == "00f067aa0ba902b7")
+
+	// 客户端没有采样
+	x, err = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.Must(x == nil && err == nil)
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := parseTraceparent(s)
+		assert.Must(err == ErrBadTraceparent)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	l, addr := fakeServer(replyByCommand(map[string]*redis.Resp{
+		"GET": redis.NewBulkBytes([]byte("v")),
+	}))
+	defer l.Close()
+	s := New()
+	defer s.Close()
+	id := hashSlot([]byte("a"))
+	assert.MustNoError(s.FillSlot(id, addr, "", false))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	session := NewSessionSize(c1, "", 1024, 1800)
+	do := func(args ...string) *redis.Resp {
+		r, err := session.handleRequest(newRequestResp(args...), s)
+		assert.MustNoError(err)
+		resp, err := session.handleResponse(r)
+		assert.MustNoError(err)
+		return resp
+	}
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	// 没有开启时返回错误
+	SetTracing(0, nil)
+	assert.Must(do("PROXY", "TRACE", tp).IsError())
+
+	var spans []*Span
+	SetTracing(1, func(sp *Span) {
+		spans = append(spans, sp)
+	})
+	defer SetTracing(0, nil)
+
+	do("GET", "a")
+	assert.Must(len(spans) == 0)
+
+	assert.Must(do("PROXY", "TRACE", "bad").IsError())
+	assert.Must(string(do("PROXY", "TRACE", tp).Value) == "OK")
+	do("GET", "a")
+	do("SELECT", "1")
+	assert.Must(len(spans) == 2)
+	x := spans[0]
+	assert.Must(x.Name == "GET" && x.Slot == id && x.Backend == addr && x.Error == "")
+	assert.Must(x.Session == session.Id())
+	assert.Must(hex.EncodeToString(x.TraceId[:]) == "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Must(hex.EncodeToString(x.ParentId[:]) == "00f067aa0ba902b7")
+	assert.Must(x.SpanId != [8]byte{} && x.End >= x.Start)
+	// 直接由proxy回复的命令没有slot和后端
+	y := spans[1]
+	assert.Must(y.Slot == -1 && y.Backend == "" && y.Error != "" && y.SpanId != x.SpanId)
+
+	// 采样率为0时不生成 span
+	SetTracing(0, func(sp *Span) {
+		spans = append(spans, sp)
+	})
+	do("GET", "a")
+	assert.Must(len(spans) == 2)
+
+	SetTracing(1, func(sp *Span) {
+		spans = append(spans, sp)
+	})
+	assert.Must(string(do("PROXY", "TRACE", "OFF").Value) == "OK")
+	assert.Must(len(spans) == 3 && spans[2].Name == "PROXY")
+	do("GET", "a")
+	assert.Must(len(spans) == 3)
+}
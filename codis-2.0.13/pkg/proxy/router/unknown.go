@@ -0,0 +1,70 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// 命令表中没有的命令的处理，比如新版本的redis或者自定义模块的命令
+const (
+	UnknownForward      = "forward"               // 有参数时把第一个参数当作key转发，没有参数时返回错误
+	UnknownReject       = "reject"                // 和redis一样返回 unknown command 错误
+	UnknownFirstBackend = "forward-first-backend" // 不管有没有key，都转发给 slot 0 所在的后端
+)
+
+var unknownAction = UnknownForward
+
+// 需要在开始处理请求之前设置
+func SetUnknownCommandAction(action string) {
+	unknownAction = action
+}
+
+// 按命令名统计的次数，超过上限之后新的命令名都记在 other 中，避免客户端发送随机的命令名耗尽内存
+const maxUnknownCommands = 256
+
+var unknownCommands struct {
+	sync.Mutex
+	m map[string]int64
+}
+
+func init() {
+	unknownCommands.m = make(map[string]int64)
+}
+
+func incrUnknownCommands(opstr string) {
+	unknownCommands.Lock()
+	defer unknownCommands.Unlock()
+	if _, ok := unknownCommands.m[opstr]; !ok && len(unknownCommands.m) >= maxUnknownCommands {
+		opstr = "other"
+	}
+	unknownCommands.m[opstr]++
+}
+
+// 获取每个未知命令出现的次数
+func UnknownCommandCounts() map[string]int64 {
+	unknownCommands.Lock()
+	defer unknownCommands.Unlock()
+	var m = make(map[string]int64, len(unknownCommands.m))
+	for opstr, n := range unknownCommands.m {
+		m[opstr] = n
+	}
+	return m
+}
+
+func (s *Session) handleUnknown(r *Request, d Dispatcher) (*Request, error) {
+	incrUnknownCommands(r.OpStr)
+	switch {
+	case unknownAction == UnknownFirstBackend:
+		r.first = true
+	case unknownAction == UnknownReject || len(r.Resp.Array) < 2:
+		s.clientError()
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR unknown command '%s'", r.Resp.Array[0].Value)))
+		return r, nil
+	}
+	return r, d.Dispatch(r)
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestUnknownCommand(t *testing.T) {
+	defer SetUnknownCommandAction(UnknownForward)
+
+	var first []bool
+	d := &fakeDispatcher{dispatch: func(r *Request) {
+		first = append(first, r.first)
+		r.setResponse(redis.NewString([]byte("OK")), nil)
+	}}
+	s := &Session{}
+	n := UnknownCommandCounts()["MYCMD"]
+
+	// 有参数时转发，没有参数时返回和redis相同的错误
+	assert.Must(doRequest(s, d, "mycmd", "key").IsString())
+	resp := doRequest(s, d, "mycmd")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR unknown command 'mycmd'")
+	// 命令表中的命令不受影响
+	assert.Must(doRequest(s, d, "GET", "key").IsString())
+
+	SetUnknownCommandAction(UnknownReject)
+	assert.Must(doRequest(s, d, "mycmd", "key").IsError())
+
+	SetUnknownCommandAction(UnknownFirstBackend)
+	assert.Must(doRequest(s, d, "mycmd").IsString())
+	assert.Must(doRequest(s, d, "mycmd", "key").IsString())
+
+	assert.Must(len(first) == 4 && !first[0] && !first[1] && first[2] && first[3])
+	assert.Must(UnknownCommandCounts()["MYCMD"] == n+5)
+}
+
+func TestUnknownCommandFirstBackend(t *testing.T) {
+	SetUnknownCommandAction(UnknownFirstBackend)
+	defer SetUnknownCommandAction(UnknownForward)
+
+	l0, addr0 := fakeServer(replyByCommand(map[string]*redis.Resp{"MYCMD": redis.NewString([]byte("slot0"))}))
+	defer l0.Close()
+	l1, addr1 := fakeServer(replyByCommand(map[string]*redis.Resp{"MYCMD": redis.NewString([]byte("other"))}))
+	defer l1.Close()
+
+	router := New()
+	defer router.Close()
+	assert.MustNoError(router.FillSlot(0, addr0, "", false))
+	slot := hashSlot([]byte("key"))
+	assert.Must(slot != 0)
+	assert.MustNoError(router.FillSlot(slot, addr1, "", false))
+
+	s := &Session{}
+	assert.Must(string(doRequest(s, router, "mycmd", "key").Value) == "slot0")
+	SetUnknownCommandAction(UnknownForward)
+	assert.Must(string(doRequest(s, router, "mycmd", "key").Value) == "other")
+}
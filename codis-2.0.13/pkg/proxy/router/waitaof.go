@@ -0,0 +1,68 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "github.com/CodisLabs/codis/pkg/proxy/redis"
+
+// 上一次 WAITAOF 之后会话写入的slot，WAITAOF 只能确认一个group的master上的写入
+// 每个写命令都要记录，使用固定大小的位图，不需要为没有使用 WAITAOF 的会话分配内存
+type aofWrites struct {
+	slots   [MaxSlotNum / 64]uint64
+	written bool
+	key     []byte // 最近一次写入的key，WAITAOF 按照这个key转发
+}
+
+func (w *aofWrites) add(key []byte) {
+	i := hashSlot(key)
+	w.slots[i/64] |= 1 << uint(i%64)
+	w.written = true
+}
+
+func (w *aofWrites) has(i int) bool {
+	return w.slots[i/64]&(1<<uint(i%64)) != 0
+}
+
+// 记录写命令转发到的slot，拆分的多key命令记录每个key所在的slot
+func (s *Session) recordWrite(opstr string, resp *redis.Resp) {
+	hkey := getHashKey(resp, opstr)
+	if hkey == nil {
+		return
+	}
+	s.aof.add(hkey)
+	eachKey(opstr, resp, s.aof.add)
+	s.aof.key = hkey
+}
+
+var replyWaitAOFGroups = redis.NewStatic(redis.NewError([]byte("ERR WAITAOF can't confirm writes to more than one group, writes since the last WAITAOF went to different masters")))
+
+// WAITAOF 转发给最近一次写入所在的master，和直连redis一样只能确认这个连接上之前的写入
+// 上一次 WAITAOF 之后的写入分布在多个group时返回错误，没有写入时转发给 slot 0 所在的后端
+// backend_pool_size 大于1并且关闭了 backend_affinity 时，WAITAOF 可能和之前的写入使用连接池中不同的连接，这时不能确认这些写入
+func (s *Session) handleWaitAOF(r *Request, d Dispatcher) (*Request, error) {
+	w := s.aof
+	s.aof = aofWrites{}
+	if !w.written {
+		r.first = true
+		return r, d.Dispatch(r)
+	}
+	if router, ok := d.(interface {
+		GetSlotRoute(i int) (addr, from string, lock bool)
+	}); ok {
+		var master string
+		for i := 0; i < MaxSlotNum; i++ {
+			if !w.has(i) {
+				continue
+			}
+			addr, _, _ := router.GetSlotRoute(i)
+			if master == "" {
+				master = addr
+			} else if addr != master {
+				r.Response.Resp = staticReply(replyWaitAOFGroups)
+				return r, nil
+			}
+		}
+	}
+	r.hkey = w.key
+	return r, d.Dispatch(r)
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestWaitAOF(t *testing.T) {
+	newReplies := func(local, replicas string) map[string]*redis.Resp {
+		return map[string]*redis.Resp{
+			"SET":     redis.NewString([]byte("OK")),
+			"WAITAOF": redis.NewArray([]*redis.Resp{redis.NewInt([]byte(local)), redis.NewInt([]byte(replicas))}),
+		}
+	}
+	l1, addr1 := fakeServer(replyByCommand(newReplies("1", "0")))
+	defer l1.Close()
+	l2, addr2 := fakeServer(replyByCommand(newReplies("0", "1")))
+	defer l2.Close()
+
+	d := New()
+	defer d.Close()
+	a, b := hashSlot([]byte("a")), hashSlot([]byte("b"))
+	assert.Must(a != b && a != 0 && b != 0)
+	assert.MustNoError(d.FillSlot(a, addr1, "", false))
+	assert.MustNoError(d.FillSlot(b, addr2, "", false))
+	assert.MustNoError(d.FillSlot(0, addr2, "", false))
+
+	s := &Session{}
+	request := func(args ...string) *redis.Resp {
+		r, err := s.handleRequest(newRequestResp(args...), d)
+		assert.MustNoError(err)
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return r.Response.Resp
+	}
+	waitaof := func() *redis.Resp {
+		return request("WAITAOF", "1", "0", "100")
+	}
+	expect := func(resp *redis.Resp, local, replicas string) {
+		assert.Must(resp.IsArray() && len(resp.Array) == 2)
+		assert.Must(resp.Array[0].IsInt() && string(resp.Array[0].Value) == local)
+		assert.Must(resp.Array[1].IsInt() && string(resp.Array[1].Value) == replicas)
+	}
+
+	// 转发给最近一次写入所在的后端，回复不做修改
+	request("SET", "a", "1")
+	expect(waitaof(), "1", "0")
+	request("SET", "b", "1")
+	expect(waitaof(), "0", "1")
+
+	// 写入了多个group
+	request("SET", "a", "1")
+	request("SET", "b", "1")
+	resp := waitaof()
+	assert.Must(resp.IsError() && string(resp.Value) == string(replyWaitAOFGroups.Value))
+
+	// 没有写入时发送给 slot 0 所在的后端
+	expect(waitaof(), "0", "1")
+}
+
+// 记录写入不分配内存，没有使用 WAITAOF 的会话也要记录
+func TestRecordWriteAllocs(t *testing.T) {
+	s := &Session{}
+	for _, args := range [][]string{{"SET", "a", "1"}, {"MSET", "a", "1", "b", "2"}, {"EVAL", "return 1", "2", "a", "b"}} {
+		resp := newRequestResp(args...)
+		n := testing.AllocsPerRun(100, func() {
+			s.recordWrite(args[0], resp)
+		})
+		assert.Must(n == 0)
+	}
+	assert.Must(s.aof.has(hashSlot([]byte("a"))) && s.aof.has(hashSlot([]byte("b"))))
+}
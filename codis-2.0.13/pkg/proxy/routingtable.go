@@ -0,0 +1,117 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 导出的路由表，用于zk不可用时启动proxy，或者离线测试时使用一份已知的路由表
+type RoutingTable struct {
+	Product  string       `json:"product"`
+	ExportAt string       `json:"export_at"`
+	Slots    []*TableSlot `json:"slots"`
+}
+
+type TableSlot struct {
+	Id       int      `json:"id"`
+	GroupId  int      `json:"group_id"`
+	Addr     string   `json:"addr"`               // 所在group的master地址
+	From     string   `json:"from,omitempty"`     // 迁移中时，迁移源group的master地址
+	Lock     bool     `json:"lock,omitempty"`     // 导出时处于预迁移状态，导入时不会阻塞这个slot
+	Fallback bool     `json:"fallback,omitempty"` // 由 default_group 服务
+	Replicas []string `json:"replicas,omitempty"` // 所在group的slave地址，只在开启读slave时记录
+}
+
+var ErrCoordinated = errors.New("proxy is coordinated by zk, an imported routing table would be overwritten")
+
+// 导出当前的路由表，有slot还没有填充时返回错误
+func (s *Server) ExportRoutingTable() ([]byte, error) {
+	t := &RoutingTable{Product: s.conf.productName, ExportAt: time.Now().Format(time.RFC3339)}
+	for i := 0; i < router.MaxSlotNum; i++ {
+		addr, from, lock := s.router.GetSlotRoute(i)
+		if addr == "" {
+			return nil, errors.Errorf("slot %04d is not filled", i)
+		}
+		t.Slots = append(t.Slots, &TableSlot{
+			Id: i, GroupId: s.router.SlotGroup(i), Addr: addr, From: from, Lock: lock,
+			Fallback: s.router.IsFallbackSlot(i), Replicas: s.router.GetSlotReplicas(i),
+		})
+	}
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return b, nil
+}
+
+// 解析导出的路由表，每个slot都需要出现并且只出现一次
+func ParseRoutingTable(b []byte) (*RoutingTable, error) {
+	var t RoutingTable
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var seen [router.MaxSlotNum]bool
+	for _, x := range t.Slots {
+		switch {
+		case x == nil:
+			return nil, errors.New("invalid routing table, null slot")
+		case x.Id < 0 || x.Id >= router.MaxSlotNum:
+			return nil, errors.Errorf("invalid routing table, slot %d is out of range", x.Id)
+		case seen[x.Id]:
+			return nil, errors.Errorf("invalid routing table, slot %04d appears more than once", x.Id)
+		case x.Addr == "":
+			return nil, errors.Errorf("invalid routing table, slot %04d has no addr", x.Id)
+		case x.From == x.Addr:
+			return nil, errors.Errorf("invalid routing table, slot %04d migrates from %s to itself", x.Id, x.Addr)
+		}
+		seen[x.Id] = true
+	}
+	for i, ok := range seen {
+		if !ok {
+			return nil, errors.Errorf("invalid routing table, slot %04d is missing", i)
+		}
+	}
+	return &t, nil
+}
+
+// 使用导入的路由表替换当前的路由，只能用于没有连接zk的proxy
+// 也就是启动时zk不可用而使用了导入的路由表，或者 NewForTest 创建的proxy
+func (s *Server) ImportRoutingTable(b []byte) error {
+	if s.topo != nil {
+		return errors.Trace(ErrCoordinated)
+	}
+	t, err := ParseRoutingTable(b)
+	if err != nil {
+		return err
+	}
+	if err := s.checkTableProduct(t); err != nil {
+		return err
+	}
+	_, err = s.reload(&reloadRequest{table: t, done: make(chan struct{})})
+	return err
+}
+
+func (s *Server) checkTableProduct(t *RoutingTable) error {
+	if t.Product != s.conf.productName {
+		return errors.Errorf("routing table of product %q can't be used by product %q", t.Product, s.conf.productName)
+	}
+	return nil
+}
+
+// 在事件循环中填充路由表中的全部slot
+func (s *Server) applyTable(t *RoutingTable) {
+	for _, x := range t.Slots {
+		if x.Lock {
+			log.Warnf("slot %04d is pre-migrating in the routing table, serve it without blocking", x.Id)
+		}
+		s.applySlotRoute(x.Id, &slotRoute{groupId: x.GroupId, addr: x.Addr, from: x.From, fallback: x.Fallback, replicas: x.Replicas})
+	}
+	log.Infof("apply routing table of %d slots exported at %s", len(t.Slots), t.ExportAt)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestRoutingTable(t *testing.T) {
+	s1, err := NewForTest(TestConfig{Backend: "127.0.0.1:1", Slots: map[int]string{5: "127.0.0.1:2"}})
+	assert.MustNoError(err)
+	defer s1.Close()
+	b, err := s1.ExportRoutingTable()
+	assert.MustNoError(err)
+	table, err := ParseRoutingTable(b)
+	assert.MustNoError(err)
+	assert.Must(table.Product == "test" && len(table.Slots) == router.MaxSlotNum)
+	assert.Must(table.Slots[5].Addr == "127.0.0.1:2" && table.Slots[0].Addr == "127.0.0.1:1")
+
+	s2, err := NewForTest(TestConfig{Backend: "127.0.0.1:3"})
+	assert.MustNoError(err)
+	defer s2.Close()
+	assert.MustNoError(s2.ImportRoutingTable(b))
+	addr, _, _ := s2.router.GetSlotRoute(5)
+	assert.Must(addr == "127.0.0.1:2")
+	addr, _, _ = s2.router.GetSlotRoute(1023)
+	assert.Must(addr == "127.0.0.1:1")
+
+	// 有slot没有填充时不能导出
+	s3, err := NewForTest(TestConfig{Slots: map[int]string{0: "127.0.0.1:1"}})
+	assert.MustNoError(err)
+	defer s3.Close()
+	_, err = s3.ExportRoutingTable()
+	assert.Must(err != nil)
+
+	// 其它集群的路由表
+	other := *table
+	other.Product = "other"
+	b, err = json.Marshal(&other)
+	assert.MustNoError(err)
+	assert.Must(s2.ImportRoutingTable(b) != nil)
+}
+
+func TestParseRoutingTable(t *testing.T) {
+	newTable := func() *RoutingTable {
+		t := &RoutingTable{Product: "test"}
+		for i := 0; i < router.MaxSlotNum; i++ {
+			t.Slots = append(t.Slots, &TableSlot{Id: i, GroupId: 1, Addr: "127.0.0.1:1"})
+		}
+		return t
+	}
+	parse := func(t *RoutingTable) error {
+		b, err := json.Marshal(t)
+		assert.MustNoError(err)
+		_, err = ParseRoutingTable(b)
+		return err
+	}
+	assert.MustNoError(parse(newTable()))
+
+	missing := newTable()
+	missing.Slots = missing.Slots[1:]
+	assert.Must(parse(missing) != nil)
+
+	duplicated := newTable()
+	duplicated.Slots[1].Id = 0
+	assert.Must(parse(duplicated) != nil)
+
+	for _, x := range []*TableSlot{{Id: 5}, {Id: 5, Addr: "a", From: "a"}, {Id: router.MaxSlotNum, Addr: "a"}} {
+		invalid := newTable()
+		invalid.Slots[5] = x
+		assert.Must(parse(invalid) != nil)
+	}
+
+	_, err := ParseRoutingTable([]byte("{"))
+	assert.Must(err != nil)
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"net"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+)
+
+// accept 之后设置客户端连接的 socket 缓冲区，需要在 TLS 之前包装原始的 listener
+type bufferedListener struct {
+	net.Listener
+	buffers *router.SocketBuffers
+}
+
+// 没有设置缓冲区大小时返回原来的 listener
+func withSocketBuffers(l net.Listener, send, recv int) net.Listener {
+	if send == 0 && recv == 0 {
+		return l
+	}
+	return &bufferedListener{Listener: l, buffers: router.NewSocketBuffers("client", send, recv)}
+}
+
+func (l *bufferedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.buffers.Apply(c)
+	return c, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 单个 UDP 包的大小上限，避免超过常见的 MTU
+const statsdMaxPacketSize = 1432
+
+// 定期将统计信息推送到 StatsD，和 /debug/vars 使用相同的计数
+type statsdExporter struct {
+	addr    string
+	prefix  string
+	metrics map[string]bool
+
+	conn net.Conn
+	last map[string]int64 // 计数类指标上一次推送时的值，用于计算增量
+}
+
+func newStatsdExporter(addr, prefix string, metrics []string) *statsdExporter {
+	e := &statsdExporter{
+		addr:    addr,
+		prefix:  strings.TrimSuffix(prefix, "."),
+		metrics: make(map[string]bool),
+		last:    make(map[string]int64),
+	}
+	for _, m := range metrics {
+		e.metrics[strings.ToLower(m)] = true
+	}
+	return e
+}
+
+// 每隔 interval 推送一次，直到 kill 通道关闭
+func (e *statsdExporter) run(interval time.Duration, kill <-chan interface{}) {
+	log.Infof("push stats to statsd %s every %s, metrics = %v", e.addr, interval, e.metrics)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kill:
+			if e.conn != nil {
+				e.conn.Close()
+			}
+			return
+		case <-ticker.C:
+			// 推送失败只记录日志，不影响proxy的正常工作
+			if err := e.push(); err != nil {
+				log.WarnErrorf(err, "push stats to statsd %s failed", e.addr)
+			}
+		}
+	}
+}
+
+func (e *statsdExporter) push() error {
+	if e.conn == nil {
+		c, err := net.Dial("udp", e.addr)
+		if err != nil {
+			return err
+		}
+		e.conn = c
+	}
+	var lines []string
+	if e.metrics["ops"] {
+		lines = append(lines, e.counter("ops", router.OpCounts()))
+	}
+	if e.metrics["cmds"] {
+		for _, s := range router.GetAllOpStats() {
+			name := "cmds." + strings.ToLower(s.OpStr())
+			lines = append(lines, e.counter(name+".calls", s.Calls()))
+			if calls := s.Calls(); calls != 0 {
+				lines = append(lines, e.timing(name+".usecs_percall", s.USecs()/calls))
+			}
+		}
+	}
+	if e.metrics["sessions"] {
+		lines = append(lines, e.gauge("sessions", router.SessionCounts()))
+	}
+	if e.metrics["broadcasts"] {
+		lines = append(lines, e.counter("broadcasts", router.BroadcastCounts()))
+	}
+	if e.metrics["localpings"] {
+		lines = append(lines, e.counter("localpings", router.LocalPingCounts()))
+	}
+	return e.send(lines)
+}
+
+// 计数类指标，推送与上一次的差值
+func (e *statsdExporter) counter(name string, v int64) string {
+	delta := v - e.last[name]
+	e.last[name] = v
+	return fmt.Sprintf("%s.%s:%d|c", e.prefix, name, delta)
+}
+
+func (e *statsdExporter) gauge(name string, v int64) string {
+	return fmt.Sprintf("%s.%s:%d|g", e.prefix, name, v)
+}
+
+// 耗时类指标，StatsD 以毫秒为单位
+func (e *statsdExporter) timing(name string, usecs int64) string {
+	return fmt.Sprintf("%s.%s:%.3f|ms", e.prefix, name, float64(usecs)/1e3)
+}
+
+// 将多条指标合并到尽量少的 UDP 包中发送
+func (e *statsdExporter) send(lines []string) error {
+	var b bytes.Buffer
+	for _, line := range lines {
+		if b.Len() != 0 && b.Len()+len(line)+1 > statsdMaxPacketSize {
+			if _, err := e.conn.Write(b.Bytes()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+		if b.Len() != 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	if b.Len() != 0 {
+		if _, err := e.conn.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
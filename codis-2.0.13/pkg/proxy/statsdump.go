@@ -0,0 +1,69 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var ErrStatsDumpDisabled = errors.New("stats dump is disabled, stats_dump_dir is not set")
+
+// 将 /debug/vars 和 /status 的内容写到 stats_dump_dir 下的文件中，用于事后分析
+// name 为空时使用当前时间作为文件名，只能是目录下的文件名，不能包含路径
+// 先写到临时文件再改名，不会读到写了一半的文件，返回写入的文件路径
+func (s *Server) DumpStats(name string) (string, error) {
+	if s.conf.statsDumpDir == "" {
+		return "", errors.Trace(ErrStatsDumpDisabled)
+	}
+	if name == "" {
+		name = time.Now().Format("stats-20060102-150405.000.json")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", errors.Errorf("invalid file name %q, should be a name in stats_dump_dir", name)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "{\n\"time\": %q,\n\"vars\": ", time.Now().Format(time.RFC3339Nano))
+	writeVars(&b)
+	status, err := json.Marshal(s.Status())
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	fmt.Fprintf(&b, ",\n\"status\": %s\n}\n", status)
+
+	path := filepath.Join(s.conf.statsDumpDir, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return "", errors.Trace(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", errors.Trace(err)
+	}
+	log.Infof("dump stats to %s, %d bytes", path, b.Len())
+	return path, nil
+}
+
+// 和 expvar 的 /debug/vars 输出相同
+func writeVars(b *bytes.Buffer) {
+	b.WriteString("{")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			b.WriteString(",")
+		}
+		first = false
+		fmt.Fprintf(b, "\n%q: %s", kv.Key, kv.Value)
+	})
+	b.WriteString("\n}")
+}
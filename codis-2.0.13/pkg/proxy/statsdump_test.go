@@ -0,0 +1,50 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestDumpStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codis-stats-dump")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	conf := newTestConf()
+	conf.statsDumpDir = dir
+	s, err := NewForTest(TestConfig{Config: conf})
+	assert.MustNoError(err)
+	defer s.Close()
+
+	path, err := s.DumpStats("snapshot.json")
+	assert.MustNoError(err)
+	assert.Must(path == filepath.Join(dir, "snapshot.json"))
+	b, err := ioutil.ReadFile(path)
+	assert.MustNoError(err)
+	var m map[string]interface{}
+	assert.MustNoError(json.Unmarshal(b, &m))
+	assert.Must(m["time"] != nil && m["vars"] != nil && m["status"] != nil)
+	assert.Must(m["vars"].(map[string]interface{})["memstats"] != nil)
+
+	// 没有指定文件名时使用当前时间
+	path, err = s.DumpStats("")
+	assert.MustNoError(err)
+	assert.Must(filepath.Dir(path) == dir)
+
+	// 只能写到 stats_dump_dir 下
+	for _, name := range []string{"../x.json", "/tmp/x.json", "a/b.json", ".."} {
+		_, err := s.DumpStats(name)
+		assert.Must(err != nil)
+	}
+	files, err := ioutil.ReadDir(dir)
+	assert.MustNoError(err)
+	assert.Must(len(files) == 2)
+}
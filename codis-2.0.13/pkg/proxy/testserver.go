@@ -0,0 +1,183 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 用于集成测试的proxy配置，不需要zk和dashboard，路由表是固定的
+type TestConfig struct {
+	// 监听地址，为空时使用 127.0.0.1:0，由系统分配端口，实际地址通过 Server.Addr 获取
+	Addr string
+	// 客户端和后端的密码，为空表示不需要 AUTH
+	Password string
+
+	// 没有在 Slots 中指定的slot全部路由到这个后端，为空时这些slot处于未就绪状态
+	Backend string
+	// 固定的路由表，slot -> 后端地址
+	Slots map[int]string
+
+	// 建立后端连接的函数，nil 时使用tcp连接
+	// 可以返回 net.Pipe 之类的内存连接，这时后端地址只作为名字使用
+	Dial func(addr string, timeout time.Duration) (net.Conn, error)
+
+	// 其它配置，通过 LoadConf 读取，nil 时使用和 config.ini 相同的默认值
+	// 其中和 zk、dashboard 相关的配置被忽略
+	Config *Config
+}
+
+// 和 loadConf 相同的默认值
+func newTestConf() *Config {
+	return &Config{
+		proxyId:          "proxy_test",
+		productName:      "test",
+		proto:            "tcp",
+		pingPeriod:       5,
+		maxTimeout:       1800,
+		maxBufSize:       131072,
+		maxPipeline:      1024,
+		checkArity:       true,
+		maxKeys:          100000,
+		localPing:        true,
+		localTime:        true,
+		multiplex:        true,
+		poolSize:         1,
+		affinity:         true,
+		staleTableAction: "serve",
+		conflictPolicy:   "serve",
+		infoBackends:     true,
+		infoCacheTTL:     1,
+		serverName:       "codis",
+		failureLogSize:   128,
+		logMaxLine:       log.DefaultMaxLine,
+		stallThreshold:   10,
+		acceptWorkers:    1,
+	}
+}
+
+// 创建一个用于集成测试的proxy，直接使用固定的路由表提供服务，不连接zk
+// 路由表不会变更，也不会注册到zk上，测试结束时调用 Close 关闭
+func NewForTest(cfg TestConfig) (*Server, error) {
+	conf := cfg.Config
+	if conf == nil {
+		conf = newTestConf()
+	}
+	copied := *conf
+	conf = &copied
+	if cfg.Password != "" {
+		conf.passwd = cfg.Password
+	}
+	for i := range cfg.Slots {
+		if i < 0 || i >= router.MaxSlotNum {
+			return nil, errors.New("invalid slot " + strconv.Itoa(i))
+		}
+	}
+	addr := cfg.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, backlog, err := listen(conf.proto, addr, conf.listenBacklog)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	l = withSocketBuffers(l, conf.clientSndBuf, conf.clientRcvBuf)
+	if conf.tlsCertFile != "" {
+		c, err := newTLSConfig(conf)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = tls.NewListener(l, c)
+	}
+
+	s := &Server{conf: conf, lastActionSeq: -1, groups: make(map[int]int), listener: l, backlog: backlog}
+	s.info.Id = conf.proxyId
+	s.info.State = models.PROXY_STATE_ONLINE
+	s.info.Addr = l.Addr().String()
+	s.info.Pid = os.Getpid()
+	s.info.StartAt = time.Now().String()
+	s.kill = make(chan interface{})
+	s.accepted = make(chan *acceptedConn, 4096)
+
+	if err := applyRouterConfig(conf); err != nil {
+		l.Close()
+		return nil, err
+	}
+	router.SetDialer(cfg.Dial)
+	s.router = router.NewWithAuth(conf.passwd)
+	s.reloadc = make(chan *reloadRequest)
+
+	for i := 0; i < router.MaxSlotNum; i++ {
+		backend, ok := cfg.Slots[i]
+		if !ok {
+			backend = cfg.Backend
+		}
+		if backend == "" {
+			continue
+		}
+		s.router.FillSlot(i, backend, "", false)
+	}
+	if err := s.startConnLog(); err != nil {
+		s.router.Close()
+		l.Close()
+		return nil, err
+	}
+	s.startTracing()
+	s.startWatchdog()
+
+	s.wait.Add(1)
+	go func() {
+		defer s.wait.Done()
+		defer s.close()
+		go func() {
+			defer s.close()
+			s.handleConns()
+		}()
+		s.loopStatic()
+	}()
+	return s, nil
+}
+
+// 固定路由表时的事件循环，只发送心跳，ReloadSlots 不修改路由，ImportRoutingTable 替换路由
+func (s *Server) loopStatic() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var tick int = 0
+	for {
+		s.loopBeat.beat()
+		select {
+		case <-s.kill:
+			return
+		case req := <-s.reloadc:
+			if req.table != nil {
+				s.applyTable(req.table)
+				req.n = len(req.table.Slots)
+			}
+			close(req.done)
+		case <-ticker.C:
+			if maxTick := s.conf.pingPeriod; maxTick != 0 {
+				if tick++; tick >= maxTick {
+					s.router.KeepAlive()
+					tick = 0
+				}
+			}
+		}
+	}
+}
+
+// 实际监听的地址
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestNewForTest(t *testing.T) {
+	r, err := miniredis.Run()
+	assert.MustNoError(err)
+	defer r.Close()
+
+	// 后端地址只是名字，实际通过 Dial 连接到 miniredis
+	var dialed = make(chan string, 16)
+	s, err := NewForTest(TestConfig{
+		Backend: "backend-1",
+		Slots:   map[int]string{0: "backend-2"},
+		Dial: func(addr string, timeout time.Duration) (net.Conn, error) {
+			dialed <- addr
+			return net.DialTimeout("tcp", r.Addr(), timeout)
+		},
+	})
+	assert.MustNoError(err)
+	defer router.SetDialer(nil)
+	defer s.Close()
+
+	c, err := redis.Dial("tcp", s.Addr())
+	assert.MustNoError(err)
+	defer c.Close()
+
+	_, err = c.Do("SET", "foo", "bar")
+	assert.MustNoError(err)
+	got, err := redis.String(c.Do("GET", "foo"))
+	assert.MustNoError(err)
+	assert.Must(got == "bar")
+
+	select {
+	case addr := <-dialed:
+		assert.Must(addr == "backend-1" || addr == "backend-2")
+	default:
+		t.Fatal("backend is not dialed")
+	}
+
+	_, err = NewForTest(TestConfig{Slots: map[int]string{router.MaxSlotNum: "backend-1"}})
+	assert.Must(err != nil)
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/router"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 即 tls.VersionTLS13，旧版本的 go 没有定义
+const versionTLS13 = 0x0304
+
+// 允许的最低 TLS 版本，1.0 和 1.1 不安全
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": versionTLS13,
+}
+
+// 可以配置的 TLS 1.2 的加密套件，TLS 1.3 的加密套件由 go 决定，不能配置
+var tlsCiphers = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// 已知不安全的加密套件，配置了直接报错
+var tlsInsecureCiphers = map[string]bool{
+	"TLS_RSA_WITH_RC4_128_SHA":            true,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":       true,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":    true,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":      true,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA": true,
+}
+
+// 检查 tls_min_version 和 tls_ciphers，返回遇到的配置错误
+func checkTLSConf(version string, ciphers []string) []error {
+	var errs []error
+	switch version {
+	case "1.0", "1.1":
+		errs = append(errs, &ErrInvalidValue{Key: "tls_min_version", Value: version, Reason: "is insecure, should be 1.2 or 1.3"})
+	default:
+		if _, ok := tlsVersions[version]; !ok {
+			errs = append(errs, &ErrInvalidValue{Key: "tls_min_version", Value: version, Reason: "should be 1.2 or 1.3"})
+		}
+	}
+	for _, name := range ciphers {
+		name = strings.ToUpper(name)
+		switch {
+		case tlsInsecureCiphers[name]:
+			errs = append(errs, &ErrInvalidValue{Key: "tls_ciphers", Value: name, Reason: "is an insecure cipher suite"})
+		case tlsCiphers[name] == 0:
+			errs = append(errs, &ErrInvalidValue{Key: "tls_ciphers", Value: name, Reason: "is not a supported cipher suite"})
+		}
+	}
+	return errs
+}
+
+// 检查双向 TLS 的配置，tls_client_identity 可以是 app 和 user，都需要配置 tls_client_ca_file
+func checkTLSClientConf(certFile, caFile string, identity []string) []error {
+	var errs []error
+	if caFile != "" && certFile == "" {
+		errs = append(errs, &ErrInvalidValue{Key: "tls_client_ca_file", Value: caFile, Reason: "requires tls_cert_file"})
+	}
+	for _, x := range identity {
+		switch {
+		case x != "app" && x != "user":
+			errs = append(errs, &ErrInvalidValue{Key: "tls_client_identity", Value: x, Reason: "should be app or user"})
+		case caFile == "":
+			errs = append(errs, &ErrInvalidValue{Key: "tls_client_identity", Value: x, Reason: "requires tls_client_ca_file"})
+		}
+	}
+	return errs
+}
+
+// 根据配置创建客户端连接使用的 tls.Config，配置需要已经通过 checkTLSConf 的检查
+func newTLSConfig(conf *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.tlsCertFile, conf.tlsKeyFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tlsVersions[conf.tlsMinVersion],
+		PreferServerCipherSuites: true,
+	}
+	for _, name := range conf.tlsCiphers {
+		c.CipherSuites = append(c.CipherSuites, tlsCiphers[strings.ToUpper(name)])
+	}
+	// 配置了 CA 时要求客户端提供由它签发的证书
+	if conf.tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(conf.tlsClientCA)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %s", conf.tlsClientCA)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// 在会话开始之前完成握手，超时时间和握手阶段的超时相同，并在 debug 日志中记录协商的版本和加密套件
+func handshakeTLS(c *tls.Conn, timeout time.Duration) error {
+	if timeout != 0 {
+		if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := c.Handshake(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return errors.Trace(err)
+	}
+	st := c.ConnectionState()
+	log.Debugf("tls handshake with %s done, version = %s, cipher = %s",
+		c.RemoteAddr(), tlsVersionName(st.Version), tlsCipherName(st.CipherSuite))
+	return nil
+}
+
+// 握手之后把客户端证书的 subject 记录到会话中，按 tls_client_identity 把 CN 作为应用名或者 acl_users 中的用户
+func identifyTLSClient(x *router.Session, c *tls.Conn, identity []string) {
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return
+	}
+	var asApp, asUser bool
+	for _, s := range identity {
+		asApp = asApp || s == "app"
+		asUser = asUser || s == "user"
+	}
+	x.SetClientCert(certSubject(certs[0].Subject), certs[0].Subject.CommonName, asApp, asUser)
+}
+
+// 和 openssl 的格式类似，只包含常用的字段，旧版本的 go 没有 pkix.Name.String
+func certSubject(n pkix.Name) string {
+	var parts []string
+	add := func(key string, values ...string) {
+		for _, v := range values {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	add("CN", n.CommonName)
+	add("OU", n.OrganizationalUnit...)
+	add("O", n.Organization...)
+	add("L", n.Locality...)
+	add("ST", n.Province...)
+	add("C", n.Country...)
+	if n.CommonName == "" {
+		parts = parts[1:]
+	}
+	return strings.Join(parts, ",")
+}
+
+func tlsVersionName(v uint16) string {
+	for name, x := range tlsVersions {
+		if x == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func tlsCipherName(v uint16) string {
+	for name, x := range tlsCiphers {
+		if x == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
@@ -6,6 +6,7 @@ package proxy
 import (
 	"encoding/json"
 	"path"
+	"sync"
 
 	topo "github.com/wandoulabs/go-zookeeper/zk"
 
@@ -28,28 +29,40 @@ type ZkFactory func(zkAddr string, zkSessionTimeout int) (zkhelper.Conn, error)
 type Topology struct {
 	ProductName      string        // 集群项目名称
 	zkAddr           string        // zk地址
-	zkConn           zkhelper.Conn // zk连接
+	zkConn           zkhelper.Conn // zk连接，重连时会被替换，通过 conn() 访问
 	fact             ZkFactory     // 通过此函数返回一个zk连接（考虑到兼容etcd）
 	provider         string        // zk or etcd
 	zkSessionTimeout int           // zk会话超时时间
+	optional         bool          // 启动后zk不可用时是否继续提供服务
+
+	mu sync.RWMutex // 保护 zkConn
+}
+
+// zk会话过期或者watch失效时发送到 evtbus 中的事件，只在 optional 为 true 时使用
+type coordinatorLost struct {
+	conn  zkhelper.Conn // 失效的zk连接，重连之后旧连接上的事件会被忽略
+	event topo.Event
 }
 
 func (top *Topology) GetGroup(groupId int) (*models.ServerGroup, error) {
-	return models.GetGroup(top.zkConn, top.ProductName, groupId)
+	return models.GetGroup(top.conn(), top.ProductName, groupId)
 }
 
 func (top *Topology) Exist(path string) (bool, error) {
-	return zkhelper.NodeExists(top.zkConn, path)
+	return zkhelper.NodeExists(top.conn(), path)
 }
 
-// 获取指定id的slot信息，并且获取所在group的信息
+// 获取指定id的slot信息，并且获取所在group的信息，slot没有分配group时返回的group为nil
 func (top *Topology) GetSlotByIndex(i int) (*models.Slot, *models.ServerGroup, error) {
-	slot, err := models.GetSlot(top.zkConn, top.ProductName, i)
+	slot, err := models.GetSlot(top.conn(), top.ProductName, i)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
+	if slot.GroupId == models.INVALID_ID {
+		return slot, nil, nil
+	}
 
-	groupServer, err := models.GetGroup(top.zkConn, top.ProductName, slot.GroupId)
+	groupServer, err := models.GetGroup(top.conn(), top.ProductName, slot.GroupId)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
@@ -59,6 +72,15 @@ func (top *Topology) GetSlotByIndex(i int) (*models.Slot, *models.ServerGroup, e
 
 // 创建集群拓扑管理对象
 func NewTopo(ProductName string, zkAddr string, f ZkFactory, provider string, zkSessionTimeout int) *Topology {
+	t, err := DialTopo(ProductName, zkAddr, f, provider, zkSessionTimeout)
+	if err != nil {
+		log.PanicErrorf(err, "init failed")
+	}
+	return t
+}
+
+// 连接失败时返回错误，zk不可用时可以使用导入的路由表提供服务
+func DialTopo(ProductName string, zkAddr string, f ZkFactory, provider string, zkSessionTimeout int) (*Topology, error) {
 	t := &Topology{zkAddr: zkAddr, ProductName: ProductName, fact: f, provider: provider, zkSessionTimeout: zkSessionTimeout}
 	if t.fact == nil {
 		switch t.provider {
@@ -67,34 +89,60 @@ func NewTopo(ProductName string, zkAddr string, f ZkFactory, provider string, zk
 		case "zookeeper":
 			t.fact = zkhelper.ConnectToZk
 		default:
-			log.Panicf("coordinator not found in config")
+			return nil, errors.New("coordinator not found in config")
 		}
 	}
-	t.InitZkConn()
-	return t
+	conn, err := t.fact(t.zkAddr, t.zkSessionTimeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	t.zkConn = conn
+	return t, nil
 }
 
 // 建立信息的zk连接
 func (top *Topology) InitZkConn() {
-	var err error
-	top.zkConn, err = top.fact(top.zkAddr, top.zkSessionTimeout)
+	conn, err := top.fact(top.zkAddr, top.zkSessionTimeout)
 	if err != nil {
 		log.PanicErrorf(err, "init failed")
 	}
+	top.mu.Lock()
+	top.zkConn = conn
+	top.mu.Unlock()
+}
+
+// 当前的zk连接，重连之后会变化
+func (top *Topology) conn() zkhelper.Conn {
+	top.mu.RLock()
+	defer top.mu.RUnlock()
+	return top.zkConn
+}
+
+// 关闭当前的zk连接，重新建立一个新的连接
+func (top *Topology) Reconnect() error {
+	top.mu.Lock()
+	defer top.mu.Unlock()
+	top.zkConn.Close()
+	conn, err := top.fact(top.zkAddr, top.zkSessionTimeout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	top.zkConn = conn
+	return nil
 }
 
 // 根据序号获取通知信息
 func (top *Topology) GetActionWithSeq(seq int64) (*models.Action, error) {
-	return models.GetActionWithSeq(top.zkConn, top.ProductName, seq, top.provider)
+	return models.GetActionWithSeq(top.conn(), top.ProductName, seq, top.provider)
 }
 
 // 根据序号获取解析后的action对象
 func (top *Topology) GetActionWithSeqObject(seq int64, act *models.Action) error {
-	return models.GetActionObject(top.zkConn, top.ProductName, seq, act, top.provider)
+	return models.GetActionObject(top.conn(), top.ProductName, seq, act, top.provider)
 }
 
 func (top *Topology) GetActionSeqList(productName string) ([]int, error) {
-	return models.GetActionSeqList(top.zkConn, productName)
+	return models.GetActionSeqList(top.conn(), productName)
 }
 
 func (top *Topology) IsChildrenChangedEvent(e interface{}) bool {
@@ -103,42 +151,42 @@ func (top *Topology) IsChildrenChangedEvent(e interface{}) bool {
 
 // 在zk上创建proxy信息
 func (top *Topology) CreateProxyInfo(pi *models.ProxyInfo) (string, error) {
-	return models.CreateProxyInfo(top.zkConn, top.ProductName, pi)
+	return models.CreateProxyInfo(top.conn(), top.ProductName, pi)
 }
 
 // 在fence节点下创建proxy信息
 func (top *Topology) CreateProxyFenceNode(pi *models.ProxyInfo) (string, error) {
-	return models.CreateProxyFenceNode(top.zkConn, top.ProductName, pi)
+	return models.CreateProxyFenceNode(top.conn(), top.ProductName, pi)
 }
 
 // 获取指定id的proxy的信息
 func (top *Topology) GetProxyInfo(proxyName string) (*models.ProxyInfo, error) {
-	return models.GetProxyInfo(top.zkConn, top.ProductName, proxyName)
+	return models.GetProxyInfo(top.conn(), top.ProductName, proxyName)
 }
 
 // 根据 action 里的序号，返回 ActionResponse 里的路径
 func (top *Topology) GetActionResponsePath(seq int) string {
-	return path.Join(models.GetActionResponsePath(top.ProductName), top.zkConn.Seq2Str(int64(seq)))
+	return path.Join(models.GetActionResponsePath(top.ProductName), top.conn().Seq2Str(int64(seq)))
 }
 
 func (top *Topology) SetProxyStatus(proxyName string, status string) error {
-	return models.SetProxyStatus(top.zkConn, top.ProductName, proxyName, status)
+	return models.SetProxyStatus(top.conn(), top.ProductName, proxyName, status)
 }
 
 // 关闭topology对象，删除zk上的相关节点
 func (top *Topology) Close(proxyName string) {
 	// delete fence znode
 	// 删除fence节点上该proxy的信息
-	pi, err := models.GetProxyInfo(top.zkConn, top.ProductName, proxyName)
+	pi, err := models.GetProxyInfo(top.conn(), top.ProductName, proxyName)
 	if err != nil {
 		log.Errorf("killing fence error, proxy %s is not exists", proxyName)
 	} else {
-		zkhelper.DeleteRecursive(top.zkConn, path.Join(models.GetProxyFencePath(top.ProductName), pi.Addr), -1)
+		zkhelper.DeleteRecursive(top.conn(), path.Join(models.GetProxyFencePath(top.ProductName), pi.Addr), -1)
 	}
 	// delete ephemeral znode
 	// 删除 proxy 节点上的该proxy的信息
-	zkhelper.DeleteRecursive(top.zkConn, path.Join(models.GetProxyPath(top.ProductName), proxyName), -1)
-	top.zkConn.Close()
+	zkhelper.DeleteRecursive(top.conn(), path.Join(models.GetProxyPath(top.ProductName), proxyName), -1)
+	top.conn().Close()
 }
 
 // 回复通知，就是在 ActionResponse 的 seq 节点下创建以自己 proxy_id 命名的节点
@@ -151,17 +199,22 @@ func (top *Topology) DoResponse(seq int, pi *models.ProxyInfo) error {
 		return errors.Trace(err)
 	}
 
-	_, err = top.zkConn.Create(path.Join(actionPath, pi.Id), data,
+	_, err = top.conn().Create(path.Join(actionPath, pi.Id), data,
 		0, zkhelper.DefaultFileACLs())
 
 	return err
 }
 
 // 监听函数，zk有变更会从 evtch 收到变更事件，处理后发送到 evtbus 通道中
-func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
+func (top *Topology) doWatch(conn zkhelper.Conn, evtch <-chan topo.Event, evtbus chan interface{}) {
 	e := <-evtch
 	if e.State == topo.StateExpired || e.Type == topo.EventNotWatching {
-		log.Panicf("session expired: %+v", e)
+		if !top.optional {
+			log.Panicf("session expired: %+v", e)
+		}
+		log.Errorf("session expired: %+v", e)
+		evtbus <- &coordinatorLost{conn: conn, event: e}
+		return
 	}
 
 	log.Warnf("topo event %+v", e)
@@ -180,22 +233,24 @@ func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
 
 // 监听目录
 func (top *Topology) WatchChildren(path string, evtbus chan interface{}) ([]string, error) {
-	content, _, evtch, err := top.zkConn.ChildrenW(path)
+	conn := top.conn()
+	content, _, evtch, err := conn.ChildrenW(path)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	go top.doWatch(evtch, evtbus)
+	go top.doWatch(conn, evtch, evtbus)
 	return content, nil
 }
 
 // 监听一个指定节点
 func (top *Topology) WatchNode(path string, evtbus chan interface{}) ([]byte, error) {
-	content, _, evtch, err := top.zkConn.GetW(path)
+	conn := top.conn()
+	content, _, evtch, err := conn.GetW(path)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	go top.doWatch(evtch, evtbus)
+	go top.doWatch(conn, evtch, evtbus)
 	return content, nil
 }
@@ -0,0 +1,117 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// 协程最近一次取得进展的时间，单位 ns，0表示还没有开始
+type heartbeat struct {
+	last atomic2.Int64
+}
+
+func (h *heartbeat) beat() {
+	h.last.Set(time.Now().UnixNano())
+}
+
+// 距离最近一次心跳的时间，还没有开始时返回0
+func (h *heartbeat) age(now time.Time) time.Duration {
+	if t := h.last.Get(); t != 0 {
+		return now.Sub(time.Unix(0, t))
+	}
+	return 0
+}
+
+// 事件循环和创建会话的协程停止前进超过 threshold 之后在日志中输出全部协程的调用栈，恢复之前只输出一次
+// 事件循环每秒至少有一次心跳；创建会话的协程只在 accepted 中有等待的连接时才需要前进
+func (s *Server) startWatchdog() {
+	if !s.conf.watchdog {
+		return
+	}
+	threshold := time.Second * time.Duration(s.conf.stallThreshold)
+	interval := threshold / 4
+	log.Infof("watchdog is watching, stall threshold = %s", threshold)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var stalled = make(map[string]bool)
+		var created, queued = s.sessionsCreated.Get(), false
+		var since time.Time
+		last := time.Now()
+		for {
+			select {
+			case <-s.kill:
+				return
+			case now := <-ticker.C:
+				s.watchBeat.beat()
+				// 整个进程都没有运行，比如 GC 或者 CPU 被限制，这时已经恢复了，输出调用栈没有意义
+				if d := now.Sub(last); d > interval+threshold {
+					s.stalls.Incr()
+					log.Warnf("watchdog woke up %s late, the whole proxy was stalled", d-interval)
+				}
+				last = now
+
+				s.checkStall(stalled, "event loop", s.loopBeat.age(now) > threshold, s.loopBeat.age(now))
+
+				// 有等待的连接并且一直没有创建新的会话
+				n, waiting := s.sessionsCreated.Get(), len(s.accepted) != 0
+				switch {
+				case !waiting || n != created:
+					queued, since = false, time.Time{}
+				case !queued:
+					queued, since = true, now
+				}
+				created = n
+				s.checkStall(stalled, "session loop", queued && now.Sub(since) > threshold, now.Sub(since))
+			}
+		}
+	}()
+}
+
+func (s *Server) checkStall(stalled map[string]bool, name string, stall bool, age time.Duration) {
+	switch {
+	case stall && !stalled[name]:
+		stalled[name] = true
+		s.stalls.Incr()
+		log.Warnf("watchdog: %s has made no progress for %s, dump goroutines", name, age)
+		logGoroutines()
+	case !stall && stalled[name]:
+		stalled[name] = false
+		log.Warnf("watchdog: %s recovered", name)
+	}
+}
+
+// 相同调用栈的协程合并输出，每一组是一行日志，避免超过日志的长度上限而被截断
+func logGoroutines() {
+	var b bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&b, 1); err != nil {
+		log.WarnErrorf(err, "watchdog: dump goroutines failed")
+		return
+	}
+	for _, x := range strings.Split(b.String(), "\n\n") {
+		if x = strings.TrimSpace(x); x != "" {
+			log.Warnf("watchdog: %s", x)
+		}
+	}
+}
+
+// 各个协程距离最近一次心跳的时间，用于 /debug/internals
+func (s *Server) heartbeatAges() map[string]int64 {
+	now := time.Now()
+	var m = map[string]int64{
+		"event_loop_ms":   int64(s.loopBeat.age(now) / time.Millisecond),
+		"session_loop_ms": int64(s.sessionBeat.age(now) / time.Millisecond),
+	}
+	if s.conf.watchdog {
+		m["watchdog_ms"] = int64(s.watchBeat.age(now) / time.Millisecond)
+	}
+	return m
+}
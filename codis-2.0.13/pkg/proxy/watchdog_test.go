@@ -0,0 +1,57 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var h heartbeat
+	now := time.Now()
+	assert.Must(h.age(now) == 0)
+	h.last.Set(now.Add(-time.Second * 3).UnixNano())
+	assert.Must(h.age(now) == time.Second*3)
+	h.beat()
+	assert.Must(h.age(time.Now()) < time.Second)
+}
+
+func TestCheckStall(t *testing.T) {
+	s := &Server{}
+	var stalled = make(map[string]bool)
+	s.checkStall(stalled, "event loop", false, 0)
+	assert.Must(s.stalls.Get() == 0)
+
+	// 停顿期间只记录一次
+	s.checkStall(stalled, "event loop", true, time.Second*20)
+	s.checkStall(stalled, "event loop", true, time.Second*30)
+	assert.Must(s.stalls.Get() == 1 && stalled["event loop"])
+	s.checkStall(stalled, "session loop", true, time.Second*20)
+	assert.Must(s.stalls.Get() == 2)
+
+	s.checkStall(stalled, "event loop", false, 0)
+	assert.Must(!stalled["event loop"] && stalled["session loop"])
+	s.checkStall(stalled, "event loop", true, time.Second*20)
+	assert.Must(s.stalls.Get() == 3)
+}
+
+func TestWatchdog(t *testing.T) {
+	conf := newTestConf()
+	conf.watchdog = true
+	conf.stallThreshold = 1
+	s, err := NewForTest(TestConfig{Config: conf, Backend: "127.0.0.1:1"})
+	assert.MustNoError(err)
+	defer s.Close()
+
+	time.Sleep(time.Millisecond * 600)
+	m := s.heartbeatAges()
+	assert.Must(s.watchBeat.last.Get() != 0 && m["watchdog_ms"] < 1000)
+	assert.Must(m["event_loop_ms"] < 2000)
+	assert.Must(s.stalls.Get() == 0)
+	assert.Must(s.Internals()["heartbeats"] != nil)
+	assert.Must(s.Status()["watchdog"] != nil)
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 获取容器通过cgroup限制的cpu数，比如 1.5 表示最多使用1.5个核，没有限制时返回false
+// 同时支持 cgroup v2 的 cpu.max 和 cgroup v1 的 cpu.cfs_quota_us
+func CPUQuota() (float64, bool) {
+	return cpuQuota("/sys/fs/cgroup")
+}
+
+func cpuQuota(root string) (float64, bool) {
+	// cgroup v2: "max 100000" 或者 "200000 100000"
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return parseQuota(fields[0], fields[1])
+	}
+	// cgroup v1，不同的系统上挂载的目录不同
+	for _, dir := range []string{"cpu", "cpu,cpuacct", "cpuacct,cpu"} {
+		quota, err := ioutil.ReadFile(filepath.Join(root, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := ioutil.ReadFile(filepath.Join(root, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			continue
+		}
+		return parseQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0, false
+}
+
+// quota 为 -1 表示不限制
+func parseQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return float64(q) / float64(p), true
+}
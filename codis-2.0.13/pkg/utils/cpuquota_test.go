@@ -0,0 +1,45 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func writeCgroupFiles(files map[string]string) string {
+	root, err := ioutil.TempDir("", "cgroup")
+	assert.MustNoError(err)
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		assert.MustNoError(os.MkdirAll(filepath.Dir(path), 0755))
+		assert.MustNoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
+
+func TestCPUQuota(t *testing.T) {
+	for _, x := range []struct {
+		files map[string]string
+		quota float64
+		ok    bool
+	}{
+		{map[string]string{"cpu.max": "200000 100000\n"}, 2, true},
+		{map[string]string{"cpu.max": "150000 100000\n"}, 1.5, true},
+		{map[string]string{"cpu.max": "max 100000\n"}, 0, false},
+		{map[string]string{"cpu/cpu.cfs_quota_us": "50000\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0.5, true},
+		{map[string]string{"cpu,cpuacct/cpu.cfs_quota_us": "400000\n", "cpu,cpuacct/cpu.cfs_period_us": "100000\n"}, 4, true},
+		{map[string]string{"cpu/cpu.cfs_quota_us": "-1\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0, false},
+		{map[string]string{}, 0, false},
+	} {
+		root := writeCgroupFiles(x.files)
+		quota, ok := cpuQuota(root)
+		os.RemoveAll(root)
+		assert.Must(quota == x.quota && ok == x.ok)
+	}
+}
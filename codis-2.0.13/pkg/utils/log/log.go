@@ -11,6 +11,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/trace"
@@ -91,6 +92,9 @@ type Logger struct {
 	log   *log.Logger
 	level LogLevel
 	trace LogLevel
+
+	sampling *sampler
+	maxLine  int64
 }
 
 var StdLog = New(NopCloser(os.Stderr), "")
@@ -101,10 +105,11 @@ func New(writer io.Writer, prefix string) *Logger {
 		out = NopCloser(writer)
 	}
 	return &Logger{
-		out:   out,
-		log:   log.New(out, prefix, LstdFlags),
-		level: LEVEL_ALL,
-		trace: LEVEL_ERROR,
+		out:     out,
+		log:     log.New(out, prefix, LstdFlags),
+		level:   LEVEL_ALL,
+		trace:   LEVEL_ERROR,
+		maxLine: DefaultMaxLine,
 	}
 }
 
@@ -160,6 +165,7 @@ func (l *Logger) SetTraceLevel(v LogLevel) {
 func (l *Logger) Close() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.stopSampling()
 	l.out.Close()
 }
 
@@ -365,7 +371,7 @@ func (l *Logger) output(traceskip int, err error, t LogType, s string) error {
 	}
 
 	var b bytes.Buffer
-	fmt.Fprint(&b, t, " ", s)
+	fmt.Fprint(&b, t, " ", l.truncateString(s))
 
 	if len(s) == 0 || s[len(s)-1] != '\n' {
 		fmt.Fprint(&b, "\n")
@@ -384,6 +390,9 @@ func (l *Logger) output(traceskip int, err error, t LogType, s string) error {
 	s = b.String()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if !l.sample(t, s) {
+		return nil
+	}
 	return l.log.Output(traceskip+2, s)
 }
 
@@ -411,6 +420,10 @@ func SetTrace(v LogLevel) {
 	StdLog.trace.Set(v)
 }
 
+func SetSampling(window time.Duration, threshold int) {
+	StdLog.SetSampling(window, threshold)
+}
+
 func Panic(v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprint(v...)
@@ -30,6 +30,11 @@ type rollingFile struct {
 
 var ErrClosedRollingFile = errors.New("rolling file is closed")
 
+// 可以重新打开的日志文件，NewRollingFile 返回的文件实现了这个接口
+type Reopener interface {
+	Reopen() error
+}
+
 func (r *rollingFile) roll() error {
 	if r.file != nil {
 		if r.fragSize < r.maxFragSize {
@@ -67,6 +72,35 @@ func (r *rollingFile) Close() error {
 	return nil
 }
 
+// 关闭并重新打开当前的文件，用于外部工具（比如 logrotate）把文件改名之后继续写到原来的路径
+// 文件仍然存在时追加到末尾，否则创建一个新的文件
+func (r *rollingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.Trace(ErrClosedRollingFile)
+	}
+	if r.file == nil {
+		return nil
+	}
+	r.file.Sync()
+	r.file.Close()
+	r.file = nil
+
+	f, err := os.OpenFile(r.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if info, err := f.Stat(); err == nil {
+		r.fragSize = info.Size()
+	} else {
+		r.fragSize = 0
+	}
+	r.file = f
+	return nil
+}
+
 func (r *rollingFile) Write(b []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
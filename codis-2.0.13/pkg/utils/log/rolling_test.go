@@ -0,0 +1,68 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollingFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "proxy.log")
+	f, err := NewRollingFile(base, 10, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := f.(Reopener)
+	path := base + ".0"
+
+	write := func(s string) {
+		if _, err := io.WriteString(f, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(path, s string) {
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != s {
+			t.Fatalf("%s = %q, %v", path, b, err)
+		}
+	}
+	reopen := func() {
+		if err := r.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 还没有写入时不需要重新打开
+	reopen()
+	write("hello\n")
+
+	// 改名之后继续写到原来的路径
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	write("world\n")
+	expect(path, "world\n")
+	expect(path+".old", "hello\n")
+
+	// 文件没有改名时追加
+	reopen()
+	write("again\n")
+	expect(path, "world\nagain\n")
+
+	f.Close()
+	if r.Reopen() == nil {
+		t.Fatal("reopen a closed file")
+	}
+}
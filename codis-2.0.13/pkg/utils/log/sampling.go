@@ -0,0 +1,109 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 最多记录的不同日志数，超过之后新的日志不再采样
+const maxSampleEntries = 4096
+
+// 相同的日志在一个窗口内最多输出 threshold 次，之后的被丢弃
+// 窗口结束时再输出一次这条日志，并且记录被丢弃的次数
+type sampler struct {
+	window    time.Duration
+	threshold int
+
+	entries map[string]*sampleEntry
+	stop    chan struct{}
+}
+
+type sampleEntry struct {
+	msg    string
+	expire time.Time
+	count  int
+}
+
+// 开启日志采样，window 或者 threshold 为 0 时关闭
+func (l *Logger) SetSampling(window time.Duration, threshold int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopSampling()
+	if window <= 0 || threshold <= 0 {
+		return
+	}
+	p := &sampler{
+		window:    window,
+		threshold: threshold,
+		entries:   make(map[string]*sampleEntry),
+		stop:      make(chan struct{}),
+	}
+	l.sampling = p
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				l.mu.Lock()
+				if l.sampling == p {
+					l.flushSampling(time.Now())
+				}
+				l.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// 需要持有 l.mu
+func (l *Logger) stopSampling() {
+	if l.sampling != nil {
+		l.flushSampling(time.Now().Add(l.sampling.window))
+		close(l.sampling.stop)
+		l.sampling = nil
+	}
+}
+
+// 返回是否需要输出这条日志，需要持有 l.mu
+func (l *Logger) sample(t LogType, s string) bool {
+	p := l.sampling
+	if p == nil || t == TYPE_PANIC {
+		return true
+	}
+	now := time.Now()
+	e := p.entries[s]
+	if e == nil || now.After(e.expire) {
+		if e != nil {
+			l.flushEntry(e)
+		} else if len(p.entries) >= maxSampleEntries {
+			return true
+		}
+		p.entries[s] = &sampleEntry{msg: s, expire: now.Add(p.window), count: 1}
+		return true
+	}
+	e.count++
+	return e.count <= p.threshold
+}
+
+// 输出已经结束的窗口的汇总，需要持有 l.mu
+func (l *Logger) flushSampling(now time.Time) {
+	for _, e := range l.sampling.entries {
+		if now.After(e.expire) {
+			l.flushEntry(e)
+		}
+	}
+}
+
+func (l *Logger) flushEntry(e *sampleEntry) {
+	delete(l.sampling.entries, e.msg)
+	if n := e.count - l.sampling.threshold; n > 0 {
+		s := strings.TrimSuffix(e.msg, "\n")
+		l.log.Output(3, fmt.Sprintf("%s [suppressed %d times in %s]\n", s, n, l.sampling.window))
+	}
+}
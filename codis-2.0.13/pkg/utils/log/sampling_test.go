@@ -0,0 +1,35 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSampling(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, "")
+	l.SetFlags(0)
+	l.SetTraceLevel(LEVEL_NONE)
+	l.SetSampling(time.Hour, 2)
+
+	for i := 0; i < 5; i++ {
+		l.Warn("backend down")
+		l.Warnf("backend %d down", i)
+	}
+	// 不同的日志不会被丢弃
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2+5 {
+		t.Fatalf("got %d lines:\n%s", len(lines), b.String())
+	}
+
+	b.Reset()
+	l.Close()
+	if s := b.String(); s != "[WARN] backend down [suppressed 3 times in 1h0m0s]\n" {
+		t.Fatalf("got summary %q", s)
+	}
+}
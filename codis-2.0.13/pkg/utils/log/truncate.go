@@ -0,0 +1,42 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package log
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// 默认的日志长度上限
+const DefaultMaxLine = 4096
+
+// 超过 n 字节的日志内容会被截断，0表示不限制
+func (l *Logger) SetMaxLine(n int) {
+	atomic.StoreInt64(&l.maxLine, int64(n))
+}
+
+func SetMaxLine(n int) {
+	StdLog.SetMaxLine(n)
+}
+
+// 截断日志中的值，比如命令的参数，避免一个很大的参数产生几MB的日志
+func Truncate(b []byte) string {
+	return StdLog.truncate(b)
+}
+
+func (l *Logger) truncate(b []byte) string {
+	n := int(atomic.LoadInt64(&l.maxLine))
+	if n <= 0 || len(b) <= n {
+		return string(b)
+	}
+	return fmt.Sprintf("%s...(truncated %d bytes)", b[:n], len(b)-n)
+}
+
+func (l *Logger) truncateString(s string) string {
+	n := int(atomic.LoadInt64(&l.maxLine))
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	return fmt.Sprintf("%s...(truncated %d bytes)", s[:n], len(s)-n)
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, "")
+	l.SetFlags(0)
+	l.SetTraceLevel(LEVEL_NONE)
+	l.SetMaxLine(8)
+
+	if s := l.truncate([]byte("0123456789")); s != "01234567...(truncated 2 bytes)" {
+		t.Fatalf("truncate = %q", s)
+	}
+	if s := l.truncate([]byte("01234567")); s != "01234567" {
+		t.Fatalf("truncate = %q", s)
+	}
+
+	l.Infof("key = %s", strings.Repeat("x", 100))
+	if s := b.String(); s != "[INFO] key = xx...(truncated 98 bytes)\n" {
+		t.Fatalf("log = %q", s)
+	}
+
+	b.Reset()
+	l.SetMaxLine(0)
+	l.Infof("key = %s", strings.Repeat("x", 100))
+	if len(b.String()) != len("[INFO] key = \n")+100 {
+		t.Fatalf("log = %q", b.String())
+	}
+}